@@ -6,374 +6,10475 @@
 package main
 
 import (
-	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
 	"crypto"
-	"crypto/rsa"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/pbkdf2"
+	"crypto/rand"
 	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"encoding/xml"
+	"errors"
+	"expvar"
+	"flag"
 	"fmt"
+	"go/format"
+	"html/template"
 	"io"
 	"io/ioutil"
+	"log"
+	"math/big"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/http/pprof"
+	"net/smtp"
+	"net/textproto"
 	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/robstradling/crlset-tools/crlset"
 )
 
-// update and the related structures are used for parsing the XML response from Omaha. The response looks like:
-// <?xml version="1.0" encoding="UTF-8"?>
-// <gupdate xmlns="http://www.google.com/update2/response" protocol="2.0" server="prod">
-//   <daystart elapsed_seconds="42913"/>
-//   <app appid="hfnkpimlhhgieaddgfemjhofmfblmnib" status="ok">
-//     <updatecheck codebase="http://www.gstatic.com/chrome/crlset/56/crl-set-14830555124393087472.crx.data" hash="" size="0" status="ok" version="56"/>
-//   </app>
-// </gupdate>
-type update struct {
-	XMLName xml.Name    `xml:"gupdate"`
-	Apps    []updateApp `xml:"app"`
+// downloadDir returns the directory in which downloads are kept so that they
+// can be resumed. It's in the user's cache directory, rather than the shared
+// temporary directory, where another user could create a file at the
+// predictable name of a partial download in advance and so control or read
+// its contents.
+func downloadDir() (string, error) {
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("Failed to find a directory for downloads: %s", err)
+	}
+	dir := filepath.Join(cache, "crlset-tools")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// downloadCRX downloads crxURL to a file in downloadDir whose name is derived
+// from the URL. If the download is interrupted then the partial file is left
+// behind and the next call for the same URL resumes from where it stopped
+// using a Range request. The partial file is locked so that
+// concurrent downloads of the same URL don't interleave their writes, and a
+// completed download is moved out of its way. The caller should close and
+// remove the returned file, which contains crxLen bytes, once it has been
+// processed.
+func downloadCRX(crxURL string) (crxFile *os.File, crxLen int64, err error) {
+	dir, err := downloadDir()
+	if err != nil {
+		return nil, 0, err
+	}
+	urlHash := sha256.Sum256([]byte(crxURL))
+	partialFilename := filepath.Join(dir, fmt.Sprintf("crlset-%x.crx.partial", urlHash[:8]))
+	unlock, err := lockFile(partialFilename)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer unlock()
+	if crxFile, err = os.OpenFile(partialFilename, os.O_RDWR|os.O_CREATE, 0600); err != nil {
+		return nil, 0, err
+	}
+
+	for {
+		offset, err := crxFile.Seek(0, io.SeekEnd)
+		if err != nil {
+			crxFile.Close()
+			return nil, 0, err
+		}
+
+		req, err := newRequest("GET", crxURL, nil)
+		if err != nil {
+			crxFile.Close()
+			return nil, 0, err
+		}
+		if offset > 0 {
+			fmt.Fprintf(os.Stderr, "Resuming download at byte %d\n", offset)
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			crxFile.Close()
+			return nil, 0, err
+		}
+
+		switch {
+		case resp.StatusCode == http.StatusPartialContent && strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)):
+		case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+			// The server ignored our Range, or the partial file doesn't
+			// match what it has, so start again from scratch. A 416
+			// without a Range is an error like any other, rather than a
+			// reason to try again forever.
+			if err := crxFile.Truncate(0); err != nil {
+				resp.Body.Close()
+				crxFile.Close()
+				return nil, 0, err
+			}
+			if offset = 0; resp.StatusCode != http.StatusOK {
+				resp.Body.Close()
+				continue
+			}
+			if _, err := crxFile.Seek(0, io.SeekStart); err != nil {
+				resp.Body.Close()
+				crxFile.Close()
+				return nil, 0, err
+			}
+		default:
+			resp.Body.Close()
+			crxFile.Close()
+			os.Remove(partialFilename)
+			return nil, 0, fmt.Errorf("unexpected HTTP status %q", resp.Status)
+		}
+
+		n, err := io.Copy(crxFile, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			crxFile.Close()
+			return nil, 0, fmt.Errorf("%s (run again to resume)", err)
+		}
+
+		crxFile.Close()
+
+		complete, err := ioutil.TempFile(dir, "crlset-*.crx")
+		if err != nil {
+			return nil, 0, err
+		}
+		complete.Close()
+		if err := os.Rename(partialFilename, complete.Name()); err != nil {
+			os.Remove(complete.Name())
+			return nil, 0, err
+		}
+		if crxFile, err = os.Open(complete.Name()); err != nil {
+			os.Remove(complete.Name())
+			return nil, 0, err
+		}
+		return crxFile, offset + n, nil
+	}
 }
 
-type updateApp struct {
-	AppId       string `xml:"appid,attr"`
-	UpdateCheck updateCheck
+// offline, recordDir and replayDir control networkTransport, through which all
+// HTTP requests are made. With replayDir set, responses are served from files
+// previously written to recordDir rather than the network.
+var (
+	offline   bool
+	recordDir string
+	replayDir string
+)
+
+// addNetworkFlags registers the flags that control network access with fs.
+func addNetworkFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&offline, "offline", false, "fail rather than make any network request")
+	fs.StringVar(&recordDir, "record", "", "save each HTTP response to this directory for later use with --replay")
+	fs.StringVar(&replayDir, "replay", "", "serve HTTP responses from this directory, as saved by --record, instead of the network")
+	fs.StringVar(&userAgent, "user-agent", userAgent, "the User-Agent header sent with every request")
+	fs.Var(&extraHeaders, "header", "an extra \"Name: value\" header to send with every request (may be repeated)")
 }
 
-type updateCheck struct {
-	XMLName xml.Name `xml:"updatecheck"`
-	URL     string   `xml:"codebase,attr"`
-	Version string   `xml:"version,attr"`
+// googlePins are the SHA-256 SPKI hashes of the roots that Google Trust
+// Services issues from: GTS Root R1 to R4, and GlobalSign Root CA and
+// GlobalSign ECC Root CA - R4, which cross-sign them.
+var googlePins = []string{
+	"871a9194f4eed5b312ff40c84c1d524aed2f778bbff25f138cf81f680a7adc67",
+	"55f77de41c03792428f8d518c55104225be43a5598d926a528ad653e1ccec7bf",
+	"4179edd981ef747477b49626408af43daa2ca7ab7f9e082c1060f84096774348",
+	"9847e5653e5e9e847516e5cb818606aa7544a19be67fd7366d506988e8d84347",
+	"2bcee858158cf5465fc9d76f0dfa312fef25a4dca8501da9b46b67d1fbfa1b64",
+	"08b3a6335fce5ef48f8f0e543986c07fd18a3b1226129f61864bbd5bdd1f1cc9",
 }
 
-// crlSetAppId is the hex(ish) encoded public key hash of the key that signs
-// the CRL sets.
-const crlSetAppId = "hfnkpimlhhgieaddgfemjhofmfblmnib"
+// pinnedDomains are the domains, with their subdomains, whose connections are
+// checked against pins: the Omaha endpoints and the hosts that serve CRXs.
+var pinnedDomains = []string{"google.com", "googleapis.com", "gstatic.com", "gvt1.com"}
 
-// buildVersionRequestURL returns a URL from which the current CRLSet version
-// information can be fetched.
-func buildVersionRequestURL() string {
-	args := url.Values(make(map[string][]string))
-	args.Add("x", "id="+crlSetAppId+"&v=&uc")
+// pins, if not empty, holds the SPKI hashes of which one must appear in the
+// verified chain of every connection to pinnedDomains. That makes fetching
+// resistant to TLS interception, even by a middlebox whose root is trusted
+// locally. Requests to pinnedDomains are upgraded to HTTPS when pins are set.
+var pins spkiList
 
-	return (&url.URL{
-		Scheme:   "http",
-		Host:     "clients2.google.com",
-		Path:     "/service/update2/crx",
-		RawQuery: args.Encode(),
-	}).String()
+// addPinFlags registers --pin-google and --pin with fs.
+func addPinFlags(fs *flag.FlagSet) {
+	fs.BoolFunc("pin-google", "fetch from Google's update servers over HTTPS and require their chains to reach a Google Trust Services root", func(string) error {
+		for _, pin := range googlePins {
+			if err := pins.Set(pin); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	fs.Var(&pins, "pin", "the hex or base64 SPKI hash of a key that connections to Google's update servers must chain to (may be repeated)")
 }
 
-// crxHeader reflects the binary header of a CRX file.
-type crxHeader struct {
-	Magic       [4]byte
-	Version     uint32
-	PubKeyBytes uint32
-	SigBytes    uint32
+// isPinnedHost reports whether connections to host are checked against pins.
+func isPinnedHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, domain := range pinnedDomains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
 }
 
-// zipReader is a small wrapper around a []byte which implements ReaderAt.
-type zipReader []byte
+var (
+	pinningTransportOnce sync.Once
+	pinningTransport     http.RoundTripper
+)
 
-func (z zipReader) ReadAt(p []byte, pos int64) (int, error) {
-	if int(pos) < 0 {
-		return 0, nil
+// newPinningTransport returns a copy of http.DefaultTransport that rejects
+// connections unless a certificate in a verified chain has a pinned SPKI.
+func newPinningTransport() http.RoundTripper {
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return failingTransport{errors.New("pinning needs http.DefaultTransport to be an *http.Transport")}
+	}
+	transport = transport.Clone()
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		for _, chain := range state.VerifiedChains {
+			for _, cert := range chain {
+				hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				for _, pin := range pins {
+					if pin == hash {
+						return nil
+					}
+				}
+			}
+		}
+		return fmt.Errorf("certificate chain for %s has no pinned key; the connection may be intercepted", state.ServerName)
 	}
-	return copy(p, []byte(z)[int(pos):]), nil
+	return transport
 }
 
-func fetch() bool {
-	resp, err := http.Get(buildVersionRequestURL())
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to get current version: %s\n", err)
-		return false
+// failingTransport is a RoundTripper that always returns err.
+type failingTransport struct {
+	err error
+}
+
+func (t failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, t.err
+}
+
+// userAgent and extraHeaders are sent with every HTTP request. Some egress
+// proxies only allow requests that carry particular headers.
+var (
+	userAgent    = "crlset-tools"
+	extraHeaders headerList
+)
+
+// headerList is a flag.Value that accumulates "Name: value" headers.
+type headerList struct {
+	http.Header
+}
+
+func (l *headerList) String() string {
+	var s []string
+	for name, values := range l.Header {
+		for _, value := range values {
+			s = append(s, name+": "+value)
+		}
 	}
+	sort.Strings(s)
+	return strings.Join(s, ", ")
+}
 
-	var reply update
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to read version reply: %s\n", err)
-		return false
+func (l *headerList) Set(value string) error {
+	i := strings.Index(value, ":")
+	if i <= 0 {
+		return fmt.Errorf("Invalid header %q: expected \"Name: value\"", value)
 	}
-	if err := xml.Unmarshal(bodyBytes, &reply); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to parse version reply: %s\n", err)
-		return false
+	if l.Header == nil {
+		l.Header = make(http.Header)
 	}
+	l.Header.Add(strings.TrimSpace(value[:i]), strings.TrimSpace(value[i+1:]))
+	return nil
+}
 
-	var crxURL, version string
-	for _, app := range reply.Apps {
-		if app.AppId == crlSetAppId {
-			crxURL = app.UpdateCheck.URL
-			version = app.UpdateCheck.Version
-			break
+// httpClient makes every HTTP request. main gives it a networkTransport.
+var httpClient crlset.HTTPClient = http.DefaultClient
+
+// networkTransport is the transport of httpClient, which applies
+// --offline, --record and --replay to every request, adds userAgent and
+// extraHeaders, and notes any Retry-After in the response.
+type networkTransport struct{}
+
+// recordingFilename returns the name of the file, within recordDir or
+// replayDir, that holds the response to req. It depends on the method, URL
+// and body of the request but not its headers, so that resumed downloads
+// still find the complete response.
+func recordingFilename(req *http.Request) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", req.Method, req.URL)
+	if req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return "", err
 		}
+		h.Write(body)
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
 	}
-	fmt.Fprintf(os.Stderr, "Downloading CRLSet version %s\n", version)
+	return fmt.Sprintf("%x.http", h.Sum(nil)[:16]), nil
+}
 
-	if len(crxURL) == 0 {
-		fmt.Fprintf(os.Stderr, "Failed to parse Omaha response\n")
-		return false
+func (t networkTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper mustn't modify the request it's given.
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", userAgent)
+	for name, values := range extraHeaders.Header {
+		req.Header[name] = values
 	}
-
-	resp, err = http.Get(crxURL)
+	resp, err := t.roundTrip(req)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to get CRX: %s\n", err)
-		return false
+		return nil, err
+	}
+	noteRetryAfter(resp)
+	return resp, nil
+}
+
+// roundTrip sends req, or replays the response to it.
+func (networkTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	if len(replayDir) > 0 {
+		name, err := recordingFilename(req)
+		if err != nil {
+			return nil, err
+		}
+		recorded, err := ioutil.ReadFile(filepath.Join(replayDir, name))
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no recorded response in %s", replayDir)
+		} else if err != nil {
+			return nil, err
+		}
+		return http.ReadResponse(bufio.NewReader(bytes.NewReader(recorded)), req)
+	}
+	if err := checkNetwork(); err != nil {
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	// zip needs to seek around, so we read the whole reply into memory.
-	crxBytes, err := ioutil.ReadAll(resp.Body)
+	name, err := recordingFilename(req)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to download CRX: %s\n", err)
-		return false
+		return nil, err
+	}
+	transport := http.DefaultTransport
+	pinned := len(pins) > 0 && isPinnedHost(req.URL.Hostname())
+	if pinned && req.URL.Scheme == "http" {
+		// A pin means nothing without TLS, and the default Omaha URL and
+		// the CRX URLs it returns are plain HTTP, so pinned hosts are
+		// always fetched over HTTPS, which they all serve.
+		upgraded := *req.URL
+		upgraded.Scheme = "https"
+		if upgraded.Port() == "80" {
+			upgraded.Host = upgraded.Hostname()
+		}
+		req = req.Clone(req.Context())
+		req.URL = &upgraded
+	}
+	if pinned {
+		pinningTransportOnce.Do(func() {
+			pinningTransport = newPinningTransport()
+		})
+		transport = pinningTransport
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil || len(recordDir) == 0 {
+		return resp, err
 	}
-	crx := bytes.NewBuffer(crxBytes)
+	// DumpResponse leaves a copy of the body in resp.
+	dump, err := httputil.DumpResponse(resp, true)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if err := writeOutput(filepath.Join(recordDir, name), dump); err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to record response: %s", err)
+	}
+	return resp, nil
+}
 
-	var header crxHeader
-	if err := binary.Read(crx, binary.LittleEndian, &header); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to parse CRX header: %s\n", err)
-		return false
+// checkNetwork returns an error if network access has been disabled with
+// --offline. Every HTTP request and every other connection goes through it,
+// so that --offline can be relied on to keep a run off the network.
+func checkNetwork() error {
+	if offline {
+		return errors.New("network access is disabled by --offline")
 	}
+	return nil
+}
 
-	if !bytes.Equal(header.Magic[:], []byte("Cr24")) ||
-		int(header.PubKeyBytes) < 0 ||
-		int(header.SigBytes) < 0 {
-		fmt.Fprintf(os.Stderr, "Downloaded file doesn't look like a CRX\n")
-		return false
+// dialNetwork connects to addr for the protocols other than HTTP, such as
+// Redis, PostgreSQL, NATS, SMTP and syslog. Those connections can't be
+// recorded, so with --replay they fail rather than reaching the network.
+func dialNetwork(network, addr string) (net.Conn, error) {
+	if err := checkNetwork(); err != nil {
+		return nil, err
+	}
+	if len(replayDir) > 0 {
+		return nil, fmt.Errorf("connections to %s can't be replayed", addr)
 	}
+	var dialer net.Dialer
+	return dialer.DialContext(interrupted, network, addr)
+}
 
-	pubKeyBytes := crx.Next(int(header.PubKeyBytes))
-	sigBytes := crx.Next(int(header.SigBytes))
+// interrupted is cancelled when SIGINT or SIGTERM is received, so that long
+// operations can stop cleanly rather than dying part way through a write.
+var interrupted = context.Background()
 
-	if len(pubKeyBytes) != int(header.PubKeyBytes) ||
-		len(sigBytes) != int(header.SigBytes) {
-		fmt.Fprintf(os.Stderr, "Downloaded file doesn't look like a CRX\n")
-		return false
+// notifyReload returns a channel that receives each SIGHUP, which tells
+// long-running commands to re-read their on-disk data without stopping.
+func notifyReload() <-chan os.Signal {
+	hup := make(chan os.Signal, 1)
+	// syscall.SIGHUP isn't defined for js/wasm, where it's never delivered.
+	signal.Notify(hup, syscall.Signal(1))
+	return hup
+}
+
+// interruptedExitCode is the exit status of a command that was stopped by a
+// signal, distinguishing it from one that failed.
+const interruptedExitCode = 130
+
+// newRequest returns a request that's cancelled by an interrupt.
+func newRequest(method, url string, body io.Reader) (*http.Request, error) {
+	return http.NewRequestWithContext(interrupted, method, url, body)
+}
+
+// retryAfter holds the longest delay, in nanoseconds, that a server has asked
+// for with Retry-After since it was last reset. fetchEvery waits at least this
+// long before polling again.
+var retryAfter atomic.Int64
+
+// noteRetryAfter records any Retry-After in resp, the response to a request
+// that was throttled or hit an unavailable server, in retryAfter.
+func noteRetryAfter(resp *http.Response) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return
 	}
+	delay := retryAfterDelay(resp)
+	for {
+		current := retryAfter.Load()
+		if int64(delay) <= current || retryAfter.CompareAndSwap(current, int64(delay)) {
+			break
+		}
+	}
+}
 
-	pubKey, err := x509.ParsePKIXPublicKey(pubKeyBytes)
+// retryAfterDelay returns the delay asked for by resp's Retry-After header,
+// or zero if it has none.
+func retryAfterDelay(resp *http.Response) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	} else if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// httpGet is like http.Get but uses httpClient.
+func httpGet(url string) (*http.Response, error) {
+	req, err := newRequest("GET", url, nil)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to parse public key: %s\n", err)
-		return false
+		return nil, err
 	}
-	rsaPubKey, ok := pubKey.(*rsa.PublicKey)
-	if !ok {
-		fmt.Fprintf(os.Stderr, "Not signed with an RSA key\n")
-		return false
+	return httpClient.Do(req)
+}
+
+// httpPost is like http.Post but uses httpClient.
+func httpPost(url, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := newRequest("POST", url, body)
+	if err != nil {
+		return nil, err
 	}
+	req.Header.Set("Content-Type", contentType)
+	return httpClient.Do(req)
+}
 
-	h := sha256.New()
-	h.Write(pubKeyBytes)
-	pubKeyHash := fmt.Sprintf("%x", h.Sum(nil)[:16])
-	tweakedPubKeyHash := make([]byte, len(pubKeyHash))
-
-	// AppIds use a different hex character set so we convert our hash into
-	// it.
-	for i := range pubKeyHash {
-		if pubKeyHash[i] < 97 {
-			tweakedPubKeyHash[i] = pubKeyHash[i] + 49
+// Tracing records spans for fetching, verifying and parsing CRLSets, building
+// the serial index and serving requests, and exports them in the OpenTelemetry
+// protocol (OTLP) so that slow operations can be investigated with any
+// OpenTelemetry collector. It's configured with the standard environment
+// variables: OTEL_TRACES_EXPORTER is "otlp", to POST OTLP/JSON to
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT (or OTEL_EXPORTER_OTLP_ENDPOINT with
+// /v1/traces appended), "console", to write it to stderr, or "none", the
+// default. OTEL_EXPORTER_OTLP_HEADERS and OTEL_SERVICE_NAME are also honored.
+var (
+	traceExporter string
+	traceEndpoint string
+	traceHeaders  http.Header
+	traceService  = "crlset"
+	// rootSpan covers the whole command, and is the parent of the spans
+	// started with startSpan.
+	rootSpan *span
+	// endedSpans holds spans that have ended but not yet been exported.
+	endedSpans   []otlpSpan
+	endedSpansMu sync.Mutex
+)
+
+// Span kinds and status codes from the OTLP specification.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanStatusError  = 2
+)
+
+// span is a timed operation in a trace. A nil *span is valid and does
+// nothing, which is what startSpan returns when tracing is disabled.
+type span struct {
+	name     string
+	kind     int
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	start    time.Time
+	attrs    []otlpAttribute
+}
+
+// otlpSpan and the types it uses are the OTLP/JSON encoding of a span.
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// otlpValue holds a string or an integer. OTLP/JSON encodes 64-bit integers
+// as strings.
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// initTracing reads the tracing configuration from the environment and, if
+// an exporter is configured, starts the root span for command.
+func initTracing(command string) error {
+	traceExporter = os.Getenv("OTEL_TRACES_EXPORTER")
+	traceEndpoint = os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if len(traceEndpoint) == 0 {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); len(base) > 0 {
+			traceEndpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
 		} else {
-			tweakedPubKeyHash[i] = pubKeyHash[i] + 10
+			traceEndpoint = "http://localhost:4318/v1/traces"
 		}
 	}
-
-	if string(tweakedPubKeyHash) != crlSetAppId {
-		fmt.Fprintf(os.Stderr, "Public key mismatch (%s)\n", tweakedPubKeyHash)
-		return false
+	if name := os.Getenv("OTEL_SERVICE_NAME"); len(name) > 0 {
+		traceService = name
+	}
+	traceHeaders = make(http.Header)
+	for _, header := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if name, value, ok := strings.Cut(header, "="); ok {
+			traceHeaders.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+		}
 	}
 
-	zipBytes := crx.Bytes()
+	switch traceExporter {
+	case "", "none":
+		traceExporter = ""
+		return nil
+	case "otlp", "console":
+	default:
+		return fmt.Errorf("Unknown OTEL_TRACES_EXPORTER %q", traceExporter)
+	}
+	rootSpan = newSpan(command, spanKindInternal, nil)
+	return nil
+}
 
-	sha1Hash := sha1.New()
-	sha1Hash.Write(zipBytes)
+// newSpan starts a span. If parent is nil then the span starts a new trace.
+func newSpan(name string, kind int, parent *span) *span {
+	s := &span{name: name, kind: kind, start: time.Now()}
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return s
+}
 
-	if err := rsa.VerifyPKCS1v15(rsaPubKey, crypto.SHA1, sha1Hash.Sum(nil), sigBytes); err != nil {
-		fmt.Fprintf(os.Stderr, "Signature verification failure: %s\n", err)
-		return false
+// startSpan starts a span as a child of rootSpan, or returns nil if tracing
+// is disabled.
+func startSpan(name string) *span {
+	if rootSpan == nil {
+		return nil
 	}
+	return newSpan(name, spanKindInternal, rootSpan)
+}
 
-	zipReader := zipReader(zipBytes)
+// set records an attribute, which is a string or an int, on s.
+func (s *span) set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	var v otlpValue
+	switch value := value.(type) {
+	case int:
+		str := strconv.Itoa(value)
+		v.IntValue = &str
+	case int64:
+		str := strconv.FormatInt(value, 10)
+		v.IntValue = &str
+	default:
+		str := fmt.Sprint(value)
+		v.StringValue = &str
+	}
+	s.attrs = append(s.attrs, otlpAttribute{key, v})
+}
 
-	z, err := zip.NewReader(zipReader, int64(len(zipBytes)))
+// end finishes s, marking it as failed if err isn't nil, and queues it for
+// export.
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+	exported := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attributes:        s.attrs,
+	}
+	if s.parentID != [8]byte{} {
+		exported.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to parse ZIP file: %s\n", err)
-		return false
+		exported.Status = otlpStatus{spanStatusError, err.Error()}
 	}
+	endedSpansMu.Lock()
+	endedSpans = append(endedSpans, exported)
+	endedSpansMu.Unlock()
+}
 
-	var crlFile *zip.File
-	for _, file := range z.File {
-		if file.Name == "crl-set" {
-			crlFile = file
-			break
-		}
+// flushSpans exports the spans that have ended since the last flush.
+func flushSpans() {
+	endedSpansMu.Lock()
+	spans := endedSpans
+	endedSpans = nil
+	endedSpansMu.Unlock()
+	if len(spans) == 0 || len(traceExporter) == 0 {
+		return
 	}
 
-	if crlFile == nil {
-		fmt.Fprintf(os.Stderr, "Downloaded CRX didn't contain a CRLSet\n")
-		return false
+	service := traceService
+	request := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttribute{{"service.name", otlpValue{StringValue: &service}}},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "crlset"},
+				"spans": spans,
+			}},
+		}},
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to encode spans: %s\n", err)
+		return
+	}
+	if traceExporter == "console" {
+		fmt.Fprintf(os.Stderr, "%s\n", body)
+		return
 	}
 
-	crlSetReader, err := crlFile.Open()
+	// Spans are sent directly rather than with Client, so that --record
+	// and --replay don't apply to them, but --offline still does.
+	if err := checkNetwork(); err != nil {
+		fmt.Fprintf(os.Stderr, "Not exporting spans: %s\n", err)
+		return
+	}
+	req, err := http.NewRequest("POST", traceEndpoint, bytes.NewReader(body))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to open crl-set in ZIP: %s\n", err)
-		return false
+		fmt.Fprintf(os.Stderr, "Failed to export spans: %s\n", err)
+		return
+	}
+	for name, values := range traceHeaders {
+		req.Header[name] = values
 	}
-	defer crlSetReader.Close()
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to export spans: %s\n", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "Failed to export spans: unexpected HTTP status %q\n", resp.Status)
+	}
+}
 
-	io.Copy(os.Stdout, crlSetReader)
+// finishTracing ends the root span, recording whether the command succeeded,
+// and exports everything.
+func finishTracing(ok bool) {
+	if rootSpan == nil {
+		return
+	}
+	var err error
+	if !ok {
+		err = errors.New("command failed")
+	}
+	rootSpan.end(err)
+	flushSpans()
+}
 
-	return true
+// statusRecorder remembers the status code written to a ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
 }
 
-// crlSetHeader is used to parse the JSON header found in CRLSet files.
-type crlSetHeader struct {
-	Sequence   int
-	NumParents int
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
 }
 
-func dump(filename string, certificateFilename string) bool {
-	var spki []byte
-	if len(certificateFilename) > 0 {
-		certBytes, err := ioutil.ReadFile(certificateFilename)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to read certificate: %s\n", err)
-			return false
-		}
+// Unwrap lets http.ResponseController flush the underlying ResponseWriter.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
 
-		var derBytes []byte
-		if block, _ := pem.Decode(certBytes); block == nil {
-			derBytes = certBytes
-		} else {
-			derBytes = block.Bytes
+// traceHandler wraps h so that each request is recorded as a server span.
+// A W3C traceparent header in the request makes the span part of the
+// caller's trace.
+func traceHandler(h http.Handler) http.Handler {
+	if len(traceExporter) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := newSpan(r.Method+" "+r.URL.Path, spanKindServer, nil)
+		parts := strings.Split(r.Header.Get("traceparent"), "-")
+		if len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+			traceID, err1 := hex.DecodeString(parts[1])
+			parentID, err2 := hex.DecodeString(parts[2])
+			if err1 == nil && err2 == nil {
+				copy(s.traceID[:], traceID)
+				copy(s.parentID[:], parentID)
+			}
 		}
+		s.set("http.request.method", r.Method)
+		s.set("url.path", r.URL.Path)
 
-		cert, err := x509.ParseCertificate(derBytes)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to parse certificate: %s\n", err)
-			return false
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(recorder, r)
+		s.set("http.response.status_code", recorder.status)
+		var err error
+		if recorder.status >= 500 {
+			err = errors.New(http.StatusText(recorder.status))
 		}
+		s.end(err)
+		go flushSpans()
+	})
+}
 
-		h := sha256.New()
-		h.Write(cert.RawSubjectPublicKeyInfo)
-		spki = h.Sum(nil)
-	}
+// omahaProtocol selects how fetchVersion talks to Omaha: "xml" for the legacy
+// update2/crx protocol, "json" for protocol 3.1, or "auto" to try XML first
+// and fall back to JSON.
+var omahaProtocol = "auto"
 
-	c, err := ioutil.ReadFile(filename)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to read CRLSet: %s\n", err)
-		return false
-	}
+// fetchVersion asks Omaha for the current CRLSet and returns the URL of the
+// CRX containing it and its version, using omahaProtocol.
+func fetchVersion() (crxURL, version string, err error) {
+	s := startSpan("omaha.update_check")
+	s.set("omaha.protocol", omahaProtocol)
+	defer func() {
+		s.set("crlset.version", version)
+		s.end(err)
+	}()
 
-	if len(c) < 2 {
-		fmt.Fprintf(os.Stderr, "CRLSet truncated at header length\n")
-		return false
+	if omahaProtocol == "auto" {
+		if crxURL, version, err = crlset.CheckForUpdate(interrupted, httpClient, "xml"); err == nil {
+			return crxURL, version, nil
+		}
+		fmt.Fprintf(os.Stderr, "%s; falling back to the JSON protocol\n", err)
+		return crlset.CheckForUpdate(interrupted, httpClient, "json")
 	}
+	return crlset.CheckForUpdate(interrupted, httpClient, omahaProtocol)
+}
 
-	headerLen := int(c[0]) | int(c[1])<<8
-	c = c[2:]
+// trustedKeys holds the keys given with --trusted-key. If there are any, they
+// replace envTrustedKeys, the keys listed in $CRLSET_TRUSTED_KEYS, as the
+// keys trusted to sign CRXs besides Chrome's CRLSet key.
+var trustedKeys, envTrustedKeys spkiList
 
-	if len(c) < headerLen {
-		fmt.Fprintf(os.Stderr, "CRLSet truncated at header\n")
-		return false
+// crxVerifier returns a Verifier that trusts the keys from trustedKeys or
+// envTrustedKeys.
+func crxVerifier() *crlset.Verifier {
+	keys := trustedKeys
+	if len(keys) == 0 {
+		keys = envTrustedKeys
 	}
-	headerBytes := c[:headerLen]
-	c = c[headerLen:]
+	return &crlset.Verifier{TrustedKeys: keys}
+}
 
-	var header crlSetHeader
-	if err := json.Unmarshal(headerBytes, &header); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to parse header: %s", err)
-		return false
+// extractCRLSet verifies the signature on the CRX in crxFile, which is crxLen
+// bytes long, and returns the contents of the CRLSet inside it.
+func extractCRLSet(crxFile io.ReaderAt, crxLen int64) (crlSetBytes []byte, err error) {
+	s := startSpan("crx.verify")
+	defer func() { s.end(err) }()
+	return crxVerifier().ExtractCRX(crxFile, crxLen)
+}
+
+// copyFile writes the contents of r to filename. The contents are written to
+// a temporary file which is then renamed into place, so that readers never see
+// a partially written file.
+func copyFile(filename string, r io.Reader) error {
+	if resolved, err := filepath.EvalSymlinks(filename); err == nil {
+		filename = resolved
+	}
+	if info, err := os.Stat(filename); err == nil && !info.Mode().IsRegular() {
+		// Devices and pipes can't be replaced by renaming.
+		f, err := os.OpenFile(filename, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
 	}
 
-	if len(spki) == 0 {
-		fmt.Printf("Sequence: %d\n", header.Sequence)
-		fmt.Printf("Parents: %d\n", header.NumParents)
-		fmt.Printf("\n")
+	f, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
 	}
+	return os.Rename(f.Name(), filename)
+}
 
-	const spkiHashLen = 32
+// lockTimeout is how long lockFile waits for another process to release a
+// lock.
+const lockTimeout = 5 * time.Minute
 
-	for len(c) > 0 {
-		if len(c) < spkiHashLen {
-			fmt.Fprintf(os.Stderr, "CRLSet truncated at SPKI hash\n")
-			return false
+// tryLock is set by crlset_flock.go and crlset_windows.go to take an
+// exclusive lock on f without waiting, returning false if another process
+// holds it. The operating system releases the lock when f is closed or the
+// process dies, so a crash never leaves a stale lock behind.
+var tryLock func(f *os.File) (bool, error)
+
+// lockFile takes an advisory lock on filename, in the form of a lock file
+// beside it, so that concurrent invocations sharing a file don't interleave
+// their updates. The returned function releases the lock.
+func lockFile(filename string) (unlock func(), err error) {
+	lockFilename := filename + ".lock"
+	if tryLock == nil {
+		return createLockFile(lockFilename)
+	}
+	f, err := os.OpenFile(lockFilename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		locked, err := tryLock(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("Failed to lock %s: %s", lockFilename, err)
+		}
+		if locked {
+			// The file is left in place when the lock is released.
+			// Removing it would let one process lock a new file while
+			// another still holds, or waits for, the old one.
+			f.Truncate(0)
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			return func() { f.Close() }, nil
 		}
-		spkiMatches := bytes.Equal(spki, c[:spkiHashLen])
-		if len(spki) == 0 {
-			fmt.Printf("%x\n", c[:spkiHashLen])
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("Timed out waiting for %s", lockFilename)
 		}
-		c = c[spkiHashLen:]
+		time.Sleep(time.Second)
+	}
+}
 
-		if len(c) < 4 {
-			fmt.Fprintf(os.Stderr, "CRLSet truncated at serial count\n")
-			return false
+// createLockFile is lockFile for platforms without file locking: the lock is
+// held by whoever manages to create lockFilename. A lock left behind by a
+// process that died has to be removed by hand, since telling it apart from a
+// live one can't be done without racing another process taking it over.
+func createLockFile(lockFilename string) (unlock func(), err error) {
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		f, err := os.OpenFile(lockFilename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			return func() { os.Remove(lockFilename) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
 		}
-		numSerials := uint32(c[0]) | uint32(c[1])<<8 | uint32(c[2])<<16 | uint32(c[3])<<24
-		c = c[4:]
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("Timed out waiting for %s; remove it if no other crlset process is running", lockFilename)
+		}
+		time.Sleep(time.Second)
+	}
+}
 
-		for i := uint32(0); i < numSerials; i++ {
-			if len(c) < 1 {
-				fmt.Fprintf(os.Stderr, "CRLSet truncated at serial length\n")
-				return false
-			}
-			serialLen := int(c[0])
-			c = c[1:]
+// fetchOptions controls the behaviour of fetch.
+type fetchOptions struct {
+	// output is the file to write the CRLSet to. If empty, the CRLSet is
+	// written to stdout. If it contains placeholders then each
+	// version is kept in its own file and a "latest" symlink in the same
+	// directory points to the newest.
+	output string
+	// minSequence is the lowest sequence number that will be accepted. If
+	// output already contains a CRLSet then its sequence number is also a
+	// lower bound.
+	minSequence int
+	// expectedSequence, if non-zero, is the only sequence number that will
+	// be accepted.
+	expectedSequence int
+	// expectedSHA256, if set, is the hex SHA-256 hash that the CRLSet, as
+	// written to output, must have.
+	expectedSHA256 string
+	// smtp, if smtp.server is set, is used to send an email alert when
+	// the set in output is replaced by a newer one.
+	smtp smtpConfig
+	// watches lists SPKIs and serials whose appearance in a new CRLSet
+	// is called out in alerts.
+	watches watchList
+	// crxOutput, if set, is a file to which the signed CRX is written, for
+	// example to populate a mirror served by serve-omaha. It may also
+	// contain placeholders.
+	crxOutput string
+	// changelog, if set, is a file to which a JSON line is appended for
+	// each change when the set in output is replaced by a newer one.
+	changelog string
+	// removalHook, if set, is a program that's run when serials or SPKIs
+	// are removed as the set in output is replaced by a newer one.
+	removalHook string
+	// source selects where the CRLSet is fetched from. See
+	// newFetchSource.
+	source string
+	// asOf, if set, selects the CRLSet that was current at that time
+	// rather than the newest. It needs an archiveSource. It's either a date,
+	// meaning the end of that day in UTC, or an RFC 3339 time.
+	asOf string
+	// publish says where, if anywhere, each change is published as a
+	// message when the set in output is replaced by a newer one.
+	publish publishConfig
+}
 
-			if len(c) < serialLen {
-				fmt.Fprintf(os.Stderr, "CRLSet truncated at serial\n")
-				return false
-			}
+// Output filenames are templates, in which placeholders are replaced by
+// details of the CRLSet: {sequence} by its sequence number, {version} by the
+// format version in its header and {sha256} by the hex SHA-256 hash of the
+// CRLSet, or {sha256:<n>} by the first n digits of it. placeholderPattern
+// matches them.
+var placeholderPattern = regexp.MustCompile(`\{([a-z0-9]+)(?::([0-9]+))?\}`)
 
-			if len(spki) == 0 {
-				fmt.Printf("  %x\n", c[:serialLen])
-			} else if spkiMatches {
-				fmt.Printf("%x\n", c[:serialLen])
+// latestLinkName is the name of the symlink that points to the newest of a
+// series of versioned output files.
+const latestLinkName = "latest"
+
+// isTemplate reports whether filename contains any placeholders, so that
+// each CRLSet gets its own file.
+func isTemplate(filename string) bool {
+	return placeholderPattern.MatchString(filename)
+}
+
+// expandFilename substitutes the details of set, whose serialized form is
+// crlSetBytes, for the placeholders in filename.
+func expandFilename(filename string, set *crlset.CRLSet, crlSetBytes []byte) (string, error) {
+	var err error
+	expanded := placeholderPattern.ReplaceAllStringFunc(filename, func(placeholder string) string {
+		match := placeholderPattern.FindStringSubmatch(placeholder)
+		name, arg := match[1], match[2]
+		switch {
+		case name == "sequence" && len(arg) == 0:
+			return strconv.Itoa(set.Header.Sequence)
+		case name == "version" && len(arg) == 0:
+			var header struct{ Version int }
+			json.Unmarshal(set.RawHeader(), &header)
+			return strconv.Itoa(header.Version)
+		case name == "sha256":
+			digest := sha256.Sum256(crlSetBytes)
+			hexDigest := hex.EncodeToString(digest[:])
+			if len(arg) == 0 {
+				return hexDigest
+			}
+			if n, _ := strconv.Atoi(arg); n > 0 && n <= len(hexDigest) {
+				return hexDigest[:n]
 			}
-			c = c[serialLen:]
 		}
+		if err == nil {
+			err = fmt.Errorf("unknown placeholder %s in %q", placeholder, filename)
+		}
+		return placeholder
+	})
+	return expanded, err
+}
+
+// updateLatestLink atomically points the symlink at link to target, which is
+// relative to the directory containing link.
+func updateLatestLink(link, target string) error {
+	tmp := link + ".tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		os.Remove(tmp)
+		return err
 	}
+	return nil
+}
 
-	return true
+// fetchSource is somewhere that fetch can get the current CRLSet from.
+type fetchSource interface {
+	// Fetch returns the CRX containing the current CRLSet, or the bare
+	// CRLSet if the source doesn't have the signed CRX, and its length. The
+	// caller must call done once it has finished with the contents.
+	Fetch() (contents io.ReaderAt, length int64, done func(), err error)
 }
 
-func usage() {
-	fmt.Fprintf(os.Stderr, "%s: { fetch | dump <filename> [<cert filename>] }\n", os.Args[0])
+// fetchSources maps the names of sources to functions that create them. The
+// argument is whatever follows the name and a colon in --source, if anything.
+var fetchSources = map[string]func(arg string) (fetchSource, error){
+	"omaha":  newOmahaSource,
+	"url":    newURLSource,
+	"chrome": newChromeSource,
+	"dir":    newDirSource,
 }
 
-func main() {
-	if len(os.Args) < 2 {
-		usage()
-		os.Exit(1)
+// newFetchSource parses the value of --source, which is a source name
+// optionally followed by a colon and an argument, such as "dir:mirror/".
+func newFetchSource(spec string) (fetchSource, error) {
+	name, arg := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		name, arg = spec[:i], spec[i+1:]
+	}
+	newSource, ok := fetchSources[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown source %q", name)
 	}
+	return newSource(arg)
+}
 
-	result := false
-	needUsage := true
+// omahaSource fetches the CRX that Omaha says is current, as Chrome does.
+type omahaSource struct{}
 
-	switch os.Args[1] {
-	case "fetch":
-		if len(os.Args) == 2 {
-			result = fetch()
-			needUsage = false
-		}
-	case "dump":
-		if len(os.Args) == 3 {
-			needUsage = false
-			result = dump(os.Args[2], "")
-		} else if len(os.Args) == 4 {
-			needUsage = false
-			result = dump(os.Args[2], os.Args[3])
-		}
+func newOmahaSource(arg string) (fetchSource, error) {
+	if len(arg) > 0 {
+		return nil, errors.New("The omaha source takes no argument; use --omaha-url to change the endpoint")
 	}
+	return omahaSource{}, nil
+}
 
-	if needUsage {
-		usage()
+func (omahaSource) Fetch() (io.ReaderAt, int64, func(), error) {
+	crxURL, version, err := fetchVersion()
+	if err != nil {
+		return nil, 0, nil, err
 	}
+	fmt.Fprintf(os.Stderr, "Downloading CRLSet version %s\n", version)
+	return urlSource(crxURL).Fetch()
+}
+
+// urlSource downloads a CRX directly from a URL, skipping the update check.
+type urlSource string
+
+func newURLSource(arg string) (fetchSource, error) {
+	if !strings.HasPrefix(arg, "https://") && !strings.HasPrefix(arg, "http://") {
+		return nil, fmt.Errorf("Invalid CRX URL %q", arg)
+	}
+	return urlSource(arg), nil
+}
+
+func (s urlSource) Fetch() (io.ReaderAt, int64, func(), error) {
+	// zip needs to seek around, so the CRX is spooled to a file rather than
+	// held in memory.
+	span := startSpan("crx.download")
+	span.set("url.full", string(s))
+	crxFile, crxLen, err := downloadCRX(string(s))
+	span.set("crx.bytes", crxLen)
+	span.end(err)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("Failed to download CRX: %s", err)
+	}
+	return crxFile, crxLen, func() {
+		crxFile.Close()
+		os.Remove(crxFile.Name())
+	}, nil
+}
+
+// chromeSource reads the CRLSet that a local installation of Chrome has
+// already downloaded and verified. Chrome unpacks the CRX, so the signature
+// isn't available.
+type chromeSource string
+
+// defaultChromeUserDataDir returns where Chrome keeps its data by default.
+func defaultChromeUserDataDir() (string, error) {
+	switch runtime.GOOS {
+	case "windows":
+		return filepath.Join(os.Getenv("LOCALAPPDATA"), "Google", "Chrome", "User Data"), nil
+	case "darwin":
+		home, err := os.UserHomeDir()
+		return filepath.Join(home, "Library", "Application Support", "Google", "Chrome"), err
+	default:
+		config, err := os.UserConfigDir()
+		return filepath.Join(config, "google-chrome"), err
+	}
+}
+
+func newChromeSource(arg string) (fetchSource, error) {
+	if len(arg) == 0 {
+		var err error
+		if arg, err = defaultChromeUserDataDir(); err != nil {
+			return nil, err
+		}
+	}
+	return chromeSource(arg), nil
+}
+
+func (s chromeSource) Fetch() (io.ReaderAt, int64, func(), error) {
+	// The component is installed into a directory named after its
+	// version, which is the sequence number.
+	dir := filepath.Join(string(s), "CertificateRevocation")
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("Failed to find Chrome's CRLSet: %s", err)
+	}
+	best := -1
+	for _, file := range files {
+		if version, err := strconv.Atoi(file.Name()); err == nil && file.IsDir() && version > best {
+			best = version
+		}
+	}
+	if best < 0 {
+		return nil, 0, nil, fmt.Errorf("No CRLSet found in %s", dir)
+	}
+	return openSourceFile(filepath.Join(dir, strconv.Itoa(best), "crl-set"))
+}
+
+// compareChrome reports whether the CRLSet installed by Chrome, in the user
+// data directory userDataDir or the default location if that's empty, is the
+// latest published version. It fails if Chrome's set is stale, so that it can
+// be used in fleet health checks.
+func compareChrome(userDataDir string) bool {
+	source, err := newChromeSource(userDataDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+	contents, length, done, err := source.Fetch()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+	crlSetBytes, err := ioutil.ReadAll(io.NewSectionReader(contents, 0, length))
+	done()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read Chrome's CRLSet: %s\n", err)
+		return false
+	}
+	local, err := parseCRLSet(crlSetBytes)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Chrome's CRLSet is invalid: %s\n", err)
+		return false
+	}
+
+	_, version, err := fetchVersion()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+	latest, err := strconv.Atoi(version)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unexpected CRLSet version %q\n", version)
+		return false
+	}
+
+	behind := latest - local.Header.Sequence
+	switch {
+	case behind > 0:
+		fmt.Printf("Chrome has sequence %d but %d is the latest: %d behind\n", local.Header.Sequence, latest, behind)
+		return false
+	case behind < 0:
+		fmt.Printf("Chrome has sequence %d, which is newer than the %d published by Omaha\n", local.Header.Sequence, latest)
+	default:
+		fmt.Printf("Chrome has sequence %d, which is the latest\n", local.Header.Sequence)
+	}
+	return true
+}
+
+// The exit statuses of freshness, following the Nagios plugin convention.
+const (
+	freshnessOK       = 0
+	freshnessWarning  = 1
+	freshnessCritical = 2
+)
+
+// freshnessState records, between runs of freshness, when a sequence newer
+// than the local CRLSet was first seen.
+type freshnessState struct {
+	Sequence int       `json:"sequence"`
+	Seen     time.Time `json:"seen"`
+}
+
+// supersededSince returns when the CRLSet in filename, with sequence local,
+// was superseded, given that latest is now published at crxURL. The time is
+// kept in a state file in downloadDir so that later runs measure from the
+// first newer sequence seen. That's seeded with the Last-Modified time of
+// the CRX, if the server gives one, so that a probe that's only just been
+// set up isn't fooled by a CRLSet that's been stale for months.
+func supersededSince(filename string, local, latest int, crxURL string) time.Time {
+	now := time.Now()
+	absFilename, err := filepath.Abs(filename)
+	if err != nil {
+		return now
+	}
+	downloads, err := downloadDir()
+	if err != nil {
+		return now
+	}
+	fileHash := sha256.Sum256([]byte(absFilename))
+	stateFilename := filepath.Join(downloads, fmt.Sprintf("freshness-%x.json", fileHash[:8]))
+
+	var state freshnessState
+	if contents, err := ioutil.ReadFile(stateFilename); err == nil && json.Unmarshal(contents, &state) == nil &&
+		state.Sequence > local && state.Sequence <= latest {
+		return state.Seen
+	}
+
+	state = freshnessState{Sequence: latest, Seen: now}
+	if req, err := newRequest("HEAD", crxURL, nil); err == nil {
+		if resp, err := httpClient.Do(req); err == nil {
+			resp.Body.Close()
+			if published, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil && resp.StatusCode == http.StatusOK && published.Before(now) {
+				state.Seen = published
+			}
+		}
+	}
+	if contents, err := json.Marshal(&state); err == nil {
+		if err := copyFile(stateFilename, bytes.NewReader(contents)); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to save %s: %s\n", stateFilename, err)
+		}
+	}
+	return state.Seen
+}
+
+// freshness checks how stale the CRLSet in filename is and returns an exit
+// status for monitoring systems. The set is OK if it's the latest published
+// version, a warning if it was superseded less than maxAge ago, and critical
+// if it was superseded longer ago than that, has passed its NotAfter time, or
+// can't be checked at all.
+func freshness(filename string, maxAge time.Duration) int {
+	set, err := readCRLSet(filename)
+	if err != nil {
+		fmt.Printf("CRLSET CRITICAL - failed to read %s: %s\n", filename, err)
+		return freshnessCritical
+	}
+	if set.Header.NotAfter != 0 && time.Now().Unix() > set.Header.NotAfter {
+		fmt.Printf("CRLSET CRITICAL - sequence %d expired at %s\n", set.Header.Sequence, time.Unix(set.Header.NotAfter, 0).UTC().Format(time.RFC3339))
+		return freshnessCritical
+	}
+
+	crxURL, version, err := fetchVersion()
+	if err != nil {
+		fmt.Printf("CRLSET CRITICAL - failed to fetch the latest version: %s\n", err)
+		return freshnessCritical
+	}
+	latest, err := strconv.Atoi(version)
+	if err != nil {
+		fmt.Printf("CRLSET CRITICAL - unexpected CRLSet version %q\n", version)
+		return freshnessCritical
+	}
+
+	behind := latest - set.Header.Sequence
+	if behind <= 0 {
+		fmt.Printf("CRLSET OK - sequence %d is the latest | behind=0 stale=0s\n", set.Header.Sequence)
+		return freshnessOK
+	}
+	stale := time.Since(supersededSince(filename, set.Header.Sequence, latest, crxURL)).Truncate(time.Second)
+	if stale > maxAge {
+		fmt.Printf("CRLSET CRITICAL - sequence %d is %d behind %d and was superseded %s ago | behind=%d stale=%ds\n", set.Header.Sequence, behind, latest, stale, behind, int64(stale.Seconds()))
+		return freshnessCritical
+	}
+	fmt.Printf("CRLSET WARNING - sequence %d is %d behind %d | behind=%d stale=%ds\n", set.Header.Sequence, behind, latest, behind, int64(stale.Seconds()))
+	return freshnessWarning
+}
+
+// dirSource reads the newest CRX in a mirror directory, such as one served
+// by serve-omaha.
+type dirSource string
+
+func newDirSource(arg string) (fetchSource, error) {
+	if len(arg) == 0 {
+		return nil, errors.New("The dir source needs a directory")
+	}
+	return dirSource(arg), nil
+}
+
+func (s dirSource) Fetch() (io.ReaderAt, int64, func(), error) {
+	mirror := &omahaServer{dir: string(s), crxs: make(map[string]mirroredCRX)}
+	name, _, err := mirror.latest()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if len(name) == 0 {
+		return nil, 0, nil, fmt.Errorf("No CRLSet CRX found in %s", s)
+	}
+	return openSourceFile(filepath.Join(string(s), name))
+}
+
+// archiveSource is a fetchSource that keeps past versions.
+type archiveSource interface {
+	fetchSource
+	// FetchAsOf is like Fetch but returns the CRLSet that was current at
+	// the given time.
+	FetchAsOf(t time.Time) (contents io.ReaderAt, length int64, done func(), err error)
+}
+
+// FetchAsOf returns the CRLSet or CRX in the directory with the highest
+// sequence number among those last modified at or before t. Files are
+// assumed to have been written when they were fetched, as fetch does.
+func (s dirSource) FetchAsOf(t time.Time) (io.ReaderAt, int64, func(), error) {
+	files, err := ioutil.ReadDir(string(s))
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	best, bestName := -1, ""
+	for _, file := range files {
+		if !file.Mode().IsRegular() || file.ModTime().After(t) {
+			continue
+		}
+		set, err := readCRLSet(filepath.Join(string(s), file.Name()))
+		if err != nil {
+			continue
+		}
+		if set.Header.Sequence > best {
+			best, bestName = set.Header.Sequence, file.Name()
+		}
+	}
+	if best < 0 {
+		return nil, 0, nil, fmt.Errorf("No CRLSet in %s is from before %s", s, t.Format(time.RFC3339))
+	}
+	fmt.Fprintf(os.Stderr, "Using CRLSet version %d from %s\n", best, bestName)
+	return openSourceFile(filepath.Join(string(s), bestName))
+}
+
+// parseAsOf parses the value of --as-of. A date means the end of that day in
+// UTC.
+func parseAsOf(value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t.Add(24*time.Hour - time.Nanosecond), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid time %q: expected YYYY-MM-DD or RFC 3339", value)
+	}
+	return t, nil
+}
+
+// openSourceFile implements Fetch for sources that read a local file.
+func openSourceFile(filename string) (io.ReaderAt, int64, func(), error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, nil, err
+	}
+	return f, info.Size(), func() { f.Close() }, nil
+}
+
+// sourceCRLSet returns the CRLSet in what a fetchSource returned, verifying
+// it first if it's a CRX.
+func sourceCRLSet(contents io.ReaderAt, length int64) (crlSetBytes []byte, isCRX bool, err error) {
+	var magic [4]byte
+	contents.ReadAt(magic[:], 0)
+	if string(magic[:]) == "Cr24" {
+		crlSetBytes, err = extractCRLSet(contents, length)
+		return crlSetBytes, true, err
+	}
+	crlSetBytes, err = ioutil.ReadAll(io.NewSectionReader(contents, 0, length))
+	return crlSetBytes, false, err
+}
+
+func fetch(opts fetchOptions) bool {
+	source, err := newFetchSource(opts.source)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+	var contents io.ReaderAt
+	var length int64
+	var done func()
+	if len(opts.asOf) > 0 {
+		var asOf time.Time
+		if asOf, err = parseAsOf(opts.asOf); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return false
+		}
+		archive, ok := source.(archiveSource)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "--as-of needs a source that keeps past versions, such as dir:<directory>\n")
+			return false
+		}
+		contents, length, done, err = archive.FetchAsOf(asOf)
+	} else {
+		contents, length, done, err = source.Fetch()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+	defer done()
+
+	crlSetBytes, isCRX, err := sourceCRLSet(contents, length)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+
+	set, err := parseCRLSet(crlSetBytes)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Downloaded CRLSet is invalid: %s\n", err)
+		return false
+	}
+
+	// Check the pinned identity before anything is written, so that a
+	// pipeline never sees an unexpected set.
+	if opts.expectedSequence != 0 && set.Header.Sequence != opts.expectedSequence {
+		fmt.Fprintf(os.Stderr, "Downloaded CRLSet has sequence %d but %d was expected\n", set.Header.Sequence, opts.expectedSequence)
+		return false
+	}
+	if len(opts.expectedSHA256) > 0 {
+		digest := sha256.Sum256(crlSetBytes)
+		if actual := hex.EncodeToString(digest[:]); !strings.EqualFold(actual, opts.expectedSHA256) {
+			fmt.Fprintf(os.Stderr, "Downloaded CRLSet has SHA-256 %s but %s was expected\n", actual, opts.expectedSHA256)
+			return false
+		}
+	}
+
+	if len(opts.crxOutput) > 0 {
+		if !isCRX {
+			fmt.Fprintf(os.Stderr, "Source %q doesn't provide the signed CRX needed for --crx-output\n", opts.source)
+			return false
+		}
+		crxOutput, err := expandFilename(opts.crxOutput, set, crlSetBytes)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return false
+		}
+		if err := copyFile(crxOutput, io.NewSectionReader(contents, 0, length)); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write CRX: %s\n", err)
+			return false
+		}
+	}
+
+	output := opts.output
+	current := opts.output
+	versioned := isTemplate(opts.output)
+	if versioned {
+		if output, err = expandFilename(opts.output, set, crlSetBytes); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return false
+		}
+		current = filepath.Join(filepath.Dir(output), latestLinkName)
+	}
+
+	if len(current) > 0 {
+		// Hold a lock from reading the current set until it has been
+		// replaced, so that concurrent fetches can't both pass the
+		// downgrade check.
+		unlock, err := lockFile(current)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to lock %s: %s\n", current, err)
+			return false
+		}
+		defer unlock()
+	}
+
+	var existing *crlset.CRLSet
+	minSequence := opts.minSequence
+	if len(current) > 0 {
+		// Never replace a local set with an older one, which could be the
+		// result of a rollback attack or a misbehaving mirror.
+		if existing, err = readCRLSet(current); err != nil {
+			existing = nil
+		} else if existing.Header.Sequence > minSequence {
+			minSequence = existing.Header.Sequence
+		}
+	}
+	if set.Header.Sequence < minSequence {
+		fmt.Fprintf(os.Stderr, "Refusing to downgrade to sequence %d (minimum %d)\n", set.Header.Sequence, minSequence)
+		return false
+	}
+
+	// Report the changes before the set is written. If any report fails
+	// then nothing is committed, so the next run, still comparing against
+	// the old set, tries them all again. Consumers may see a change more
+	// than once, but never miss one.
+	if !reportChanges(opts, output, existing, set) {
+		return false
+	}
+
+	if err := writeOutput(output, crlSetBytes); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write CRLSet: %s\n", err)
+		return false
+	}
+
+	if versioned {
+		if err := updateLatestLink(current, filepath.Base(output)); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to update %s: %s\n", current, err)
+			return false
+		}
+	}
+
+	return true
+}
+
+// reportChanges writes the changelog, publishes the changes, runs the removal
+// hook and sends the email alert for an update from existing, which may be
+// nil, to set. Every one is attempted even if an earlier one fails, and it
+// returns false if any failed.
+func reportChanges(opts fetchOptions, output string, existing, set *crlset.CRLSet) bool {
+	updated := existing != nil && set.Header.Sequence > existing.Header.Sequence
+	ok := true
+
+	if len(opts.changelog) > 0 && updated {
+		if err := appendChangelog(opts.changelog, existing, set); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write changelog: %s\n", err)
+			ok = false
+		}
+	}
+
+	if opts.publish.enabled() && updated {
+		if err := opts.publish.publish(existing, set); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to publish changes: %s\n", err)
+			ok = false
+		}
+	}
+
+	if len(opts.removalHook) > 0 && updated {
+		if err := runRemovalHook(opts.removalHook, existing, set); err != nil {
+			fmt.Fprintf(os.Stderr, "Removal hook failed: %s\n", err)
+			ok = false
+		}
+	}
+
+	if len(output) > 0 && len(opts.smtp.server) > 0 && (existing == nil || updated) {
+		if err := opts.smtp.send(fmt.Sprintf("CRLSet sequence %d", set.Header.Sequence), alertMessages(existing, set, opts.watches)); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to send email alert: %s\n", err)
+			ok = false
+		}
+	}
+
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Not writing sequence %d so that the changes are reported again next time\n", set.Header.Sequence)
+	}
+	return ok
+}
+
+// maxPollBackoff is the largest multiple of the interval that fetchEvery
+// waits after consecutive failures.
+const maxPollBackoff = 16
+
+// pollDelay returns how long fetchEvery waits before the next poll, given
+// the number of consecutive failures so far and any delay requested with
+// Retry-After. The interval doubles with each failure, up to maxPollBackoff
+// times, and up to a tenth of it is randomly added or removed so that many
+// instances started together drift apart rather than polling in lockstep.
+func pollDelay(interval time.Duration, failures int, requested time.Duration) time.Duration {
+	delay := interval
+	for i := 0; i < failures && delay < maxPollBackoff*interval; i++ {
+		delay *= 2
+	}
+	if spread := int64(delay / 5); spread > 0 {
+		if jitter, err := rand.Int(rand.Reader, big.NewInt(spread)); err == nil {
+			delay += time.Duration(jitter.Int64() - spread/2)
+		}
+	}
+	if delay < requested {
+		delay = requested
+	}
+	return delay
+}
+
+// fetchEvery runs fetch repeatedly, waiting about interval between polls,
+// until interrupted. Failures are reported but don't stop polling. SIGHUP
+// triggers a poll straight away; it doesn't re-read opts, which are fixed
+// once the flags are parsed.
+func fetchEvery(opts fetchOptions, interval time.Duration) bool {
+	hup := notifyReload()
+	failures := 0
+	for {
+		retryAfter.Store(0)
+		if fetch(opts) {
+			failures = 0
+		} else {
+			failures++
+		}
+		if interrupted.Err() != nil {
+			return failures == 0
+		}
+
+		delay := pollDelay(interval, failures, time.Duration(retryAfter.Load()))
+		if failures > 0 {
+			fmt.Fprintf(os.Stderr, "Fetch failed (%d in a row); retrying in %s\n", failures, delay.Round(time.Second))
+		}
+		select {
+		case <-time.After(delay):
+		case <-hup:
+			log.Printf("Received SIGHUP; fetching now")
+		case <-interrupted.Done():
+			return failures == 0
+		}
+	}
+}
+
+// smtpConfig holds the settings used to send email alerts.
+type smtpConfig struct {
+	// server is the host:port of the SMTP server.
+	server string
+	from   string
+	// to is a comma separated list of recipients.
+	to string
+	// username and password, if set, are used to authenticate to the
+	// server.
+	username string
+	password string
+}
+
+// send emails the given lines to the configured recipients.
+func (c *smtpConfig) send(subject string, lines []string) error {
+	host, _, err := net.SplitHostPort(c.server)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if len(c.username) > 0 {
+		auth = smtp.PlainAuth("", c.username, c.password, host)
+	}
+
+	to := strings.Split(c.to, ",")
+	for i := range to {
+		to[i] = strings.TrimSpace(to[i])
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", c.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	for _, line := range lines {
+		fmt.Fprintf(&msg, "%s\r\n", line)
+	}
+
+	// This is smtp.SendMail, but dialling with dialNetwork.
+	conn, err := dialNetwork("tcp", c.server)
+	if err != nil {
+		return err
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(c.from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := client.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// watchEntry is an SPKI hash, and optionally a serial under it, whose
+// appearance in a new CRLSet should be called out in alerts.
+type watchEntry struct {
+	spkiHash [crlset.SPKIHashLen]byte
+	serial   []byte
+}
+
+// watchList is a flag.Value that accumulates watchEntries given as
+// "<SPKI hash>" or "<SPKI hash>:<hex serial>".
+type watchList []watchEntry
+
+func (entry *watchEntry) String() string {
+	if entry.serial == nil {
+		return hex.EncodeToString(entry.spkiHash[:])
+	}
+	return fmt.Sprintf("%x:%x", entry.spkiHash, entry.serial)
+}
+
+func (w *watchList) String() string {
+	var s []string
+	for i := range *w {
+		s = append(s, (*w)[i].String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (w *watchList) Set(value string) error {
+	var entry watchEntry
+	spki := value
+	if i := strings.Index(value, ":"); i >= 0 {
+		spki = value[:i]
+		serial, err := hex.DecodeString(value[i+1:])
+		if err != nil {
+			return fmt.Errorf("Invalid serial %q", value[i+1:])
+		}
+		entry.serial = serial
+	}
+	hash, err := parseSPKIHash(spki)
+	if err != nil {
+		return err
+	}
+	entry.spkiHash = hash
+	*w = append(*w, entry)
+	return nil
+}
+
+// matches reports whether set contains the watched entry: either the serial
+// under the SPKI or, if no serial was given, any mention of the SPKI,
+// including in the header's interception lists.
+func (entry *watchEntry) matches(set *crlset.CRLSet) bool {
+	if set == nil {
+		return false
+	}
+	if entry.serial == nil {
+		for _, list := range [][][crlset.SPKIHashLen]byte{
+			set.Header.BlockedSPKIHashes(),
+			set.Header.KnownInterceptionSPKIHashes(),
+			set.Header.BlockedInterceptionSPKIHashes(),
+		} {
+			for _, hash := range list {
+				if hash == entry.spkiHash {
+					return true
+				}
+			}
+		}
+	}
+	for _, e := range set.Entries {
+		if !bytes.Equal(e.SPKIHash, entry.spkiHash[:]) {
+			continue
+		}
+		if entry.serial == nil {
+			return true
+		}
+		for _, serial := range e.Serials {
+			if serialMatch.Match(serial, entry.serial) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// alertMessages describes the changes between previous, which may be nil,
+// and set, calling out any watched entries that have newly appeared.
+func alertMessages(previous, set *crlset.CRLSet, watches []watchEntry) []string {
+	var lines []string
+	if previous == nil {
+		lines = append(lines, fmt.Sprintf("CRLSet sequence %d has been downloaded.", set.Header.Sequence))
+	} else {
+		added, removed := diffCRLSets(previous, set)
+		lines = append(lines, fmt.Sprintf("CRLSet sequence %d replaces %d: %d serials added, %d removed.", set.Header.Sequence, previous.Header.Sequence, countSerials(added), countSerials(removed)))
+
+		// Removals can let previously blocked certificates be trusted
+		// again, so they're listed individually.
+		removals := removedEvents(previous, set)
+		for i, event := range removals {
+			if i == maxAlertRemovals {
+				lines = append(lines, fmt.Sprintf("... and %d more removals.", len(removals)-i))
+				break
+			}
+			if event.Kind == "serial" {
+				lines = append(lines, fmt.Sprintf("Removed serial %s under SPKI %s.", event.Serial, event.SPKI))
+			} else {
+				lines = append(lines, fmt.Sprintf("Removed SPKI %s from %s.", event.SPKI, event.Kind))
+			}
+		}
+	}
+
+	for i := range watches {
+		if watches[i].matches(set) && !watches[i].matches(previous) {
+			lines = append(lines, fmt.Sprintf("Watched entry %s now appears.", watches[i].String()))
+		} else if previous != nil && watches[i].matches(previous) && !watches[i].matches(set) {
+			lines = append(lines, fmt.Sprintf("Watched entry %s has been removed.", watches[i].String()))
+		}
+	}
+	return lines
+}
+
+// maxAlertRemovals limits the number of removals listed in an alert, since
+// expired certificates are regularly pruned in bulk.
+const maxAlertRemovals = 50
+
+// removedEvents returns the changelog events for the serials and header SPKIs
+// that were removed between previous and set.
+func removedEvents(previous, set *crlset.CRLSet) []changelogEvent {
+	var removed []changelogEvent
+	for _, event := range changelogEvents(previous, set) {
+		if event.Change == "removed" {
+			removed = append(removed, event)
+		}
+	}
+	return removed
+}
+
+// runRemovalHook runs the program hook if anything was removed between
+// previous and set, passing the removals on its stdin as changelog lines. The
+// sequence numbers are also given in $CRLSET_SEQUENCE and
+// $CRLSET_PREVIOUS_SEQUENCE.
+func runRemovalHook(hook string, previous, set *crlset.CRLSet) error {
+	removals := removedEvents(previous, set)
+	if len(removals) == 0 {
+		return nil
+	}
+
+	var in bytes.Buffer
+	e := json.NewEncoder(&in)
+	for _, event := range removals {
+		if err := e.Encode(&event); err != nil {
+			return err
+		}
+	}
+
+	cmd := exec.Command(hook)
+	cmd.Stdin = &in
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("CRLSET_SEQUENCE=%d", set.Header.Sequence),
+		fmt.Sprintf("CRLSET_PREVIOUS_SEQUENCE=%d", previous.Header.Sequence))
+	return cmd.Run()
+}
+
+// publishConfig holds the settings used to publish changes to a NATS subject
+// or Kafka topic.
+type publishConfig struct {
+	// natsURL is a nats:// or tls:// URL of a NATS server, optionally with
+	// a user and password or a token as the username.
+	natsURL string
+	// kafkaRESTURL is the base URL of a Kafka REST proxy, through which
+	// messages are produced to Kafka.
+	kafkaRESTURL string
+	// topic is the NATS subject or Kafka topic.
+	topic string
+	// format is "json", for a changelogEvent, or "csv", for a line of
+	// publishCSVFields.
+	format string
+}
+
+// publishCSVFields are the columns of a message published with --publish-format=csv.
+var publishCSVFields = []string{"time", "sequence", "previousSequence", "change", "kind", "spki", "serial"}
+
+// kafkaRESTBatch is the largest number of records sent to the Kafka REST
+// proxy in one request.
+const kafkaRESTBatch = 500
+
+func (c *publishConfig) enabled() bool {
+	return len(c.natsURL) > 0 || len(c.kafkaRESTURL) > 0
+}
+
+// encode serializes event as a message in the configured format.
+func (c *publishConfig) encode(event *changelogEvent) ([]byte, error) {
+	switch c.format {
+	case "json":
+		return json.Marshal(event)
+	case "csv":
+		var out bytes.Buffer
+		w := csv.NewWriter(&out)
+		w.Write([]string{event.Time, strconv.Itoa(event.Sequence), strconv.Itoa(event.PreviousSequence), event.Change, event.Kind, event.SPKI, event.Serial})
+		w.Flush()
+		return bytes.TrimSuffix(out.Bytes(), []byte("\n")), w.Error()
+	}
+	return nil, fmt.Errorf("unknown publish format %q", c.format)
+}
+
+// publish sends a message for each serial and header SPKI that was added or
+// removed between previous and set.
+func (c *publishConfig) publish(previous, set *crlset.CRLSet) error {
+	events := changelogEvents(previous, set)
+	if len(events) == 0 {
+		return nil
+	}
+	messages := make([][]byte, len(events))
+	for i := range events {
+		var err error
+		if messages[i], err = c.encode(&events[i]); err != nil {
+			return err
+		}
+	}
+
+	if len(c.natsURL) > 0 {
+		if err := publishNATS(c.natsURL, c.topic, messages); err != nil {
+			return fmt.Errorf("NATS: %s", err)
+		}
+	}
+	if len(c.kafkaRESTURL) > 0 {
+		if err := publishKafkaREST(c.kafkaRESTURL, c.topic, events, messages); err != nil {
+			return fmt.Errorf("Kafka: %s", err)
+		}
+	}
+	return nil
+}
+
+// publishNATS publishes messages to subject on the NATS server at natsURL,
+// then waits for the server to acknowledge them with a PONG.
+func publishNATS(natsURL, subject string, messages [][]byte) error {
+	u, err := url.Parse(natsURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "nats" && u.Scheme != "tls" {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	addr := u.Host
+	if len(u.Port()) == 0 {
+		addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+
+	conn, err := dialNetwork("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	r := bufio.NewReader(conn)
+
+	// The server starts with an INFO line, after which a TLS server
+	// expects the handshake.
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("unexpected greeting %q", strings.TrimSpace(line))
+	}
+	var w io.Writer = conn
+	if u.Scheme == "tls" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tlsConn.HandshakeContext(interrupted); err != nil {
+			return err
+		}
+		r, w = bufio.NewReader(tlsConn), tlsConn
+	}
+
+	connect := map[string]interface{}{"verbose": false, "pedantic": false, "name": "crlset-tools", "lang": "go"}
+	if password, ok := u.User.Password(); ok {
+		connect["user"], connect["pass"] = u.User.Username(), password
+	} else if token := u.User.Username(); len(token) > 0 {
+		connect["auth_token"] = token
+	}
+	connectJSON, err := json.Marshal(connect)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "CONNECT %s\r\n", connectJSON)
+	for _, message := range messages {
+		fmt.Fprintf(bw, "PUB %s %d\r\n", subject, len(message))
+		bw.Write(message)
+		bw.WriteString("\r\n")
+	}
+	bw.WriteString("PING\r\n")
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New(strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+// kafkaRESTRecord is a record in a request to a Kafka REST proxy's v2 API,
+// with a base64 key and value.
+type kafkaRESTRecord struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// publishKafkaREST produces messages to topic through the Kafka REST proxy at
+// proxyURL. Each message is keyed by its SPKI hash so that the changes for an
+// issuer stay in order within a partition.
+func publishKafkaREST(proxyURL, topic string, events []changelogEvent, messages [][]byte) error {
+	endpoint := strings.TrimSuffix(proxyURL, "/") + "/topics/" + url.PathEscape(topic)
+	for start := 0; start < len(messages); start += kafkaRESTBatch {
+		end := start + kafkaRESTBatch
+		if end > len(messages) {
+			end = len(messages)
+		}
+		var request struct {
+			Records []kafkaRESTRecord `json:"records"`
+		}
+		for i := start; i < end; i++ {
+			request.Records = append(request.Records, kafkaRESTRecord{Key: []byte(events[i].SPKI), Value: messages[i]})
+		}
+		body, err := json.Marshal(&request)
+		if err != nil {
+			return err
+		}
+
+		resp, err := httpPost(endpoint, "application/vnd.kafka.binary.v2+json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		var reply struct {
+			Offsets []struct {
+				Error string `json:"error"`
+			} `json:"offsets"`
+			Message string `json:"message"`
+		}
+		err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&reply)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected HTTP status %q: %s", resp.Status, reply.Message)
+		}
+		if err != nil {
+			return err
+		}
+		for _, offset := range reply.Offsets {
+			if len(offset.Error) > 0 {
+				return errors.New(offset.Error)
+			}
+		}
+	}
+	return nil
+}
+
+// changelogEvent is a line of the changelog written by fetch.
+type changelogEvent struct {
+	Time             string `json:"time"`
+	Sequence         int    `json:"sequence"`
+	PreviousSequence int    `json:"previousSequence"`
+	// Change is either "added" or "removed".
+	Change string `json:"change"`
+	// Kind is "serial" for a revoked serial, or the name of the header
+	// list that an SPKI was added to or removed from.
+	Kind   string `json:"kind"`
+	SPKI   string `json:"spki"`
+	Serial string `json:"serial,omitempty"`
+}
+
+// changelogEvents returns an event for each serial and header SPKI that was
+// added or removed between previous and set.
+func changelogEvents(previous, set *crlset.CRLSet) []changelogEvent {
+	template := changelogEvent{
+		Time:             time.Now().UTC().Format(time.RFC3339),
+		Sequence:         set.Header.Sequence,
+		PreviousSequence: previous.Header.Sequence,
+	}
+	var events []changelogEvent
+
+	lists := []struct {
+		kind          string
+		before, after [][crlset.SPKIHashLen]byte
+	}{
+		{"BlockedSPKIs", previous.Header.BlockedSPKIHashes(), set.Header.BlockedSPKIHashes()},
+		{"KnownInterceptionSPKIs", previous.Header.KnownInterceptionSPKIHashes(), set.Header.KnownInterceptionSPKIHashes()},
+		{"BlockedInterceptionSPKIs", previous.Header.BlockedInterceptionSPKIHashes(), set.Header.BlockedInterceptionSPKIHashes()},
+	}
+	for _, list := range lists {
+		for _, change := range []struct {
+			name     string
+			from, to [][crlset.SPKIHashLen]byte
+		}{{"added", list.before, list.after}, {"removed", list.after, list.before}} {
+			present := make(map[[crlset.SPKIHashLen]byte]bool)
+			for _, hash := range change.from {
+				present[hash] = true
+			}
+			for _, hash := range change.to {
+				if !present[hash] {
+					event := template
+					event.Change = change.name
+					event.Kind = list.kind
+					event.SPKI = hex.EncodeToString(hash[:])
+					events = append(events, event)
+				}
+			}
+		}
+	}
+
+	added, removed := diffCRLSets(previous, set)
+	for _, change := range []struct {
+		name    string
+		entries []crlset.Entry
+	}{{"added", added}, {"removed", removed}} {
+		for _, entry := range change.entries {
+			for _, serial := range entry.Serials {
+				event := template
+				event.Change = change.name
+				event.Kind = "serial"
+				event.SPKI = hex.EncodeToString(entry.SPKIHash)
+				event.Serial = hex.EncodeToString(serial)
+				events = append(events, event)
+			}
+		}
+	}
+
+	return events
+}
+
+// appendChangelog appends the changes between previous and set to filename,
+// one JSON object per line.
+func appendChangelog(filename string, previous, set *crlset.CRLSet) error {
+	var out bytes.Buffer
+	e := json.NewEncoder(&out)
+	for _, event := range changelogEvents(previous, set) {
+		if err := e.Encode(&event); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(out.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// sortedSPKIHashes returns a sorted copy of hashes.
+func sortedSPKIHashes(hashes [][crlset.SPKIHashLen]byte) [][crlset.SPKIHashLen]byte {
+	sorted := append([][crlset.SPKIHashLen]byte(nil), hashes...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i][:], sorted[j][:]) < 0
+	})
+	return sorted
+}
+
+// parseCRLSet parses the contents of a CRLSet file.
+func parseCRLSet(c []byte) (set *crlset.CRLSet, err error) {
+	s := startSpan("crlset.parse")
+	s.set("crlset.bytes", len(c))
+	defer func() {
+		if set != nil {
+			s.set("crlset.sequence", set.Header.Sequence)
+			s.set("crlset.spkis", len(set.Entries))
+		}
+		s.end(err)
+	}()
+	return crlset.Parse(c)
+}
+
+// readCRLSet reads and parses the CRLSet in filename, which may either be a
+// bare CRLSet or the CRX that it's distributed in. A CRX's signature is
+// verified before the CRLSet is extracted from it.
+func readCRLSet(filename string) (*crlset.CRLSet, error) {
+	c, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read CRLSet: %s", err)
+	}
+	return parseCRLSetOrCRX(c)
+}
+
+// mapFile is set by crlset_unix.go to memory-map a file read-only. It
+// returns the file's contents and a function that releases them.
+var mapFile = func(filename string) ([]byte, func(), error) {
+	c, err := ioutil.ReadFile(filename)
+	return c, func() {}, err
+}
+
+// readMappedCRLSet is like readCRLSet except that, where the platform
+// allows, a bare CRLSet is memory-mapped rather than read, so the SPKI
+// hashes and serials of the returned set refer to the file's pages. Processes
+// serving the same file then share it through the page cache. release must
+// be called once nothing refers to the set. The file must be replaced by
+// renaming over it, as fetch does, rather than rewritten in place.
+func readMappedCRLSet(filename string) (set *crlset.CRLSet, release func(), err error) {
+	c, release, err := mapFile(filename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to read CRLSet: %s", err)
+	}
+	if bytes.HasPrefix(c, []byte("Cr24")) {
+		// Extracting a CRX copies the CRLSet out of it anyway.
+		defer release()
+		set, err := parseCRLSetOrCRX(c)
+		return set, func() {}, err
+	}
+	if set, err = parseCRLSet(c); err != nil {
+		release()
+		return nil, nil, err
+	}
+	return set, release, nil
+}
+
+// parseCRLSetOrCRX parses c, which may either be a bare CRLSet or a CRX
+// containing one, whose signature is verified.
+func parseCRLSetOrCRX(c []byte) (*crlset.CRLSet, error) {
+	if bytes.HasPrefix(c, []byte("Cr24")) {
+		var err error
+		if c, err = extractCRLSet(bytes.NewReader(c), int64(len(c))); err != nil {
+			return nil, err
+		}
+	}
+	return parseCRLSet(c)
+}
+
+// diffCRLSets returns the serials that appear in b but not in a (added) and
+// those that appear in a but not in b (removed), grouped by SPKI hash and in
+// sorted order.
+func diffCRLSets(a, b *crlset.CRLSet) (added, removed []crlset.Entry) {
+	return subtractCRLSet(b, a), subtractCRLSet(a, b)
+}
+
+// subtractCRLSet returns the serials in a that aren't present under the same
+// SPKI in b, grouped by SPKI hash and in sorted order.
+func subtractCRLSet(a, b *crlset.CRLSet) []crlset.Entry {
+	present := make(map[string]bool)
+	for _, entry := range b.Entries {
+		for _, serial := range entry.Serials {
+			present[string(entry.SPKIHash)+string(serial)] = true
+		}
+	}
+
+	result := &crlset.CRLSet{}
+	for _, entry := range a.Entries {
+		missing := crlset.Entry{SPKIHash: entry.SPKIHash}
+		for _, serial := range entry.Serials {
+			if !present[string(entry.SPKIHash)+string(serial)] {
+				missing.Serials = append(missing.Serials, serial)
+			}
+		}
+		if len(missing.Serials) > 0 {
+			result.Entries = append(result.Entries, missing)
+		}
+	}
+	result.Sort()
+	return result.Entries
+}
+
+// intersectCRLSets returns the serials that appear under the same SPKI in
+// both a and b, grouped by SPKI hash and in sorted order.
+func intersectCRLSets(a, b *crlset.CRLSet) []crlset.Entry {
+	present := make(map[string]bool)
+	for _, entry := range b.Entries {
+		for _, serial := range entry.Serials {
+			present[string(entry.SPKIHash)+string(serial)] = true
+		}
+	}
+
+	result := &crlset.CRLSet{}
+	for _, entry := range a.Entries {
+		common := crlset.Entry{SPKIHash: entry.SPKIHash}
+		for _, serial := range entry.Serials {
+			key := string(entry.SPKIHash) + string(serial)
+			if present[key] {
+				common.Serials = append(common.Serials, serial)
+				// Only report each pair once, even if a repeats it.
+				delete(present, key)
+			}
+		}
+		if len(common.Serials) > 0 {
+			result.Entries = append(result.Entries, common)
+		}
+	}
+	result.Sort()
+	return result.Entries
+}
+
+// sharedSerial is a serial that's revoked under more than one SPKI.
+type sharedSerial struct {
+	serial []byte
+	// spkiHashes lists the SPKIs under which the serial appears, in
+	// sorted order.
+	spkiHashes [][]byte
+}
+
+// sharedSerials returns the serials in set that appear in more than one SPKI
+// section, for example because the same certificate was revoked under each
+// of the keys of a cross-signed issuer. The result is sorted by serial.
+func sharedSerials(set *crlset.CRLSet) []sharedSerial {
+	bySerial := make(map[string][][]byte)
+	for _, entry := range set.Entries {
+		for _, serial := range entry.Serials {
+			bySerial[string(serial)] = append(bySerial[string(serial)], entry.SPKIHash)
+		}
+	}
+
+	var shared []sharedSerial
+	for serial, hashes := range bySerial {
+		if len(hashes) < 2 {
+			continue
+		}
+		sort.Slice(hashes, func(i, j int) bool {
+			return bytes.Compare(hashes[i], hashes[j]) < 0
+		})
+		// A serial may be repeated within a section, or a section split
+		// in two, so count each SPKI once.
+		unique := hashes[:1]
+		for _, hash := range hashes[1:] {
+			if !bytes.Equal(hash, unique[len(unique)-1]) {
+				unique = append(unique, hash)
+			}
+		}
+		if len(unique) > 1 {
+			shared = append(shared, sharedSerial{[]byte(serial), unique})
+		}
+	}
+	sort.Slice(shared, func(i, j int) bool {
+		return bytes.Compare(shared[i].serial, shared[j].serial) < 0
+	})
+	return shared
+}
+
+// countSerials returns the total number of serials in entries.
+func countSerials(entries []crlset.Entry) int {
+	n := 0
+	for _, entry := range entries {
+		n += len(entry.Serials)
+	}
+	return n
+}
+
+// writeOutput writes contents to filename, or to stdout if filename is empty.
+func writeOutput(filename string, contents []byte) error {
+	if len(filename) == 0 {
+		_, err := os.Stdout.Write(contents)
+		return err
+	}
+	return copyFile(filename, bytes.NewReader(contents))
+}
+
+// dumpOptions controls the output of dump.
+type dumpOptions struct {
+	// sorted causes SPKI sections and serials to be emitted in a canonical
+	// order rather than the order in which they appear in the file.
+	sorted bool
+	// format is the name of a registered formatter, such as "text",
+	// "base64", "pg", "go", "snapshot" or "go-loader".
+	format string
+	// goPackage is the package name used by the "go" and "go-loader"
+	// formats.
+	goPackage string
+	// offset and limit select a page of SPKI sections, or of serials if a
+	// certificate is given, in the text formats. A limit of zero means no
+	// limit.
+	offset, limit int
+	// spkiOnly causes the text formats to omit serials.
+	spkiOnly bool
+	// bufferSize is the size of the buffer used for the output.
+	bufferSize int
+	// spki, if non-empty, is the SPKI hash of the certificate given to dump.
+	// Only that SPKI's entries are written, and the text formats print just
+	// their serials.
+	spki []byte
+}
+
+// readCertificate reads a PEM or DER encoded certificate from filename.
+func readCertificate(filename string) (*x509.Certificate, error) {
+	certBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read certificate: %s", err)
+	}
+
+	var derBytes []byte
+	if block, _ := pem.Decode(certBytes); block == nil {
+		derBytes = certBytes
+	} else {
+		derBytes = block.Bytes
+	}
+
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse certificate: %s", err)
+	}
+	return cert, nil
+}
+
+func dump(filename string, certificateFilename string, opts dumpOptions) bool {
+	var spki []byte
+	if len(certificateFilename) > 0 {
+		cert, err := readCertificate(certificateFilename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return false
+		}
+		spki = crlset.SPKIHash(cert)
+	}
+
+	set, err := readCRLSet(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+
+	if opts.sorted {
+		set.Sort()
+	}
+
+	textFormat := opts.format == "text" || opts.format == "base64" || opts.format == "pg"
+	if !textFormat && (opts.offset != 0 || opts.limit != 0 || opts.spkiOnly) {
+		fmt.Fprintf(os.Stderr, "--offset, --limit and --spki-only can only be used with --format=text, base64 or pg\n")
+		return false
+	}
+	if opts.offset < 0 || opts.limit < 0 {
+		fmt.Fprintf(os.Stderr, "--offset and --limit must not be negative\n")
+		return false
+	}
+
+	newFormatter, ok := formatters[opts.format]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown output format %q\n", opts.format)
+		return false
+	}
+	if opts.bufferSize <= 0 {
+		fmt.Fprintf(os.Stderr, "--buffer-size must be positive\n")
+		return false
+	}
+	opts.spki = spki
+	out := bufio.NewWriterSize(os.Stdout, opts.bufferSize)
+	f := newFormatter(out, opts)
+	err = writeFormatted(f, set, spki)
+	if err == nil {
+		err = out.Flush()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write %s output: %s\n", f.Name(), err)
+		return false
+	}
+
+	return true
+}
+
+// formatter writes a CRLSet in one of dump's output formats. WriteHeader is
+// called first, then WriteEntry for each SPKI section, and finally Close.
+type formatter interface {
+	// Name returns the name of the format, as given to --format.
+	Name() string
+	WriteHeader(header *crlset.Header) error
+	WriteEntry(entry crlset.Entry) error
+	Close() error
+}
+
+// formatters maps the names of output formats to functions that return a
+// formatter writing to w.
+var formatters = make(map[string]func(w io.Writer, opts dumpOptions) formatter)
+
+// registerFormatter makes a format available to dump's --format flag.
+func registerFormatter(name string, newFormatter func(w io.Writer, opts dumpOptions) formatter) {
+	if _, ok := formatters[name]; ok {
+		panic("formatter " + name + " registered twice")
+	}
+	formatters[name] = newFormatter
+}
+
+// formatterNames returns the names of the registered formats, in order.
+func formatterNames() []string {
+	var names []string
+	for name := range formatters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	registerFormatter("text", func(w io.Writer, opts dumpOptions) formatter {
+		return &textFormatter{name: "text", w: w, opts: opts, encode: hex.AppendEncode}
+	})
+	registerFormatter("base64", func(w io.Writer, opts dumpOptions) formatter {
+		return &textFormatter{name: "base64", w: w, opts: opts, encode: base64.StdEncoding.AppendEncode}
+	})
+	registerFormatter("pg", func(w io.Writer, opts dumpOptions) formatter {
+		return &textFormatter{name: "pg", w: w, opts: opts, encode: appendPgBytea}
+	})
+	registerFormatter("go", func(w io.Writer, opts dumpOptions) formatter {
+		return &setFormatter{name: "go", w: w, write: func(w io.Writer, set *crlset.CRLSet) error {
+			return writeGoSource(w, set, opts.goPackage)
+		}}
+	})
+	registerFormatter("snapshot", func(w io.Writer, opts dumpOptions) formatter {
+		return &setFormatter{name: "snapshot", w: w, write: writeSnapshot}
+	})
+	registerFormatter("parquet", func(w io.Writer, opts dumpOptions) formatter {
+		return &setFormatter{name: "parquet", w: w, write: writeParquet}
+	})
+	registerFormatter("bigquery", func(w io.Writer, opts dumpOptions) formatter {
+		return &setFormatter{name: "bigquery", w: w, write: writeBigQueryRows}
+	})
+	registerFormatter("ndjson", func(w io.Writer, opts dumpOptions) formatter {
+		return newNDJSONFormatter(w, opts)
+	})
+	registerFormatter("pgcopy", func(w io.Writer, opts dumpOptions) formatter {
+		return &setFormatter{name: "pgcopy", w: w, write: writePgCopy}
+	})
+	registerFormatter("go-loader", func(w io.Writer, opts dumpOptions) formatter {
+		return &setFormatter{name: "go-loader", w: w, write: func(w io.Writer, set *crlset.CRLSet) error {
+			_, err := fmt.Fprintf(w, goLoaderSource, opts.goPackage)
+			return err
+		}}
+	})
+}
+
+// writeFormatted writes set with f. If spki is non-empty then only the
+// entries for that SPKI are written.
+func writeFormatted(f formatter, set *crlset.CRLSet, spki []byte) error {
+	if err := f.WriteHeader(&set.Header); err != nil {
+		return err
+	}
+	for _, entry := range set.Entries {
+		if len(spki) > 0 && !bytes.Equal(spki, entry.SPKIHash) {
+			continue
+		}
+		if err := f.WriteEntry(entry); err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// textFormatter implements the human readable "text" format, and the "base64"
+// and "pg" formats that differ only in how hashes and serials are encoded. If
+// opts.spki is set then only the serials are printed.
+type textFormatter struct {
+	name string
+	w    io.Writer
+	opts dumpOptions
+	// encode appends the encoding of hashes and serials to a line: hex for
+	// "text", base64 for "base64" and PostgreSQL's bytea hex format for
+	// "pg".
+	encode func(dst, src []byte) []byte
+	// n counts the SPKI sections, or serials if opts.spki is set, seen so
+	// far to select the page given by opts.offset and opts.limit.
+	n int
+	// line is reused to format each line without allocating.
+	line []byte
+}
+
+func (f *textFormatter) Name() string { return f.name }
+
+// appendPgBytea appends src to dst as a PostgreSQL bytea literal in hex
+// format, such as \x0102, for loading with COPY.
+func appendPgBytea(dst, src []byte) []byte {
+	return hex.AppendEncode(append(dst, `\x`...), src)
+}
+
+// inPage reports whether the next item is in the selected page, and counts
+// it.
+func (f *textFormatter) inPage() bool {
+	i := f.n
+	f.n++
+	return i >= f.opts.offset && (f.opts.limit == 0 || i < f.opts.offset+f.opts.limit)
+}
+
+// writeSPKIs prints a list of SPKI hashes from the header, if it's non-empty.
+func (f *textFormatter) writeSPKIs(name string, hashes [][crlset.SPKIHashLen]byte) {
+	if len(hashes) == 0 {
+		return
+	}
+	fmt.Fprintf(f.w, "%s:\n", name)
+	for _, hash := range hashes {
+		f.writeBytesLine("  ", hash[:])
+	}
+}
+
+func (f *textFormatter) WriteHeader(header *crlset.Header) error {
+	if len(f.opts.spki) > 0 {
+		return nil
+	}
+	fmt.Fprintf(f.w, "Sequence: %d\n", header.Sequence)
+	fmt.Fprintf(f.w, "Parents: %d\n", header.NumParents)
+	f.writeSPKIs("BlockedSPKIs", header.BlockedSPKIHashes())
+	f.writeSPKIs("KnownInterceptionSPKIs", header.KnownInterceptionSPKIHashes())
+	f.writeSPKIs("BlockedInterceptionSPKIs", header.BlockedInterceptionSPKIHashes())
+	_, err := fmt.Fprintf(f.w, "\n")
+	return err
+}
+
+// writeBytesLine writes b, encoded with f.encode, on a line of its own after
+// indent.
+func (f *textFormatter) writeBytesLine(indent string, b []byte) error {
+	f.line = append(f.line[:0], indent...)
+	f.line = f.encode(f.line, b)
+	f.line = append(f.line, '\n')
+	_, err := f.w.Write(f.line)
+	return err
+}
+
+// writeSerialLine writes serial on a line of its own after indent, in decimal
+// if serialFormat asks for it and otherwise encoded with f.encode.
+func (f *textFormatter) writeSerialLine(indent string, serial []byte) error {
+	if serialFormat != "decimal" {
+		return f.writeBytesLine(indent, serial)
+	}
+	f.line = append(f.line[:0], indent...)
+	f.line = serialInt(serial).Append(f.line, 10)
+	f.line = append(f.line, '\n')
+	_, err := f.w.Write(f.line)
+	return err
+}
+
+func (f *textFormatter) WriteEntry(entry crlset.Entry) error {
+	if len(f.opts.spki) > 0 {
+		if f.opts.spkiOnly {
+			// Close prints the SPKI if any serials were seen.
+			f.n += len(entry.Serials)
+			return nil
+		}
+		for _, serial := range entry.Serials {
+			if f.inPage() {
+				if err := f.writeSerialLine("", serial); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	if !f.inPage() {
+		return nil
+	}
+	if err := f.writeBytesLine("", entry.SPKIHash); err != nil || f.opts.spkiOnly {
+		return err
+	}
+	for _, serial := range entry.Serials {
+		if err := f.writeSerialLine("  ", serial); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *textFormatter) Close() error {
+	if len(f.opts.spki) > 0 && f.opts.spkiOnly && f.n > 0 {
+		return f.writeBytesLine("", f.opts.spki)
+	}
+	return nil
+}
+
+// setFormatter collects the header and entries into a CRLSet, for formats
+// that need to see the whole set at once, and passes it to write on Close.
+type setFormatter struct {
+	name  string
+	w     io.Writer
+	write func(w io.Writer, set *crlset.CRLSet) error
+	set   crlset.CRLSet
+}
+
+func (f *setFormatter) Name() string { return f.name }
+
+func (f *setFormatter) WriteHeader(header *crlset.Header) error {
+	f.set.Header = *header
+	return nil
+}
+
+func (f *setFormatter) WriteEntry(entry crlset.Entry) error {
+	f.set.Entries = append(f.set.Entries, entry)
+	return nil
+}
+
+func (f *setFormatter) Close() error {
+	return f.write(f.w, &f.set)
+}
+
+// ndjsonFormatter writes a JSON object per line for each SPKI in the header's
+// lists and each revoked serial, with the same categories as crlSetRows. The
+// output is flushed after each SPKI section, so that large dumps can be
+// processed as they're written.
+type ndjsonFormatter struct {
+	w    io.Writer
+	enc  *json.Encoder
+	opts dumpOptions
+}
+
+// ndjsonRow is a line written by ndjsonFormatter.
+type ndjsonRow struct {
+	SPKI     string `json:"spki"`
+	Serial   string `json:"serial,omitempty"`
+	Category string `json:"category"`
+}
+
+func newNDJSONFormatter(w io.Writer, opts dumpOptions) *ndjsonFormatter {
+	return &ndjsonFormatter{w: w, enc: json.NewEncoder(w), opts: opts}
+}
+
+func (f *ndjsonFormatter) Name() string { return "ndjson" }
+
+// flush writes out anything buffered, if w is buffered.
+func (f *ndjsonFormatter) flush() error {
+	if flusher, ok := f.w.(interface{ Flush() error }); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+func (f *ndjsonFormatter) WriteHeader(header *crlset.Header) error {
+	// With a certificate, only its SPKI's serials are wanted.
+	if len(f.opts.spki) > 0 {
+		return nil
+	}
+	for _, row := range crlSetRows(&crlset.CRLSet{Header: *header}) {
+		if err := f.enc.Encode(&ndjsonRow{SPKI: hex.EncodeToString(row.spkiHash), Category: row.category}); err != nil {
+			return err
+		}
+	}
+	return f.flush()
+}
+
+func (f *ndjsonFormatter) WriteEntry(entry crlset.Entry) error {
+	spki := hex.EncodeToString(entry.SPKIHash)
+	for _, serial := range entry.Serials {
+		if err := f.enc.Encode(&ndjsonRow{SPKI: spki, Serial: formatSerial(serial), Category: "revoked_serial"}); err != nil {
+			return err
+		}
+	}
+	return f.flush()
+}
+
+func (f *ndjsonFormatter) Close() error {
+	return nil
+}
+
+// goSourceFuncs contains the lookup functions included in the output of
+// writeGoSource.
+const goSourceFuncs = `
+// IsBlockedSPKI reports whether the key with the given SHA-256
+// SubjectPublicKeyInfo hash is blocked outright.
+func IsBlockedSPKI(spkiHash []byte) bool {
+	i := sort.SearchStrings(blockedSPKIs, string(spkiHash))
+	return i < len(blockedSPKIs) && blockedSPKIs[i] == string(spkiHash)
+}
+
+// IsRevoked reports whether the certificate with the given serial number,
+// issued by the key with the given SHA-256 SubjectPublicKeyInfo hash, is
+// revoked. The serial is the contents of the DER encoded INTEGER from the
+// certificate. As in Chrome, leading zero bytes are stripped before it's looked
+// up, and a negative serial is never revoked.
+func IsRevoked(spkiHash, serial []byte) bool {
+	if len(serial) > 0 && serial[0]&0x80 != 0 {
+		return false
+	}
+	for len(serial) > 1 && serial[0] == 0 {
+		serial = serial[1:]
+	}
+	i := sort.Search(len(revocations), func(i int) bool {
+		return revocations[i].spkiHash >= string(spkiHash)
+	})
+	if i == len(revocations) || revocations[i].spkiHash != string(spkiHash) {
+		return false
+	}
+	serials := revocations[i].serials
+	j := sort.SearchStrings(serials, string(serial))
+	return j < len(serials) && serials[j] == string(serial)
+}
+`
+
+// goBytesLiteral returns a Go string literal containing b, with every byte
+// hex escaped so that hashes and serials remain readable.
+func goBytesLiteral(b []byte) string {
+	lit := make([]byte, 0, 2+4*len(b))
+	lit = append(lit, '"')
+	for _, c := range b {
+		lit = append(lit, fmt.Sprintf("\\x%02x", c)...)
+	}
+	return string(append(lit, '"'))
+}
+
+// writeGoSource writes a Go source file for package pkg that embeds the
+// contents of set as sorted tables, along with functions to search them.
+func writeGoSource(w io.Writer, set *crlset.CRLSet, pkg string) error {
+	if err := set.Normalize(); err != nil {
+		return err
+	}
+	blockedSPKIs := sortedSPKIHashes(set.Header.BlockedSPKIHashes())
+
+	var src bytes.Buffer
+	fmt.Fprintf(&src, "// Code generated by \"crlset dump --format=go\"; DO NOT EDIT.\n\n")
+	fmt.Fprintf(&src, "// Package %s contains a snapshot of CRLSet sequence %d.\n", pkg, set.Header.Sequence)
+	fmt.Fprintf(&src, "package %s\n\nimport \"sort\"\n\n", pkg)
+	fmt.Fprintf(&src, "// Sequence is the sequence number of the CRLSet that this package was\n// generated from.\n")
+	fmt.Fprintf(&src, "const Sequence = %d\n\n", set.Header.Sequence)
+
+	fmt.Fprintf(&src, "// blockedSPKIs is sorted.\nvar blockedSPKIs = []string{\n")
+	for _, spki := range blockedSPKIs {
+		fmt.Fprintf(&src, "%s,\n", goBytesLiteral(spki[:]))
+	}
+	fmt.Fprintf(&src, "}\n\n")
+
+	fmt.Fprintf(&src, "// revocations is sorted by SPKI hash, and each list of serials is sorted.\n")
+	fmt.Fprintf(&src, "var revocations = []struct {\nspkiHash string\nserials []string\n}{\n")
+	for _, entry := range set.Entries {
+		fmt.Fprintf(&src, "{%s, []string{", goBytesLiteral(entry.SPKIHash))
+		for _, serial := range entry.Serials {
+			fmt.Fprintf(&src, "%s,", goBytesLiteral(serial))
+		}
+		fmt.Fprintf(&src, "}},\n")
+	}
+	fmt.Fprintf(&src, "}\n")
+	src.WriteString(goSourceFuncs)
+
+	formatted, err := format.Source(src.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(formatted)
+	return err
+}
+
+func normalize(filename, outputFilename string) bool {
+	set, err := readCRLSet(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+
+	if err := set.Normalize(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+
+	out, err := set.Marshal()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to serialize CRLSet: %s\n", err)
+		return false
+	}
+
+	if err := writeOutput(outputFilename, out); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write CRLSet: %s\n", err)
+		return false
+	}
+
+	return true
+}
+
+// spkiList is a flag.Value that accumulates SPKI hashes given in hex or
+// base64.
+type spkiList [][crlset.SPKIHashLen]byte
+
+func (l *spkiList) String() string {
+	var s []string
+	for _, hash := range *l {
+		s = append(s, hex.EncodeToString(hash[:]))
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *spkiList) Set(value string) error {
+	hash, err := parseSPKIHash(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, hash)
+	return nil
+}
+
+// filter writes a copy of the CRLSet in filename that contains only the
+// sections for the given SPKIs. The header, including its blocked SPKIs, is
+// kept unchanged.
+func filter(filename string, spkis [][crlset.SPKIHashLen]byte, outputFilename string) bool {
+	set, err := readCRLSet(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+
+	found := make(map[[crlset.SPKIHashLen]byte]bool)
+	for _, hash := range spkis {
+		found[hash] = false
+	}
+	var entries []crlset.Entry
+	for _, entry := range set.Entries {
+		var hash [crlset.SPKIHashLen]byte
+		copy(hash[:], entry.SPKIHash)
+		if _, ok := found[hash]; ok {
+			found[hash] = true
+			entries = append(entries, entry)
+		}
+	}
+	set.Entries = entries
+
+	for _, hash := range spkis {
+		if !found[hash] {
+			fmt.Fprintf(os.Stderr, "Warning: no section for SPKI %x\n", hash)
+		}
+	}
+
+	out, err := set.Marshal()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to serialize CRLSet: %s\n", err)
+		return false
+	}
+
+	if err := writeOutput(outputFilename, out); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write CRLSet: %s\n", err)
+		return false
+	}
+
+	return true
+}
+
+// redact writes a copy of the CRLSet in filename with the given entries
+// removed. An entry with a serial removes just that serial, while an entry
+// without one removes the SPKI's section and any mention of it in the header.
+func redact(filename string, removals []watchEntry, outputFilename string) bool {
+	set, err := readCRLSet(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+
+	for _, removal := range removals {
+		found, err := set.Unblock(removal.spkiHash, removal.serial, serialMatch)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return false
+		}
+		if !found {
+			fmt.Fprintf(os.Stderr, "Warning: %s is not in the CRLSet\n", removal.String())
+		}
+	}
+
+	out, err := set.Marshal()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to serialize CRLSet: %s\n", err)
+		return false
+	}
+
+	if err := writeOutput(outputFilename, out); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write CRLSet: %s\n", err)
+		return false
+	}
+
+	return true
+}
+
+// intersect prints the serials that are revoked under the same SPKI in both
+// of the given CRLSets.
+func intersect(filenameA, filenameB string) bool {
+	a, err := readCRLSet(filenameA)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+	b, err := readCRLSet(filenameB)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+
+	for _, entry := range intersectCRLSets(a, b) {
+		fmt.Printf("%x\n", entry.SPKIHash)
+		for _, serial := range entry.Serials {
+			fmt.Printf("  %x\n", serial)
+		}
+	}
+	return true
+}
+
+// printSharedSerials prints the serials in the CRLSet in filename that are
+// revoked under more than one SPKI, each followed by those SPKIs. If
+// namesFilename is given, it maps SPKI hashes to CA names to show alongside.
+func printSharedSerials(filename, namesFilename string) bool {
+	set, err := readCRLSet(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+	var names map[[crlset.SPKIHashLen]byte]string
+	if len(namesFilename) > 0 {
+		if names, err = readSPKILabels(namesFilename); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read names: %s\n", err)
+			return false
+		}
+	}
+
+	for _, shared := range sharedSerials(set) {
+		fmt.Printf("%s (%d SPKIs)\n", formatSerial(shared.serial), len(shared.spkiHashes))
+		for _, hash := range shared.spkiHashes {
+			var key [crlset.SPKIHashLen]byte
+			copy(key[:], hash)
+			if name := names[key]; len(name) > 0 {
+				fmt.Printf("  %x %s\n", hash, name)
+			} else {
+				fmt.Printf("  %x\n", hash)
+			}
+		}
+	}
+	return true
+}
+
+// printTop prints the n SPKIs with the most revoked serials in the CRLSet in
+// filename, largest first, with their CA names from namesFilename if given.
+func printTop(filename, namesFilename string, n int) bool {
+	set, err := readCRLSet(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+	var names map[[crlset.SPKIHashLen]byte]string
+	if len(namesFilename) > 0 {
+		if names, err = readSPKILabels(namesFilename); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read names: %s\n", err)
+			return false
+		}
+	}
+
+	// An SPKI's serials may be split across several sections.
+	counts := make(map[[crlset.SPKIHashLen]byte]int)
+	for _, entry := range set.Entries {
+		var hash [crlset.SPKIHashLen]byte
+		copy(hash[:], entry.SPKIHash)
+		counts[hash] += len(entry.Serials)
+	}
+	hashes := make([][crlset.SPKIHashLen]byte, 0, len(counts))
+	for hash := range counts {
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		if counts[hashes[i]] != counts[hashes[j]] {
+			return counts[hashes[i]] > counts[hashes[j]]
+		}
+		return bytes.Compare(hashes[i][:], hashes[j][:]) < 0
+	})
+	if n > 0 && len(hashes) > n {
+		hashes = hashes[:n]
+	}
+
+	total := countSerials(set.Entries)
+	for i, hash := range hashes {
+		// Sections can be empty, so there may be no serials to share.
+		share := 0.0
+		if total > 0 {
+			share = 100 * float64(counts[hash]) / float64(total)
+		}
+		fmt.Printf("%3d %8d %5.1f%% %x", i+1, counts[hash], share, hash)
+		if name := names[hash]; len(name) > 0 {
+			fmt.Printf(" %s", name)
+		}
+		fmt.Printf("\n")
+	}
+	fmt.Fprintf(os.Stderr, "%d serials under %d SPKIs\n", total, len(counts))
+	return true
+}
+
+// defaultCRLValidity is the validity period given to exported CRLs when the
+// CRLSet doesn't specify an expiry time.
+const defaultCRLValidity = 7 * 24 * time.Hour
+
+// createCRL returns a DER encoded CRL, issued by issuer and signed with key,
+// that revokes the serials in entry.
+func createCRL(header crlset.Header, entry crlset.Entry, issuer *x509.Certificate, key crypto.Signer) ([]byte, error) {
+	now := time.Now()
+	nextUpdate := now.Add(defaultCRLValidity)
+	if header.NotAfter > now.Unix() {
+		nextUpdate = time.Unix(header.NotAfter, 0)
+	}
+
+	template := &x509.RevocationList{
+		Number:     big.NewInt(int64(header.Sequence)),
+		ThisUpdate: now,
+		NextUpdate: nextUpdate,
+	}
+	for _, serial := range entry.Serials {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   new(big.Int).SetBytes(serial),
+			RevocationTime: now,
+		})
+	}
+
+	return x509.CreateRevocationList(rand.Reader, template, issuer, key)
+}
+
+// createWrapperIssuer returns a self-signed certificate for key that can be
+// used to issue a CRL on behalf of the issuer with the given SPKI hash, whose
+// real private key we don't have.
+func createWrapperIssuer(spkiHash []byte, key crypto.Signer) (*x509.Certificate, error) {
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          new(big.Int).SetBytes(spkiHash[:16]),
+		Subject:               pkix.Name{CommonName: fmt.Sprintf("CRLSet issuer %x", spkiHash)},
+		NotBefore:             now,
+		NotAfter:              now.Add(defaultCRLValidity),
+		KeyUsage:              x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(derBytes)
+}
+
+// exportCRLs writes a DER encoded CRL for each SPKI section in the CRLSet to
+// outputDir, named by the hex SPKI hash, along with the DER encoded
+// certificate of its issuer. Sections whose issuer is in issuerFilenames,
+// each of which holds a certificate and its private key, are signed by that
+// issuer; the others are signed by a freshly generated key under a
+// self-signed wrapper certificate, which doesn't chain to the real issuer.
+func exportCRLs(filename string, issuerFilenames []string, outputDir string) bool {
+	set, err := readCRLSet(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+
+	type signer struct {
+		cert *x509.Certificate
+		key  crypto.Signer
+	}
+	issuers := make(map[string]signer)
+	for _, issuerFilename := range issuerFilenames {
+		cert, key, err := readIssuer(issuerFilename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return false
+		}
+		issuers[string(crlset.SPKIHash(cert))] = signer{cert, key}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to generate signing key: %s\n", err)
+		return false
+	}
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create output directory: %s\n", err)
+		return false
+	}
+
+	for _, entry := range set.Entries {
+		issuer, ok := issuers[string(entry.SPKIHash)]
+		if !ok {
+			cert, err := createWrapperIssuer(entry.SPKIHash, key)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to create issuer for %x: %s\n", entry.SPKIHash, err)
+				return false
+			}
+			issuer = signer{cert, key}
+		}
+
+		crl, err := createCRL(set.Header, entry, issuer.cert, issuer.key)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create CRL for %x: %s\n", entry.SPKIHash, err)
+			return false
+		}
+
+		// Consumers need the issuer's certificate to check the CRL's
+		// signature, which is all the more important for a wrapper.
+		base := filepath.Join(outputDir, fmt.Sprintf("%x", entry.SPKIHash))
+		if err := ioutil.WriteFile(base+".crl", crl, 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write CRL: %s\n", err)
+			return false
+		}
+		if err := ioutil.WriteFile(base+".crt", issuer.cert.Raw, 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write issuer certificate: %s\n", err)
+			return false
+		}
+	}
+
+	return true
+}
+
+// readIssuer reads a PEM file containing an issuer certificate and the
+// corresponding private key.
+func readIssuer(filename string) (*x509.Certificate, crypto.Signer, error) {
+	pemBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to read issuer: %s", err)
+	}
+
+	var cert *x509.Certificate
+	var key crypto.Signer
+	for {
+		var block *pem.Block
+		if block, pemBytes = pem.Decode(pemBytes); block == nil {
+			break
+		}
+
+		switch block.Type {
+		case "CERTIFICATE":
+			if cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+				return nil, nil, fmt.Errorf("Failed to parse certificate in %s: %s", filename, err)
+			}
+		case "PRIVATE KEY", "RSA PRIVATE KEY", "EC PRIVATE KEY":
+			var parsed interface{}
+			switch block.Type {
+			case "PRIVATE KEY":
+				parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+			case "RSA PRIVATE KEY":
+				parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+			default:
+				parsed, err = x509.ParseECPrivateKey(block.Bytes)
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("Failed to parse private key in %s: %s", filename, err)
+			}
+			var ok bool
+			if key, ok = parsed.(crypto.Signer); !ok {
+				return nil, nil, fmt.Errorf("Unsupported private key type in %s", filename)
+			}
+		}
+	}
+
+	if cert == nil {
+		return nil, nil, fmt.Errorf("No certificate found in %s", filename)
+	}
+	// Servers check the CRL's signature against the issuer certificate, so
+	// a CRL signed by any other key would cause every client to be rejected.
+	if key == nil {
+		return nil, nil, fmt.Errorf("No private key found in %s; CRLs must be signed by the issuer", filename)
+	}
+	return cert, key, nil
+}
+
+// exportCRLBundle writes a concatenation of PEM encoded CRLs, one for each of
+// the given issuers, suitable for nginx's ssl_crl or HAProxy's crl-file
+// directives. Issuers without a section in the CRLSet get an empty CRL, since
+// OpenSSL rejects chains for which it can't find a CRL.
+func exportCRLBundle(filename string, issuerFilenames []string, outputFilename string) bool {
+	set, err := readCRLSet(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+
+	issuers, err := readIssuers(issuerFilenames)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+	bundle, ok := buildCRLBundle(set, issuers)
+	if !ok {
+		return false
+	}
+
+	if err := writeOutput(outputFilename, bundle); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write CRL bundle: %s\n", err)
+		return false
+	}
+
+	return true
+}
+
+// crlIssuer is an issuer certificate, and its key, read by readIssuers.
+type crlIssuer struct {
+	filename string
+	cert     *x509.Certificate
+	key      crypto.Signer
+}
+
+// readIssuers reads each of issuerFilenames with readIssuer.
+func readIssuers(issuerFilenames []string) ([]crlIssuer, error) {
+	var issuers []crlIssuer
+	for _, issuerFilename := range issuerFilenames {
+		cert, key, err := readIssuer(issuerFilename)
+		if err != nil {
+			return nil, err
+		}
+		issuers = append(issuers, crlIssuer{issuerFilename, cert, key})
+	}
+	return issuers, nil
+}
+
+// buildCRLBundle returns the PEM encoded CRLs for the given issuers.
+func buildCRLBundle(set *crlset.CRLSet, issuers []crlIssuer) ([]byte, bool) {
+	var bundle bytes.Buffer
+	for _, issuer := range issuers {
+		spki := crlset.SPKIHash(issuer.cert)
+		entry := crlset.Entry{SPKIHash: spki}
+		for _, e := range set.Entries {
+			if bytes.Equal(e.SPKIHash, spki) {
+				entry.Serials = append(entry.Serials, e.Serials...)
+			}
+		}
+
+		crl, err := createCRL(set.Header, entry, issuer.cert, issuer.key)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create CRL for %s: %s\n", issuer.filename, err)
+			return nil, false
+		}
+		pem.Encode(&bundle, &pem.Block{Type: "X509 CRL", Bytes: crl})
+	}
+
+	return bundle.Bytes(), true
+}
+
+// envoyDataSource, envoySecret and related structures are used to emit an
+// Envoy SDS secret containing a certificate validation context. See
+// envoy.extensions.transport_sockets.tls.v3.Secret.
+type envoyDataSource struct {
+	InlineString string `json:"inline_string"`
+}
+
+type envoyValidationContext struct {
+	TrustedCA *envoyDataSource `json:"trusted_ca,omitempty"`
+	CRL       envoyDataSource  `json:"crl"`
+}
+
+type envoySecret struct {
+	Type              string                 `json:"@type"`
+	Name              string                 `json:"name"`
+	ValidationContext envoyValidationContext `json:"validation_context"`
+}
+
+type envoySDSResponse struct {
+	Resources []envoySecret `json:"resources"`
+}
+
+// exportEnvoyConfig writes an Envoy SDS secret whose validation context
+// contains CRLs for the given issuers. Envoy can only pin SPKIs, not block
+// them, so the CRLSet's BlockedSPKIs are enforced by leaving any certificate
+// with one of them out of the trusted CAs. A given issuer with a blocked SPKI
+// is reported on stderr, since its CRL can't revoke its own key.
+func exportEnvoyConfig(filename string, issuerFilenames []string, secretName, trustedCAFilename, outputFilename string) bool {
+	set, err := readCRLSet(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+
+	issuers, err := readIssuers(issuerFilenames)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+	bundle, ok := buildCRLBundle(set, issuers)
+	if !ok {
+		return false
+	}
+
+	blocked := make(map[[crlset.SPKIHashLen]byte]bool)
+	for _, spki := range set.Header.BlockedSPKIHashes() {
+		blocked[spki] = true
+	}
+	isBlocked := func(cert *x509.Certificate) bool {
+		var spki [crlset.SPKIHashLen]byte
+		copy(spki[:], crlset.SPKIHash(cert))
+		return blocked[spki]
+	}
+	for _, issuer := range issuers {
+		if isBlocked(issuer.cert) {
+			fmt.Fprintf(os.Stderr, "Warning: %s has a blocked SPKI and should not be trusted\n", issuer.filename)
+		}
+	}
+
+	secret := envoySecret{
+		Type:              "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.Secret",
+		Name:              secretName,
+		ValidationContext: envoyValidationContext{CRL: envoyDataSource{string(bundle)}},
+	}
+	if len(trustedCAFilename) > 0 {
+		contents, err := ioutil.ReadFile(trustedCAFilename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read trusted CAs: %s\n", err)
+			return false
+		}
+		certs := parseCertificates(contents)
+		if len(certs) == 0 {
+			fmt.Fprintf(os.Stderr, "No certificates found in %s\n", trustedCAFilename)
+			return false
+		}
+		var trustedCA bytes.Buffer
+		for _, cert := range certs {
+			if isBlocked(cert) {
+				fmt.Fprintf(os.Stderr, "Leaving %q out of the trusted CAs: its SPKI %x is blocked\n", cert.Subject, crlset.SPKIHash(cert))
+				continue
+			}
+			pem.Encode(&trustedCA, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		}
+		secret.ValidationContext.TrustedCA = &envoyDataSource{trustedCA.String()}
+	} else if len(blocked) > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: without --trusted-ca, the %d blocked SPKIs can't be enforced\n", len(blocked))
+	}
+
+	out, err := json.MarshalIndent(envoySDSResponse{[]envoySecret{secret}}, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to serialize Envoy config: %s\n", err)
+		return false
+	}
+	out = append(out, '\n')
+
+	if err := writeOutput(outputFilename, out); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write Envoy config: %s\n", err)
+		return false
+	}
+
+	return true
+}
+
+// A snapshot is a compact, versioned encoding of a CRLSet intended to be
+// embedded in other programs with go:embed and read by the package emitted by
+// "dump --format=go-loader". It consists of snapshotMagic, a version byte,
+// then uvarints and raw bytes:
+//
+//	sequence
+//	number of blocked SPKIs, followed by that many 32-byte hashes
+//	number of sections, then for each section:
+//	  32-byte SPKI hash
+//	  number of serials, then for each serial a length byte and the serial
+//
+// Blocked SPKIs, sections and serials are all sorted so that the loader can
+// use binary search without copying the data.
+const (
+	snapshotMagic   = "CRLSNAP"
+	snapshotVersion = 1
+)
+
+// writeSnapshot writes set to w in the snapshot format.
+func writeSnapshot(w io.Writer, set *crlset.CRLSet) error {
+	if err := set.Normalize(); err != nil {
+		return err
+	}
+	blockedSPKIs := sortedSPKIHashes(set.Header.BlockedSPKIHashes())
+
+	var out bytes.Buffer
+	var varint [binary.MaxVarintLen64]byte
+	putUvarint := func(v uint64) {
+		out.Write(varint[:binary.PutUvarint(varint[:], v)])
+	}
+
+	out.WriteString(snapshotMagic)
+	out.WriteByte(snapshotVersion)
+	putUvarint(uint64(set.Header.Sequence))
+	putUvarint(uint64(len(blockedSPKIs)))
+	for _, spki := range blockedSPKIs {
+		out.Write(spki[:])
+	}
+	putUvarint(uint64(len(set.Entries)))
+	for _, entry := range set.Entries {
+		out.Write(entry.SPKIHash)
+		putUvarint(uint64(len(entry.Serials)))
+		for _, serial := range entry.Serials {
+			if len(serial) > 0xff {
+				return fmt.Errorf("Serial %x is too long", serial)
+			}
+			out.WriteByte(byte(len(serial)))
+			out.Write(serial)
+		}
+	}
+
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// crlSetRow is a row of the flat table that the analytics formats write: a
+// revoked serial, or an SPKI hash from one of the header's lists, in which
+// case serial is nil.
+type crlSetRow struct {
+	spkiHash []byte
+	serial   []byte
+	// category is "blocked_spki", "known_interception_spki",
+	// "blocked_interception_spki" or "revoked_serial".
+	category string
+}
+
+// crlSetRows flattens set into rows, header lists first.
+func crlSetRows(set *crlset.CRLSet) []crlSetRow {
+	var rows []crlSetRow
+	for _, list := range []struct {
+		category string
+		hashes   [][crlset.SPKIHashLen]byte
+	}{
+		{"blocked_spki", set.Header.BlockedSPKIHashes()},
+		{"known_interception_spki", set.Header.KnownInterceptionSPKIHashes()},
+		{"blocked_interception_spki", set.Header.BlockedInterceptionSPKIHashes()},
+	} {
+		for _, hash := range list.hashes {
+			rows = append(rows, crlSetRow{append([]byte(nil), hash[:]...), nil, list.category})
+		}
+	}
+	for _, entry := range set.Entries {
+		for _, serial := range entry.Serials {
+			rows = append(rows, crlSetRow{entry.SPKIHash, serial, "revoked_serial"})
+		}
+	}
+	return rows
+}
+
+// Thrift compact protocol field types, used to encode Parquet metadata.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes structs with the Thrift compact protocol, which is
+// all that writing Parquet metadata needs.
+type thriftWriter struct {
+	buf bytes.Buffer
+	// lastField holds the ID of the last field written in each open
+	// struct, since field headers encode the difference.
+	lastField []int
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	t.buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func (t *thriftWriter) field(id, typ int) {
+	last := &t.lastField[len(t.lastField)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta<<4 | typ))
+	} else {
+		t.buf.WriteByte(byte(typ))
+		t.varint(uint64(int16(id)<<1 ^ int16(id)>>15))
+	}
+	*last = id
+}
+
+func (t *thriftWriter) i32(id int, v int32) {
+	t.field(id, thriftI32)
+	t.varint(uint64(uint32(v<<1 ^ v>>31)))
+}
+
+func (t *thriftWriter) i64(id int, v int64) {
+	t.field(id, thriftI64)
+	t.varint(uint64(v<<1 ^ v>>63))
+}
+
+func (t *thriftWriter) binary(id int, s string) {
+	t.field(id, thriftBinary)
+	t.varint(uint64(len(s)))
+	t.buf.WriteString(s)
+}
+
+// list writes the header of a list of n elements of type typ. Elements that
+// are structs are then written between beginStruct and endStruct.
+func (t *thriftWriter) list(id, typ, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.buf.WriteByte(byte(n<<4 | typ))
+	} else {
+		t.buf.WriteByte(byte(0xf0 | typ))
+		t.varint(uint64(n))
+	}
+}
+
+// i32List writes a list of i32s.
+func (t *thriftWriter) i32List(id int, values ...int32) {
+	t.list(id, thriftI32, len(values))
+	for _, v := range values {
+		t.varint(uint64(uint32(v<<1 ^ v>>31)))
+	}
+}
+
+// beginStruct starts a struct-valued field, or a struct list element if id
+// is zero.
+func (t *thriftWriter) beginStruct(id int) {
+	if id != 0 {
+		t.field(id, thriftStruct)
+	}
+	t.lastField = append(t.lastField, 0)
+}
+
+func (t *thriftWriter) endStruct() {
+	t.buf.WriteByte(0)
+	t.lastField = t.lastField[:len(t.lastField)-1]
+}
+
+// Parquet physical types, encodings and other enums used by writeParquet.
+const (
+	parquetInt64     = 2
+	parquetByteArray = 6
+
+	parquetRequired = 0
+	parquetOptional = 1
+
+	parquetUTF8 = 0
+
+	parquetPlain = 0
+	parquetRLE   = 3
+
+	parquetGzip     = 2
+	parquetDataPage = 0
+)
+
+// parquetColumn is a column being written by writeParquet. Only INT64 and
+// UTF-8 BYTE_ARRAY columns are needed.
+type parquetColumn struct {
+	name     string
+	typ      int
+	optional bool
+	// values holds the PLAIN encoding of the non-null values.
+	values bytes.Buffer
+	// defined records, for optional columns, whether each row is non-null.
+	defined []bool
+}
+
+func (c *parquetColumn) addInt64(v int64) {
+	binary.Write(&c.values, binary.LittleEndian, v)
+}
+
+func (c *parquetColumn) addString(s string) {
+	binary.Write(&c.values, binary.LittleEndian, uint32(len(s)))
+	c.values.WriteString(s)
+	c.defined = append(c.defined, true)
+}
+
+func (c *parquetColumn) addNull() {
+	c.defined = append(c.defined, false)
+}
+
+// page returns the column's data page, before compression: the definition
+// levels of an optional column, as runs of the RLE/bit-packing hybrid
+// encoding with a bit width of one, followed by the values.
+func (c *parquetColumn) page() []byte {
+	var page bytes.Buffer
+	if c.optional {
+		var levels bytes.Buffer
+		var b [binary.MaxVarintLen64]byte
+		for i := 0; i < len(c.defined); {
+			j := i
+			for j < len(c.defined) && c.defined[j] == c.defined[i] {
+				j++
+			}
+			levels.Write(b[:binary.PutUvarint(b[:], uint64(j-i)<<1)])
+			if c.defined[i] {
+				levels.WriteByte(1)
+			} else {
+				levels.WriteByte(0)
+			}
+			i = j
+		}
+		binary.Write(&page, binary.LittleEndian, uint32(levels.Len()))
+		page.Write(levels.Bytes())
+	}
+	page.Write(c.values.Bytes())
+	return page.Bytes()
+}
+
+// writeParquet writes the rows of set to w as a Parquet file with the
+// columns sequence, spki, serial and category. Hashes and serials are
+// lowercase hex strings, and serial is null for rows from the header. The
+// file has a single row group with one gzip compressed page per column.
+func writeParquet(w io.Writer, set *crlset.CRLSet) error {
+	rows := crlSetRows(set)
+	columns := []*parquetColumn{
+		{name: "sequence", typ: parquetInt64},
+		{name: "spki", typ: parquetByteArray},
+		{name: "serial", typ: parquetByteArray, optional: true},
+		{name: "category", typ: parquetByteArray},
+	}
+	for _, row := range rows {
+		columns[0].addInt64(int64(set.Header.Sequence))
+		columns[1].addString(hex.EncodeToString(row.spkiHash))
+		if row.serial != nil {
+			columns[2].addString(hex.EncodeToString(row.serial))
+		} else {
+			columns[2].addNull()
+		}
+		columns[3].addString(row.category)
+	}
+
+	var out bytes.Buffer
+	out.WriteString("PAR1")
+	type chunk struct {
+		offset                           int64
+		uncompressedSize, compressedSize int64
+	}
+	chunks := make([]chunk, len(columns))
+	for i, c := range columns {
+		page := c.page()
+		var compressed bytes.Buffer
+		zw := gzip.NewWriter(&compressed)
+		zw.Write(page)
+		if err := zw.Close(); err != nil {
+			return err
+		}
+
+		var header thriftWriter
+		header.beginStruct(0)
+		header.i32(1, parquetDataPage)
+		header.i32(2, int32(len(page)))
+		header.i32(3, int32(compressed.Len()))
+		header.beginStruct(5)
+		header.i32(1, int32(len(rows)))
+		header.i32(2, parquetPlain)
+		header.i32(3, parquetRLE)
+		header.i32(4, parquetRLE)
+		header.endStruct()
+		header.endStruct()
+
+		chunks[i] = chunk{
+			offset:           int64(out.Len()),
+			uncompressedSize: int64(header.buf.Len() + len(page)),
+			compressedSize:   int64(header.buf.Len() + compressed.Len()),
+		}
+		out.Write(header.buf.Bytes())
+		out.Write(compressed.Bytes())
+	}
+
+	var meta thriftWriter
+	meta.beginStruct(0)
+	meta.i32(1, 1)
+	meta.list(2, thriftStruct, len(columns)+1)
+	meta.beginStruct(0)
+	meta.binary(4, "schema")
+	meta.i32(5, int32(len(columns)))
+	meta.endStruct()
+	for _, c := range columns {
+		meta.beginStruct(0)
+		meta.i32(1, int32(c.typ))
+		if c.optional {
+			meta.i32(3, parquetOptional)
+		} else {
+			meta.i32(3, parquetRequired)
+		}
+		meta.binary(4, c.name)
+		if c.typ == parquetByteArray {
+			meta.i32(6, parquetUTF8)
+			// LogicalType STRING, an empty struct in field 1 of the
+			// union.
+			meta.beginStruct(10)
+			meta.beginStruct(1)
+			meta.endStruct()
+			meta.endStruct()
+		}
+		meta.endStruct()
+	}
+	meta.i64(3, int64(len(rows)))
+	meta.list(4, thriftStruct, 1)
+	meta.beginStruct(0)
+	meta.list(1, thriftStruct, len(columns))
+	var totalSize int64
+	for i, c := range columns {
+		meta.beginStruct(0)
+		meta.i64(2, chunks[i].offset)
+		meta.beginStruct(3)
+		meta.i32(1, int32(c.typ))
+		meta.i32List(2, parquetPlain, parquetRLE)
+		meta.list(3, thriftBinary, 1)
+		meta.varint(uint64(len(c.name)))
+		meta.buf.WriteString(c.name)
+		meta.i32(4, parquetGzip)
+		meta.i64(5, int64(len(rows)))
+		meta.i64(6, chunks[i].uncompressedSize)
+		meta.i64(7, chunks[i].compressedSize)
+		meta.i64(9, chunks[i].offset)
+		meta.endStruct()
+		meta.endStruct()
+		totalSize += chunks[i].uncompressedSize
+	}
+	meta.i64(2, totalSize)
+	meta.i64(3, int64(len(rows)))
+	meta.endStruct()
+	meta.binary(6, "crlset-tools")
+	meta.endStruct()
+
+	out.Write(meta.buf.Bytes())
+	binary.Write(&out, binary.LittleEndian, uint32(meta.buf.Len()))
+	out.WriteString("PAR1")
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// goLoaderSource is the package emitted by "dump --format=go-loader". It
+// embeds crlset.snapshot and indexes it at init time; the index refers to
+// substrings of the embedded data rather than copies.
+const goLoaderSource = `// Code generated by "crlset dump --format=go-loader"; DO NOT EDIT.
+
+// Package %[1]s answers revocation queries against a CRLSet snapshot that
+// is embedded at build time. To update it, regenerate crlset.snapshot with
+// "crlset dump --format=snapshot"; this file doesn't need to change.
+package %[1]s
+
+import (
+	_ "embed"
+	"sort"
+)
+
+//go:embed crlset.snapshot
+var snapshot string
+
+// Sequence is the sequence number of the embedded CRLSet.
+var Sequence uint64
+
+type section struct {
+	spkiHash string
+	serials  []string
+}
+
+var (
+	blockedSPKIs []string
+	revocations  []section
+)
+
+func init() {
+	s := snapshot
+	if len(s) < 8 || s[:7] != "CRLSNAP" || s[7] != 1 {
+		panic("crlset.snapshot: unknown format")
+	}
+	s = s[8:]
+
+	Sequence = readUvarint(&s)
+	blockedSPKIs = make([]string, readUvarint(&s))
+	for i := range blockedSPKIs {
+		blockedSPKIs[i] = readBytes(&s, 32)
+	}
+	revocations = make([]section, readUvarint(&s))
+	for i := range revocations {
+		revocations[i].spkiHash = readBytes(&s, 32)
+		revocations[i].serials = make([]string, readUvarint(&s))
+		for j := range revocations[i].serials {
+			revocations[i].serials[j] = readBytes(&s, int(readBytes(&s, 1)[0]))
+		}
+	}
+	if len(s) != 0 {
+		panic("crlset.snapshot: trailing data")
+	}
+}
+
+func readUvarint(s *string) uint64 {
+	var v uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		b := readBytes(s, 1)[0]
+		v |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return v
+		}
+	}
+	panic("crlset.snapshot: invalid varint")
+}
+
+func readBytes(s *string, n int) string {
+	if len(*s) < n {
+		panic("crlset.snapshot: truncated")
+	}
+	b := (*s)[:n]
+	*s = (*s)[n:]
+	return b
+}
+
+// IsBlockedSPKI reports whether the key with the given SHA-256
+// SubjectPublicKeyInfo hash is blocked outright.
+func IsBlockedSPKI(spkiHash []byte) bool {
+	i := sort.SearchStrings(blockedSPKIs, string(spkiHash))
+	return i < len(blockedSPKIs) && blockedSPKIs[i] == string(spkiHash)
+}
+
+// IsRevoked reports whether the certificate with the given serial number,
+// issued by the key with the given SHA-256 SubjectPublicKeyInfo hash, is
+// revoked. The serial is the contents of the DER encoded INTEGER from the
+// certificate. As in Chrome, leading zero bytes are stripped before it's looked
+// up, and a negative serial is never revoked.
+func IsRevoked(spkiHash, serial []byte) bool {
+	if len(serial) > 0 && serial[0]&0x80 != 0 {
+		return false
+	}
+	for len(serial) > 1 && serial[0] == 0 {
+		serial = serial[1:]
+	}
+	i := sort.Search(len(revocations), func(i int) bool {
+		return revocations[i].spkiHash >= string(spkiHash)
+	})
+	if i == len(revocations) || revocations[i].spkiHash != string(spkiHash) {
+		return false
+	}
+	serials := revocations[i].serials
+	j := sort.SearchStrings(serials, string(serial))
+	return j < len(serials) && serials[j] == string(serial)
+}
+`
+
+// The Redis keys written by exportRedis. SPKI hashes and serials are stored
+// as lowercase hex, so a lookup service checks a certificate with
+// SISMEMBER crlset:serials:<issuer SPKI hash> <serial> and
+// SISMEMBER crlset:blocked_spkis <SPKI hash>.
+const (
+	// redisSequenceKey holds the sequence number of the loaded CRLSet.
+	redisSequenceKey = "crlset:sequence"
+	// redisSPKIsKey is the set of SPKI hashes that have revoked serials.
+	redisSPKIsKey = "crlset:spkis"
+	// redisSerialsKeyPrefix, followed by an SPKI hash, names the set of
+	// serials revoked under that SPKI.
+	redisSerialsKeyPrefix = "crlset:serials:"
+	// The header's lists of SPKI hashes are each stored as a set.
+	redisBlockedSPKIsKey             = "crlset:blocked_spkis"
+	redisKnownInterceptionSPKIsKey   = "crlset:known_interception_spkis"
+	redisBlockedInterceptionSPKIsKey = "crlset:blocked_interception_spkis"
+)
+
+// redisConn is a connection to a Redis server that speaks just enough RESP
+// to pipeline commands and read their replies.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// dialRedis connects to the server in a redis:// or rediss:// URL, of the
+// form redis://[[user]:password@]host[:port][/db], authenticating and
+// selecting the database if the URL says to.
+func dialRedis(redisURL string) (*redisConn, error) {
+	u, err := url.Parse(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	addr := u.Host
+	if len(u.Port()) == 0 {
+		addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+
+	conn, err := dialNetwork("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "rediss" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tlsConn.HandshakeContext(interrupted); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+
+	var setup [][]string
+	if password, ok := u.User.Password(); ok {
+		if user := u.User.Username(); len(user) > 0 {
+			setup = append(setup, []string{"AUTH", user, password})
+		} else {
+			setup = append(setup, []string{"AUTH", password})
+		}
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); len(db) > 0 {
+		setup = append(setup, []string{"SELECT", db})
+	}
+	for _, args := range setup {
+		if _, err := c.do(args...); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// send queues a command without waiting for its reply.
+func (c *redisConn) send(args ...string) {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+}
+
+// reply reads the reply to the oldest command that has been sent. Bulk
+// strings are returned as strings, integers as int64s, arrays as
+// []interface{} and nil replies as nil. An error reply is returned as an
+// error.
+func (c *redisConn) reply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("empty reply from Redis")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("Redis error: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		elements := make([]interface{}, n)
+		for i := range elements {
+			if elements[i], err = c.reply(); err != nil {
+				return nil, err
+			}
+		}
+		return elements, nil
+	}
+	return nil, fmt.Errorf("unexpected reply from Redis: %q", line)
+}
+
+// do sends a command and waits for its reply.
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	c.send(args...)
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	return c.reply()
+}
+
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
+
+// exportRedis loads the CRLSet in filename into the Redis server at
+// redisURL, using the keys described above. The previous contents, including
+// the serials of SPKIs that are no longer in the CRLSet, are replaced in a
+// single transaction so that lookups never see a mixture of two CRLSets.
+func exportRedis(filename, redisURL string) bool {
+	set, err := readCRLSet(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+
+	c, err := dialRedis(redisURL)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to connect to Redis: %s\n", err)
+		return false
+	}
+	defer c.Close()
+
+	oldSPKIs, err := c.do("SMEMBERS", redisSPKIsKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read %s: %s\n", redisSPKIsKey, err)
+		return false
+	}
+	del := []string{"DEL", redisSequenceKey, redisSPKIsKey, redisBlockedSPKIsKey, redisKnownInterceptionSPKIsKey, redisBlockedInterceptionSPKIsKey}
+	if members, ok := oldSPKIs.([]interface{}); ok {
+		for _, member := range members {
+			if spki, ok := member.(string); ok {
+				del = append(del, redisSerialsKeyPrefix+spki)
+			}
+		}
+	}
+	for _, entry := range set.Entries {
+		del = append(del, redisSerialsKeyPrefix+hex.EncodeToString(entry.SPKIHash))
+	}
+
+	commands := 0
+	send := func(args ...string) {
+		c.send(args...)
+		commands++
+	}
+	sendSPKIs := func(key string, hashes [][crlset.SPKIHashLen]byte) {
+		if len(hashes) == 0 {
+			return
+		}
+		args := []string{"SADD", key}
+		for _, hash := range hashes {
+			args = append(args, hex.EncodeToString(hash[:]))
+		}
+		send(args...)
+	}
+
+	send("MULTI")
+	send(del...)
+	send("SET", redisSequenceKey, strconv.Itoa(set.Header.Sequence))
+	sendSPKIs(redisBlockedSPKIsKey, set.Header.BlockedSPKIHashes())
+	sendSPKIs(redisKnownInterceptionSPKIsKey, set.Header.KnownInterceptionSPKIHashes())
+	sendSPKIs(redisBlockedInterceptionSPKIsKey, set.Header.BlockedInterceptionSPKIHashes())
+	serials := 0
+	for _, entry := range set.Entries {
+		spki := hex.EncodeToString(entry.SPKIHash)
+		send("SADD", redisSPKIsKey, spki)
+		args := []string{"SADD", redisSerialsKeyPrefix + spki}
+		for _, serial := range entry.Serials {
+			args = append(args, hex.EncodeToString(serial))
+		}
+		if len(entry.Serials) > 0 {
+			send(args...)
+		}
+		serials += len(entry.Serials)
+	}
+	send("EXEC")
+	if err := c.w.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write to Redis: %s\n", err)
+		return false
+	}
+
+	// Every reply has to be read, but the first error is the interesting
+	// one: errors while queuing make Redis abort the transaction.
+	var firstErr error
+	var execReply interface{}
+	for i := 0; i < commands; i++ {
+		reply, err := c.reply()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		execReply = reply
+	}
+	if firstErr == nil && execReply == nil {
+		firstErr = errors.New("transaction aborted")
+	}
+	if firstErr != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load CRLSet into Redis: %s\n", firstErr)
+		return false
+	}
+
+	fmt.Fprintf(os.Stderr, "Loaded sequence %d into Redis: %d SPKIs with %d serials\n", set.Header.Sequence, len(set.Entries), serials)
+	return true
+}
+
+// bigQueryField is a column of a BigQuery table schema.
+type bigQueryField struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Mode string `json:"mode"`
+}
+
+// bigQuerySchema is the schema of the rows written by "dump
+// --format=bigquery" and loaded by exportBigQuery. It's the same table as
+// --format=parquet.
+var bigQuerySchema = []bigQueryField{
+	{"sequence", "INTEGER", "REQUIRED"},
+	{"spki", "STRING", "REQUIRED"},
+	{"serial", "STRING", "NULLABLE"},
+	{"category", "STRING", "REQUIRED"},
+}
+
+// bigQueryRow is a row of bigQuerySchema.
+type bigQueryRow struct {
+	Sequence int     `json:"sequence"`
+	SPKI     string  `json:"spki"`
+	Serial   *string `json:"serial"`
+	Category string  `json:"category"`
+}
+
+// writeBigQueryRows writes the rows of set to w as newline-delimited JSON
+// matching bigQuerySchema.
+func writeBigQueryRows(w io.Writer, set *crlset.CRLSet) error {
+	enc := json.NewEncoder(w)
+	for _, row := range crlSetRows(set) {
+		out := bigQueryRow{Sequence: set.Header.Sequence, SPKI: hex.EncodeToString(row.spkiHash), Category: row.category}
+		if row.serial != nil {
+			serial := hex.EncodeToString(row.serial)
+			out.Serial = &serial
+		}
+		if err := enc.Encode(&out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bigQueryURL is the root of the BigQuery API.
+var bigQueryURL = "https://bigquery.googleapis.com"
+
+// bigQueryJob is the subset of a BigQuery job resource that exportBigQuery
+// sends and reads back.
+type bigQueryJob struct {
+	JobReference struct {
+		ProjectID string `json:"projectId,omitempty"`
+		JobID     string `json:"jobId,omitempty"`
+		Location  string `json:"location,omitempty"`
+	} `json:"jobReference"`
+	Configuration struct {
+		Load struct {
+			DestinationTable struct {
+				ProjectID string `json:"projectId"`
+				DatasetID string `json:"datasetId"`
+				TableID   string `json:"tableId"`
+			} `json:"destinationTable"`
+			Schema struct {
+				Fields []bigQueryField `json:"fields"`
+			} `json:"schema"`
+			SourceFormat      string `json:"sourceFormat"`
+			CreateDisposition string `json:"createDisposition"`
+			WriteDisposition  string `json:"writeDisposition"`
+		} `json:"load"`
+	} `json:"configuration"`
+	Status struct {
+		State       string `json:"state,omitempty"`
+		ErrorResult *struct {
+			Message string `json:"message"`
+		} `json:"errorResult,omitempty"`
+	} `json:"status"`
+}
+
+// bigQueryRequest sends a request with an OAuth access token to the BigQuery
+// API and decodes the job in the reply.
+func bigQueryRequest(method, url, contentType string, body io.Reader, token string) (*bigQueryJob, error) {
+	req, err := newRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("unexpected HTTP status %q: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	var job bigQueryJob
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// exportBigQuery appends the rows of the CRLSet in filename to the BigQuery
+// table given as project.dataset.table or project:dataset.table, creating it
+// with bigQuerySchema if necessary, and waits for the load job to finish.
+// token is an OAuth access token, such as the output of "gcloud auth
+// print-access-token".
+func exportBigQuery(filename, table, token string) bool {
+	parts := strings.FieldsFunc(table, func(r rune) bool { return r == '.' || r == ':' })
+	if len(parts) != 3 {
+		fmt.Fprintf(os.Stderr, "Invalid BigQuery table %q: expected project.dataset.table\n", table)
+		return false
+	}
+	if len(token) == 0 {
+		fmt.Fprintf(os.Stderr, "--bigquery needs an access token from --bigquery-token or $CRLSET_BIGQUERY_TOKEN\n")
+		return false
+	}
+	set, err := readCRLSet(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+
+	var job bigQueryJob
+	load := &job.Configuration.Load
+	load.DestinationTable.ProjectID = parts[0]
+	load.DestinationTable.DatasetID = parts[1]
+	load.DestinationTable.TableID = parts[2]
+	load.Schema.Fields = bigQuerySchema
+	load.SourceFormat = "NEWLINE_DELIMITED_JSON"
+	load.CreateDisposition = "CREATE_IF_NEEDED"
+	load.WriteDisposition = "WRITE_APPEND"
+	config, err := json.Marshal(&job)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to encode load job: %s\n", err)
+		return false
+	}
+
+	// A multipart upload sends the job configuration and the data together.
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json; charset=UTF-8"}})
+	part.Write(config)
+	part, _ = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/octet-stream"}})
+	if err := writeBigQueryRows(part, set); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to encode rows: %s\n", err)
+		return false
+	}
+	mw.Close()
+
+	uploadURL := fmt.Sprintf("%s/upload/bigquery/v2/projects/%s/jobs?uploadType=multipart", bigQueryURL, url.PathEscape(parts[0]))
+	result, err := bigQueryRequest("POST", uploadURL, "multipart/related; boundary="+mw.Boundary(), &body, token)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start BigQuery load job: %s\n", err)
+		return false
+	}
+	for result.Status.State != "DONE" {
+		select {
+		case <-time.After(2 * time.Second):
+		case <-interrupted.Done():
+			fmt.Fprintf(os.Stderr, "Stopped waiting for BigQuery job %s\n", result.JobReference.JobID)
+			return false
+		}
+		jobURL := fmt.Sprintf("%s/bigquery/v2/projects/%s/jobs/%s?location=%s", bigQueryURL,
+			url.PathEscape(parts[0]), url.PathEscape(result.JobReference.JobID), url.QueryEscape(result.JobReference.Location))
+		if result, err = bigQueryRequest("GET", jobURL, "", nil, token); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to check BigQuery load job: %s\n", err)
+			return false
+		}
+	}
+	if result.Status.ErrorResult != nil {
+		fmt.Fprintf(os.Stderr, "BigQuery load job %s failed: %s\n", result.JobReference.JobID, result.Status.ErrorResult.Message)
+		return false
+	}
+
+	fmt.Fprintf(os.Stderr, "Loaded sequence %d into %s\n", set.Header.Sequence, table)
+	return true
+}
+
+// clickHouseTableSchema is the layout of the ClickHouse table written by
+// exportClickHouse, with %s replaced by the table name. The rows are the same
+// as bigQuerySchema's. Ordering by SPKI and sequence keeps each issuer's
+// history together for time-series queries.
+const clickHouseTableSchema = `CREATE TABLE IF NOT EXISTS %s (
+    sequence UInt64,
+    spki String,
+    serial Nullable(String),
+    category LowCardinality(String)
+) ENGINE = ReplacingMergeTree
+ORDER BY (spki, sequence, category, ifNull(serial, ''))`
+
+// clickHouseQuery sends query to the ClickHouse HTTP interface at
+// clickHouseURL, with body as the data for an INSERT.
+func clickHouseQuery(clickHouseURL, query string, body io.Reader) error {
+	u, err := url.Parse(clickHouseURL)
+	if err != nil {
+		return err
+	}
+	params := u.Query()
+	params.Set("query", query)
+	u.RawQuery = params.Encode()
+	resp, err := httpPost(u.String(), "text/plain", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected HTTP status %q: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// exportClickHouse inserts the rows of the CRLSet in filename into table,
+// creating it with clickHouseTableSchema if necessary, through the ClickHouse
+// HTTP interface at clickHouseURL. Credentials can be given in the URL.
+// ReplacingMergeTree drops the duplicates if a sequence is loaded twice.
+func exportClickHouse(filename, clickHouseURL, table string) bool {
+	set, err := readCRLSet(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+
+	if err := clickHouseQuery(clickHouseURL, fmt.Sprintf(clickHouseTableSchema, table), nil); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create ClickHouse table %s: %s\n", table, err)
+		return false
+	}
+	var rows bytes.Buffer
+	if err := writeBigQueryRows(&rows, set); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to encode rows: %s\n", err)
+		return false
+	}
+	if err := clickHouseQuery(clickHouseURL, "INSERT INTO "+table+" FORMAT JSONEachRow", &rows); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to insert into ClickHouse table %s: %s\n", table, err)
+		return false
+	}
+
+	fmt.Fprintf(os.Stderr, "Loaded sequence %d into %s\n", set.Header.Sequence, table)
+	return true
+}
+
+// pgTableSchema creates the PostgreSQL table written by exportPostgres, with
+// %s replaced by the table name. The rows are the same as bigQuerySchema's
+// but hashes and serials are stored as bytea.
+const pgTableSchema = `CREATE TABLE IF NOT EXISTS %s (
+    sequence bigint NOT NULL,
+    spki bytea NOT NULL,
+    serial bytea,
+    category text NOT NULL
+)`
+
+// writePgCopy writes the rows of set to w in the text format of PostgreSQL's
+// COPY, for the columns of pgTableSchema.
+func writePgCopy(w io.Writer, set *crlset.CRLSet) error {
+	bw := bufio.NewWriter(w)
+	var line []byte
+	for _, row := range crlSetRows(set) {
+		line = strconv.AppendInt(line[:0], int64(set.Header.Sequence), 10)
+		// COPY's text format needs the backslash of bytea's \x doubled.
+		line = append(line, "\t\\"...)
+		line = appendPgBytea(line, row.spkiHash)
+		if row.serial != nil {
+			line = append(line, "\t\\"...)
+			line = appendPgBytea(line, row.serial)
+		} else {
+			line = append(line, "\t\\N"...)
+		}
+		line = append(line, '\t')
+		line = append(line, row.category...)
+		line = append(line, '\n')
+		if _, err := bw.Write(line); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// pgConn is a connection to a PostgreSQL server that speaks just enough of
+// the frontend/backend protocol to run simple queries and COPY FROM STDIN.
+type pgConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialPostgres connects to the server in a postgres:// URL and
+// authenticates with a cleartext, MD5 or SCRAM-SHA-256 password. The sslmode
+// parameter may be disable, prefer (the default), require or verify-full.
+func dialPostgres(dsn string) (*pgConn, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "postgres" && u.Scheme != "postgresql" {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	addr := u.Host
+	if len(u.Port()) == 0 {
+		addr = net.JoinHostPort(u.Hostname(), "5432")
+	}
+	user := u.User.Username()
+	password, _ := u.User.Password()
+	database := strings.TrimPrefix(u.Path, "/")
+	if len(database) == 0 {
+		database = user
+	}
+	sslMode := u.Query().Get("sslmode")
+	if len(sslMode) == 0 {
+		sslMode = "prefer"
+	}
+
+	conn, err := dialNetwork("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if sslMode != "disable" {
+		// An SSLRequest is answered with a single byte.
+		conn.Write([]byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f})
+		var answer [1]byte
+		if _, err := io.ReadFull(conn, answer[:]); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		switch {
+		case answer[0] == 'S':
+			config := &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: sslMode != "verify-full"}
+			tlsConn := tls.Client(conn, config)
+			if err := tlsConn.HandshakeContext(interrupted); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			conn = tlsConn
+		case sslMode != "prefer":
+			conn.Close()
+			return nil, errors.New("server doesn't support SSL")
+		}
+	}
+	c := &pgConn{conn: conn, r: bufio.NewReader(conn)}
+
+	var startup []byte
+	startup = binary.BigEndian.AppendUint32(startup, 3<<16)
+	for _, param := range []string{"user", user, "database", database, "application_name", "crlset-tools"} {
+		startup = append(append(startup, param...), 0)
+	}
+	startup = append(startup, 0)
+	if err := c.send(0, startup); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err := c.authenticate(user, password); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// send writes a message of the given type, or a startup message if typ is
+// zero.
+func (c *pgConn) send(typ byte, payload []byte) error {
+	var msg []byte
+	if typ != 0 {
+		msg = append(msg, typ)
+	}
+	msg = binary.BigEndian.AppendUint32(msg, uint32(len(payload)+4))
+	_, err := c.conn.Write(append(msg, payload...))
+	return err
+}
+
+// receive reads the next message from the server. ErrorResponses are
+// returned as errors, after the message that was being waited for.
+func (c *pgConn) receive() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(header[1:])
+	if n < 4 {
+		return 0, nil, errors.New("invalid message length")
+	}
+	payload := make([]byte, n-4)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// pgError returns the message of an ErrorResponse.
+func pgError(payload []byte) error {
+	var severity, message string
+	for _, field := range bytes.Split(payload, []byte{0}) {
+		if len(field) < 1 {
+			continue
+		}
+		switch field[0] {
+		case 'S':
+			severity = string(field[1:])
+		case 'M':
+			message = string(field[1:])
+		}
+	}
+	return fmt.Errorf("%s: %s", severity, message)
+}
+
+// authenticate answers the server's authentication requests until it's
+// ready for a query.
+func (c *pgConn) authenticate(user, password string) error {
+	var scram *scramClient
+	for {
+		typ, payload, err := c.receive()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 'E':
+			return pgError(payload)
+		case 'Z':
+			return nil
+		case 'R':
+		default:
+			// ParameterStatus, BackendKeyData and notices aren't
+			// needed.
+			continue
+		}
+		if len(payload) < 4 {
+			return errors.New("invalid authentication request")
+		}
+		switch method, data := binary.BigEndian.Uint32(payload), payload[4:]; method {
+		case 0:
+			// AuthenticationOk; the server still sends its parameters.
+		case 3:
+			err = c.send('p', append([]byte(password), 0))
+		case 5:
+			if len(data) < 4 {
+				return errors.New("invalid MD5 salt")
+			}
+			inner := md5.Sum([]byte(password + user))
+			outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), data[:4]...))
+			err = c.send('p', append([]byte("md5"+hex.EncodeToString(outer[:])), 0))
+		case 10:
+			if !bytes.Contains(data, []byte("SCRAM-SHA-256\x00")) {
+				return errors.New("server doesn't offer SCRAM-SHA-256")
+			}
+			if scram, err = newSCRAMClient(password); err != nil {
+				return err
+			}
+			first := scram.clientFirst()
+			msg := append([]byte("SCRAM-SHA-256\x00"), binary.BigEndian.AppendUint32(nil, uint32(len(first)))...)
+			err = c.send('p', append(msg, first...))
+		case 11:
+			var final string
+			if scram == nil {
+				return errors.New("unexpected SASL continuation")
+			}
+			if final, err = scram.clientFinal(string(data)); err != nil {
+				return err
+			}
+			err = c.send('p', []byte(final))
+		case 12:
+			if scram == nil {
+				return errors.New("unexpected SASL completion")
+			}
+			if err := scram.verifyServerFinal(string(data)); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported authentication method %d", method)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// scramClient performs the client side of SCRAM-SHA-256 (RFC 7677) without
+// channel binding.
+type scramClient struct {
+	password        string
+	nonce           string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+func newSCRAMClient(password string) (*scramClient, error) {
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	s := &scramClient{password: password, nonce: base64.StdEncoding.EncodeToString(nonce)}
+	// PostgreSQL takes the user name from the startup message.
+	s.clientFirstBare = "n=,r=" + s.nonce
+	return s, nil
+}
+
+func (s *scramClient) clientFirst() string {
+	return "n,," + s.clientFirstBare
+}
+
+// clientFinal returns the final client message, with its proof, in reply to
+// the server's first message.
+func (s *scramClient) clientFinal(serverFirst string) (string, error) {
+	var nonce, salt string
+	iterations := 0
+	for _, attr := range strings.Split(serverFirst, ",") {
+		switch {
+		case strings.HasPrefix(attr, "r="):
+			nonce = attr[2:]
+		case strings.HasPrefix(attr, "s="):
+			salt = attr[2:]
+		case strings.HasPrefix(attr, "i="):
+			iterations, _ = strconv.Atoi(attr[2:])
+		}
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil || !strings.HasPrefix(nonce, s.nonce) || iterations <= 0 {
+		return "", errors.New("invalid SCRAM server message")
+	}
+
+	salted, err := pbkdf2.Key(sha256.New, s.password, saltBytes, iterations, sha256.Size)
+	if err != nil {
+		return "", err
+	}
+	hmacSHA256 := func(key []byte, msg string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(msg))
+		return h.Sum(nil)
+	}
+	clientKey := hmacSHA256(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=biws,r=" + nonce
+	authMessage := s.clientFirstBare + "," + serverFirst + "," + withoutProof
+	proof := hmacSHA256(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	s.serverSignature = hmacSHA256(hmacSHA256(salted, "Server Key"), authMessage)
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// verifyServerFinal checks that the server knew the password too.
+func (s *scramClient) verifyServerFinal(serverFinal string) error {
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(serverFinal, "v="))
+	if err != nil || !hmac.Equal(signature, s.serverSignature) {
+		return errors.New("invalid SCRAM server signature")
+	}
+	return nil
+}
+
+// exec runs a simple query, or a COPY FROM STDIN that sends copyData, and
+// waits for the server to be ready for the next one. It returns the tag of
+// the last command.
+func (c *pgConn) exec(query string, copyData io.Reader) (string, error) {
+	if err := c.send('Q', append([]byte(query), 0)); err != nil {
+		return "", err
+	}
+	var tag string
+	var queryErr error
+	for {
+		typ, payload, err := c.receive()
+		if err != nil {
+			return "", err
+		}
+		switch typ {
+		case 'C':
+			tag = string(bytes.TrimRight(payload, "\x00"))
+		case 'E':
+			if queryErr == nil {
+				queryErr = pgError(payload)
+			}
+		case 'G':
+			if copyData == nil {
+				c.send('f', append([]byte("no data to copy"), 0))
+				continue
+			}
+			buf := make([]byte, 64*1024)
+			for {
+				n, err := copyData.Read(buf)
+				if n > 0 {
+					if err := c.send('d', buf[:n]); err != nil {
+						return "", err
+					}
+				}
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					c.send('f', append([]byte(err.Error()), 0))
+					return "", err
+				}
+			}
+			if err := c.send('c', nil); err != nil {
+				return "", err
+			}
+		case 'Z':
+			return tag, queryErr
+		}
+	}
+}
+
+func (c *pgConn) Close() error {
+	c.send('X', nil)
+	return c.conn.Close()
+}
+
+// pgIdentifier quotes name, which may be qualified with a schema, as a
+// PostgreSQL identifier.
+func pgIdentifier(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = `"` + strings.ReplaceAll(part, `"`, `""`) + `"`
+	}
+	return strings.Join(parts, ".")
+}
+
+// exportPostgres creates table, if it doesn't exist, and copies the rows of
+// the CRLSet in filename into it, for the PostgreSQL server at dsn. Any rows
+// already loaded for the same sequence number are replaced, in one
+// transaction, so that loading a CRLSet twice doesn't duplicate them.
+func exportPostgres(filename, dsn, table string) bool {
+	set, err := readCRLSet(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+
+	c, err := dialPostgres(dsn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to connect to PostgreSQL: %s\n", err)
+		return false
+	}
+	defer c.Close()
+
+	quoted := pgIdentifier(table)
+	if _, err := c.exec(fmt.Sprintf(pgTableSchema, quoted), nil); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create table %s: %s\n", table, err)
+		return false
+	}
+	if _, err := c.exec("BEGIN", nil); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start transaction: %s\n", err)
+		return false
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			c.exec("ROLLBACK", nil)
+		}
+	}()
+	if _, err := c.exec(fmt.Sprintf("DELETE FROM %s WHERE sequence = %d", quoted, set.Header.Sequence), nil); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to delete earlier rows from %s: %s\n", table, err)
+		return false
+	}
+	// The rows are encoded as they're sent, rather than all at once.
+	rows, rowsWriter := io.Pipe()
+	go func() {
+		rowsWriter.CloseWithError(writePgCopy(rowsWriter, set))
+	}()
+	tag, err := c.exec("COPY "+quoted+" (sequence, spki, serial, category) FROM STDIN", rows)
+	rows.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to copy into %s: %s\n", table, err)
+		return false
+	}
+	if _, err := c.exec("COMMIT", nil); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to commit: %s\n", err)
+		return false
+	}
+	committed = true
+
+	fmt.Fprintf(os.Stderr, "Loaded sequence %d into %s: %s\n", set.Header.Sequence, table, tag)
+	return true
+}
+
+// sequence prints the sequence number of the CRLSet in filename or, if remote
+// is true, of the latest published CRLSet, and nothing else.
+func sequence(filename string, remote bool) bool {
+	if remote {
+		_, version, err := fetchVersion()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return false
+		}
+		fmt.Println(version)
+		return true
+	}
+
+	set, err := readCRLSet(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+	fmt.Println(set.Header.Sequence)
+	return true
+}
+
+// parseSPKIHash parses a SHA-256 SPKI hash given in either hex or base64.
+func parseSPKIHash(s string) ([crlset.SPKIHashLen]byte, error) {
+	var hash [crlset.SPKIHashLen]byte
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		decoded, err = base64.StdEncoding.DecodeString(s)
+	}
+	if err != nil || len(decoded) != crlset.SPKIHashLen {
+		return hash, fmt.Errorf("Invalid SPKI hash %q", s)
+	}
+	copy(hash[:], decoded)
+	return hash, nil
+}
+
+// readSPKILabels reads a file that maps SPKI hashes to descriptions. Each
+// line contains a hex or base64 SPKI hash followed by whitespace and the
+// description. Blank lines and lines starting with '#' are ignored.
+func readSPKILabels(filename string) (map[[crlset.SPKIHashLen]byte]string, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	labels := make(map[[crlset.SPKIHashLen]byte]string)
+	for i, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: missing description", filename, i+1)
+		}
+		hash, err := parseSPKIHash(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", filename, i+1, err)
+		}
+		labels[hash] = strings.TrimSpace(line[len(fields[0]):])
+	}
+	return labels, nil
+}
+
+// chromeBlocklistURL is where Chromium documents the keys that it blocks.
+// The README groups them under a heading for each incident, and names each
+// certificate file by the SHA-256 hash of its SubjectPublicKeyInfo. Gitiles
+// returns the file base64 encoded.
+var chromeBlocklistURL = "https://chromium.googlesource.com/chromium/src/+/main/net/data/ssl/blocklist/README.md?format=TEXT"
+
+// spkiHashPattern matches a hex SPKI hash in the blocklist README.
+var spkiHashPattern = regexp.MustCompile(`\b[0-9a-f]{64}\b`)
+
+// readIncidents reads a curated mapping of SPKI hashes to distrust incidents
+// from location, a URL or filename of a README in the format of Chromium's
+// blocklist README. Each hash is labelled with the heading it appears under.
+func readIncidents(location string) (map[[crlset.SPKIHashLen]byte]string, error) {
+	data, err := readURLOrFile(location)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Contains(data, []byte("\n#")) {
+		if decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data))); err == nil {
+			data = decoded
+		}
+	}
+
+	incidents := make(map[[crlset.SPKIHashLen]byte]string)
+	heading := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "#") {
+			heading = strings.TrimSpace(strings.TrimLeft(line, "#"))
+			continue
+		}
+		if len(heading) == 0 {
+			continue
+		}
+		for _, match := range spkiHashPattern.FindAllString(line, -1) {
+			var hash [crlset.SPKIHashLen]byte
+			hex.Decode(hash[:], []byte(match))
+			if _, ok := incidents[hash]; !ok {
+				incidents[hash] = heading
+			}
+		}
+	}
+	if len(incidents) == 0 {
+		return nil, errors.New("no SPKI hashes found")
+	}
+	return incidents, nil
+}
+
+// audit prints each of the CRLSet's BlockedSPKIs along with the distrust
+// incident that explains it, taken from the curated mapping at
+// incidentsLocation, if any, and from labelsFilename, if given, whose
+// labels take precedence. Entries without an explanation are marked for
+// review.
+func audit(filename, incidentsLocation, labelsFilename string) bool {
+	set, err := readCRLSet(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+
+	incidents := make(map[[crlset.SPKIHashLen]byte]string)
+	if len(incidentsLocation) > 0 {
+		if incidents, err = readIncidents(incidentsLocation); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read incidents: %s\n", err)
+			return false
+		}
+	}
+	if len(labelsFilename) > 0 {
+		labels, err := readSPKILabels(labelsFilename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read incidents: %s\n", err)
+			return false
+		}
+		for spki, label := range labels {
+			incidents[spki] = label
+		}
+	}
+
+	unexplained := 0
+	for _, spki := range set.Header.BlockedSPKIHashes() {
+		incident, ok := incidents[spki]
+		if !ok {
+			incident = "UNEXPLAINED: needs review"
+			unexplained++
+		}
+		fmt.Printf("%x  %s\n", spki, incident)
+	}
+	fmt.Fprintf(os.Stderr, "%d blocked SPKIs, %d unexplained\n", len(set.Header.BlockedSPKIHashes()), unexplained)
+
+	return true
+}
+
+// trendPoint contains the statistics for one CRLSet in the output of trend.
+type trendPoint struct {
+	Filename                 string `json:"filename"`
+	Sequence                 int    `json:"sequence"`
+	SPKIs                    int    `json:"spkis"`
+	Serials                  int    `json:"serials"`
+	BlockedSPKIs             int    `json:"blocked_spkis"`
+	KnownInterceptionSPKIs   int    `json:"known_interception_spkis"`
+	BlockedInterceptionSPKIs int    `json:"blocked_interception_spkis"`
+	// SerialsAdded and SerialsRemoved count the changes since the previous
+	// version, and are zero for the first.
+	SerialsAdded   int `json:"serials_added"`
+	SerialsRemoved int `json:"serials_removed"`
+}
+
+// writePrometheusTrend writes the statistics for the newest CRLSet in points
+// in the Prometheus text format. Since node_exporter's textfile collector
+// doesn't accept timestamps, only the current values can be exported and
+// Prometheus builds the history by scraping them.
+func writePrometheusTrend(w io.Writer, points []trendPoint) error {
+	if len(points) == 0 {
+		return errors.New("No CRLSets found")
+	}
+	latest := points[len(points)-1]
+	metrics := []struct {
+		name, help string
+		value      int
+	}{
+		{"crlset_sequence", "Sequence number of the newest CRLSet.", latest.Sequence},
+		{"crlset_spkis", "Number of SPKIs with revoked serials.", latest.SPKIs},
+		{"crlset_serials", "Number of revoked serials.", latest.Serials},
+		{"crlset_blocked_spkis", "Number of blocked SPKIs.", latest.BlockedSPKIs},
+		{"crlset_known_interception_spkis", "Number of known interception SPKIs.", latest.KnownInterceptionSPKIs},
+		{"crlset_blocked_interception_spkis", "Number of blocked interception SPKIs.", latest.BlockedInterceptionSPKIs},
+		{"crlset_serials_added", "Serials added since the previous CRLSet.", latest.SerialsAdded},
+		{"crlset_serials_removed", "Serials removed since the previous CRLSet.", latest.SerialsRemoved},
+		{"crlset_versions", "Number of CRLSets in the archive.", len(points)},
+	}
+	for _, m := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", m.name, m.help, m.name, m.name, m.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archivedCRLSet summarises one of the CRLSets in a directory read by
+// readCRLSetDir. Only the header and counts are kept, so that an archive of
+// many versions needn't be held in memory at once.
+type archivedCRLSet struct {
+	filename string
+	header   crlset.Header
+	spkis    int
+	serials  int
+}
+
+// readCRLSetDir parses every CRLSet in dir and returns a summary of each, in
+// order of sequence number. Files that can't be parsed are skipped with a
+// warning.
+func readCRLSetDir(dir string) ([]archivedCRLSet, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var archived []archivedCRLSet
+	for _, file := range files {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		filename := filepath.Join(dir, file.Name())
+		set, err := readCRLSet(filename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping %s: %s\n", filename, err)
+			continue
+		}
+		archived = append(archived, archivedCRLSet{filename, set.Header, len(set.Entries), countSerials(set.Entries)})
+	}
+
+	sort.SliceStable(archived, func(i, j int) bool {
+		return archived[i].header.Sequence < archived[j].header.Sequence
+	})
+	return archived, nil
+}
+
+// archivedChanges returns the number of serials that each of the CRLSets in
+// archived added and removed since the one before it, which are zero for the
+// first. The sets are read again in turn, so only two are in memory at once.
+func archivedChanges(archived []archivedCRLSet) (added, removed []int, err error) {
+	added, removed = make([]int, len(archived)), make([]int, len(archived))
+	var previous *crlset.CRLSet
+	for i, a := range archived {
+		set, err := readCRLSet(a.filename)
+		if err != nil {
+			return nil, nil, err
+		}
+		if previous != nil {
+			addedEntries, removedEntries := diffCRLSets(previous, set)
+			added[i], removed[i] = countSerials(addedEntries), countSerials(removedEntries)
+		}
+		previous = set
+	}
+	return added, removed, nil
+}
+
+// archivedVersion describes one of the CRLSets in an archive directory.
+type archivedVersion struct {
+	Sequence int       `json:"sequence"`
+	Filename string    `json:"filename"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// listVersions prints the sequence number, modification time, size and
+// filename of each CRLSet or CRX in dir, oldest first.
+func listVersions(dir, format string) bool {
+	if format != "text" && format != "json" {
+		fmt.Fprintf(os.Stderr, "Unknown output format %q\n", format)
+		return false
+	}
+
+	archived, err := readCRLSetDir(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read directory: %s\n", err)
+		return false
+	}
+
+	versions := make([]archivedVersion, 0, len(archived))
+	for _, a := range archived {
+		info, err := os.Stat(a.filename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return false
+		}
+		versions = append(versions, archivedVersion{
+			Sequence: a.header.Sequence,
+			Filename: a.filename,
+			Size:     info.Size(),
+			Modified: info.ModTime().UTC().Truncate(time.Second),
+		})
+	}
+
+	if format == "json" {
+		out, err := json.MarshalIndent(versions, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to serialize versions: %s\n", err)
+			return false
+		}
+		fmt.Printf("%s\n", out)
+		return true
+	}
+
+	for _, v := range versions {
+		fmt.Printf("%d %s %d %s\n", v.Sequence, v.Modified.Format(time.RFC3339), v.Size, v.Filename)
+	}
+	return true
+}
+
+// whenRevoked reports the first CRLSet archived in dir that contains spec,
+// which is an SPKI hash optionally followed by a colon and a hex serial. The
+// files are taken to be in order of modification time and only O(log n) of
+// them are parsed, which assumes that once an entry appears it isn't removed.
+func whenRevoked(dir, spec string) bool {
+	var watches watchList
+	if err := watches.Set(spec); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+	entry := watches[0]
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read directory: %s\n", err)
+		return false
+	}
+	var files []os.FileInfo
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			files = append(files, info)
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	sets := make(map[string]*crlset.CRLSet)
+	// load returns the CRLSet in files[i]. Files that can't be parsed are
+	// removed from files, so the search has to start again.
+	load := func(i int) (*crlset.CRLSet, bool) {
+		name := files[i].Name()
+		if set, ok := sets[name]; ok {
+			return set, true
+		}
+		set, err := readCRLSet(filepath.Join(dir, name))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping %s: %s\n", name, err)
+			files = append(files[:i], files[i+1:]...)
+			return nil, false
+		}
+		sets[name] = set
+		return set, true
+	}
+
+	for {
+		if len(files) == 0 {
+			fmt.Fprintf(os.Stderr, "No CRLSets found in %s\n", dir)
+			return false
+		}
+		newest, ok := load(len(files) - 1)
+		if !ok {
+			continue
+		}
+		if !entry.matches(newest) {
+			fmt.Printf("%s is not in the newest archived CRLSet, sequence %d\n", entry.String(), newest.Header.Sequence)
+			return true
+		}
+
+		restart := false
+		first := sort.Search(len(files), func(i int) bool {
+			if restart {
+				return true
+			}
+			set, ok := load(i)
+			if !ok {
+				restart = true
+				return true
+			}
+			return entry.matches(set)
+		})
+		if restart {
+			continue
+		}
+
+		set := sets[files[first].Name()]
+		if first == 0 {
+			fmt.Printf("%s is in the oldest archived CRLSet, sequence %d from %s, so it was added then or earlier\n", entry.String(), set.Header.Sequence, files[first].ModTime().UTC().Format(time.RFC3339))
+			return true
+		}
+		previous := sets[files[first-1].Name()]
+		fmt.Printf("%s first appeared in sequence %d, archived %s (not in sequence %d, archived %s)\n", entry.String(), set.Header.Sequence, files[first].ModTime().UTC().Format(time.RFC3339), previous.Header.Sequence, files[first-1].ModTime().UTC().Format(time.RFC3339))
+		return true
+	}
+}
+
+// trend prints per-version statistics for the CRLSets in dir, as CSV or JSON,
+// so that growth and major revocation events can be charted.
+func trend(dir, format, outputFilename string) bool {
+	if format != "csv" && format != "json" && format != "prometheus-textfile" {
+		fmt.Fprintf(os.Stderr, "Unknown output format %q\n", format)
+		return false
+	}
+
+	archived, err := readCRLSetDir(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read directory: %s\n", err)
+		return false
+	}
+	added, removed, err := archivedChanges(archived)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+
+	points := make([]trendPoint, 0, len(archived))
+	for i, a := range archived {
+		points = append(points, trendPoint{
+			Filename:                 a.filename,
+			Sequence:                 a.header.Sequence,
+			SPKIs:                    a.spkis,
+			Serials:                  a.serials,
+			BlockedSPKIs:             len(a.header.BlockedSPKIHashes()),
+			KnownInterceptionSPKIs:   len(a.header.KnownInterceptionSPKIHashes()),
+			BlockedInterceptionSPKIs: len(a.header.BlockedInterceptionSPKIHashes()),
+			SerialsAdded:             added[i],
+			SerialsRemoved:           removed[i],
+		})
+	}
+
+	var out bytes.Buffer
+	switch format {
+	case "json":
+		encoded, err := json.MarshalIndent(points, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to serialize trend: %s\n", err)
+			return false
+		}
+		out.Write(encoded)
+		out.WriteString("\n")
+	case "prometheus-textfile":
+		if err := writePrometheusTrend(&out, points); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return false
+		}
+	case "csv":
+		if err := writeTrendCSV(&out, points); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write trend: %s\n", err)
+			return false
+		}
+	}
+
+	// The textfile collector may read the output at any moment, so it's
+	// replaced atomically.
+	if err := writeOutput(outputFilename, out.Bytes()); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write trend: %s\n", err)
+		return false
+	}
+	return true
+}
+
+// writeTrendCSV writes points as CSV with a header row.
+func writeTrendCSV(out io.Writer, points []trendPoint) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"filename", "sequence", "spkis", "serials", "blocked_spkis", "known_interception_spkis", "blocked_interception_spkis", "serials_added", "serials_removed"})
+	for _, p := range points {
+		w.Write([]string{
+			p.Filename,
+			strconv.Itoa(p.Sequence),
+			strconv.Itoa(p.SPKIs),
+			strconv.Itoa(p.Serials),
+			strconv.Itoa(p.BlockedSPKIs),
+			strconv.Itoa(p.KnownInterceptionSPKIs),
+			strconv.Itoa(p.BlockedInterceptionSPKIs),
+			strconv.Itoa(p.SerialsAdded),
+			strconv.Itoa(p.SerialsRemoved),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// mirroredCRX is a CRX file in the directory served by serveOmaha.
+type mirroredCRX struct {
+	name    string
+	modTime time.Time
+	size    int64
+	// sequence is the sequence number of the CRLSet inside the CRX, or -1
+	// if the file isn't a valid CRLSet CRX.
+	sequence int
+}
+
+// omahaServer answers update checks for the CRLSet using the newest CRX in
+// dir, or a particular version if the request asks for one.
+type omahaServer struct {
+	dir     string
+	baseURL string
+
+	mu sync.Mutex
+	// crxs caches the results of verifying each file in dir, so that only
+	// new or modified files are examined on each request.
+	crxs map[string]mirroredCRX
+	// checkers caches the Checkers for the versions most recently queried
+	// with /check.
+	checkers map[mirroredCRX]*crlset.Checker
+
+	watchMu sync.Mutex
+	// current is the newest CRLSet, as last seen by watch.
+	current *crlset.CRLSet
+	// watchers are the channels of the /watch requests in progress.
+	watchers map[chan watchUpdate]bool
+}
+
+// watchPollInterval is how often serve-omaha looks for a new CRLSet to
+// announce to /watch subscribers.
+const watchPollInterval = 10 * time.Second
+
+// watchUpdate is a line of the /watch stream, sent whenever the newest
+// CRLSet in the mirror changes. The first line describes the CRLSet being
+// served when the subscription starts and has no previous sequence.
+type watchUpdate struct {
+	Sequence         int `json:"sequence"`
+	PreviousSequence int `json:"previousSequence,omitempty"`
+	SerialsAdded     int `json:"serialsAdded"`
+	SerialsRemoved   int `json:"serialsRemoved"`
+	// SPKIsAdded and SPKIsRemoved count changes to the header's lists of
+	// blocked and interception SPKIs.
+	SPKIsAdded   int `json:"spkisAdded"`
+	SPKIsRemoved int `json:"spkisRemoved"`
+}
+
+// readMirrored reads the CRLSet from the named CRX in the directory.
+func (s *omahaServer) readMirrored(name string) (*crlset.CRLSet, error) {
+	crlSetBytes, err := s.extractMirrored(name)
+	if err != nil {
+		return nil, err
+	}
+	return parseCRLSet(crlSetBytes)
+}
+
+// extractMirrored returns the contents of the CRLSet in the named CRX in the
+// directory, after verifying its signature.
+func (s *omahaServer) extractMirrored(name string) ([]byte, error) {
+	f, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return extractCRLSet(f, info.Size())
+}
+
+// mapMirrored returns the CRLSet from crx, memory-mapped from a sidecar file
+// holding the CRLSet extracted from it. The sidecar is written the first
+// time, so later loads, and other processes serving the same mirror, share
+// its pages. Sidecars are kept in downloadDir, named after the CRX's size and
+// modification time so that a replaced CRX gets a new one, rather than in
+// the mirror, where every command that reads the directory would warn about
+// them. release must be called once nothing refers to the set.
+func (s *omahaServer) mapMirrored(crx mirroredCRX) (set *crlset.CRLSet, release func(), err error) {
+	absDir, err := filepath.Abs(s.dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	downloads, err := downloadDir()
+	if err != nil {
+		return nil, nil, err
+	}
+	dirHash := sha256.Sum256([]byte(absDir))
+	sidecarDir := filepath.Join(downloads, fmt.Sprintf("mirror-%x", dirHash[:8]))
+	if err := os.MkdirAll(sidecarDir, 0700); err != nil {
+		return nil, nil, err
+	}
+
+	sidecar := filepath.Join(sidecarDir, fmt.Sprintf("%s-%d-%d.crl-set", crx.name, crx.size, crx.modTime.UnixNano()))
+	if _, err := os.Stat(sidecar); os.IsNotExist(err) {
+		crlSetBytes, err := s.extractMirrored(crx.name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := copyFile(sidecar, bytes.NewReader(crlSetBytes)); err != nil {
+			return nil, nil, err
+		}
+		// Sidecars of earlier versions of the CRX are no longer needed.
+		// Any that are still mapped stay readable until they're unmapped.
+		if old, err := filepath.Glob(filepath.Join(sidecarDir, crx.name+"-*.crl-set")); err == nil {
+			for _, filename := range old {
+				if filename != sidecar {
+					os.Remove(filename)
+				}
+			}
+		}
+	}
+	return readMappedCRLSet(sidecar)
+}
+
+// checkForUpdate looks for a newer CRLSet in the directory and, if there is
+// one, tells every /watch subscriber what changed.
+func (s *omahaServer) checkForUpdate() {
+	name, sequence, err := s.latest()
+	if err != nil || len(name) == 0 {
+		return
+	}
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	if s.current != nil && s.current.Header.Sequence == sequence {
+		return
+	}
+	set, err := s.readMirrored(name)
+	if err != nil {
+		log.Printf("Failed to read %s: %s", name, err)
+		return
+	}
+
+	previous := s.current
+	s.current = set
+	if previous == nil {
+		return
+	}
+	update := watchUpdate{Sequence: set.Header.Sequence, PreviousSequence: previous.Header.Sequence}
+	for _, event := range changelogEvents(previous, set) {
+		switch {
+		case event.Kind == "serial" && event.Change == "added":
+			update.SerialsAdded++
+		case event.Kind == "serial":
+			update.SerialsRemoved++
+		case event.Change == "added":
+			update.SPKIsAdded++
+		default:
+			update.SPKIsRemoved++
+		}
+	}
+	s.announce(update)
+}
+
+// announce sends update to every watcher. s.watchMu must be held.
+func (s *omahaServer) announce(update watchUpdate) {
+	log.Printf("Announcing sequence %d to %d watchers", update.Sequence, len(s.watchers))
+	for ch := range s.watchers {
+		select {
+		case ch <- update:
+		default:
+			// A watcher that isn't keeping up is disconnected rather
+			// than left to miss an update and then add up the counts
+			// wrongly. On reconnecting it starts again from the
+			// current sequence.
+			close(ch)
+			delete(s.watchers, ch)
+		}
+	}
+}
+
+// watch subscribes to the updates announced by checkForUpdate. The channel
+// first receives the sequence being served, if any, and is closed if the
+// subscriber falls too far behind. unsubscribe must be called when the
+// subscriber is done.
+func (s *omahaServer) watch() (updates chan watchUpdate, unsubscribe func()) {
+	ch := make(chan watchUpdate, 16)
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	if s.current != nil {
+		ch <- watchUpdate{Sequence: s.current.Header.Sequence}
+	}
+	s.watchers[ch] = true
+	return ch, func() {
+		s.watchMu.Lock()
+		delete(s.watchers, ch)
+		s.watchMu.Unlock()
+	}
+}
+
+// serveWatch streams a watchUpdate, as a line of JSON, whenever the newest
+// CRLSet changes, so that clients can refresh without polling. The stream
+// ends if the client falls too far behind.
+func (s *omahaServer) serveWatch(w http.ResponseWriter, r *http.Request) {
+	ch, unsubscribe := s.watch()
+	defer unsubscribe()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	e := json.NewEncoder(w)
+	for {
+		select {
+		case update, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := e.Encode(&update); err != nil {
+				return
+			}
+			rc.Flush()
+		case <-r.Context().Done():
+			return
+		case <-interrupted.Done():
+			return
+		}
+	}
+}
+
+// watchUpdatesMethod is the path of the gRPC WatchUpdates method, which
+// streams the same updates as /watch. The service is defined by:
+//
+//	syntax = "proto3";
+//	package crlset.v1;
+//
+//	service CRLSetService {
+//	  rpc WatchUpdates(WatchUpdatesRequest) returns (stream WatchUpdate);
+//	}
+//
+//	message WatchUpdatesRequest {}
+//
+//	message WatchUpdate {
+//	  int64 sequence = 1;
+//	  int64 previous_sequence = 2;
+//	  int64 serials_added = 3;
+//	  int64 serials_removed = 4;
+//	  int64 spkis_added = 5;
+//	  int64 spkis_removed = 6;
+//	}
+const watchUpdatesMethod = "/crlset.v1.CRLSetService/WatchUpdates"
+
+// gRPC status codes used by serveWatchUpdates.
+const (
+	grpcOK                = 0
+	grpcInvalidArgument   = 3
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcUnavailable       = 14
+)
+
+// marshalWatchUpdate encodes update as a WatchUpdate protocol buffer.
+// Fields with their default value of zero are left out, as proto3 does.
+func marshalWatchUpdate(update watchUpdate) []byte {
+	var out []byte
+	for i, value := range []int{update.Sequence, update.PreviousSequence, update.SerialsAdded, update.SerialsRemoved, update.SPKIsAdded, update.SPKIsRemoved} {
+		if value == 0 {
+			continue
+		}
+		out = binary.AppendUvarint(out, uint64(i+1)<<3)
+		out = binary.AppendUvarint(out, uint64(value))
+	}
+	return out
+}
+
+// serveWatchUpdates implements the server-streaming gRPC WatchUpdates
+// method over HTTP/2, sending a WatchUpdate message whenever the newest
+// CRLSet changes. Messages are sent uncompressed. A client that falls too
+// far behind gets a RESOURCE_EXHAUSTED status, and can call again to
+// resynchronize.
+func (s *omahaServer) serveWatchUpdates(w http.ResponseWriter, r *http.Request) {
+	finish := func(code int, message string) {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+		if len(message) > 0 {
+			w.Header().Set(http.TrailerPrefix+"Grpc-Message", url.PathEscape(message))
+		}
+	}
+	if r.ProtoMajor != 2 || r.Method != "POST" {
+		http.Error(w, "gRPC requires a POST over HTTP/2", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	if contentType := r.Header.Get("Content-Type"); contentType != "application/grpc" && contentType != "application/grpc+proto" {
+		w.WriteHeader(http.StatusOK)
+		finish(grpcInvalidArgument, "only protocol buffers are supported")
+		return
+	}
+	// The request is a single WatchUpdatesRequest, which has no fields, so
+	// it's only checked for being uncompressed.
+	var prefix [5]byte
+	if _, err := io.ReadFull(r.Body, prefix[:]); err != nil || prefix[0] != 0 {
+		w.WriteHeader(http.StatusOK)
+		if err == nil {
+			finish(grpcUnimplemented, "compressed requests are not supported")
+		} else {
+			finish(grpcInvalidArgument, "missing request message")
+		}
+		return
+	}
+	io.CopyN(io.Discard, r.Body, int64(binary.BigEndian.Uint32(prefix[1:])))
+
+	ch, unsubscribe := s.watch()
+	defer unsubscribe()
+
+	rc := http.NewResponseController(w)
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	for {
+		select {
+		case update, ok := <-ch:
+			if !ok {
+				finish(grpcResourceExhausted, "fell behind the updates")
+				return
+			}
+			message := marshalWatchUpdate(update)
+			frame := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(message)))
+			if _, err := w.Write(append(frame, message...)); err != nil {
+				return
+			}
+			rc.Flush()
+		case <-r.Context().Done():
+			finish(grpcOK, "")
+			return
+		case <-interrupted.Done():
+			finish(grpcUnavailable, "server shutting down")
+			return
+		}
+	}
+}
+
+// latest returns the name and sequence number of the newest valid CRX in the
+// directory, or an empty name if there is none.
+func (s *omahaServer) latest() (string, int, error) {
+	return s.find(-1)
+}
+
+// find returns the name and sequence number of the valid CRX in the
+// directory with the given sequence number, or of the newest one if sequence
+// is negative. The name is empty if there is no such CRX.
+func (s *omahaServer) find(sequence int) (string, int, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return "", 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	best := mirroredCRX{sequence: -1}
+	for _, file := range files {
+		if !file.Mode().IsRegular() || !strings.HasSuffix(file.Name(), ".crx") {
+			continue
+		}
+
+		crx, ok := s.crxs[file.Name()]
+		if !ok || !crx.modTime.Equal(file.ModTime()) || crx.size != file.Size() {
+			crx = mirroredCRX{name: file.Name(), modTime: file.ModTime(), size: file.Size(), sequence: -1}
+			if f, err := os.Open(filepath.Join(s.dir, file.Name())); err == nil {
+				if crlSetBytes, err := extractCRLSet(f, file.Size()); err == nil {
+					if set, err := parseCRLSet(crlSetBytes); err == nil {
+						crx.sequence = set.Header.Sequence
+					}
+				}
+				f.Close()
+			}
+			if crx.sequence < 0 {
+				log.Printf("Ignoring %s: not a valid CRLSet CRX", file.Name())
+			}
+			s.crxs[file.Name()] = crx
+		}
+
+		if sequence >= 0 {
+			if crx.sequence == sequence {
+				best = crx
+			}
+		} else if crx.sequence > best.sequence {
+			best = crx
+		}
+	}
+
+	return best.name, best.sequence, nil
+}
+
+// requestedSequence returns the CRLSet version that r asks for, either with a
+// sequence query parameter or with a path that starts /sequence/<n>/, along
+// with the rest of the path. The sequence is -1 if r doesn't ask for one.
+func requestedSequence(r *http.Request) (sequence int, path string, err error) {
+	sequence, path = -1, r.URL.Path
+	if rest := strings.TrimPrefix(path, "/sequence/"); rest != path {
+		i := strings.IndexByte(rest, '/')
+		if i < 0 {
+			return 0, "", errors.New("missing path after sequence")
+		}
+		if sequence, err = strconv.Atoi(rest[:i]); err != nil || sequence < 0 {
+			return 0, "", fmt.Errorf("invalid sequence %q", rest[:i])
+		}
+		path = rest[i:]
+	}
+	if value := r.URL.Query().Get("sequence"); len(value) > 0 {
+		if sequence, err = strconv.Atoi(value); err != nil || sequence < 0 {
+			return 0, "", fmt.Errorf("invalid sequence %q", value)
+		}
+	}
+	return sequence, path, nil
+}
+
+// maxCachedCheckers is the number of CRLSet versions that serve-omaha keeps
+// indexed for /check.
+const maxCachedCheckers = 4
+
+// checker returns a Checker for the CRLSet in the CRX with the given name,
+// with any --blocklist and --allowlist applied.
+func (s *omahaServer) checker(name string) (*crlset.Checker, error) {
+	s.mu.Lock()
+	crx := s.crxs[name]
+	checker := s.checkers[crx]
+	s.mu.Unlock()
+	if checker != nil {
+		return checker, nil
+	}
+
+	if len(crx.name) == 0 {
+		return nil, fmt.Errorf("%s is not in the mirror", name)
+	}
+	set, release, err := s.mapMirrored(crx)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyOverrides(set); err != nil {
+		release()
+		return nil, err
+	}
+	checker = newCertChecker(set)
+	// The set stays mapped until neither the cache nor any request in
+	// progress refers to the checker.
+	runtime.AddCleanup(checker, func(release func()) { release() }, release)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.checkers) >= maxCachedCheckers {
+		for cached := range s.checkers {
+			delete(s.checkers, cached)
+			break
+		}
+	}
+	s.checkers[crx] = checker
+	return checker, nil
+}
+
+// checkResponse is the JSON reply to /check.
+type checkResponse struct {
+	Sequence int `json:"sequence"`
+	// Verdict is "ok", "warning" or "blocked", as in the audit log.
+	Verdict  string         `json:"verdict"`
+	Problems []checkProblem `json:"problems,omitempty"`
+}
+
+// checkProblem is a crlset.Problem in a checkResponse.
+type checkProblem struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// serveCheck answers whether the serial given by the serial query parameter,
+// under the SPKI given by the spki parameter, is affected by the CRLSet with
+// the wanted sequence number, or by the newest one if wanted is negative.
+// Without a serial, only the SPKI is looked up.
+func (s *omahaServer) serveCheck(w http.ResponseWriter, r *http.Request, wanted int) {
+	query := r.URL.Query()
+	hash, err := parseSPKIHash(query.Get("spki"))
+	if err != nil {
+		http.Error(w, "Invalid spki parameter", http.StatusBadRequest)
+		return
+	}
+	var serial []byte
+	if serialHex := query.Get("serial"); len(serialHex) > 0 {
+		if len(serialHex)%2 == 1 {
+			serialHex = "0" + serialHex
+		}
+		if serial, err = hex.DecodeString(serialHex); err != nil {
+			http.Error(w, "Invalid serial parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	name, sequence, err := s.find(wanted)
+	if err != nil {
+		log.Printf("Failed to read mirror: %s", err)
+		http.Error(w, "Failed to read mirror", http.StatusInternalServerError)
+		return
+	}
+	if len(name) == 0 {
+		http.Error(w, fmt.Sprintf("No CRLSet with sequence %d", wanted), http.StatusNotFound)
+		return
+	}
+	checker, err := s.checker(name)
+	if err != nil {
+		log.Printf("Failed to read %s: %s", name, err)
+		http.Error(w, "Failed to read CRLSet", http.StatusInternalServerError)
+		return
+	}
+
+	problems := checker.SPKIProblems(hash)
+	if serial != nil && checker.IsRevoked(hash[:], serial) {
+		problems = append(problems, crlset.Problem{Rule: "revoked-serial", Message: fmt.Sprintf("serial %s revoked under SPKI %x", formatSerial(crlset.NormalizeSerial(serial)), hash)})
+	}
+	response := checkResponse{Sequence: sequence, Verdict: "ok"}
+	for _, problem := range problems {
+		response.Problems = append(response.Problems, checkProblem{problem.Rule, problem.Message})
+		if !problem.Warning {
+			response.Verdict = "blocked"
+		} else if response.Verdict == "ok" {
+			response.Verdict = "warning"
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *omahaServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wanted, path, err := requestedSequence(r)
+	if err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if path == "/watch" {
+		s.serveWatch(w, r)
+		return
+	}
+	if path == watchUpdatesMethod {
+		s.serveWatchUpdates(w, r)
+		return
+	}
+	if path == "/check" {
+		s.serveCheck(w, r, wanted)
+		return
+	}
+	if path != "/service/update2/crx" {
+		if strings.HasPrefix(path, "/crx/") && strings.HasSuffix(path, ".crx") {
+			// ServeFile handles Range requests, which fetch relies on to
+			// resume interrupted downloads.
+			http.ServeFile(w, r, filepath.Join(s.dir, filepath.Base(path)))
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	reply := crlset.UpdateResponse{
+		Xmlns:    "http://www.google.com/update2/response",
+		Protocol: "2.0",
+	}
+	for _, x := range r.URL.Query()["x"] {
+		args, err := url.ParseQuery(x)
+		if err != nil {
+			http.Error(w, "Invalid x parameter", http.StatusBadRequest)
+			return
+		}
+
+		app := crlset.UpdateApp{AppId: args.Get("id"), Status: "ok"}
+		if app.AppId != crlset.AppID {
+			app.Status = "error-unknownApplication"
+			reply.Apps = append(reply.Apps, app)
+			continue
+		}
+
+		name, sequence, err := s.find(wanted)
+		if err != nil {
+			log.Printf("Failed to read mirror: %s", err)
+			http.Error(w, "Failed to read mirror", http.StatusInternalServerError)
+			return
+		}
+		if len(name) == 0 && wanted >= 0 {
+			http.Error(w, fmt.Sprintf("No CRLSet with sequence %d", wanted), http.StatusNotFound)
+			return
+		}
+		// A client that asks for a particular version is given it even if
+		// it's older than the one the client has.
+		current, _ := strconv.Atoi(args.Get("v"))
+		if len(name) == 0 || current == sequence || (wanted < 0 && current > sequence) {
+			app.UpdateCheck = &crlset.UpdateCheck{Status: "noupdate"}
+		} else {
+			app.UpdateCheck = &crlset.UpdateCheck{
+				URL:     strings.TrimSuffix(s.baseURL, "/") + "/crx/" + url.PathEscape(name),
+				Version: strconv.Itoa(sequence),
+				Status:  "ok",
+			}
+		}
+		reply.Apps = append(reply.Apps, app)
+	}
+
+	out, err := xml.Marshal(reply)
+	if err != nil {
+		http.Error(w, "Failed to serialize reply", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	w.Write(out)
+}
+
+// backfillRecord is a line of a backfill checkpoint file, recording a source
+// CRX that has already been copied. Sources that failed aren't recorded, so
+// they're tried again next time.
+type backfillRecord struct {
+	// Source is the filename or URL of the CRX.
+	Source string `json:"source"`
+	// Size and ModTime identify the version of a file, so that a file
+	// which has since changed is examined again. They're empty for URLs.
+	Size     int64  `json:"size,omitempty"`
+	ModTime  string `json:"modTime,omitempty"`
+	Sequence int    `json:"sequence,omitempty"`
+}
+
+// key identifies the source version that r records.
+func (r *backfillRecord) key() string {
+	return fmt.Sprintf("%s\x00%d\x00%s", r.Source, r.Size, r.ModTime)
+}
+
+// readBackfillCheckpoint returns the keys of the records in filename, which
+// may not exist yet.
+func readBackfillCheckpoint(filename string) (map[string]bool, error) {
+	done := make(map[string]bool)
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return done, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record backfillRecord
+		// A line cut short by a crash is ignored, so that source is
+		// examined again.
+		if json.Unmarshal(scanner.Bytes(), &record) == nil {
+			done[record.key()] = true
+		}
+	}
+	return done, scanner.Err()
+}
+
+// backfillSources expands the arguments to backfill into a list of sources:
+// URLs are kept, and directories are replaced by the CRX files in them.
+func backfillSources(args []string) ([]string, error) {
+	var sources []string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "https://") || strings.HasPrefix(arg, "http://") {
+			sources = append(sources, arg)
+			continue
+		}
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			sources = append(sources, arg)
+			continue
+		}
+		files, err := ioutil.ReadDir(arg)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if file.Mode().IsRegular() && strings.HasSuffix(file.Name(), ".crx") {
+				sources = append(sources, filepath.Join(arg, file.Name()))
+			}
+		}
+	}
+	return sources, nil
+}
+
+// defaultBackfillCheckpoint returns the checkpoint file for the mirror in
+// dir when --checkpoint isn't given. It's kept in downloadDir rather than in
+// the mirror, where every command that reads the directory would warn about
+// it.
+func defaultBackfillCheckpoint(dir string) (string, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	downloads, err := downloadDir()
+	if err != nil {
+		return "", err
+	}
+	dirHash := sha256.Sum256([]byte(absDir))
+	return filepath.Join(downloads, fmt.Sprintf("backfill-%x.checkpoint", dirHash[:8])), nil
+}
+
+// backfill copies historical CRLSet CRXs, from files, directories of CRXs or
+// URLs, into the mirror directory dir as crlset-<sequence>.crx, verifying
+// each one first. Every source that's copied, or was already in the mirror,
+// is appended to the checkpoint file, so that an interrupted run resumes
+// where it stopped rather than downloading and verifying every version again.
+func backfill(dir, checkpoint string, args []string) bool {
+	if len(checkpoint) == 0 {
+		var err error
+		if checkpoint, err = defaultBackfillCheckpoint(dir); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return false
+		}
+	}
+	done, err := readBackfillCheckpoint(checkpoint)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read checkpoint: %s\n", err)
+		return false
+	}
+	sources, err := backfillSources(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+	out, err := os.OpenFile(checkpoint, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open checkpoint: %s\n", err)
+		return false
+	}
+	defer out.Close()
+
+	copied, skipped, invalid := 0, 0, 0
+	for _, source := range sources {
+		if interrupted.Err() != nil {
+			break
+		}
+
+		record := backfillRecord{Source: source}
+		var contents []byte
+		if strings.Contains(source, "://") {
+			if done[record.key()] {
+				skipped++
+				continue
+			}
+			resp, err := httpGet(source)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to download %s: %s\n", source, err)
+				return false
+			}
+			if resp.StatusCode != http.StatusOK {
+				resp.Body.Close()
+				fmt.Fprintf(os.Stderr, "Failed to download %s: unexpected HTTP status %q\n", source, resp.Status)
+				return false
+			}
+			contents, err = ioutil.ReadAll(io.LimitReader(resp.Body, crlset.MaxCRXSize+1))
+			resp.Body.Close()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to download %s: %s\n", source, err)
+				return false
+			}
+			if len(contents) > crlset.MaxCRXSize {
+				log.Printf("Skipping %s: larger than %d bytes", source, crlset.MaxCRXSize)
+				invalid++
+				continue
+			}
+		} else {
+			info, err := os.Stat(source)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				return false
+			}
+			record.Size, record.ModTime = info.Size(), info.ModTime().UTC().Format(time.RFC3339Nano)
+			if done[record.key()] {
+				skipped++
+				continue
+			}
+			if contents, err = ioutil.ReadFile(source); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				return false
+			}
+		}
+
+		crlSetBytes, err := extractCRLSet(bytes.NewReader(contents), int64(len(contents)))
+		var set *crlset.CRLSet
+		if err == nil {
+			set, err = parseCRLSet(crlSetBytes)
+		}
+		if err != nil {
+			log.Printf("Skipping %s: %s", source, err)
+			invalid++
+			continue
+		}
+		record.Sequence = set.Header.Sequence
+		target := filepath.Join(dir, fmt.Sprintf("crlset-%d.crx", set.Header.Sequence))
+		if existing, err := ioutil.ReadFile(target); err == nil {
+			if !bytes.Equal(existing, contents) {
+				log.Printf("Keeping the existing %s rather than %s, which differs", target, source)
+			}
+		} else if err := copyFile(target, bytes.NewReader(contents)); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write %s: %s\n", target, err)
+			return false
+		} else {
+			log.Printf("Copied %s to %s", source, target)
+			copied++
+		}
+
+		line, err := json.Marshal(&record)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return false
+		}
+		if _, err := out.Write(append(line, '\n')); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write checkpoint: %s\n", err)
+			return false
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "%d copied, %d invalid, %d already done\n", copied, invalid, skipped)
+	return true
+}
+
+// serveOmaha runs an HTTP server that speaks enough of the Omaha update2/crx
+// protocol to serve the CRLSet CRXs in dir to Chrome's component updater and
+// to fetch. baseURL is the externally visible URL of the server, used to
+// build download links.
+func serveOmaha(dir, listenAddr, baseURL string) bool {
+	if len(baseURL) == 0 {
+		baseURL = "http://" + listenAddr
+	}
+	server := &omahaServer{dir: dir, baseURL: baseURL, crxs: make(map[string]mirroredCRX), checkers: make(map[mirroredCRX]*crlset.Checker), watchers: make(map[chan watchUpdate]bool)}
+	server.checkForUpdate()
+	go func() {
+		ticker := time.NewTicker(watchPollInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			server.checkForUpdate()
+		}
+	}()
+
+	// On SIGHUP, forget what's known about the files in dir so that every
+	// CRX is read and verified again. Requests in progress are unaffected.
+	// The flags aren't re-read, so the configuration needs a restart.
+	hup := notifyReload()
+	go func() {
+		for range hup {
+			server.mu.Lock()
+			server.crxs = make(map[string]mirroredCRX)
+			server.checkers = make(map[mirroredCRX]*crlset.Checker)
+			server.mu.Unlock()
+			if name, sequence, err := server.latest(); err != nil {
+				log.Printf("Reloading %s on SIGHUP failed: %s", dir, err)
+			} else if len(name) == 0 {
+				log.Printf("Reloaded %s on SIGHUP: no valid CRX found", dir)
+			} else {
+				log.Printf("Reloaded %s on SIGHUP: serving %s (sequence %d)", dir, name, sequence)
+			}
+			server.checkForUpdate()
+		}
+	}()
+
+	// gRPC clients connect with HTTP/2 without TLS, sending the HTTP/2
+	// preface straight away.
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	httpServer := &http.Server{Addr: listenAddr, Handler: traceHandler(server), Protocols: &protocols}
+	go func() {
+		<-interrupted.Done()
+		// Give in-flight downloads a little time to finish.
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		httpServer.Shutdown(ctx)
+	}()
+
+	log.Printf("Serving CRLSets from %s on %s", dir, listenAddr)
+	if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		fmt.Fprintf(os.Stderr, "Failed to serve: %s\n", err)
+		return false
+	}
+	return true
+}
+
+// The addresses that serveDNS answers with, in the manner of a DNSBL, for
+// names that are listed. Names that aren't listed get NXDOMAIN.
+var (
+	dnsRevokedSerial = net.IPv4(127, 0, 0, 2)
+	dnsBlockedSPKI   = net.IPv4(127, 0, 0, 3)
+	// dnsBlockedInterceptionSPKI is returned for SPKIs in
+	// BlockedInterceptionSPKIs.
+	dnsBlockedInterceptionSPKI = net.IPv4(127, 0, 0, 4)
+)
+
+const (
+	// dnsMinSPKIPrefix is the shortest SPKI hash prefix, in hex digits,
+	// that serveDNS accepts. A whole hash doesn't fit in a 63 byte label.
+	dnsMinSPKIPrefix = 16
+	// dnsTTL is the TTL, in seconds, of serveDNS's answers.
+	dnsTTL = 300
+
+	dnsTypeA   = 1
+	dnsTypeTXT = 16
+	dnsClassIN = 1
+
+	dnsNoError  = 0
+	dnsFormErr  = 1
+	dnsNXDomain = 3
+	dnsNotImp   = 4
+	dnsRefused  = 5
+)
+
+// dnsServer answers DNS queries about the CRLSet in filename for names in
+// zone: <serial hex>.<SPKI hash prefix>.<zone> for a certificate and
+// <SPKI hash prefix>.<zone> for an issuer.
+type dnsServer struct {
+	filename string
+	zone     string
+
+	mu       sync.RWMutex
+	sequence int
+	spkis    []string
+	revoked  *crlset.Checker
+	blocked  map[string]net.IP
+	// release unmaps the CRLSet that revoked refers to.
+	release func()
+}
+
+// load reads the CRLSet, replacing the one being served.
+func (s *dnsServer) load() error {
+	set, release, err := readMappedCRLSet(s.filename)
+	if err != nil {
+		return err
+	}
+	if err := applyOverrides(set); err != nil {
+		release()
+		return err
+	}
+	var spkis []string
+	for _, entry := range set.Entries {
+		spkis = append(spkis, hex.EncodeToString(entry.SPKIHash))
+	}
+	blocked := make(map[string]net.IP)
+	for _, hash := range set.Header.BlockedInterceptionSPKIHashes() {
+		blocked[hex.EncodeToString(hash[:])] = dnsBlockedInterceptionSPKI
+	}
+	for _, hash := range set.Header.BlockedSPKIHashes() {
+		blocked[hex.EncodeToString(hash[:])] = dnsBlockedSPKI
+	}
+	for spki := range blocked {
+		spkis = append(spkis, spki)
+	}
+	revoked := newCertChecker(set)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Lookups hold the read lock while they use the old set, so it can be
+	// released once the write lock is held.
+	if s.release != nil {
+		s.release()
+	}
+	s.sequence, s.spkis, s.revoked, s.blocked, s.release = set.Header.Sequence, spkis, revoked, blocked, release
+	return nil
+}
+
+// lookup returns the address that name, less the zone, is listed with, and
+// a description of why, or nil if it isn't listed. ok is false if the name
+// isn't of the right form.
+func (s *dnsServer) lookup(labels []string) (ip net.IP, reason string, ok bool) {
+	if len(labels) < 1 || len(labels) > 2 {
+		return nil, "", false
+	}
+	prefix := labels[len(labels)-1]
+	if len(prefix) < dnsMinSPKIPrefix {
+		return nil, "", false
+	}
+	if _, err := hex.DecodeString(prefix[:len(prefix)&^1]); err != nil {
+		return nil, "", false
+	}
+	var serial []byte
+	if len(labels) == 2 {
+		serialHex := labels[0]
+		if len(serialHex)%2 == 1 {
+			serialHex = "0" + serialHex
+		}
+		var err error
+		if serial, err = hex.DecodeString(serialHex); err != nil {
+			return nil, "", false
+		}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, spki := range s.spkis {
+		if !strings.HasPrefix(spki, prefix) {
+			continue
+		}
+		if blockedIP := s.blocked[spki]; blockedIP != nil {
+			return blockedIP, fmt.Sprintf("SPKI %s is blocked by CRLSet %d", spki, s.sequence), true
+		}
+		if serial != nil {
+			hash, _ := hex.DecodeString(spki)
+			if s.revoked.IsRevoked(hash, serial) {
+				return dnsRevokedSerial, fmt.Sprintf("serial %x is revoked under SPKI %s by CRLSet %d", serial, spki, s.sequence), true
+			}
+		}
+	}
+	return nil, "", true
+}
+
+// answer returns the response to the DNS query in packet, or nil if it
+// should be ignored.
+func (s *dnsServer) answer(packet []byte) []byte {
+	if len(packet) < 12 || packet[2]&0x80 != 0 {
+		return nil
+	}
+	reply := func(rcode byte, question []byte, answers ...[]byte) []byte {
+		out := append([]byte(nil), packet[:2]...)
+		// QR and AA, with RD copied from the query.
+		out = append(out, 0x84|packet[2]&0x01, rcode)
+		qdcount := 0
+		if question != nil {
+			qdcount = 1
+		}
+		out = binary.BigEndian.AppendUint16(out, uint16(qdcount))
+		out = binary.BigEndian.AppendUint16(out, uint16(len(answers)))
+		out = append(out, 0, 0, 0, 0)
+		out = append(out, question...)
+		for _, answer := range answers {
+			out = append(out, answer...)
+		}
+		return out
+	}
+	if packet[2]&0x78 != 0 {
+		return reply(dnsNotImp, nil)
+	}
+	if binary.BigEndian.Uint16(packet[4:]) != 1 {
+		return reply(dnsFormErr, nil)
+	}
+
+	var labels []string
+	offset := 12
+	for {
+		if offset >= len(packet) {
+			return reply(dnsFormErr, nil)
+		}
+		n := int(packet[offset])
+		offset++
+		if n == 0 {
+			break
+		}
+		if n > 63 || offset+n > len(packet) {
+			return reply(dnsFormErr, nil)
+		}
+		labels = append(labels, strings.ToLower(string(packet[offset:offset+n])))
+		offset += n
+	}
+	if offset+4 > len(packet) {
+		return reply(dnsFormErr, nil)
+	}
+	question := packet[12 : offset+4]
+	qtype, qclass := binary.BigEndian.Uint16(packet[offset:]), binary.BigEndian.Uint16(packet[offset+2:])
+
+	zoneLabels := strings.Split(s.zone, ".")
+	if qclass != dnsClassIN || len(labels) < len(zoneLabels) || strings.Join(labels[len(labels)-len(zoneLabels):], ".") != s.zone {
+		return reply(dnsRefused, question)
+	}
+	ip, reason, ok := s.lookup(labels[:len(labels)-len(zoneLabels)])
+	if !ok || ip == nil {
+		return reply(dnsNXDomain, question)
+	}
+
+	// The answer's name is a pointer to the one in the question.
+	rr := []byte{0xc0, 12}
+	rr = binary.BigEndian.AppendUint16(rr, qtype)
+	rr = binary.BigEndian.AppendUint16(rr, dnsClassIN)
+	rr = binary.BigEndian.AppendUint32(rr, dnsTTL)
+	switch qtype {
+	case dnsTypeA:
+		rr = binary.BigEndian.AppendUint16(rr, 4)
+		rr = append(rr, ip.To4()...)
+	case dnsTypeTXT:
+		rr = binary.BigEndian.AppendUint16(rr, uint16(len(reason)+1))
+		rr = append(rr, byte(len(reason)))
+		rr = append(rr, reason...)
+	default:
+		// The name exists but has no records of this type.
+		return reply(dnsNoError, question)
+	}
+	return reply(dnsNoError, question, rr)
+}
+
+// serveDNS answers DNSBL-style queries about the CRLSet in filename over UDP,
+// so that appliances which can only make DNS lookups can check revocation.
+// The CRLSet is re-read on SIGHUP.
+func serveDNS(filename, zone, listenAddr string) bool {
+	s := &dnsServer{filename: filename, zone: strings.ToLower(strings.Trim(zone, "."))}
+	if err := s.load(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+
+	hup := notifyReload()
+	go func() {
+		for range hup {
+			if err := s.load(); err != nil {
+				log.Printf("Reloading %s on SIGHUP failed: %s", filename, err)
+			} else {
+				log.Printf("Reloaded %s on SIGHUP: serving sequence %d", filename, s.sequence)
+			}
+		}
+	}()
+
+	conn, err := net.ListenPacket("udp", listenAddr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to listen: %s\n", err)
+		return false
+	}
+	go func() {
+		<-interrupted.Done()
+		conn.Close()
+	}()
+
+	log.Printf("Serving %s for %s on %s", filename, s.zone, conn.LocalAddr())
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if interrupted.Err() != nil {
+				return true
+			}
+			fmt.Fprintf(os.Stderr, "Failed to serve: %s\n", err)
+			return false
+		}
+		if out := s.answer(buf[:n]); out != nil {
+			conn.WriteTo(out, addr)
+		}
+	}
+}
+
+// isLoopbackAddress reports whether listenAddr, a host and port, only accepts
+// connections from the local machine.
+func isLoopbackAddress(listenAddr string) bool {
+	host, _, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// debugVars serves the expvar variables like expvar.Handler, except for
+// cmdline, which would disclose any secrets given as flags.
+func debugVars(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key == "cmdline" {
+			return
+		}
+		if !first {
+			fmt.Fprintf(w, ",\n")
+		}
+		first = false
+		fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+	})
+	fmt.Fprintf(w, "\n}\n")
+}
+
+// startDebugServer serves /debug/pprof and /debug/vars on listenAddr, for
+// diagnosing memory and CPU use in long-running processes. Profiles reveal a
+// lot about the process, so unless $CRLSET_DEBUG_TOKEN is set, and requests
+// must then carry it as a bearer token, listenAddr must be a loopback
+// address. The command line isn't served, since it may contain passwords.
+func startDebugServer(listenAddr string) error {
+	token := os.Getenv("CRLSET_DEBUG_TOKEN")
+	if len(token) == 0 && !isLoopbackAddress(listenAddr) {
+		return fmt.Errorf("--debug-listen %s isn't a loopback address; set CRLSET_DEBUG_TOKEN to serve debug endpoints on other addresses", listenAddr)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/vars", debugVars)
+
+	var handler http.Handler = mux
+	if len(token) > 0 {
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			mux.ServeHTTP(w, r)
+		})
+	}
+
+	log.Printf("Serving debug endpoints on %s", listenAddr)
+	go func() {
+		if err := http.ListenAndServe(listenAddr, handler); err != nil {
+			log.Printf("Failed to serve debug endpoints: %s", err)
+		}
+	}()
+	return nil
+}
+
+// browser holds the state of an interactive browse session.
+type browser struct {
+	set      *crlset.CRLSet
+	names    map[[crlset.SPKIHashLen]byte]string
+	pageSize int
+	// section is the index of the SPKI section whose serials are being
+	// shown, or -1 when the list of sections is shown.
+	section int
+	page    int
+}
+
+// name returns the CA name for hash, if known.
+func (b *browser) name(hash []byte) string {
+	var key [crlset.SPKIHashLen]byte
+	copy(key[:], hash)
+	return b.names[key]
+}
+
+// label returns the CA name for hash preceded by a space, or nothing if the
+// name isn't known, for appending to a line.
+func (b *browser) label(hash []byte) string {
+	if name := b.name(hash); len(name) > 0 {
+		return " " + name
+	}
+	return ""
+}
+
+// pages returns the number of pages in the current listing.
+func (b *browser) pages() int {
+	n := len(b.set.Entries)
+	if b.section >= 0 {
+		n = len(b.set.Entries[b.section].Serials)
+	}
+	if n == 0 {
+		return 1
+	}
+	return (n + b.pageSize - 1) / b.pageSize
+}
+
+// show prints the current page of the current listing.
+func (b *browser) show() {
+	start := b.page * b.pageSize
+	if b.section < 0 {
+		end := start + b.pageSize
+		if end > len(b.set.Entries) {
+			end = len(b.set.Entries)
+		}
+		for i := start; i < end; i++ {
+			entry := b.set.Entries[i]
+			fmt.Printf("[%d] %x %d serials%s\n", i, entry.SPKIHash, len(entry.Serials), b.label(entry.SPKIHash))
+		}
+	} else {
+		entry := b.set.Entries[b.section]
+		fmt.Printf("Section %d: %x%s\n", b.section, entry.SPKIHash, b.label(entry.SPKIHash))
+		end := start + b.pageSize
+		if end > len(entry.Serials) {
+			end = len(entry.Serials)
+		}
+		for _, serial := range entry.Serials[start:end] {
+			fmt.Printf("  %x\n", serial)
+		}
+	}
+	fmt.Printf("Page %d of %d\n", b.page+1, b.pages())
+}
+
+// showHeader prints the header, with CA names where known.
+func (b *browser) showHeader() {
+	h := &b.set.Header
+	fmt.Printf("Sequence: %d\n", h.Sequence)
+	fmt.Printf("Parents: %d\n", h.NumParents)
+	if h.NotAfter != 0 {
+		fmt.Printf("NotAfter: %s\n", time.Unix(h.NotAfter, 0).UTC().Format(time.RFC3339))
+	}
+	fmt.Printf("SPKI sections: %d, Serials: %d\n", len(b.set.Entries), countSerials(b.set.Entries))
+	for _, list := range []struct {
+		name   string
+		hashes [][crlset.SPKIHashLen]byte
+	}{
+		{"BlockedSPKIs", h.BlockedSPKIHashes()},
+		{"KnownInterceptionSPKIs", h.KnownInterceptionSPKIHashes()},
+		{"BlockedInterceptionSPKIs", h.BlockedInterceptionSPKIHashes()},
+	} {
+		fmt.Printf("%s: %d\n", list.name, len(list.hashes))
+		for _, hash := range list.hashes {
+			fmt.Printf("  %x%s\n", hash, b.label(hash[:]))
+		}
+	}
+}
+
+// search prints the SPKI sections whose hash starts with, or whose CA name
+// contains, query, and the serials that start with query.
+func (b *browser) search(query string) {
+	query = strings.ToLower(query)
+	found := 0
+	for i, entry := range b.set.Entries {
+		name := b.name(entry.SPKIHash)
+		if strings.HasPrefix(hex.EncodeToString(entry.SPKIHash), query) || (len(name) > 0 && strings.Contains(strings.ToLower(name), query)) {
+			fmt.Printf("[%d] %x %d serials%s\n", i, entry.SPKIHash, len(entry.Serials), b.label(entry.SPKIHash))
+			found++
+		}
+		for _, serial := range entry.Serials {
+			if strings.HasPrefix(hex.EncodeToString(serial), query) {
+				fmt.Printf("[%d] %x serial %x\n", i, entry.SPKIHash, serial)
+				found++
+			}
+		}
+	}
+	fmt.Printf("%d matches\n", found)
+}
+
+const browseHelp = `Commands:
+  l            list the SPKI sections
+  o <n>        open section n to page through its serials
+  n, p         next or previous page
+  g <page>     go to a page
+  h            show the header
+  / <text>     search SPKI hashes, serials and CA names
+  ?            show this help
+  q            quit
+`
+
+// browse lets the user interactively page through and search the CRLSet in
+// filename. namesFilename optionally maps SPKI hashes to CA names, as for
+// report.
+func browse(filename, namesFilename string, pageSize int) bool {
+	set, err := readCRLSet(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+	if pageSize < 1 {
+		fmt.Fprintf(os.Stderr, "--page-size must be positive\n")
+		return false
+	}
+	b := &browser{set: set, pageSize: pageSize, section: -1}
+	if len(namesFilename) > 0 {
+		if b.names, err = readSPKILabels(namesFilename); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read names: %s\n", err)
+			return false
+		}
+	}
+
+	b.showHeader()
+	fmt.Printf("\n%s\n", browseHelp)
+	b.show()
+
+	input := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Printf("> ")
+		if !input.Scan() {
+			fmt.Printf("\n")
+			return input.Err() == nil
+		}
+		fields := strings.Fields(input.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		arg := strings.TrimSpace(strings.TrimPrefix(input.Text(), fields[0]))
+		switch fields[0] {
+		case "q":
+			return true
+		case "?":
+			fmt.Print(browseHelp)
+		case "h":
+			b.showHeader()
+		case "l":
+			b.section, b.page = -1, 0
+			b.show()
+		case "o":
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 0 || n >= len(set.Entries) {
+				fmt.Printf("No section %q\n", arg)
+				continue
+			}
+			b.section, b.page = n, 0
+			b.show()
+		case "n", "p":
+			if fields[0] == "n" && b.page+1 < b.pages() {
+				b.page++
+			} else if fields[0] == "p" && b.page > 0 {
+				b.page--
+			}
+			b.show()
+		case "g":
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 1 || n > b.pages() {
+				fmt.Printf("No page %q\n", arg)
+				continue
+			}
+			b.page = n - 1
+			b.show()
+		case "/":
+			if len(arg) == 0 {
+				fmt.Printf("Search for what?\n")
+				continue
+			}
+			b.search(arg)
+		default:
+			fmt.Printf("Unknown command %q; type ? for help\n", fields[0])
+		}
+	}
+}
+
+// atomFeed, atomAuthor, atomEntry and atomLink are used to write Atom feeds of CRLSet
+// releases.
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Link    []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	ID      string     `xml:"id"`
+	Title   string     `xml:"title"`
+	Updated string     `xml:"updated"`
+	Summary string     `xml:"summary"`
+	Link    []atomLink `xml:"link"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+// feed writes an Atom feed with an entry for each CRLSet in dir, newest
+// first, summarising how it differs from the previous one. Entries are dated
+// by the modification times of the files. If baseURL is given, each entry
+// links to the file under that URL.
+func feed(dir, baseURL, outputFilename string) bool {
+	archived, err := readCRLSetDir(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read directory: %s\n", err)
+		return false
+	}
+	added, removed, err := archivedChanges(archived)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+
+	const idPrefix = "tag:crlset-tools,2012:"
+	f := atomFeed{
+		ID:      idPrefix + "feed",
+		Title:   "CRLSet releases",
+		Updated: time.Unix(0, 0).UTC().Format(time.RFC3339),
+		// Atom requires an author for a feed whose entries don't have
+		// their own.
+		Author: atomAuthor{Name: "crlset-tools"},
+	}
+	if len(baseURL) > 0 {
+		f.Link = []atomLink{{Href: baseURL}}
+	}
+
+	for i, a := range archived {
+		info, err := os.Stat(a.filename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return false
+		}
+		updated := info.ModTime().UTC().Format(time.RFC3339)
+		if updated > f.Updated {
+			f.Updated = updated
+		}
+
+		summary := fmt.Sprintf("%d serials under %d SPKIs, %d blocked SPKIs.", a.serials, a.spkis, len(a.header.BlockedSPKIHashes()))
+		if i > 0 {
+			summary += fmt.Sprintf(" Since sequence %d: %d serials added, %d removed.", archived[i-1].header.Sequence, added[i], removed[i])
+		}
+
+		entry := atomEntry{
+			ID:      fmt.Sprintf("%ssequence/%d", idPrefix, a.header.Sequence),
+			Title:   fmt.Sprintf("CRLSet sequence %d", a.header.Sequence),
+			Updated: updated,
+			Summary: summary,
+		}
+		if len(baseURL) > 0 {
+			entry.Link = []atomLink{{Href: strings.TrimSuffix(baseURL, "/") + "/" + url.PathEscape(filepath.Base(a.filename))}}
+		}
+		f.Entries = append([]atomEntry{entry}, f.Entries...)
+	}
+
+	out, err := xml.MarshalIndent(f, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to serialize feed: %s\n", err)
+		return false
+	}
+	out = append([]byte(xml.Header), append(out, '\n')...)
+
+	if err := writeOutput(outputFilename, out); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write feed: %s\n", err)
+		return false
+	}
+
+	return true
+}
+
+// reportSection describes one SPKI section in the HTML report.
+type reportSection struct {
+	SPKIHash string
+	Name     string
+	Serials  int
+}
+
+// reportDiff describes the changes under one SPKI in the HTML report.
+type reportDiff struct {
+	SPKIHash string
+	Name     string
+	Serials  []string
+}
+
+// reportData is the input to reportTemplate.
+type reportData struct {
+	Generated                string
+	Sequence                 int
+	NumParents               int
+	NotAfter                 string
+	BlockedSPKIs             []reportSection
+	KnownInterceptionSPKIs   []reportSection
+	BlockedInterceptionSPKIs []reportSection
+	Sections                 []reportSection
+	TotalSerials             int
+	MeanSerials              string
+	HasPrevious              bool
+	PreviousSequence         int
+	Added                    []reportDiff
+	Removed                  []reportDiff
+	AddedCount               int
+	RemovedCount             int
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`{{define "spkis"}}<table>
+<tr><th>SPKI hash</th><th>Name</th></tr>
+{{range .}}<tr><td><code>{{.SPKIHash}}</code></td><td>{{.Name}}</td></tr>
+{{else}}<tr><td colspan="2">None</td></tr>
+{{end}}</table>
+{{end}}{{define "diff"}}{{range .}}<details>
+<summary><code>{{.SPKIHash}}</code> {{.Name}} ({{len .Serials}})</summary>
+<ul>{{range .Serials}}<li><code>{{.}}</code></li>{{end}}</ul>
+</details>
+{{else}}<p>None.</p>
+{{end}}{{end}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>CRLSet {{.Sequence}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; }
+td.num { text-align: right; }
+code { font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>CRLSet {{.Sequence}}</h1>
+<p>Generated {{.Generated}}.</p>
+
+<h2>Header</h2>
+<table>
+<tr><th>Sequence</th><td>{{.Sequence}}</td></tr>
+<tr><th>Parents</th><td>{{.NumParents}}</td></tr>
+<tr><th>Not after</th><td>{{.NotAfter}}</td></tr>
+</table>
+<h3>Blocked SPKIs</h3>
+{{template "spkis" .BlockedSPKIs}}
+<h3>Known interception SPKIs</h3>
+{{template "spkis" .KnownInterceptionSPKIs}}
+<h3>Blocked interception SPKIs</h3>
+{{template "spkis" .BlockedInterceptionSPKIs}}
+
+<h2>Serials</h2>
+<p>{{.TotalSerials}} serials in {{len .Sections}} sections ({{.MeanSerials}} per section on average).</p>
+<table>
+<tr><th>SPKI hash</th><th>Name</th><th>Serials</th></tr>
+{{range .Sections}}<tr><td><code>{{.SPKIHash}}</code></td><td>{{.Name}}</td><td class="num">{{.Serials}}</td></tr>
+{{end}}</table>
+{{if .HasPrevious}}
+<h2>Changes since {{.PreviousSequence}}</h2>
+<p>{{.AddedCount}} serials added and {{.RemovedCount}} removed.</p>
+<h3>Added</h3>
+{{template "diff" .Added}}
+<h3>Removed</h3>
+{{template "diff" .Removed}}
+{{end}}
+</body>
+</html>
+`))
+
+// report writes a standalone HTML report describing the CRLSet in filename
+// and, if previousFilename is given, how it differs from that set. SPKI
+// hashes are named using namesFilename, if given.
+func report(filename, previousFilename, namesFilename, outputFilename string) bool {
+	set, err := readCRLSet(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+
+	names := make(map[[crlset.SPKIHashLen]byte]string)
+	if len(namesFilename) > 0 {
+		if names, err = readSPKILabels(namesFilename); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read names: %s\n", err)
+			return false
+		}
+	}
+	nameOf := func(spki []byte) string {
+		var hash [crlset.SPKIHashLen]byte
+		copy(hash[:], spki)
+		return names[hash]
+	}
+	headerSPKIs := func(hashes [][crlset.SPKIHashLen]byte) []reportSection {
+		var sections []reportSection
+		for _, hash := range hashes {
+			sections = append(sections, reportSection{SPKIHash: hex.EncodeToString(hash[:]), Name: names[hash]})
+		}
+		return sections
+	}
+
+	data := reportData{
+		Generated:                time.Now().UTC().Format(time.RFC1123),
+		Sequence:                 set.Header.Sequence,
+		NumParents:               set.Header.NumParents,
+		NotAfter:                 "unspecified",
+		BlockedSPKIs:             headerSPKIs(set.Header.BlockedSPKIHashes()),
+		KnownInterceptionSPKIs:   headerSPKIs(set.Header.KnownInterceptionSPKIHashes()),
+		BlockedInterceptionSPKIs: headerSPKIs(set.Header.BlockedInterceptionSPKIHashes()),
+	}
+	if set.Header.NotAfter != 0 {
+		data.NotAfter = time.Unix(set.Header.NotAfter, 0).UTC().Format(time.RFC1123)
+	}
+
+	for _, entry := range set.Entries {
+		data.Sections = append(data.Sections, reportSection{
+			SPKIHash: hex.EncodeToString(entry.SPKIHash),
+			Name:     nameOf(entry.SPKIHash),
+			Serials:  len(entry.Serials),
+		})
+		data.TotalSerials += len(entry.Serials)
+	}
+	sort.SliceStable(data.Sections, func(i, j int) bool {
+		return data.Sections[i].Serials > data.Sections[j].Serials
+	})
+	data.MeanSerials = "0"
+	if len(set.Entries) > 0 {
+		data.MeanSerials = fmt.Sprintf("%.1f", float64(data.TotalSerials)/float64(len(set.Entries)))
+	}
+
+	if len(previousFilename) > 0 {
+		previous, err := readCRLSet(previousFilename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return false
+		}
+		data.HasPrevious = true
+		data.PreviousSequence = previous.Header.Sequence
+
+		toDiffs := func(entries []crlset.Entry) (diffs []reportDiff, count int) {
+			for _, entry := range entries {
+				diff := reportDiff{SPKIHash: hex.EncodeToString(entry.SPKIHash), Name: nameOf(entry.SPKIHash)}
+				for _, serial := range entry.Serials {
+					diff.Serials = append(diff.Serials, hex.EncodeToString(serial))
+				}
+				diffs = append(diffs, diff)
+				count += len(entry.Serials)
+			}
+			return diffs, count
+		}
+		added, removed := diffCRLSets(previous, set)
+		data.Added, data.AddedCount = toDiffs(added)
+		data.Removed, data.RemovedCount = toDiffs(removed)
+	}
+
+	var out bytes.Buffer
+	if err := reportTemplate.Execute(&out, data); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to generate report: %s\n", err)
+		return false
+	}
+
+	if err := writeOutput(outputFilename, out.Bytes()); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write report: %s\n", err)
+		return false
+	}
+
+	return true
+}
+
+// ctSearchURL is the crt.sh instance used to find certificates by serial
+// number.
+var ctSearchURL = "https://crt.sh/"
+
+// ctLogEntry is an element of crt.sh's JSON search results.
+type ctLogEntry struct {
+	ID int64 `json:"id"`
+}
+
+const (
+	// ctQueryInterval is the least time between queries to crt.sh, which
+	// throttles clients that query it faster.
+	ctQueryInterval = time.Second
+	// ctMaxAttempts is how many times a query that crt.sh throttles is
+	// tried before giving up.
+	ctMaxAttempts = 5
+)
+
+// ctLastQuery is when ctGet last queried crt.sh.
+var ctLastQuery time.Time
+
+// ctGet fetches the crt.sh page with the given query, waiting at least
+// ctQueryInterval since the previous query. If crt.sh says it's overloaded
+// or that there have been too many requests, the query is tried again after
+// any Retry-After delay, or an exponentially increasing one.
+func ctGet(query url.Values) ([]byte, error) {
+	delay := ctQueryInterval
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-time.After(time.Until(ctLastQuery.Add(delay))):
+		case <-interrupted.Done():
+			return nil, interrupted.Err()
+		}
+		ctLastQuery = time.Now()
+
+		resp, err := httpGet(ctSearchURL + "?" + query.Encode())
+		if err != nil {
+			return nil, err
+		}
+		if (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) && attempt < ctMaxAttempts {
+			resp.Body.Close()
+			delay *= 2
+			if retryAfter := retryAfterDelay(resp); retryAfter > delay {
+				delay = retryAfter
+			}
+			fmt.Fprintf(os.Stderr, "crt.sh returned %q; trying again in %s\n", resp.Status, delay)
+			continue
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected HTTP status %q", resp.Status)
+		}
+		return ioutil.ReadAll(resp.Body)
+	}
+}
+
+// isPrecertificate reports whether cert contains the CT poison extension.
+func isPrecertificate(cert *x509.Certificate) bool {
+	for _, ext := range cert.Extensions {
+		if ext.Id.String() == "1.3.6.1.4.1.11129.2.4.3" {
+			return true
+		}
+	}
+	return false
+}
+
+// findCertificates searches CT, via crt.sh, for certificates signed by
+// issuer with the given serial number. Precertificates are only returned if
+// the corresponding final certificate wasn't logged.
+func findCertificates(issuer *x509.Certificate, serial []byte) ([]*x509.Certificate, error) {
+	body, err := ctGet(url.Values{"serial": {hex.EncodeToString(serial)}, "output": {"json"}})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to search CT for serial %x: %s", serial, err)
+	}
+	var entries []ctLogEntry
+	if err := json.Unmarshal(body, &entries); err != nil {
+		return nil, fmt.Errorf("Failed to parse CT search results: %s", err)
+	}
+
+	serialNumber := new(big.Int).SetBytes(serial)
+	var certs, precerts []*x509.Certificate
+	for _, entry := range entries {
+		body, err := ctGet(url.Values{"d": {strconv.FormatInt(entry.ID, 10)}})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to download certificate %d from CT: %s", entry.ID, err)
+		}
+		if block, _ := pem.Decode(body); block != nil {
+			body = block.Bytes
+		}
+		cert, err := x509.ParseCertificate(body)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping certificate %d: %s\n", entry.ID, err)
+			continue
+		}
+		if cert.SerialNumber.Cmp(serialNumber) != 0 || cert.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+		if isPrecertificate(cert) {
+			precerts = append(precerts, cert)
+		} else {
+			certs = append(certs, cert)
+		}
+	}
+
+	if len(certs) == 0 {
+		return precerts, nil
+	}
+	return certs, nil
+}
+
+// issuerEntry returns the serials in set that are revoked under issuer.
+func issuerEntry(set *crlset.CRLSet, issuer *x509.Certificate) crlset.Entry {
+	hash := crlset.SPKIHash(issuer)
+	result := crlset.Entry{SPKIHash: hash}
+	for _, entry := range set.Entries {
+		if bytes.Equal(entry.SPKIHash, hash) {
+			result.Serials = append(result.Serials, entry.Serials...)
+		}
+	}
+	return result
+}
+
+// ctCertificates writes a PEM bundle of the certificates, found in CT, that
+// are revoked under the issuer certificate in issuerFilename.
+func ctCertificates(filename, issuerFilename, outputFilename string) bool {
+	set, err := readCRLSet(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+	issuer, err := readCertificate(issuerFilename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+
+	entry := issuerEntry(set, issuer)
+	if len(entry.Serials) == 0 {
+		fmt.Fprintf(os.Stderr, "No serials are revoked under SPKI %x\n", entry.SPKIHash)
+		return false
+	}
+
+	var out bytes.Buffer
+	for _, serial := range entry.Serials {
+		certs, err := findCertificates(issuer, serial)
+		if interrupted.Err() != nil {
+			fmt.Fprintf(os.Stderr, "Interrupted; writing the certificates found so far\n")
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return false
+		}
+		if len(certs) == 0 {
+			fmt.Fprintf(os.Stderr, "No certificate found in CT for serial %x\n", serial)
+		}
+		for _, cert := range certs {
+			pem.Encode(&out, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		}
+	}
+
+	if err := writeOutput(outputFilename, out.Bytes()); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write certificates: %s\n", err)
+		return false
+	}
+
+	return true
+}
+
+// activeRevocations prints the certificates, found in CT, that are revoked
+// under any of the issuer certificates in issuerFilenames and haven't yet
+// expired. These are the revocations that currently have an effect.
+func activeRevocations(filename string, issuerFilenames []string) bool {
+	set, err := readCRLSet(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+
+	now := time.Now()
+	for _, issuerFilename := range issuerFilenames {
+		issuer, err := readCertificate(issuerFilename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return false
+		}
+
+		entry := issuerEntry(set, issuer)
+		if len(entry.Serials) == 0 {
+			fmt.Fprintf(os.Stderr, "Warning: no serials are revoked under %s\n", issuerFilename)
+			continue
+		}
+
+		for _, serial := range entry.Serials {
+			certs, err := findCertificates(issuer, serial)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				return false
+			}
+			if len(certs) == 0 {
+				fmt.Fprintf(os.Stderr, "No certificate found in CT for serial %x under %x\n", serial, entry.SPKIHash)
+			}
+			for _, cert := range certs {
+				if now.After(cert.NotAfter) {
+					continue
+				}
+				fmt.Printf("%x %x %s %s\n", entry.SPKIHash, serial, cert.NotAfter.UTC().Format(time.RFC3339), cert.Subject)
+			}
+		}
+	}
+
+	return true
+}
+
+// parseCertificates returns the certificates in data, which may contain any
+// number of PEM certificates or a single DER certificate. Anything else yields
+// no certificates.
+func parseCertificates(data []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		if cert, err := x509.ParseCertificate(data); err == nil {
+			certs = append(certs, cert)
+		}
+		return certs
+	}
+
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+	return certs
+}
+
+// serialFormat selects how serials are printed by dump and in reports on
+// certificates: "hex", as they're stored in CRLSets, or "decimal", as many
+// inventory databases and CA interfaces show them.
+var serialFormat = "hex"
+
+// addSerialFormatFlag adds --serial-format, which sets serialFormat, to fs.
+func addSerialFormatFlag(fs *flag.FlagSet) {
+	fs.Func("serial-format", "how serials are printed: hex or decimal", func(value string) error {
+		if value != "hex" && value != "decimal" {
+			return fmt.Errorf("unknown serial format %q", value)
+		}
+		serialFormat = value
+		return nil
+	})
+}
+
+// serialInt returns the value of serial. Serials in CRLSets are unsigned, as
+// Chrome strips the padding byte that DER puts before a set high bit.
+func serialInt(serial []byte) *big.Int {
+	return new(big.Int).SetBytes(serial)
+}
+
+// formatSerial returns serial in serialFormat.
+func formatSerial(serial []byte) string {
+	if serialFormat == "decimal" {
+		return serialInt(serial).String()
+	}
+	return hex.EncodeToString(serial)
+}
+
+// formatCertSerial returns a certificate's serial in serialFormat, with a
+// minus sign if it's negative.
+func formatCertSerial(serial *big.Int) string {
+	if serial.Sign() < 0 {
+		return "-" + formatSerial(crlset.SerialBytes(new(big.Int).Neg(serial)))
+	}
+	return formatSerial(crlset.SerialBytes(serial))
+}
+
+// serialMatch is how serials are compared, as set by --serial-match.
+var serialMatch = crlset.SerialMatchChrome
+
+// addSerialMatchFlag adds --serial-match, which sets serialMatch, to fs.
+func addSerialMatchFlag(fs *flag.FlagSet) {
+	fs.Func("serial-match", "how serials are compared: chrome (leading zero bytes stripped from the serial being checked, as Chrome does) or unsigned (also stripped from the CRLSet's serials)", func(value string) error {
+		switch value {
+		case "chrome":
+			serialMatch = crlset.SerialMatchChrome
+		case "unsigned":
+			serialMatch = crlset.SerialMatchUnsigned
+		default:
+			return fmt.Errorf("unknown serial matching %q", value)
+		}
+		return nil
+	})
+}
+
+// newCertChecker returns a checker for set that applies the interception
+// policies and formats serials with --serial-format.
+func newCertChecker(set *crlset.CRLSet) *crlset.Checker {
+	s := startSpan("index.build")
+	defer s.end(nil)
+	s.set("index.spkis", len(set.Entries))
+
+	c := crlset.NewChecker(set, serialMatch)
+	c.KnownInterception, c.BlockedInterception = knownInterceptionPolicy, blockedInterceptionPolicy
+	c.FormatSerial = formatSerial
+	return c
+}
+
+// knownInterceptionPolicy and blockedInterceptionPolicy say how certificates
+// whose SPKIs are in KnownInterceptionSPKIs and BlockedInterceptionSPKIs are
+// treated: "ignore", "warn" or "fail". The defaults match Chrome, but a
+// deployment behind a sanctioned TLS-inspecting proxy may want to ignore the
+// proxy's key, while one that should never see interception may want any
+// sign of it to fail.
+var (
+	knownInterceptionPolicy   = "warn"
+	blockedInterceptionPolicy = "fail"
+)
+
+// addInterceptionPolicyFlags adds --known-interception and
+// --blocked-interception, which set the interception policies, to fs.
+func addInterceptionPolicyFlags(fs *flag.FlagSet) {
+	for _, f := range []struct {
+		name   string
+		policy *string
+	}{
+		{"known-interception", &knownInterceptionPolicy},
+		{"blocked-interception", &blockedInterceptionPolicy},
+	} {
+		policy := f.policy
+		fs.Func(f.name, fmt.Sprintf("how to treat a certificate with a %s SPKI: ignore, warn or fail (default %s)", strings.Replace(f.name, "-", " ", 1), *policy), func(value string) error {
+			if value != "ignore" && value != "warn" && value != "fail" {
+				return fmt.Errorf("unknown interception policy %q", value)
+			}
+			*policy = value
+			return nil
+		})
+	}
+}
+
+// problemMessages returns the messages of problems joined together, or "ok"
+// if there are none.
+func problemMessages(problems []crlset.Problem) string {
+	if len(problems) == 0 {
+		return "ok"
+	}
+	var messages []string
+	for _, problem := range problems {
+		messages = append(messages, problem.Message)
+	}
+	return strings.Join(messages, "; ")
+}
+
+// scannedCertificate is a certificate found by scanDir.
+type scannedCertificate struct {
+	filename string
+	cert     *x509.Certificate
+}
+
+// scanFormat is the output format of the scan commands: "text" or "sarif".
+var scanFormat = "text"
+
+// scanIntermediates, if set, is a file of extra certificates that the scan
+// commands use as possible issuers but don't report on, for when the scanned
+// certificates are missing intermediates.
+var scanIntermediates string
+
+// scanAuditLog, if set, is where the scan commands record every check, as
+// evidence that revocation checking happened: a file to append JSON lines to,
+// "syslog" for the local syslog daemon, or syslog://<host:port> for a remote
+// one over UDP.
+var scanAuditLog string
+
+// blocklistFilename, if set, is a file of extra entries that the commands
+// giving verdicts treat as if they were in the CRLSet, in the format read by
+// readEntryList.
+var blocklistFilename string
+
+// allowlistFilename, if set, is a file of CRLSet entries that the commands
+// giving verdicts ignore, each with a justification, in the format read by
+// readAllowlist.
+var allowlistFilename string
+
+// addOverrideFlags adds the --blocklist and --allowlist flags to fs.
+func addOverrideFlags(fs *flag.FlagSet) {
+	fs.StringVar(&blocklistFilename, "blocklist", "", "a file of extra SPKI hashes and <SPKI hash>:<serial> entries to treat as blocked")
+	fs.StringVar(&allowlistFilename, "allowlist", "", "a file of entries to ignore, each followed by a justification")
+}
+
+// allowedEntry is a CRLSet entry that's deliberately ignored, along with the
+// reason why.
+type allowedEntry struct {
+	entry         watchEntry
+	justification string
+}
+
+// readAllowlist reads a file of CRLSet entries to ignore. Each line contains
+// an entry in the format read by readEntryList followed by whitespace and a
+// justification, which is required. Blank lines and lines starting with '#'
+// are ignored.
+func readAllowlist(filename string) ([]allowedEntry, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var allowed []allowedEntry
+	for i, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: missing justification", filename, i+1)
+		}
+		var entries watchList
+		if err := entries.Set(fields[0]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", filename, i+1, err)
+		}
+		allowed = append(allowed, allowedEntry{entries[0], strings.TrimSpace(line[len(fields[0]):])})
+	}
+	return allowed, nil
+}
+
+// readEntryList reads a file of CRLSet entries, one per line, as
+// "<SPKI hash>" or "<SPKI hash>:<hex serial>" like --watch. Blank lines and
+// lines starting with '#' are ignored.
+func readEntryList(filename string) ([]watchEntry, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries watchList
+	for i, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		if err := entries.Set(line); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", filename, i+1, err)
+		}
+	}
+	return entries, nil
+}
+
+// mergeEntries adds entries to set: an SPKI hash on its own is blocked
+// outright and a serial is revoked under its SPKI.
+func mergeEntries(set *crlset.CRLSet, entries []watchEntry) error {
+	for _, entry := range entries {
+		if err := set.Block(entry.spkiHash, entry.serial); err != nil {
+			return err
+		}
+	}
+	return set.Normalize()
+}
+
+// readCheckCRLSet reads the CRLSet in filename for the commands that give
+// verdicts, with applyOverrides.
+func readCheckCRLSet(filename string) (*crlset.CRLSet, error) {
+	set, err := readCRLSet(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyOverrides(set); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// applyOverrides adds the entries in blocklistFilename to set and then
+// removes those in allowlistFilename. Each allowlisted entry is reported,
+// with its justification, so that overrides stay visible.
+func applyOverrides(set *crlset.CRLSet) error {
+	if len(blocklistFilename) > 0 {
+		entries, err := readEntryList(blocklistFilename)
+		if err != nil {
+			return fmt.Errorf("Failed to read blocklist: %s", err)
+		}
+		if err := mergeEntries(set, entries); err != nil {
+			return fmt.Errorf("Failed to merge blocklist: %s", err)
+		}
+	}
+	if len(allowlistFilename) > 0 {
+		allowed, err := readAllowlist(allowlistFilename)
+		if err != nil {
+			return fmt.Errorf("Failed to read allowlist: %s", err)
+		}
+		for _, a := range allowed {
+			found, err := set.Unblock(a.entry.spkiHash, a.entry.serial, serialMatch)
+			if err != nil {
+				return err
+			}
+			if !found {
+				fmt.Fprintf(os.Stderr, "Warning: allowlisted %s is not in the CRLSet\n", a.entry.String())
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "Ignoring %s: %s\n", a.entry.String(), a.justification)
+		}
+	}
+	return nil
+}
+
+// auditRecord is a line of the audit log.
+type auditRecord struct {
+	Time        string `json:"time"`
+	Caller      string `json:"caller"`
+	Command     string `json:"command"`
+	Sequence    int    `json:"crlset_sequence"`
+	Source      string `json:"source"`
+	Fingerprint string `json:"sha256_fingerprint"`
+	Subject     string `json:"subject"`
+	Serial      string `json:"serial"`
+	// Verdict is "ok", "warning" if there are only problems that Chrome
+	// warns about, or "blocked".
+	Verdict   string   `json:"verdict"`
+	Rules     []string `json:"rules,omitempty"`
+	LatencyUs int64    `json:"latency_us"`
+}
+
+// syslogAuthPriv is the syslog priority of audit messages: the authpriv
+// facility at the info severity.
+const syslogAuthPriv = 10*8 + 6
+
+// syslogWriter sends each Write as a message to a syslog daemon.
+type syslogWriter struct {
+	conn     net.Conn
+	hostname string
+}
+
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	msg := fmt.Sprintf("<%d>%s %s crlset[%d]: %s", syslogAuthPriv, time.Now().Format(time.Stamp), w.hostname, os.Getpid(), bytes.TrimSuffix(p, []byte("\n")))
+	if _, err := w.conn.Write([]byte(msg)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *syslogWriter) Close() error {
+	return w.conn.Close()
+}
+
+// openAuditLog opens the destination given by scanAuditLog. Each Write to
+// the result is a complete record.
+func openAuditLog(dest string) (io.WriteCloser, error) {
+	if dest != "syslog" && !strings.HasPrefix(dest, "syslog://") {
+		return os.OpenFile(dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	}
+	hostname, _ := os.Hostname()
+	var conn net.Conn
+	var err error
+	if dest == "syslog" {
+		for _, path := range []string{"/dev/log", "/var/run/syslog", "/var/run/log"} {
+			if conn, err = net.Dial("unixgram", path); err == nil {
+				break
+			}
+		}
+	} else {
+		conn, err = dialNetwork("udp", strings.TrimPrefix(dest, "syslog://"))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to syslog: %s", err)
+	}
+	return &syslogWriter{conn: conn, hostname: hostname}, nil
+}
+
+// auditCaller identifies who ran the check, as user@host.
+func auditCaller() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	hostname, _ := os.Hostname()
+	return name + "@" + hostname
+}
+
+// writeAuditLog records the results of checking certs to scanAuditLog.
+func writeAuditLog(set *crlset.CRLSet, certs []scannedCertificate, allProblems [][]crlset.Problem, latencies []time.Duration) error {
+	w, err := openAuditLog(scanAuditLog)
+	if err != nil {
+		return err
+	}
+	caller := auditCaller()
+	for i, scanned := range certs {
+		fingerprint := sha256.Sum256(scanned.cert.Raw)
+		record := auditRecord{
+			Time:        time.Now().UTC().Format(time.RFC3339Nano),
+			Caller:      caller,
+			Command:     os.Args[1],
+			Sequence:    set.Header.Sequence,
+			Source:      scanned.filename,
+			Fingerprint: hex.EncodeToString(fingerprint[:]),
+			Subject:     scanned.cert.Subject.String(),
+			Serial:      formatCertSerial(scanned.cert.SerialNumber),
+			Verdict:     "ok",
+			LatencyUs:   latencies[i].Microseconds(),
+		}
+		for _, problem := range allProblems[i] {
+			record.Rules = append(record.Rules, problem.Rule)
+			if !problem.Warning {
+				record.Verdict = "blocked"
+			} else if record.Verdict == "ok" {
+				record.Verdict = "warning"
+			}
+		}
+		line, err := json.Marshal(&record)
+		if err != nil {
+			w.Close()
+			return err
+		}
+		if _, err := w.Write(append(line, '\n')); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// readIntermediates reads the PEM or DER certificates in filename.
+func readIntermediates(filename string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read intermediates: %s", err)
+	}
+	certs := parseCertificates(data)
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("No certificates found in %s", filename)
+	}
+	return certs, nil
+}
+
+// scanJobs is the number of goroutines that the scan commands use to parse
+// and check certificates.
+var scanJobs = runtime.NumCPU()
+
+// parallelFor calls fn for each i in [0, n) using up to scanJobs goroutines,
+// and returns once all the calls have finished.
+func parallelFor(n int, fn func(i int)) {
+	jobs := scanJobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for j := 0; j < jobs; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
+
+// sarifLog and the related structures are the subset of SARIF 2.1.0 that
+// writeSARIF emits.
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool struct {
+		Driver struct {
+			Name           string `json:"name"`
+			InformationURI string `json:"informationUri"`
+		} `json:"driver"`
+	} `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifResult struct {
+	RuleID  string `json:"ruleId"`
+	Level   string `json:"level"`
+	Message struct {
+		Text string `json:"text"`
+	} `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation struct {
+		ArtifactLocation struct {
+			URI string `json:"uri"`
+		} `json:"artifactLocation"`
+	} `json:"physicalLocation"`
+}
+
+// reportCertificates checks each certificate and reports the results in
+// scanFormat. The text format has a line for each certificate, followed by a
+// summary on stderr, while SARIF output only includes affected certificates.
+func reportCertificates(checker *crlset.Checker, certs []scannedCertificate) bool {
+	if len(scanIntermediates) > 0 {
+		intermediates, err := readIntermediates(scanIntermediates)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return false
+		}
+		for _, cert := range intermediates {
+			checker.Add(cert)
+		}
+	}
+
+	run := sarifRun{Results: []sarifResult{}}
+	run.Tool.Driver.Name = "crlset"
+	run.Tool.Driver.InformationURI = "https://github.com/robstradling/crlset-tools"
+
+	// The checker is read-only once all the certificates have been added,
+	// so checking can be spread across goroutines.
+	allProblems := make([][]crlset.Problem, len(certs))
+	latencies := make([]time.Duration, len(certs))
+	parallelFor(len(certs), func(i int) {
+		start := time.Now()
+		allProblems[i] = checker.Check(certs[i].cert)
+		latencies[i] = time.Since(start)
+	})
+	if len(scanAuditLog) > 0 {
+		if err := writeAuditLog(checker.CRLSet(), certs, allProblems, latencies); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write audit log: %s\n", err)
+			return false
+		}
+	}
+
+	affected := 0
+	for i, scanned := range certs {
+		problems := allProblems[i]
+		if len(problems) > 0 {
+			affected++
+		}
+		if scanFormat == "text" {
+			fmt.Printf("%s: %s: %s\n", scanned.filename, scanned.cert.Subject, problemMessages(problems))
+			continue
+		}
+		for _, problem := range problems {
+			result := sarifResult{RuleID: problem.Rule, Level: "error"}
+			if problem.Warning {
+				result.Level = "warning"
+			}
+			result.Message.Text = fmt.Sprintf("%s: %s", scanned.cert.Subject, problem.Message)
+			var location sarifLocation
+			location.PhysicalLocation.ArtifactLocation.URI = filepath.ToSlash(scanned.filename)
+			result.Locations = []sarifLocation{location}
+			run.Results = append(run.Results, result)
+		}
+	}
+
+	switch scanFormat {
+	case "text":
+	case "sarif":
+		out, err := json.MarshalIndent(&sarifLog{
+			Version: "2.1.0",
+			Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+			Runs:    []sarifRun{run},
+		}, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to encode SARIF: %s\n", err)
+			return false
+		}
+		fmt.Printf("%s\n", out)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown output format %q\n", scanFormat)
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "%d certificates checked, %d affected\n", len(certs), affected)
+	return true
+}
+
+// scanDir checks every certificate in the files in dir, and its
+// subdirectories if recursive is set, against the CRLSet in filename.
+func scanDir(filename, dir string, recursive bool) bool {
+	set, err := readCheckCRLSet(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+
+	var paths []string
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if interrupted.Err() != nil {
+			return filepath.SkipAll
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping %s: %s\n", path, err)
+			return nil
+		}
+		if info.IsDir() {
+			if path != dir && !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to scan %s: %s\n", dir, err)
+		return false
+	}
+
+	// Reading and parsing the files is spread across goroutines, keeping
+	// the results in walk order.
+	parsed := make([][]*x509.Certificate, len(paths))
+	readErrs := make([]error, len(paths))
+	parallelFor(len(paths), func(i int) {
+		if interrupted.Err() != nil {
+			return
+		}
+		data, err := ioutil.ReadFile(paths[i])
+		if err != nil {
+			readErrs[i] = err
+			return
+		}
+		parsed[i] = parseCertificates(data)
+	})
+	var certs []scannedCertificate
+	for i, path := range paths {
+		if readErrs[i] != nil {
+			fmt.Fprintf(os.Stderr, "Skipping %s: %s\n", path, readErrs[i])
+		}
+		for _, cert := range parsed[i] {
+			certs = append(certs, scannedCertificate{path, cert})
+		}
+	}
+	if interrupted.Err() != nil {
+		fmt.Fprintf(os.Stderr, "Interrupted; checking the %d certificates found so far\n", len(certs))
+	}
+
+	checker := newCertChecker(set)
+	for _, scanned := range certs {
+		checker.Add(scanned.cert)
+	}
+	return reportCertificates(checker, certs)
+}
+
+// k8sSecretList is the subset of a Kubernetes SecretList, as output by
+// "kubectl get secrets -o json", that scanK8s needs.
+type k8sSecretList struct {
+	Items []struct {
+		Metadata struct {
+			Namespace string `json:"namespace"`
+			Name      string `json:"name"`
+		} `json:"metadata"`
+		Type string `json:"type"`
+		// Data maps keys to base64 encoded values, which encoding/json
+		// decodes.
+		Data map[string][]byte `json:"data"`
+	} `json:"items"`
+}
+
+// scanK8s checks the certificates, and bundled chains, in the
+// kubernetes.io/tls secrets in secretsFilename against the CRLSet in
+// filename. secretsFilename contains the output of kubectl, or is "-" to read
+// it from stdin.
+func scanK8s(filename, secretsFilename string) bool {
+	set, err := readCheckCRLSet(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+
+	var secretsJSON []byte
+	if secretsFilename == "-" {
+		secretsJSON, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		secretsJSON, err = ioutil.ReadFile(secretsFilename)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read secrets: %s\n", err)
+		return false
+	}
+	var secrets k8sSecretList
+	if err := json.Unmarshal(secretsJSON, &secrets); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to parse secrets: %s\n", err)
+		return false
+	}
+
+	var certs []scannedCertificate
+	for _, secret := range secrets.Items {
+		if secret.Type != "kubernetes.io/tls" {
+			continue
+		}
+		for _, key := range []string{"tls.crt", "ca.crt"} {
+			name := fmt.Sprintf("%s/%s:%s", secret.Metadata.Namespace, secret.Metadata.Name, key)
+			for _, cert := range parseCertificates(secret.Data[key]) {
+				certs = append(certs, scannedCertificate{name, cert})
+			}
+		}
+	}
+
+	checker := newCertChecker(set)
+	for _, scanned := range certs {
+		checker.Add(scanned.cert)
+	}
+	return reportCertificates(checker, certs)
+}
+
+// readJKSUTF reads a Java modified UTF-8 string, which is prefixed by its
+// length, from r.
+func readJKSUTF(r io.Reader) (string, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return "", err
+	}
+	s := make([]byte, length)
+	if _, err := io.ReadFull(r, s); err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
+
+// readJKSBytes reads a byte string, which is prefixed by its length, from r.
+func readJKSBytes(r io.Reader) ([]byte, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length > 1<<24 {
+		return nil, errors.New("entry too long")
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// parseJKS returns the certificates in a JKS or JCEKS keystore. Certificates
+// aren't encrypted in these formats, so the password is only used, if
+// non-empty, to check the keystore's integrity.
+func parseJKS(data []byte, password string) ([]*x509.Certificate, error) {
+	if len(data) < 12+sha1.Size {
+		return nil, errors.New("keystore truncated")
+	}
+	r := bytes.NewReader(data[:len(data)-sha1.Size])
+
+	var header struct {
+		Magic, Version, Count uint32
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	if header.Version != 1 && header.Version != 2 {
+		return nil, fmt.Errorf("unsupported keystore version %d", header.Version)
+	}
+
+	var certs []*x509.Certificate
+	readCert := func() error {
+		if header.Version == 2 {
+			if _, err := readJKSUTF(r); err != nil {
+				return err
+			}
+		}
+		der, err := readJKSBytes(r)
+		if err != nil {
+			return err
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+		return nil
+	}
+
+	for i := uint32(0); i < header.Count; i++ {
+		var tag uint32
+		if err := binary.Read(r, binary.BigEndian, &tag); err != nil {
+			return nil, err
+		}
+		if _, err := readJKSUTF(r); err != nil {
+			return nil, err
+		}
+		var timestamp uint64
+		if err := binary.Read(r, binary.BigEndian, &timestamp); err != nil {
+			return nil, err
+		}
+
+		switch tag {
+		case 1:
+			// A private key, which is skipped, and its chain.
+			if _, err := readJKSBytes(r); err != nil {
+				return nil, err
+			}
+			var chainLen uint32
+			if err := binary.Read(r, binary.BigEndian, &chainLen); err != nil {
+				return nil, err
+			}
+			for j := uint32(0); j < chainLen; j++ {
+				if err := readCert(); err != nil {
+					return nil, err
+				}
+			}
+		case 2:
+			if err := readCert(); err != nil {
+				return nil, err
+			}
+		default:
+			// JCEKS secret keys are serialized Java objects, which can't
+			// be skipped without parsing them.
+			return certs, fmt.Errorf("unsupported keystore entry type %d", tag)
+		}
+	}
+
+	if len(password) > 0 {
+		h := sha1.New()
+		for _, c := range password {
+			h.Write([]byte{byte(c >> 8), byte(c)})
+		}
+		h.Write([]byte("Mighty Aphrodite"))
+		h.Write(data[:len(data)-sha1.Size])
+		if !bytes.Equal(h.Sum(nil), data[len(data)-sha1.Size:]) {
+			return nil, errors.New("keystore integrity check failed (wrong password?)")
+		}
+	}
+
+	return certs, nil
+}
+
+var (
+	oidPKCS7Data            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidPKCS7EncryptedData   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 6}
+	oidCertBag              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509CertificateBag   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidPBEWithSHAAnd3DESCBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidPBES2                = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1         = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256       = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC            = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC            = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC            = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// pkcs7ContentInfo is a PKCS#7 ContentInfo.
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type pkcs12PFX struct {
+	Version  int
+	AuthSafe pkcs7ContentInfo
+	MacData  asn1.RawValue `asn1:"optional"`
+}
+
+type pkcs12EncryptedData struct {
+	Version              int
+	EncryptedContentInfo struct {
+		ContentType      asn1.ObjectIdentifier
+		Algorithm        pkix.AlgorithmIdentifier
+		EncryptedContent []byte `asn1:"tag:0,optional"`
+	}
+}
+
+type pkcs12SafeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue `asn1:"tag:0,explicit"`
+	Attributes asn1.RawValue `asn1:"optional"`
+}
+
+type pkcs12CertBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type pkcs12PBEParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+type pkcs12PBES2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pkcs12PBKDF2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                      `asn1:"optional"`
+	PRF        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// pkcs12KDF derives n bytes of key material of the given type (1 for a key
+// or 2 for an IV) from password, using the algorithm in appendix B.2 of RFC
+// 7292 with SHA-1.
+func pkcs12KDF(password string, salt []byte, iterations int, id byte, n int) []byte {
+	const u, v = sha1.Size, 64
+
+	var bmp []byte
+	for _, c := range password {
+		bmp = append(bmp, byte(c>>8), byte(c))
+	}
+	bmp = append(bmp, 0, 0)
+
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(b)+v-1)/v))
+		for i := range out {
+			out[i] = b[i%len(b)]
+		}
+		return out
+	}
+	D := bytes.Repeat([]byte{id}, v)
+	I := append(fill(salt), fill(bmp)...)
+
+	var result []byte
+	for len(result) < n {
+		A := append(append([]byte(nil), D...), I...)
+		for i := 0; i < iterations; i++ {
+			h := sha1.Sum(A)
+			A = h[:]
+		}
+		result = append(result, A...)
+
+		B := fill(A)
+		one := new(big.Int).Add(new(big.Int).SetBytes(B), big.NewInt(1))
+		for j := 0; j < len(I); j += v {
+			block := new(big.Int).SetBytes(I[j : j+v])
+			block.Add(block, one)
+			b := block.Bytes()
+			if len(b) > v {
+				b = b[len(b)-v:]
+			}
+			copy(I[j:j+v], make([]byte, v))
+			copy(I[j+v-len(b):j+v], b)
+		}
+	}
+	return result[:n]
+}
+
+// pkcs12Decrypt decrypts data that was encrypted with the given algorithm
+// and password.
+func pkcs12Decrypt(algorithm pkix.AlgorithmIdentifier, password string, data []byte) ([]byte, error) {
+	var block cipher.Block
+	var iv []byte
+
+	switch {
+	case algorithm.Algorithm.Equal(oidPBEWithSHAAnd3DESCBC):
+		var params pkcs12PBEParams
+		if _, err := asn1.Unmarshal(algorithm.Parameters.FullBytes, &params); err != nil {
+			return nil, err
+		}
+		key := pkcs12KDF(password, params.Salt, params.Iterations, 1, 24)
+		iv = pkcs12KDF(password, params.Salt, params.Iterations, 2, des.BlockSize)
+		var err error
+		if block, err = des.NewTripleDESCipher(key); err != nil {
+			return nil, err
+		}
+	case algorithm.Algorithm.Equal(oidPBES2):
+		var params pkcs12PBES2Params
+		if _, err := asn1.Unmarshal(algorithm.Parameters.FullBytes, &params); err != nil {
+			return nil, err
+		}
+		if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+			return nil, fmt.Errorf("unsupported key derivation function %s", params.KeyDerivationFunc.Algorithm)
+		}
+		var kdfParams pkcs12PBKDF2Params
+		if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdfParams); err != nil {
+			return nil, err
+		}
+
+		var keyLen int
+		switch {
+		case params.EncryptionScheme.Algorithm.Equal(oidAES128CBC):
+			keyLen = 16
+		case params.EncryptionScheme.Algorithm.Equal(oidAES192CBC):
+			keyLen = 24
+		case params.EncryptionScheme.Algorithm.Equal(oidAES256CBC):
+			keyLen = 32
+		default:
+			return nil, fmt.Errorf("unsupported encryption scheme %s", params.EncryptionScheme.Algorithm)
+		}
+		if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+			return nil, err
+		}
+
+		var key []byte
+		var err error
+		switch prf := kdfParams.PRF.Algorithm; {
+		case len(prf) == 0 || prf.Equal(oidHMACWithSHA1):
+			key, err = pbkdf2.Key(sha1.New, password, kdfParams.Salt, kdfParams.Iterations, keyLen)
+		case prf.Equal(oidHMACWithSHA256):
+			key, err = pbkdf2.Key(sha256.New, password, kdfParams.Salt, kdfParams.Iterations, keyLen)
+		default:
+			return nil, fmt.Errorf("unsupported PBKDF2 PRF %s", prf)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if block, err = aes.NewCipher(key); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported encryption algorithm %s", algorithm.Algorithm)
+	}
+
+	if len(data) == 0 || len(data)%block.BlockSize() != 0 || len(iv) != block.BlockSize() {
+		return nil, errors.New("invalid encrypted data")
+	}
+	plaintext := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, data)
+
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > block.BlockSize() || !bytes.Equal(plaintext[len(plaintext)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, errors.New("decryption failed (wrong password?)")
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
+
+// parsePKCS12 returns the certificates in a PKCS#12 file, decrypting them
+// with password where necessary.
+func parsePKCS12(data []byte, password string) ([]*x509.Certificate, error) {
+	var pfx pkcs12PFX
+	if _, err := asn1.Unmarshal(data, &pfx); err != nil {
+		return nil, err
+	}
+	if !pfx.AuthSafe.ContentType.Equal(oidPKCS7Data) {
+		return nil, errors.New("only password integrity mode is supported")
+	}
+	var authSafeBytes []byte
+	if _, err := asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authSafeBytes); err != nil {
+		return nil, err
+	}
+	var authSafe []pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(authSafeBytes, &authSafe); err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for _, info := range authSafe {
+		var safeContents []byte
+		switch {
+		case info.ContentType.Equal(oidPKCS7Data):
+			if _, err := asn1.Unmarshal(info.Content.Bytes, &safeContents); err != nil {
+				return nil, err
+			}
+		case info.ContentType.Equal(oidPKCS7EncryptedData):
+			var encrypted pkcs12EncryptedData
+			if _, err := asn1.Unmarshal(info.Content.Bytes, &encrypted); err != nil {
+				return nil, err
+			}
+			var err error
+			content := encrypted.EncryptedContentInfo
+			if safeContents, err = pkcs12Decrypt(content.Algorithm, password, content.EncryptedContent); err != nil {
+				return nil, err
+			}
+		default:
+			continue
+		}
+
+		var bags []pkcs12SafeBag
+		if _, err := asn1.Unmarshal(safeContents, &bags); err != nil {
+			return nil, err
+		}
+		for _, bag := range bags {
+			if !bag.ID.Equal(oidCertBag) {
+				continue
+			}
+			var certBag pkcs12CertBag
+			if _, err := asn1.Unmarshal(bag.Value.Bytes, &certBag); err != nil {
+				return nil, err
+			}
+			if !certBag.ID.Equal(oidX509CertificateBag) {
+				continue
+			}
+			cert, err := x509.ParseCertificate(certBag.Data)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, cert)
+		}
+	}
+	return certs, nil
+}
+
+// scanKeystores checks the certificates in each of the JKS, JCEKS or PKCS#12
+// keystores in keystoreFilenames against the CRLSet in filename.
+func scanKeystores(filename string, keystoreFilenames []string, password string) bool {
+	set, err := readCheckCRLSet(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+
+	var certs []scannedCertificate
+	for _, keystoreFilename := range keystoreFilenames {
+		data, err := ioutil.ReadFile(keystoreFilename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read keystore: %s\n", err)
+			return false
+		}
+
+		var keystoreCerts []*x509.Certificate
+		switch {
+		case bytes.HasPrefix(data, []byte{0xfe, 0xed, 0xfe, 0xed}), bytes.HasPrefix(data, []byte{0xce, 0xce, 0xce, 0xce}):
+			keystoreCerts, err = parseJKS(data, password)
+		default:
+			keystoreCerts, err = parsePKCS12(data, password)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to parse %s: %s\n", keystoreFilename, err)
+			return false
+		}
+		for _, cert := range keystoreCerts {
+			certs = append(certs, scannedCertificate{keystoreFilename, cert})
+		}
+	}
+
+	checker := newCertChecker(set)
+	for _, scanned := range certs {
+		checker.Add(scanned.cert)
+	}
+	return reportCertificates(checker, certs)
+}
+
+// systemRootFiles and systemRootDirs are where Unix systems other than macOS
+// keep their trusted roots. This is the same list that crypto/x509 uses.
+var (
+	systemRootFiles = []string{
+		"/etc/ssl/certs/ca-certificates.crt",
+		"/etc/pki/tls/certs/ca-bundle.crt",
+		"/etc/ssl/ca-bundle.pem",
+		"/etc/pki/tls/cacert.pem",
+		"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem",
+		"/etc/ssl/cert.pem",
+		"/usr/local/etc/ssl/cert.pem",
+		"/etc/openssl/certs/ca-certificates.crt",
+	}
+	systemRootDirs = []string{
+		"/etc/ssl/certs",
+		"/etc/pki/tls/certs",
+		"/system/etc/security/cacerts",
+	}
+)
+
+// systemRoots returns the certificates in the operating system's root store.
+// x509.SystemCertPool can't enumerate its contents, so the platform's own
+// tools or files are used instead.
+func systemRoots() ([]scannedCertificate, error) {
+	var certs []scannedCertificate
+	addPEM := func(source string, data []byte) {
+		for _, cert := range parseCertificates(data) {
+			certs = append(certs, scannedCertificate{source, cert})
+		}
+	}
+
+	switch runtime.GOOS {
+	case "darwin":
+		for _, keychain := range []string{
+			"/System/Library/Keychains/SystemRootCertificates.keychain",
+			"/Library/Keychains/System.keychain",
+		} {
+			out, err := exec.Command("/usr/bin/security", "find-certificate", "-a", "-p", keychain).Output()
+			if err != nil {
+				return nil, fmt.Errorf("Failed to read %s: %s", keychain, err)
+			}
+			addPEM(keychain, out)
+		}
+	case "windows":
+		for _, store := range []string{`Cert:\LocalMachine\Root`, `Cert:\CurrentUser\Root`} {
+			out, err := exec.Command("powershell", "-NoProfile", "-Command",
+				"Get-ChildItem "+store+" | ForEach-Object { [Convert]::ToBase64String($_.RawData) }").Output()
+			if err != nil {
+				return nil, fmt.Errorf("Failed to read %s: %s", store, err)
+			}
+			for _, line := range strings.Fields(string(out)) {
+				der, err := base64.StdEncoding.DecodeString(line)
+				if err != nil {
+					continue
+				}
+				if cert, err := x509.ParseCertificate(der); err == nil {
+					certs = append(certs, scannedCertificate{store, cert})
+				}
+			}
+		}
+	default:
+		files := systemRootFiles
+		if f := os.Getenv("SSL_CERT_FILE"); len(f) > 0 {
+			files = []string{f}
+		}
+		for _, filename := range files {
+			if data, err := ioutil.ReadFile(filename); err == nil {
+				addPEM(filename, data)
+				break
+			}
+		}
+
+		dirs := systemRootDirs
+		if d := os.Getenv("SSL_CERT_DIR"); len(d) > 0 {
+			dirs = filepath.SplitList(d)
+		}
+		for _, dir := range dirs {
+			files, err := ioutil.ReadDir(dir)
+			if err != nil {
+				continue
+			}
+			for _, file := range files {
+				filename := filepath.Join(dir, file.Name())
+				// Directories of roots are often full of symlinks to
+				// each other and to the bundle, so follow them with Stat.
+				if info, err := os.Stat(filename); err != nil || !info.Mode().IsRegular() {
+					continue
+				}
+				if data, err := ioutil.ReadFile(filename); err == nil {
+					addPEM(filename, data)
+				}
+			}
+		}
+	}
+
+	// Remove duplicates, which are common when both a bundle and a
+	// directory exist.
+	var unique []scannedCertificate
+	seen := make(map[string]bool)
+	for _, scanned := range certs {
+		if !seen[string(scanned.cert.Raw)] {
+			seen[string(scanned.cert.Raw)] = true
+			unique = append(unique, scanned)
+		}
+	}
+	return unique, nil
+}
+
+// revokedExitCode is the exit status of check-serial when the serial is
+// revoked or its issuer is blocked.
+const revokedExitCode = 2
+
+// checkSerial reports whether the certificate with the hex serial serialHex,
+// issued by the key with the SPKI hash spki, is affected by the CRLSet in
+// filename. It's for when only the identifiers are known, say from a CT entry
+// or an incident report, rather than the certificate. affected is set unless
+// there are no problems other than warnings.
+func checkSerial(filename, spki, serialHex string) (affected, ok bool) {
+	hash, err := parseSPKIHash(spki)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false, false
+	}
+	serialHex = strings.NewReplacer(":", "", " ", "").Replace(serialHex)
+	if len(serialHex)%2 == 1 {
+		serialHex = "0" + serialHex
+	}
+	serial, err := hex.DecodeString(serialHex)
+	if err != nil || len(serial) == 0 {
+		fmt.Fprintf(os.Stderr, "Invalid serial %q\n", serialHex)
+		return false, false
+	}
+	// Chrome strips leading zeros from a certificate's serial before
+	// looking it up, so a serial typed with padding is checked, and
+	// reported, the same way.
+	serial = crlset.NormalizeSerial(serial)
+
+	set, err := readCheckCRLSet(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false, false
+	}
+
+	checker := newCertChecker(set)
+	var problems []crlset.Problem
+	if checker.IsRevoked(hash[:], serial) {
+		problems = append(problems, crlset.Problem{Rule: "revoked-serial", Message: fmt.Sprintf("serial %s revoked under SPKI %x", formatSerial(serial), hash)})
+	}
+	for _, problem := range checker.SPKIProblems(hash) {
+		problem.Message = fmt.Sprintf("issued by %s %x", problem.Message, hash)
+		problems = append(problems, problem)
+	}
+	fmt.Printf("%s\n", problemMessages(problems))
+
+	for _, problem := range problems {
+		if !problem.Warning {
+			return true, true
+		}
+	}
+	return false, true
+}
+
+// checkRoots reports any certificate in the system root store whose SPKI is
+// blocked, or is known to be used for TLS interception, by the CRLSet in
+// filename.
+func checkRoots(filename string) bool {
+	set, err := readCheckCRLSet(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+
+	roots, err := systemRoots()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+
+	checker := newCertChecker(set)
+	affected := 0
+	for _, root := range roots {
+		var hash [crlset.SPKIHashLen]byte
+		copy(hash[:], crlset.SPKIHash(root.cert))
+		if problems := checker.SPKIProblems(hash); len(problems) > 0 {
+			fmt.Printf("%s: %s: %s\n", root.filename, root.cert.Subject, problemMessages(problems))
+			affected++
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%d roots checked, %d affected\n", len(roots), affected)
+
+	return true
+}
+
+// interceptedExitCode is the exit status of detect-interception when the
+// chain passes through an interception key.
+const interceptedExitCode = 3
+
+// detectInterception reports whether the certificate chain in chainFilename,
+// as presented by a server, passes through a TLS interception key listed in
+// the CRLSet in filename. Middleboxes rarely send their root, so the chain is
+// completed with the certificates in rootsFilename or, if that's empty, the
+// system root store. chainFilename may be "-" to read the chain from stdin.
+func detectInterception(filename, chainFilename, rootsFilename string) (intercepted, ok bool) {
+	set, err := readCheckCRLSet(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false, false
+	}
+
+	var data []byte
+	if chainFilename == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(chainFilename)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read certificates: %s\n", err)
+		return false, false
+	}
+	chain := parseCertificates(data)
+	if len(chain) == 0 {
+		fmt.Fprintf(os.Stderr, "No certificates found in %s\n", chainFilename)
+		return false, false
+	}
+	presented := len(chain)
+
+	var roots []*x509.Certificate
+	if len(rootsFilename) > 0 {
+		if roots, err = readIntermediates(rootsFilename); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return false, false
+		}
+	} else {
+		systemCerts, err := systemRoots()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return false, false
+		}
+		for _, root := range systemCerts {
+			roots = append(roots, root.cert)
+		}
+	}
+	for i := 0; i < len(chain); i++ {
+		for _, candidate := range roots {
+			included := false
+			for _, cert := range chain {
+				if cert.Equal(candidate) {
+					included = true
+					break
+				}
+			}
+			if !included && chain[i].CheckSignatureFrom(candidate) == nil {
+				chain = append(chain, candidate)
+			}
+		}
+	}
+
+	matches := set.DetectInterception(chain)
+	for _, match := range matches {
+		list := "known"
+		if match.Blocked {
+			list = "blocked"
+		}
+		where := "presented"
+		for i, cert := range chain {
+			if cert == match.Cert && i >= presented {
+				where = "from the roots"
+			}
+		}
+		fmt.Printf("%s (%s): %s interception SPKI %x\n", match.Cert.Subject, where, list, crlset.SPKIHash(match.Cert))
+	}
+	if len(matches) > 0 {
+		fmt.Println("Intercepted: the chain passes through a TLS interception key")
+		return true, true
+	}
+	fmt.Println("Not intercepted by any key this CRLSet knows of")
+	return false, true
+}
+
+// sqliteVarint decodes a SQLite variable length integer from the start of b,
+// returning it and its length.
+func sqliteVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 9 && i < len(b); i++ {
+		if i == 8 {
+			return v<<8 | uint64(b[i]), 9
+		}
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return v, len(b)
+}
+
+// sqliteWALChecksum continues the cumulative checksum s0, s1 of a SQLite
+// write-ahead log over b, whose length is a multiple of 8.
+func sqliteWALChecksum(order binary.ByteOrder, s0, s1 uint32, b []byte) (uint32, uint32) {
+	for i := 0; i+8 <= len(b); i += 8 {
+		s0 += order.Uint32(b[i:]) + s1
+		s1 += order.Uint32(b[i+4:]) + s0
+	}
+	return s0, s1
+}
+
+// sqliteApplyWAL returns the database in db as updated by the transactions
+// committed to the write-ahead log in wal, which SQLite only copies into the
+// database file itself at a checkpoint. Frames after the last valid commit
+// are ignored, as SQLite would.
+func sqliteApplyWAL(db, wal []byte, pageSize int) []byte {
+	const walHeaderLen, frameHeaderLen = 32, 24
+	if len(wal) < walHeaderLen {
+		return db
+	}
+	var order binary.ByteOrder
+	switch binary.BigEndian.Uint32(wal) {
+	case 0x377f0682:
+		order = binary.LittleEndian
+	case 0x377f0683:
+		order = binary.BigEndian
+	default:
+		return db
+	}
+	if int(binary.BigEndian.Uint32(wal[8:])) != pageSize {
+		return db
+	}
+	s0, s1 := sqliteWALChecksum(order, 0, 0, wal[:24])
+	if s0 != binary.BigEndian.Uint32(wal[24:]) || s1 != binary.BigEndian.Uint32(wal[28:]) {
+		return db
+	}
+
+	pages := make(map[uint32][]byte)
+	committed := make(map[uint32][]byte)
+	numPages := len(db) / pageSize
+	for frame := wal[walHeaderLen:]; len(frame) >= frameHeaderLen+pageSize; frame = frame[frameHeaderLen+pageSize:] {
+		if !bytes.Equal(frame[8:16], wal[16:24]) {
+			break
+		}
+		s0, s1 = sqliteWALChecksum(order, s0, s1, frame[:8])
+		s0, s1 = sqliteWALChecksum(order, s0, s1, frame[frameHeaderLen:frameHeaderLen+pageSize])
+		if s0 != binary.BigEndian.Uint32(frame[16:]) || s1 != binary.BigEndian.Uint32(frame[20:]) {
+			break
+		}
+		pageNumber := binary.BigEndian.Uint32(frame)
+		if pageNumber == 0 {
+			break
+		}
+		pages[pageNumber] = frame[frameHeaderLen : frameHeaderLen+pageSize]
+		if commitSize := int(binary.BigEndian.Uint32(frame[4:])); commitSize > 0 {
+			for n, page := range pages {
+				committed[n] = page
+			}
+			pages = make(map[uint32][]byte)
+			numPages = commitSize
+		}
+	}
+	if len(committed) == 0 {
+		return db
+	}
+
+	out := make([]byte, numPages*pageSize)
+	copy(out, db)
+	for n, page := range committed {
+		if int(n) <= numPages {
+			copy(out[(int(n)-1)*pageSize:], page)
+		}
+	}
+	return out
+}
+
+// sqliteFreePages returns the pages on the freelist of the SQLite database
+// in db, whose contents are left over from deleted rows.
+func sqliteFreePages(db []byte, page func(int) []byte, numPages int) map[int]bool {
+	free := make(map[int]bool)
+	trunk := int(binary.BigEndian.Uint32(db[32:36]))
+	for trunk != 0 && !free[trunk] && len(free) <= numPages {
+		p := page(trunk)
+		if p == nil {
+			break
+		}
+		free[trunk] = true
+		leaves := int(binary.BigEndian.Uint32(p[4:8]))
+		for i := 0; i < leaves && 8+4*i+4 <= len(p); i++ {
+			free[int(binary.BigEndian.Uint32(p[8+4*i:]))] = true
+		}
+		trunk = int(binary.BigEndian.Uint32(p))
+	}
+	return free
+}
+
+// sqliteBlobs returns every blob stored in a row of any table in the SQLite
+// database in db, including any transactions committed to its write-ahead
+// log, wal, which may be nil. Rather than interpreting the schema, every
+// table b-tree leaf page that isn't on the freelist is examined, which is
+// enough to find the certificates that NSS stores in cert9.db.
+func sqliteBlobs(db, wal []byte) ([][]byte, error) {
+	if len(db) < 100 || !bytes.HasPrefix(db, []byte("SQLite format 3\x00")) {
+		return nil, errors.New("not a SQLite database")
+	}
+	pageSize := int(binary.BigEndian.Uint16(db[16:18]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	if pageSize < 512 {
+		return nil, errors.New("invalid SQLite page size")
+	}
+	db = sqliteApplyWAL(db, wal, pageSize)
+	usable := pageSize - int(db[20])
+	numPages := len(db) / pageSize
+
+	page := func(n int) []byte {
+		if n < 1 || n > numPages {
+			return nil
+		}
+		return db[(n-1)*pageSize : n*pageSize]
+	}
+	free := sqliteFreePages(db, page, numPages)
+
+	var blobs [][]byte
+	for n := 1; n <= numPages; n++ {
+		if free[n] {
+			continue
+		}
+		p := page(n)
+		headerOffset := 0
+		if n == 1 {
+			headerOffset = 100
+		}
+		// 0x0d marks a table b-tree leaf page, which holds the rows.
+		if p[headerOffset] != 0x0d {
+			continue
+		}
+		numCells := int(binary.BigEndian.Uint16(p[headerOffset+3:]))
+		for i := 0; i < numCells; i++ {
+			pointerOffset := headerOffset + 8 + 2*i
+			if pointerOffset+2 > usable {
+				break
+			}
+			cell := int(binary.BigEndian.Uint16(p[pointerOffset:]))
+			if cell >= usable {
+				continue
+			}
+			payloadLen, n1 := sqliteVarint(p[cell:usable])
+			_, n2 := sqliteVarint(p[cell+n1 : usable])
+			start := cell + n1 + n2
+			if payloadLen > uint64(len(db)) {
+				continue
+			}
+
+			// See "Cell Payload Overflow Pages" in the SQLite file
+			// format documentation.
+			local := int(payloadLen)
+			if maxLocal := usable - 35; local > maxLocal {
+				minLocal := (usable-12)*32/255 - 23
+				local = minLocal + (int(payloadLen)-minLocal)%(usable-4)
+				if local > maxLocal {
+					local = minLocal
+				}
+			}
+			if start+local > usable {
+				continue
+			}
+			payload := append([]byte(nil), p[start:start+local]...)
+			if local < int(payloadLen) && start+local+4 <= usable {
+				next := int(binary.BigEndian.Uint32(p[start+local:]))
+				for visited := 0; next != 0 && len(payload) < int(payloadLen) && visited < numPages; visited++ {
+					overflow := page(next)
+					if overflow == nil {
+						break
+					}
+					end := usable
+					if remaining := int(payloadLen) - len(payload); remaining < usable-4 {
+						end = 4 + remaining
+					}
+					payload = append(payload, overflow[4:end]...)
+					next = int(binary.BigEndian.Uint32(overflow))
+				}
+			}
+			if len(payload) < int(payloadLen) {
+				continue
+			}
+
+			// Decode the record, keeping the blobs.
+			headerLen, n3 := sqliteVarint(payload)
+			if headerLen > uint64(len(payload)) {
+				continue
+			}
+			data := int(headerLen)
+			for pos := n3; pos < int(headerLen); {
+				serialType, n4 := sqliteVarint(payload[pos:headerLen])
+				pos += n4
+				// Larger serial types can't fit in the payload, and
+				// would overflow size.
+				if serialType > uint64(2*len(payload)+13) {
+					break
+				}
+				var size int
+				switch {
+				case serialType >= 12:
+					size = int(serialType-12) / 2
+				case serialType == 5:
+					size = 6
+				case serialType == 6 || serialType == 7:
+					size = 8
+				case serialType >= 1 && serialType <= 4:
+					size = int(serialType)
+				}
+				if size < 0 || data+size > len(payload) {
+					break
+				}
+				if serialType >= 12 && serialType%2 == 0 {
+					blobs = append(blobs, payload[data:data+size])
+				}
+				data += size
+			}
+		}
+	}
+	return blobs, nil
+}
+
+// scanNSS checks the certificates stored in the NSS databases (cert9.db) in
+// nssFilenames, which may also name the profile directories containing them,
+// against the CRLSet in filename.
+func scanNSS(filename string, nssFilenames []string) bool {
+	set, err := readCheckCRLSet(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+
+	var certs []scannedCertificate
+	for _, nssFilename := range nssFilenames {
+		if info, err := os.Stat(nssFilename); err == nil && info.IsDir() {
+			nssFilename = filepath.Join(nssFilename, "cert9.db")
+		}
+		db, err := ioutil.ReadFile(nssFilename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read NSS database: %s\n", err)
+			return false
+		}
+		// Changes that haven't been checkpointed yet are only in the
+		// write-ahead log.
+		wal, err := ioutil.ReadFile(nssFilename + "-wal")
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Failed to read NSS database: %s\n", err)
+			return false
+		}
+		blobs, err := sqliteBlobs(db, wal)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to parse %s: %s\n", nssFilename, err)
+			return false
+		}
+
+		seen := make(map[string]bool)
+		for _, blob := range blobs {
+			// Only the CKA_VALUE attribute of certificate objects
+			// parses as a certificate.
+			cert, err := x509.ParseCertificate(blob)
+			if err != nil || seen[string(cert.Raw)] {
+				continue
+			}
+			seen[string(cert.Raw)] = true
+			certs = append(certs, scannedCertificate{nssFilename, cert})
+		}
+	}
+
+	checker := newCertChecker(set)
+	for _, scanned := range certs {
+		checker.Add(scanned.cert)
+	}
+	return reportCertificates(checker, certs)
+}
+
+// chromeRootStoreURL is where the certificates in the Chrome Root Store are
+// published. Gitiles returns the file base64 encoded.
+var chromeRootStoreURL = "https://chromium.googlesource.com/chromium/src/+/main/net/data/ssl/chrome_root_store/root_store.certs?format=TEXT"
+
+// readRootStore reads PEM certificates from location, which is either a URL
+// or a filename. Base64 encoded contents, as served by Gitiles, are decoded.
+func readRootStore(location string) ([]*x509.Certificate, error) {
+	data, err := readURLOrFile(location)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		if decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data))); err == nil {
+			data = decoded
+		}
+	}
+	certs := parseCertificates(data)
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+	return certs, nil
+}
+
+// compareRootStore reports, for each SPKI blocked by the CRLSet in filename,
+// whether a root with that SPKI is in the Chrome Root Store. Blocks of roots
+// that are still in the store are the ones that have a real-world effect.
+func compareRootStore(filename, rootStoreLocation string) bool {
+	set, err := readCRLSet(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+
+	roots, err := readRootStore(rootStoreLocation)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read Chrome Root Store: %s\n", err)
+		return false
+	}
+	inStore := make(map[[crlset.SPKIHashLen]byte]*x509.Certificate)
+	for _, root := range roots {
+		var hash [crlset.SPKIHashLen]byte
+		copy(hash[:], crlset.SPKIHash(root))
+		inStore[hash] = root
+	}
+
+	present := 0
+	blocked := set.Header.BlockedSPKIHashes()
+	for _, spki := range blocked {
+		if root, ok := inStore[spki]; ok {
+			fmt.Printf("%x  in Chrome Root Store: %s\n", spki, root.Subject)
+			present++
+		} else {
+			fmt.Printf("%x  not in Chrome Root Store\n", spki)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%d blocked SPKIs, %d in the Chrome Root Store of %d roots\n", len(blocked), present, len(roots))
+
+	return true
+}
+
+// ecosystemEntry is a revocation from another browser's revocation list,
+// normalized to the terms used by CRLSets: a serial under an issuer SPKI, or
+// a blocked SPKI if serial is nil.
+type ecosystemEntry struct {
+	spkiHash [crlset.SPKIHashLen]byte
+	serial   []byte
+}
+
+// compareEcosystem prints the revocations that appear only in the CRLSet or
+// only in the other list, named name, followed by a summary on stderr.
+func compareEcosystem(set *crlset.CRLSet, name string, entries []ecosystemEntry) {
+	var crlSetEntries []ecosystemEntry
+	for _, hash := range set.Header.BlockedSPKIHashes() {
+		crlSetEntries = append(crlSetEntries, ecosystemEntry{spkiHash: hash})
+	}
+	for _, entry := range set.Entries {
+		var hash [crlset.SPKIHashLen]byte
+		copy(hash[:], entry.SPKIHash)
+		for _, serial := range entry.Serials {
+			crlSetEntries = append(crlSetEntries, ecosystemEntry{hash, serial})
+		}
+	}
+
+	key := func(entry ecosystemEntry) string {
+		if entry.serial == nil {
+			return fmt.Sprintf("%x *", entry.spkiHash)
+		}
+		return fmt.Sprintf("%x %x", entry.spkiHash, entry.serial)
+	}
+	keys := func(entries []ecosystemEntry) map[string]bool {
+		m := make(map[string]bool)
+		for _, entry := range entries {
+			m[key(entry)] = true
+		}
+		return m
+	}
+	inCRLSet, inOther := keys(crlSetEntries), keys(entries)
+
+	both, otherOnly, crlSetOnly := 0, 0, 0
+	printed := make(map[string]bool)
+	for _, entry := range entries {
+		k := key(entry)
+		if printed[k] {
+			continue
+		}
+		printed[k] = true
+		if inCRLSet[k] {
+			both++
+		} else {
+			fmt.Printf("%s-only %s\n", name, k)
+			otherOnly++
+		}
+	}
+	for _, entry := range crlSetEntries {
+		k := key(entry)
+		if printed[k] {
+			continue
+		}
+		printed[k] = true
+		if !inOther[k] {
+			fmt.Printf("crlset-only %s\n", k)
+			crlSetOnly++
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%d in both, %d only in %s, %d only in the CRLSet\n", both, otherOnly, name, crlSetOnly)
+}
+
+// readIssuerIndex maps the subjects of the certificates in the files under
+// dir to their SPKI hashes, so that revocations identified by issuer name can
+// be normalized to issuer SPKIs.
+func readIssuerIndex(dir string) (map[string][][crlset.SPKIHashLen]byte, error) {
+	index := make(map[string][][crlset.SPKIHashLen]byte)
+	if len(dir) == 0 {
+		return index, nil
+	}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+	certs:
+		for _, cert := range parseCertificates(data) {
+			var hash [crlset.SPKIHashLen]byte
+			copy(hash[:], crlset.SPKIHash(cert))
+			for _, existing := range index[string(cert.RawSubject)] {
+				if existing == hash {
+					continue certs
+				}
+			}
+			index[string(cert.RawSubject)] = append(index[string(cert.RawSubject)], hash)
+		}
+		return nil
+	})
+	return index, err
+}
+
+// readURLOrFile returns the contents of location, which is either an HTTP(S)
+// URL or a filename.
+func readURLOrFile(location string) ([]byte, error) {
+	if !strings.HasPrefix(location, "https://") && !strings.HasPrefix(location, "http://") {
+		return ioutil.ReadFile(location)
+	}
+	resp, err := httpGet(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status %q", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// oneCRLURL is where Firefox fetches OneCRL from.
+var oneCRLURL = "https://firefox.settings.services.mozilla.com/v1/buckets/security-state/collections/onecrl/records"
+
+// oneCRLRecords is the response from the OneCRL endpoint. Each record either
+// revokes a serial under an issuer name, or blocks a subject and key.
+type oneCRLRecords struct {
+	Data []struct {
+		IssuerName   string `json:"issuerName"`
+		SerialNumber string `json:"serialNumber"`
+		PubKeyHash   string `json:"pubKeyHash"`
+	} `json:"data"`
+}
+
+// compareOneCRL compares the CRLSet in filename with OneCRL. OneCRL names
+// issuers rather than identifying their keys, so the certificates of the
+// issuers must be found in issuersDir for their entries to be compared.
+func compareOneCRL(filename, oneCRLLocation, issuersDir string) bool {
+	set, err := readCRLSet(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+
+	issuers, err := readIssuerIndex(issuersDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read issuers: %s\n", err)
+		return false
+	}
+
+	data, err := readURLOrFile(oneCRLLocation)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to fetch OneCRL: %s\n", err)
+		return false
+	}
+	var records oneCRLRecords
+	if err := json.Unmarshal(data, &records); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to parse OneCRL: %s\n", err)
+		return false
+	}
+
+	var entries []ecosystemEntry
+	unmapped := 0
+	for _, record := range records.Data {
+		if len(record.PubKeyHash) > 0 {
+			hash, err := parseSPKIHash(record.PubKeyHash)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Skipping OneCRL record: %s\n", err)
+				continue
+			}
+			entries = append(entries, ecosystemEntry{spkiHash: hash})
+			continue
+		}
+
+		issuerName, err := base64.StdEncoding.DecodeString(record.IssuerName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping OneCRL record with invalid issuer %q\n", record.IssuerName)
+			continue
+		}
+		serial, err := base64.StdEncoding.DecodeString(record.SerialNumber)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping OneCRL record with invalid serial %q\n", record.SerialNumber)
+			continue
+		}
+		hashes, ok := issuers[string(issuerName)]
+		if !ok {
+			unmapped++
+			continue
+		}
+		// OneCRL has the DER encoding of the serial, padded with a zero
+		// byte if its high bit is set, but Chrome strips leading zeros
+		// before looking serials up in a CRLSet.
+		serial = crlset.NormalizeSerial(serial)
+		for _, hash := range hashes {
+			entries = append(entries, ecosystemEntry{hash, serial})
+		}
+	}
+
+	compareEcosystem(set, "onecrl", entries)
+	if unmapped > 0 {
+		fmt.Fprintf(os.Stderr, "%d OneCRL revocations were skipped because their issuer certificates weren't given\n", unmapped)
+	}
+	return true
+}
+
+// disallowedCTLURL is where Windows fetches the list of certificates that
+// Microsoft has disallowed, and disallowedCertURL is the prefix of the URLs
+// from which the certificates themselves can be downloaded by SHA-1 hash.
+var (
+	disallowedCTLURL  = "http://ctldl.windowsupdate.com/msdownload/update/v3/static/trustedr/en/disallowedcertstl.cab"
+	disallowedCertURL = "http://ctldl.windowsupdate.com/msdownload/update/v3/static/trustedr/en/"
+)
+
+// extractCAB returns the contents of the first file in a Microsoft cabinet.
+// Only uncompressed and MSZIP compressed cabinets are supported.
+func extractCAB(cab []byte) ([]byte, error) {
+	var header struct {
+		Signature                   [4]byte
+		Reserved1, Size, Reserved2  uint32
+		FilesOffset, Reserved3      uint32
+		VersionMinor, VersionMajor  uint8
+		NumFolders, NumFiles, Flags uint16
+		SetID, Index                uint16
+	}
+	r := bytes.NewReader(cab)
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil || string(header.Signature[:]) != "MSCF" {
+		return nil, errors.New("not a cabinet file")
+	}
+	var headerReserve, folderReserve, dataReserve int
+	if header.Flags&4 != 0 {
+		var reserve struct {
+			Header       uint16
+			Folder, Data uint8
+		}
+		if err := binary.Read(r, binary.LittleEndian, &reserve); err != nil {
+			return nil, err
+		}
+		headerReserve, folderReserve, dataReserve = int(reserve.Header), int(reserve.Folder), int(reserve.Data)
+	}
+	r.Seek(int64(headerReserve), io.SeekCurrent)
+
+	var folder struct {
+		DataOffset  uint32
+		NumBlocks   uint16
+		Compression uint16
+	}
+	if header.NumFolders < 1 || header.NumFiles < 1 {
+		return nil, errors.New("empty cabinet")
+	}
+	if err := binary.Read(r, binary.LittleEndian, &folder); err != nil {
+		return nil, err
+	}
+	r.Seek(int64(folderReserve), io.SeekCurrent)
+
+	var file struct {
+		Size, FolderOffset uint32
+	}
+	r.Seek(int64(header.FilesOffset), io.SeekStart)
+	if err := binary.Read(r, binary.LittleEndian, &file); err != nil {
+		return nil, err
+	}
+
+	var folderData []byte
+	r.Seek(int64(folder.DataOffset), io.SeekStart)
+	for i := uint16(0); i < folder.NumBlocks; i++ {
+		var block struct {
+			Checksum           uint32
+			Size, Uncompressed uint16
+		}
+		if err := binary.Read(r, binary.LittleEndian, &block); err != nil {
+			return nil, err
+		}
+		r.Seek(int64(dataReserve), io.SeekCurrent)
+		data := make([]byte, block.Size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+
+		switch folder.Compression & 0xf {
+		case 0:
+			folderData = append(folderData, data...)
+		case 1:
+			// Each MSZIP block is a deflate stream, prefixed with "CK",
+			// which may refer back to the previous 32KB of output.
+			if !bytes.HasPrefix(data, []byte("CK")) {
+				return nil, errors.New("invalid MSZIP block")
+			}
+			history := folderData
+			if len(history) > 32768 {
+				history = history[len(history)-32768:]
+			}
+			inflated, err := ioutil.ReadAll(flate.NewReaderDict(bytes.NewReader(data[2:]), history))
+			if err != nil {
+				return nil, err
+			}
+			folderData = append(folderData, inflated...)
+		default:
+			return nil, fmt.Errorf("unsupported cabinet compression %d", folder.Compression)
+		}
+	}
+
+	if uint64(file.FolderOffset)+uint64(file.Size) > uint64(len(folderData)) {
+		return nil, errors.New("cabinet truncated")
+	}
+	return folderData[file.FolderOffset : file.FolderOffset+file.Size], nil
+}
+
+// parseDisallowedCTL returns the SHA-1 hashes of the certificates listed in a
+// certificate trust list, which is a PKCS#7 signed message. The signature
+// isn't checked.
+func parseDisallowedCTL(data []byte) ([][]byte, error) {
+	var contentInfo pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(data, &contentInfo); err != nil {
+		return nil, err
+	}
+	var signedData struct {
+		Version          int
+		DigestAlgorithms asn1.RawValue
+		ContentInfo      pkcs7ContentInfo
+		Rest             asn1.RawValue `asn1:"optional"`
+	}
+	if _, err := asn1.Unmarshal(contentInfo.Content.Bytes, &signedData); err != nil {
+		return nil, err
+	}
+	ctl := signedData.ContentInfo.Content.Bytes
+	if len(ctl) > 0 && ctl[0] == asn1.TagOctetString {
+		if _, err := asn1.Unmarshal(ctl, &ctl); err != nil {
+			return nil, err
+		}
+	}
+
+	// Several fields of the list are optional, so look for the one that
+	// contains the trusted subjects: a sequence of sequences that each
+	// start with a hash.
+	var fields []asn1.RawValue
+	if _, err := asn1.Unmarshal(ctl, &fields); err != nil {
+		return nil, err
+	}
+	for _, field := range fields {
+		if field.Class != asn1.ClassUniversal || field.Tag != asn1.TagSequence {
+			continue
+		}
+		var subjects []asn1.RawValue
+		if _, err := asn1.Unmarshal(field.FullBytes, &subjects); err != nil || len(subjects) == 0 {
+			continue
+		}
+		var hashes [][]byte
+		for _, subject := range subjects {
+			var trusted struct {
+				Identifier []byte
+				Attributes asn1.RawValue `asn1:"optional"`
+			}
+			if _, err := asn1.Unmarshal(subject.FullBytes, &trusted); err != nil || len(trusted.Identifier) != sha1.Size {
+				hashes = nil
+				break
+			}
+			hashes = append(hashes, trusted.Identifier)
+		}
+		if hashes != nil {
+			return hashes, nil
+		}
+	}
+	return nil, errors.New("no subjects found in certificate trust list")
+}
+
+// compareDisallowed compares the CRLSet in filename with Microsoft's list of
+// disallowed certificates. Each disallowed certificate is counted as a
+// blocked SPKI if the CRLSet blocks its key or it's a CA certificate, and
+// otherwise as a serial under its issuer's SPKI, which requires that the
+// issuer's certificate is in issuersDir.
+func compareDisallowed(filename, ctlLocation, issuersDir string) bool {
+	set, err := readCRLSet(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+
+	issuers, err := readIssuerIndex(issuersDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read issuers: %s\n", err)
+		return false
+	}
+
+	data, err := readURLOrFile(ctlLocation)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to fetch the disallowed list: %s\n", err)
+		return false
+	}
+	if bytes.HasPrefix(data, []byte("MSCF")) {
+		if data, err = extractCAB(data); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to extract the disallowed list: %s\n", err)
+			return false
+		}
+	}
+	hashes, err := parseDisallowedCTL(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to parse the disallowed list: %s\n", err)
+		return false
+	}
+
+	blocked := make(map[[crlset.SPKIHashLen]byte]bool)
+	for _, hash := range set.Header.BlockedSPKIHashes() {
+		blocked[hash] = true
+	}
+
+	var entries []ecosystemEntry
+	unmapped := 0
+	for _, hash := range hashes {
+		certURL := disallowedCertURL + strings.ToUpper(hex.EncodeToString(hash)) + ".crt"
+		der, err := readURLOrFile(certURL)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to fetch disallowed certificate %x: %s\n", hash, err)
+			unmapped++
+			continue
+		}
+		certs := parseCertificates(der)
+		if len(certs) == 0 {
+			fmt.Fprintf(os.Stderr, "Failed to parse disallowed certificate %x\n", hash)
+			unmapped++
+			continue
+		}
+		cert := certs[0]
+
+		var spki [crlset.SPKIHashLen]byte
+		copy(spki[:], crlset.SPKIHash(cert))
+		if blocked[spki] || cert.IsCA {
+			entries = append(entries, ecosystemEntry{spkiHash: spki})
+			continue
+		}
+		issuerHashes, ok := issuers[string(cert.RawIssuer)]
+		if !ok {
+			unmapped++
+			continue
+		}
+		serial := crlset.SerialBytes(cert.SerialNumber)
+		if serial == nil {
+			// Chrome never finds a negative serial revoked.
+			continue
+		}
+		for _, issuerHash := range issuerHashes {
+			entries = append(entries, ecosystemEntry{issuerHash, serial})
+		}
+	}
+
+	compareEcosystem(set, "microsoft", entries)
+	if unmapped > 0 {
+		fmt.Fprintf(os.Stderr, "%d disallowed certificates were skipped because they, or their issuers' certificates, couldn't be found\n", unmapped)
+	}
+	return true
+}
+
+// explain prints each rule of the CRLSet in filename that applies to the
+// certificate chain in chainFilename, which starts with the leaf, and the
+// resulting verdict.
+func explain(filename, chainFilename, intermediatesFilename string) bool {
+	set, err := readCheckCRLSet(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+
+	data, err := ioutil.ReadFile(chainFilename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read certificates: %s\n", err)
+		return false
+	}
+	chain := parseCertificates(data)
+	if len(chain) == 0 {
+		fmt.Fprintf(os.Stderr, "No certificates found in %s\n", chainFilename)
+		return false
+	}
+	presented := len(chain)
+
+	// Servers often omit intermediates, so complete the chain with any
+	// issuers, and their issuers in turn, from the bundle.
+	if len(intermediatesFilename) > 0 {
+		intermediates, err := readIntermediates(intermediatesFilename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return false
+		}
+		for i := 0; i < len(chain); i++ {
+			for _, candidate := range intermediates {
+				included := false
+				for _, cert := range chain {
+					if cert.Equal(candidate) {
+						included = true
+						break
+					}
+				}
+				if !included && chain[i].CheckSignatureFrom(candidate) == nil {
+					chain = append(chain, candidate)
+				}
+			}
+		}
+	}
+
+	lists := []struct {
+		name   string
+		hashes [][crlset.SPKIHashLen]byte
+		policy string
+	}{
+		{"BlockedSPKIs", set.Header.BlockedSPKIHashes(), "fail"},
+		{"BlockedInterceptionSPKIs", set.Header.BlockedInterceptionSPKIHashes(), blockedInterceptionPolicy},
+		{"KnownInterceptionSPKIs", set.Header.KnownInterceptionSPKIHashes(), knownInterceptionPolicy},
+	}
+
+	blocked, warned, leafIssuerFound := false, false, false
+	for i, cert := range chain {
+		if i < presented {
+			fmt.Printf("Certificate %d: %s\n", i, cert.Subject)
+		} else {
+			fmt.Printf("Certificate %d (from intermediates): %s\n", i, cert.Subject)
+		}
+		hash := crlset.SPKIHash(cert)
+		fmt.Printf("  SPKI: %x (%s)\n", hash, base64.StdEncoding.EncodeToString(hash))
+
+		for _, list := range lists {
+			for _, listed := range list.hashes {
+				if !bytes.Equal(listed[:], hash) {
+					continue
+				}
+				switch list.policy {
+				case "ignore":
+					fmt.Printf("  MATCH: SPKI is in %s, which is ignored by policy\n", list.name)
+				case "warn":
+					fmt.Printf("  MATCH: SPKI is in %s\n", list.name)
+					warned = true
+				default:
+					fmt.Printf("  MATCH: SPKI is in %s\n", list.name)
+					blocked = true
+				}
+			}
+		}
+
+		for _, issuer := range chain {
+			if issuer == cert || cert.CheckSignatureFrom(issuer) != nil {
+				continue
+			}
+			if i == 0 {
+				leafIssuerFound = true
+			}
+			issuerHash := crlset.SPKIHash(issuer)
+			serial := crlset.SerialBytes(cert.SerialNumber)
+			if serial == nil {
+				fmt.Printf("  Serial %s is negative, so Chrome never finds it revoked\n", formatCertSerial(cert.SerialNumber))
+				continue
+			}
+			for _, entry := range set.Entries {
+				if !bytes.Equal(entry.SPKIHash, issuerHash) {
+					continue
+				}
+				for _, s := range entry.Serials {
+					if serialMatch.Match(s, serial) {
+						fmt.Printf("  MATCH: serial %s is revoked under issuer SPKI %x (%s)\n", formatSerial(serial), issuerHash, base64.StdEncoding.EncodeToString(issuerHash))
+						blocked = true
+					}
+				}
+			}
+		}
+	}
+
+	switch {
+	case blocked:
+		fmt.Println("Verdict: blocked")
+	case warned:
+		fmt.Println("Verdict: allowed, with a warning about TLS interception")
+	default:
+		fmt.Println("Verdict: not blocked by this CRLSet")
+	}
+	if !leafIssuerFound && !bytes.Equal(chain[0].RawIssuer, chain[0].RawSubject) {
+		fmt.Fprintf(os.Stderr, "Warning: the leaf's issuer isn't in the chain, so its serial couldn't be checked\n")
+	}
+
+	return true
+}
+
+// flagEnvName returns the environment variable from which the flag with the
+// given name can be set: --smtp-server is read from $CRLSET_SMTP_SERVER.
+func flagEnvName(name string) string {
+	return "CRLSET_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// parseArgs parses the flags in args, which may be interspersed with
+// positional arguments, and returns the positional arguments. Everything
+// after "--" is positional, even if it looks like a flag. Any flag that
+// isn't on the command line is then set from its environment variable, if
+// that's set, so that containers can be configured without templating
+// command lines. A repeatable flag given on the command line therefore
+// replaces the value in its variable rather than adding to it.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			args, rest = args[:i], args[i+1:]
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' || strings.Contains(arg, "=") {
+			continue
+		}
+		// Skip the value of a flag that takes one, which may be "--".
+		if f := fs.Lookup(strings.TrimLeft(arg, "-")); f != nil {
+			if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !b.IsBoolFlag() {
+				i++
+			}
+		}
+	}
+
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	positional = append(positional, rest...)
+
+	onCommandLine := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		onCommandLine[f.Name] = true
+	})
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		if onCommandLine[f.Name] || envErr != nil {
+			return
+		}
+		name := flagEnvName(f.Name)
+		if value, ok := os.LookupEnv(name); ok {
+			if err := fs.Set(f.Name, value); err != nil {
+				envErr = fmt.Errorf("Invalid value for $%s: %s", name, err)
+			}
+		}
+	})
+	if envErr != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", envErr)
+		return nil, envErr
+	}
+	return positional, nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `%s: { fetch [-o <output filename>] [--min-sequence <n>] [--crx-output <filename>]
+          [--omaha-url <URL>] [--omaha-json-url <URL>] [--omaha-protocol xml|json|auto]
+          [--smtp-server <host:port> --smtp-from <address> --smtp-to <addresses>
+           [--smtp-username <username>] [--watch <SPKI hash>[:<serial>]]...]
+          [--serial-match chrome|unsigned]
+          [--changelog <filename>] [--on-removal <program>]
+          [{ --nats <URL> | --kafka-rest <URL> }... [--publish-topic <name>] [--publish-format json|csv]]
+          [--source omaha|url:<URL>|chrome[:<directory>]|dir:<directory>] [--as-of <date>]
+          [--expected-sequence <n>] [--expected-sha256 <hex>] [--trusted-key <SPKI hash>]...
+          [--out-dir <directory> [--name-template <template>]] [--pin-google] [--pin <SPKI hash>]...
+          [--interval <duration> [--debug-listen <address>]]
+    | dump [--sort] [--format=text|base64|pg|go|snapshot|go-loader|parquet|bigquery|pgcopy|ndjson]
+          [--package <name>] [--offset <n>] [--limit <n>] [--spki-only] [--buffer-size <bytes>]
+          [--serial-format hex|decimal] <filename> [<cert filename>]
+    | sequence { <filename> | --remote [--omaha-url <URL>] [--omaha-json-url <URL>]
+          [--omaha-protocol xml|json|auto] [--pin-google] [--pin <SPKI hash>]... }
+    | serve-omaha --dir <directory> [--listen <address>] [--base-url <URL>]
+          [--trusted-key <SPKI hash>]... [--debug-listen <address>] [--serial-match chrome|unsigned]
+          [--blocklist <filename>] [--allowlist <filename>]
+    | backfill --dir <directory> [--checkpoint <filename>] [--trusted-key <SPKI hash>]...
+          [--pin-google] [--pin <SPKI hash>]... { <CRX filename> | <directory> | <URL> }...
+    | serve-dns --zone <zone> [--listen <address>] [--serial-match chrome|unsigned]
+          [--blocklist <filename>] [--allowlist <filename>] <filename>
+    | audit [--incidents <URL or filename>] <filename> [<labels filename>]
+    | service { install | run } [--log <filename>] <name> <command> [<arg>...]
+    | service { uninstall | start | stop | status } <name>   (Windows only)
+    | trend --dir <directory> [--format=csv|json|prometheus-textfile] [-o <output filename>]
+    | list-versions --dir <directory> [--format=text|json]
+    | when-revoked --dir <directory> <SPKI hash>[:<serial>]
+    | report [-o <output filename>] [--previous <filename>] [--names <filename>] <filename>
+    | browse [--names <filename>] [--page-size <n>] <filename>
+    | feed --dir <directory> [--base-url <URL>] [-o <output filename>]
+    | normalize <filename> [-o <output filename>]
+    | intersect <filename> <filename>
+    | shared-serials [--names <filename>] [--serial-format hex|decimal] <filename>
+    | top [-n <n>] [--names <filename>] <filename>
+    | explain [--intermediates <filename>] [--serial-match chrome|unsigned] [--serial-format hex|decimal]
+          [--known-interception ignore|warn|fail] [--blocked-interception ignore|warn|fail]
+          [--blocklist <filename>] [--allowlist <filename>] <filename> <chain filename>
+    | filter --spki <SPKI hash> [--spki <SPKI hash>]... [-o <output filename>] <filename>
+    | redact --remove <SPKI hash>[:<serial>] [--remove ...]... [-o <output filename>] <filename>
+    | ct-certs [-o <output filename>] [--ct-url <URL>] <filename> <issuer cert filename>
+    | active-revocations [--ct-url <URL>] <filename> <issuer cert filename>...
+    | scan-dir [--recursive] [--format=text|sarif] [--jobs <n>] [--intermediates <filename>]
+          [--serial-match chrome|unsigned] [--serial-format hex|decimal] [--audit-log <destination>]
+          [--blocklist <filename>] [--allowlist <filename>] [--known-interception ignore|warn|fail]
+          [--blocked-interception ignore|warn|fail] <filename> <directory>
+    | scan-k8s [--format=text|sarif] [--jobs <n>] [--intermediates <filename>]
+          [--serial-match chrome|unsigned] [--serial-format hex|decimal] [--audit-log <destination>]
+          [--blocklist <filename>] [--allowlist <filename>] [--known-interception ignore|warn|fail]
+          [--blocked-interception ignore|warn|fail] <filename> { <secrets JSON filename> | - }
+    | scan-keystore [--password <password>] [--format=text|sarif] [--jobs <n>] [--intermediates <filename>]
+          [--serial-match chrome|unsigned] [--serial-format hex|decimal] [--audit-log <destination>]
+          [--blocklist <filename>] [--allowlist <filename>] [--known-interception ignore|warn|fail]
+          [--blocked-interception ignore|warn|fail] <filename> <keystore filename>...
+    | check-roots [--known-interception ignore|warn|fail] [--blocked-interception ignore|warn|fail]
+          [--blocklist <filename>] [--allowlist <filename>] <filename>
+    | detect-interception [--roots <filename>] [--blocklist <filename>] [--allowlist <filename>]
+          <filename> { <chain filename> | - }
+    | check-serial --spki <SPKI hash> --serial <hex> [--serial-match chrome|unsigned]
+          [--serial-format hex|decimal] [--known-interception ignore|warn|fail]
+          [--blocked-interception ignore|warn|fail] [--blocklist <filename>] [--allowlist <filename>]
+          <filename>
+    | scan-nss [--format=text|sarif] [--jobs <n>] [--intermediates <filename>]
+          [--serial-match chrome|unsigned] [--serial-format hex|decimal] [--audit-log <destination>]
+          [--blocklist <filename>] [--allowlist <filename>] [--known-interception ignore|warn|fail]
+          [--blocked-interception ignore|warn|fail] <filename> { <cert9.db filename> | <profile directory> }...
+    | compare-root-store [--root-store <URL or filename>] <filename>
+    | compare-onecrl [--onecrl <URL or filename>] [--issuers <directory>] <filename>
+    | compare-disallowed [--ctl <URL or filename>] [--cert-url <URL prefix>] [--issuers <directory>] <filename>
+    | compare-chrome [--user-data-dir <directory>] [--omaha-url <URL>] [--omaha-json-url <URL>]
+          [--omaha-protocol xml|json|auto]
+    | freshness --file <filename> [--max-age <duration>] [--omaha-url <URL>]
+          [--omaha-json-url <URL>] [--omaha-protocol xml|json|auto]
+    | export-crls <filename> <output directory> [<issuer filename>...]
+    | crl-bundle [-o <output filename>] <filename> <issuer filename>...
+    | envoy-config [-o <output filename>] [--name <secret name>] [--trusted-ca <filename>]
+          <filename> <issuer filename>...
+    | export { --redis <URL> | --bigquery <project.dataset.table> [--bigquery-token <token>]
+          | --clickhouse <URL> [--clickhouse-table <table>] | --pg-dsn <URL> [--pg-table <table>] }...
+          <filename> }
+
+The commands that use the network (fetch, sequence --remote, backfill, ct-certs,
+active-revocations, freshness, export and the compare commands) also accept
+--offline, --record <directory>, --replay <directory>, --user-agent <string>
+and --header "<name>: <value>".
+
+Every flag can also be set with an environment variable named after it:
+--smtp-server is read from $CRLSET_SMTP_SERVER, for example. A flag given on
+the command line replaces its variable, even for a repeatable flag. The
+variables apply to every command with a flag of that name, so generic ones
+such as $CRLSET_O are best set for a single command rather than exported.
+`, os.Args[0])
+}
+
+// jsMain is set by crlset_js.go, in the js/wasm build, to run instead of the
+// command line interface.
+var jsMain func()
+
+// windowsService is set by crlset_windows.go to implement the service
+// command, which is only available on Windows.
+var windowsService func(args []string) bool
+
+func main() {
+	if jsMain != nil {
+		jsMain()
+		return
+	}
+
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(1)
+	}
+
+	httpClient = &http.Client{Transport: networkTransport{}}
+
+	// After the first signal, stop trapping them so that a second one kills
+	// the process immediately.
+	var stop context.CancelFunc
+	interrupted, stop = signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupted.Done()
+		stop()
+	}()
+
+	for _, key := range strings.Split(os.Getenv("CRLSET_TRUSTED_KEYS"), ",") {
+		if key = strings.TrimSpace(key); len(key) == 0 {
+			continue
+		}
+		if err := envTrustedKeys.Set(key); err != nil {
+			fmt.Fprintf(os.Stderr, "CRLSET_TRUSTED_KEYS: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := initTracing(os.Args[1]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	result := false
+	needUsage := true
+
+	switch os.Args[1] {
+	case "fetch":
+		var opts fetchOptions
+		fs := flag.NewFlagSet("fetch", flag.ContinueOnError)
+		fs.StringVar(&opts.output, "o", "", "write the CRLSet to this file, which must not contain a newer set, rather than stdout; {sequence}, {version} and {sha256[:<n>]} are replaced by the CRLSet's sequence number, format version and hash")
+		fs.IntVar(&opts.minSequence, "min-sequence", 0, "refuse to accept a CRLSet with a lower sequence number")
+		fs.IntVar(&opts.expectedSequence, "expected-sequence", 0, "fail unless the CRLSet has exactly this sequence number")
+		fs.StringVar(&opts.expectedSHA256, "expected-sha256", "", "fail unless the CRLSet has this hex SHA-256 hash")
+		fs.StringVar(&opts.smtp.server, "smtp-server", "", "the host:port of an SMTP server used to send alerts when -o is updated")
+		fs.StringVar(&opts.smtp.from, "smtp-from", "", "the sender of email alerts")
+		fs.StringVar(&opts.smtp.to, "smtp-to", "", "comma separated recipients of email alerts")
+		fs.StringVar(&opts.smtp.username, "smtp-username", "", "the SMTP username; the password is taken from $CRLSET_SMTP_PASSWORD")
+		opts.smtp.password = os.Getenv("CRLSET_SMTP_PASSWORD")
+		addSerialMatchFlag(fs)
+		fs.Var(&opts.watches, "watch", "an SPKI hash, or <SPKI hash>:<hex serial>, to call out in alerts when it appears (may be repeated)")
+		fs.StringVar(&opts.changelog, "changelog", "", "append a JSON line to this file for each serial or SPKI added or removed when -o is updated")
+		fs.StringVar(&opts.removalHook, "on-removal", "", "run this program, with the removals as JSON lines on stdin, when -o is updated and serials or SPKIs were removed")
+		fs.StringVar(&opts.publish.natsURL, "nats", "", "publish a message to --publish-topic on this NATS server for each serial or SPKI added or removed when -o is updated")
+		fs.StringVar(&opts.publish.kafkaRESTURL, "kafka-rest", "", "likewise, produce to the --publish-topic Kafka topic through the Kafka REST proxy at this URL")
+		fs.StringVar(&opts.publish.topic, "publish-topic", "crlset.changes", "the NATS subject or Kafka topic to publish changes to")
+		fs.Func("publish-format", "the serialization of published changes: json or csv (default json)", func(value string) error {
+			if value != "json" && value != "csv" {
+				return errors.New("must be json or csv")
+			}
+			opts.publish.format = value
+			return nil
+		})
+		opts.publish.format = "json"
+		fs.StringVar(&opts.crxOutput, "crx-output", "", "also write the signed CRX to this file; {sequence}, {version} and {sha256[:<n>]} are replaced as for -o")
+		outDir := fs.String("out-dir", "", "write each CRLSet to its own file in this directory, named by --name-template, instead of -o")
+		nameTemplate := fs.String("name-template", "crlset-{sequence}.bin", "the filename used with --out-dir; {sequence}, {version} and {sha256[:<n>]} are replaced")
+		fs.StringVar(&opts.source, "source", "omaha", "where to fetch from: omaha, url:<CRX URL>, chrome[:<user data directory>] or dir:<mirror directory>")
+		fs.Var(&trustedKeys, "trusted-key", "the hex or base64 SHA-256 SPKI hash of another key trusted to sign the CRX (may be repeated)")
+		fs.StringVar(&opts.asOf, "as-of", "", "fetch the CRLSet that was current at this date (YYYY-MM-DD) or RFC 3339 time; needs --source dir:<directory>")
+		fs.StringVar(&crlset.OmahaURL, "omaha-url", crlset.OmahaURL, "the Omaha update endpoint to query")
+		fs.StringVar(&crlset.OmahaJSONURL, "omaha-json-url", crlset.OmahaJSONURL, "the Omaha protocol 3.1 endpoint to query")
+		fs.StringVar(&omahaProtocol, "omaha-protocol", omahaProtocol, "the Omaha protocol to use: xml, json or auto")
+		interval := fs.Duration("interval", 0, "keep running, fetching about this often; needs -o")
+		debugListen := fs.String("debug-listen", "", "with --interval, serve /debug/pprof and /debug/vars on this address")
+		addNetworkFlags(fs)
+		addPinFlags(fs)
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(*outDir) > 0 {
+			if len(opts.output) > 0 {
+				fmt.Fprintf(os.Stderr, "-o and --out-dir can't be used together\n")
+				break
+			}
+			opts.output = filepath.Join(*outDir, *nameTemplate)
+		}
+		for _, template := range []string{opts.output, opts.crxOutput} {
+			if _, err = expandFilename(template, &crlset.CRLSet{}, nil); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+		if len(*debugListen) > 0 && *interval == 0 {
+			fmt.Fprintf(os.Stderr, "--debug-listen needs --interval, since a single fetch exits before it could be used\n")
+			needUsage = false
+			break
+		}
+		if len(*debugListen) > 0 {
+			if err = startDebugServer(*debugListen); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				needUsage = false
+				break
+			}
+		}
+		if len(args) == 0 && *interval > 0 && len(opts.output) > 0 {
+			needUsage = false
+			result = fetchEvery(opts, *interval)
+		} else if len(args) == 0 && *interval == 0 {
+			needUsage = false
+			result = fetch(opts)
+		}
+	case "dump":
+		var opts dumpOptions
+		fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+		fs.BoolVar(&opts.sorted, "sort", false, "emit SPKI sections and serials in a canonical order")
+		fs.StringVar(&opts.format, "format", "text", "the output format: "+strings.Join(formatterNames(), ", "))
+		fs.StringVar(&opts.goPackage, "package", "crlsetdata", "the package name used by --format=go and --format=go-loader")
+		fs.IntVar(&opts.offset, "offset", 0, "skip this many SPKI sections, or serials if a certificate is given")
+		fs.IntVar(&opts.limit, "limit", 0, "print at most this many SPKI sections, or serials if a certificate is given")
+		fs.IntVar(&opts.bufferSize, "buffer-size", 64*1024, "the size in bytes of the output buffer")
+		fs.BoolVar(&opts.spkiOnly, "spki-only", false, "print SPKI hashes without their serials")
+		addSerialFormatFlag(fs)
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) == 1 {
+			needUsage = false
+			result = dump(args[0], "", opts)
+		} else if len(args) == 2 {
+			needUsage = false
+			result = dump(args[0], args[1], opts)
+		}
+	case "sequence":
+		fs := flag.NewFlagSet("sequence", flag.ContinueOnError)
+		remote := fs.Bool("remote", false, "print the sequence number of the latest published CRLSet")
+		fs.StringVar(&crlset.OmahaURL, "omaha-url", crlset.OmahaURL, "the Omaha update endpoint to query")
+		fs.StringVar(&crlset.OmahaJSONURL, "omaha-json-url", crlset.OmahaJSONURL, "the Omaha protocol 3.1 endpoint to query")
+		fs.StringVar(&omahaProtocol, "omaha-protocol", omahaProtocol, "the Omaha protocol to use: xml, json or auto")
+		addNetworkFlags(fs)
+		addPinFlags(fs)
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if *remote && len(args) == 0 {
+			needUsage = false
+			result = sequence("", true)
+		} else if !*remote && len(args) == 1 {
+			needUsage = false
+			result = sequence(args[0], false)
+		}
+	case "audit":
+		fs := flag.NewFlagSet("audit", flag.ContinueOnError)
+		incidents := fs.String("incidents", chromeBlocklistURL, "the URL or filename of the curated incidents README, or empty for none")
+		addNetworkFlags(fs)
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) == 1 || len(args) == 2 {
+			needUsage = false
+			labels := ""
+			if len(args) == 2 {
+				labels = args[1]
+			}
+			result = audit(args[0], *incidents, labels)
+		}
+	case "trend":
+		fs := flag.NewFlagSet("trend", flag.ContinueOnError)
+		dir := fs.String("dir", "", "the directory containing CRLSets")
+		format := fs.String("format", "csv", "the output format: csv, json or prometheus-textfile")
+		output := fs.String("o", "", "write to this file, which is replaced atomically, rather than stdout")
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) == 0 && len(*dir) > 0 {
+			needUsage = false
+			result = trend(*dir, *format, *output)
+		}
+	case "list-versions":
+		fs := flag.NewFlagSet("list-versions", flag.ContinueOnError)
+		dir := fs.String("dir", "", "the directory containing CRLSets or CRXs")
+		format := fs.String("format", "text", "the output format: text or json")
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) == 0 && len(*dir) > 0 {
+			needUsage = false
+			result = listVersions(*dir, *format)
+		}
+	case "when-revoked":
+		fs := flag.NewFlagSet("when-revoked", flag.ContinueOnError)
+		dir := fs.String("dir", "", "the directory containing archived CRLSets or CRXs")
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) == 1 && len(*dir) > 0 {
+			needUsage = false
+			result = whenRevoked(*dir, args[0])
+		}
+	case "report":
+		fs := flag.NewFlagSet("report", flag.ContinueOnError)
+		output := fs.String("o", "", "write the report to this file rather than stdout")
+		previous := fs.String("previous", "", "a previous CRLSet to report changes against")
+		names := fs.String("names", "", "a file mapping SPKI hashes to CA names")
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) == 1 {
+			needUsage = false
+			result = report(args[0], *previous, *names, *output)
+		}
+	case "browse":
+		fs := flag.NewFlagSet("browse", flag.ContinueOnError)
+		names := fs.String("names", "", "a file mapping SPKI hashes to CA names")
+		pageSize := fs.Int("page-size", 20, "the number of sections or serials per page")
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) == 1 {
+			needUsage = false
+			result = browse(args[0], *names, *pageSize)
+		}
+	case "feed":
+		fs := flag.NewFlagSet("feed", flag.ContinueOnError)
+		dir := fs.String("dir", "", "the directory containing CRLSets")
+		baseURL := fs.String("base-url", "", "the URL at which the directory is published")
+		output := fs.String("o", "", "write the feed to this file rather than stdout")
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) == 0 && len(*dir) > 0 {
+			needUsage = false
+			result = feed(*dir, *baseURL, *output)
+		}
+	case "backfill":
+		fs := flag.NewFlagSet("backfill", flag.ContinueOnError)
+		dir := fs.String("dir", "", "the mirror directory to copy CRX files into")
+		checkpoint := fs.String("checkpoint", "", "the file recording progress (default: one for dir in the user's cache directory)")
+		fs.Var(&trustedKeys, "trusted-key", "the hex or base64 SHA-256 SPKI hash of another key trusted to sign the CRX (may be repeated)")
+		addNetworkFlags(fs)
+		addPinFlags(fs)
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) > 0 && len(*dir) > 0 {
+			needUsage = false
+			result = backfill(*dir, *checkpoint, args)
+		}
+	case "service":
+		needUsage = false
+		if windowsService == nil {
+			fmt.Fprintf(os.Stderr, "service is only available on Windows\n")
+			break
+		}
+		result = windowsService(os.Args[2:])
+	case "serve-omaha":
+		fs := flag.NewFlagSet("serve-omaha", flag.ContinueOnError)
+		dir := fs.String("dir", "", "the directory containing mirrored CRX files")
+		listen := fs.String("listen", "localhost:8080", "the address to listen on")
+		baseURL := fs.String("base-url", "", "the externally visible URL of this server")
+		fs.Var(&trustedKeys, "trusted-key", "the hex or base64 SHA-256 SPKI hash of another key trusted to sign mirrored CRXs (may be repeated)")
+		debugListen := fs.String("debug-listen", "", "serve /debug/pprof and /debug/vars on this address")
+		addSerialMatchFlag(fs)
+		addOverrideFlags(fs)
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(*debugListen) > 0 {
+			if err = startDebugServer(*debugListen); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				needUsage = false
+				break
+			}
+		}
+		if len(args) == 0 && len(*dir) > 0 {
+			needUsage = false
+			result = serveOmaha(*dir, *listen, *baseURL)
+		}
+	case "serve-dns":
+		fs := flag.NewFlagSet("serve-dns", flag.ContinueOnError)
+		zone := fs.String("zone", "", "the DNS zone to answer for, such as crl.example.internal")
+		listen := fs.String("listen", "localhost:5353", "the UDP address to listen on")
+		addSerialMatchFlag(fs)
+		addOverrideFlags(fs)
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) == 1 && len(*zone) > 0 {
+			needUsage = false
+			result = serveDNS(args[0], *zone, *listen)
+		}
+	case "normalize":
+		fs := flag.NewFlagSet("normalize", flag.ContinueOnError)
+		output := fs.String("o", "", "write the normalized CRLSet to this file rather than stdout")
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) == 1 {
+			needUsage = false
+			result = normalize(args[0], *output)
+		}
+	case "filter":
+		var spkis spkiList
+		fs := flag.NewFlagSet("filter", flag.ContinueOnError)
+		fs.Var(&spkis, "spki", "the SPKI hash, in hex or base64, of an issuer whose section should be kept (may be repeated)")
+		output := fs.String("o", "", "write the filtered CRLSet to this file rather than stdout")
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) == 1 && len(spkis) > 0 {
+			needUsage = false
+			result = filter(args[0], spkis, *output)
+		}
+	case "redact":
+		var removals watchList
+		fs := flag.NewFlagSet("redact", flag.ContinueOnError)
+		fs.Var(&removals, "remove", "an SPKI hash, or <SPKI hash>:<hex serial>, to remove (may be repeated)")
+		output := fs.String("o", "", "write the redacted CRLSet to this file rather than stdout")
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) == 1 && len(removals) > 0 {
+			needUsage = false
+			result = redact(args[0], removals, *output)
+		}
+	case "ct-certs":
+		fs := flag.NewFlagSet("ct-certs", flag.ContinueOnError)
+		output := fs.String("o", "", "write the PEM bundle to this file rather than stdout")
+		fs.StringVar(&ctSearchURL, "ct-url", ctSearchURL, "the crt.sh instance used to search CT")
+		addNetworkFlags(fs)
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) == 2 {
+			needUsage = false
+			result = ctCertificates(args[0], args[1], *output)
+		}
+	case "active-revocations":
+		fs := flag.NewFlagSet("active-revocations", flag.ContinueOnError)
+		fs.StringVar(&ctSearchURL, "ct-url", ctSearchURL, "the crt.sh instance used to search CT")
+		addNetworkFlags(fs)
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) >= 2 {
+			needUsage = false
+			result = activeRevocations(args[0], args[1:])
+		}
+	case "intersect":
+		fs := flag.NewFlagSet("intersect", flag.ContinueOnError)
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) == 2 {
+			needUsage = false
+			result = intersect(args[0], args[1])
+		}
+	case "shared-serials":
+		fs := flag.NewFlagSet("shared-serials", flag.ContinueOnError)
+		names := fs.String("names", "", "a file mapping SPKI hashes to CA names")
+		addSerialFormatFlag(fs)
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) == 1 {
+			needUsage = false
+			result = printSharedSerials(args[0], *names)
+		}
+	case "top":
+		fs := flag.NewFlagSet("top", flag.ContinueOnError)
+		n := fs.Int("n", 20, "the number of SPKIs to list, or 0 for all of them")
+		names := fs.String("names", "", "a file mapping SPKI hashes to CA names")
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) == 1 && *n >= 0 {
+			needUsage = false
+			result = printTop(args[0], *names, *n)
+		}
+	case "scan-dir":
+		fs := flag.NewFlagSet("scan-dir", flag.ContinueOnError)
+		recursive := fs.Bool("recursive", false, "also scan subdirectories")
+		fs.StringVar(&scanFormat, "format", scanFormat, "the output format: text or sarif")
+		fs.IntVar(&scanJobs, "jobs", scanJobs, "the number of certificates to parse and check in parallel")
+		fs.StringVar(&scanIntermediates, "intermediates", "", "a PEM bundle of intermediates to use as issuers without reporting on them")
+		fs.StringVar(&scanAuditLog, "audit-log", "", "record every check as a JSON line in this file, or send it to syslog or syslog://<host:port>")
+		addOverrideFlags(fs)
+		addInterceptionPolicyFlags(fs)
+		addSerialMatchFlag(fs)
+		addSerialFormatFlag(fs)
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) == 2 {
+			needUsage = false
+			result = scanDir(args[0], args[1], *recursive)
+		}
+	case "scan-k8s":
+		fs := flag.NewFlagSet("scan-k8s", flag.ContinueOnError)
+		fs.StringVar(&scanFormat, "format", scanFormat, "the output format: text or sarif")
+		fs.IntVar(&scanJobs, "jobs", scanJobs, "the number of certificates to parse and check in parallel")
+		fs.StringVar(&scanIntermediates, "intermediates", "", "a PEM bundle of intermediates to use as issuers without reporting on them")
+		fs.StringVar(&scanAuditLog, "audit-log", "", "record every check as a JSON line in this file, or send it to syslog or syslog://<host:port>")
+		addOverrideFlags(fs)
+		addInterceptionPolicyFlags(fs)
+		addSerialMatchFlag(fs)
+		addSerialFormatFlag(fs)
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) == 2 {
+			needUsage = false
+			result = scanK8s(args[0], args[1])
+		}
+	case "scan-keystore":
+		fs := flag.NewFlagSet("scan-keystore", flag.ContinueOnError)
+		password := fs.String("password", os.Getenv("CRLSET_KEYSTORE_PASSWORD"), "the keystore password, needed to decrypt PKCS#12 files")
+		fs.StringVar(&scanFormat, "format", scanFormat, "the output format: text or sarif")
+		fs.IntVar(&scanJobs, "jobs", scanJobs, "the number of certificates to parse and check in parallel")
+		fs.StringVar(&scanIntermediates, "intermediates", "", "a PEM bundle of intermediates to use as issuers without reporting on them")
+		fs.StringVar(&scanAuditLog, "audit-log", "", "record every check as a JSON line in this file, or send it to syslog or syslog://<host:port>")
+		addOverrideFlags(fs)
+		addInterceptionPolicyFlags(fs)
+		addSerialMatchFlag(fs)
+		addSerialFormatFlag(fs)
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) >= 2 {
+			needUsage = false
+			result = scanKeystores(args[0], args[1:], *password)
+		}
+	case "check-roots":
+		fs := flag.NewFlagSet("check-roots", flag.ContinueOnError)
+		addInterceptionPolicyFlags(fs)
+		addOverrideFlags(fs)
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) == 1 {
+			needUsage = false
+			result = checkRoots(args[0])
+		}
+	case "check-serial":
+		fs := flag.NewFlagSet("check-serial", flag.ContinueOnError)
+		spki := fs.String("spki", "", "the hex or base64 SHA-256 hash of the issuer's SubjectPublicKeyInfo")
+		serial := fs.String("serial", "", "the certificate's serial number in hex")
+		addSerialMatchFlag(fs)
+		addSerialFormatFlag(fs)
+		addInterceptionPolicyFlags(fs)
+		addOverrideFlags(fs)
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) == 1 && len(*spki) > 0 && len(*serial) > 0 {
+			affected, ok := checkSerial(args[0], *spki, *serial)
+			if affected {
+				finishTracing(true)
+				os.Exit(revokedExitCode)
+			}
+			needUsage = false
+			result = ok
+		}
+	case "detect-interception":
+		fs := flag.NewFlagSet("detect-interception", flag.ContinueOnError)
+		roots := fs.String("roots", "", "a PEM bundle of roots to complete the chain with, instead of the system root store")
+		addOverrideFlags(fs)
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) == 2 {
+			intercepted, ok := detectInterception(args[0], args[1], *roots)
+			if intercepted {
+				finishTracing(true)
+				os.Exit(interceptedExitCode)
+			}
+			needUsage = false
+			result = ok
+		}
+	case "scan-nss":
+		fs := flag.NewFlagSet("scan-nss", flag.ContinueOnError)
+		fs.StringVar(&scanFormat, "format", scanFormat, "the output format: text or sarif")
+		fs.IntVar(&scanJobs, "jobs", scanJobs, "the number of certificates to parse and check in parallel")
+		fs.StringVar(&scanIntermediates, "intermediates", "", "a PEM bundle of intermediates to use as issuers without reporting on them")
+		fs.StringVar(&scanAuditLog, "audit-log", "", "record every check as a JSON line in this file, or send it to syslog or syslog://<host:port>")
+		addOverrideFlags(fs)
+		addInterceptionPolicyFlags(fs)
+		addSerialMatchFlag(fs)
+		addSerialFormatFlag(fs)
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) >= 2 {
+			needUsage = false
+			result = scanNSS(args[0], args[1:])
+		}
+	case "compare-root-store":
+		fs := flag.NewFlagSet("compare-root-store", flag.ContinueOnError)
+		rootStore := fs.String("root-store", chromeRootStoreURL, "the URL or filename of the Chrome Root Store's root_store.certs")
+		addNetworkFlags(fs)
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) == 1 {
+			needUsage = false
+			result = compareRootStore(args[0], *rootStore)
+		}
+	case "compare-onecrl":
+		fs := flag.NewFlagSet("compare-onecrl", flag.ContinueOnError)
+		oneCRL := fs.String("onecrl", oneCRLURL, "the URL or filename of the OneCRL records")
+		addNetworkFlags(fs)
+		issuers := fs.String("issuers", "", "a directory of issuer certificates, used to find the SPKIs of the issuers named in OneCRL")
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) == 1 {
+			needUsage = false
+			result = compareOneCRL(args[0], *oneCRL, *issuers)
+		}
+	case "compare-disallowed":
+		fs := flag.NewFlagSet("compare-disallowed", flag.ContinueOnError)
+		ctl := fs.String("ctl", disallowedCTLURL, "the URL or filename of Microsoft's disallowed certificate list, as a CAB or STL file")
+		addNetworkFlags(fs)
+		fs.StringVar(&disallowedCertURL, "cert-url", disallowedCertURL, "the URL, or directory, from which disallowed certificates are fetched by SHA-1 hash")
+		issuers := fs.String("issuers", "", "a directory of issuer certificates, used to find the SPKIs of the issuers of disallowed certificates")
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) == 1 {
+			needUsage = false
+			result = compareDisallowed(args[0], *ctl, *issuers)
+		}
+	case "explain":
+		fs := flag.NewFlagSet("explain", flag.ContinueOnError)
+		intermediates := fs.String("intermediates", "", "a PEM bundle of intermediates used to complete the chain")
+		addSerialMatchFlag(fs)
+		addSerialFormatFlag(fs)
+		addInterceptionPolicyFlags(fs)
+		addOverrideFlags(fs)
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) == 2 {
+			needUsage = false
+			result = explain(args[0], args[1], *intermediates)
+		}
+	case "compare-chrome":
+		fs := flag.NewFlagSet("compare-chrome", flag.ContinueOnError)
+		userDataDir := fs.String("user-data-dir", "", "Chrome's user data directory, if not the default")
+		fs.StringVar(&crlset.OmahaURL, "omaha-url", crlset.OmahaURL, "the Omaha update endpoint to query")
+		fs.StringVar(&crlset.OmahaJSONURL, "omaha-json-url", crlset.OmahaJSONURL, "the Omaha protocol 3.1 endpoint to query")
+		fs.StringVar(&omahaProtocol, "omaha-protocol", omahaProtocol, "the Omaha protocol to use: xml, json or auto")
+		addNetworkFlags(fs)
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) == 0 {
+			needUsage = false
+			result = compareChrome(*userDataDir)
+		}
+	case "freshness":
+		fs := flag.NewFlagSet("freshness", flag.ContinueOnError)
+		filename := fs.String("file", "", "the CRLSet file to check")
+		maxAge := fs.Duration("max-age", 7*24*time.Hour, "how long after it's superseded a CRLSet becomes critical")
+		fs.StringVar(&crlset.OmahaURL, "omaha-url", crlset.OmahaURL, "the Omaha update endpoint to query")
+		fs.StringVar(&crlset.OmahaJSONURL, "omaha-json-url", crlset.OmahaJSONURL, "the Omaha protocol 3.1 endpoint to query")
+		fs.StringVar(&omahaProtocol, "omaha-protocol", omahaProtocol, "the Omaha protocol to use: xml, json or auto")
+		addNetworkFlags(fs)
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) == 0 && len(*filename) > 0 {
+			if status := freshness(*filename, *maxAge); status != freshnessOK {
+				finishTracing(false)
+				os.Exit(status)
+			}
+			needUsage = false
+			result = true
+		}
+	case "export-crls":
+		fs := flag.NewFlagSet("export-crls", flag.ContinueOnError)
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) >= 2 {
+			needUsage = false
+			result = exportCRLs(args[0], args[2:], args[1])
+		}
+	case "crl-bundle":
+		fs := flag.NewFlagSet("crl-bundle", flag.ContinueOnError)
+		output := fs.String("o", "", "write the bundle to this file rather than stdout")
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) >= 2 {
+			needUsage = false
+			result = exportCRLBundle(args[0], args[1:], *output)
+		}
+	case "export":
+		fs := flag.NewFlagSet("export", flag.ContinueOnError)
+		redisURL := fs.String("redis", "", "load the CRLSet into the Redis server at this redis:// or rediss:// URL")
+		bigQueryTable := fs.String("bigquery", "", "append the CRLSet's rows to this BigQuery table, given as project.dataset.table")
+		bigQueryToken := fs.String("bigquery-token", "", "the OAuth access token to use with --bigquery")
+		clickHouseURL := fs.String("clickhouse", "", "insert the CRLSet's rows through the ClickHouse HTTP interface at this URL")
+		clickHouseTable := fs.String("clickhouse-table", "crlsets", "the ClickHouse table to use with --clickhouse")
+		pgDSN := fs.String("pg-dsn", "", "copy the CRLSet's rows into the PostgreSQL database at this postgres:// URL")
+		pgTable := fs.String("pg-table", "crlset_entries", "the PostgreSQL table to use with --pg-dsn")
+		addNetworkFlags(fs)
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) == 1 && (len(*redisURL) > 0 || len(*bigQueryTable) > 0 || len(*clickHouseURL) > 0 || len(*pgDSN) > 0) {
+			needUsage = false
+			result = true
+			if len(*redisURL) > 0 {
+				result = exportRedis(args[0], *redisURL) && result
+			}
+			if len(*bigQueryTable) > 0 {
+				result = exportBigQuery(args[0], *bigQueryTable, *bigQueryToken) && result
+			}
+			if len(*clickHouseURL) > 0 {
+				result = exportClickHouse(args[0], *clickHouseURL, *clickHouseTable) && result
+			}
+			if len(*pgDSN) > 0 {
+				result = exportPostgres(args[0], *pgDSN, *pgTable) && result
+			}
+		}
+	case "envoy-config":
+		fs := flag.NewFlagSet("envoy-config", flag.ContinueOnError)
+		output := fs.String("o", "", "write the config to this file rather than stdout")
+		name := fs.String("name", "crlset", "the name of the SDS secret")
+		trustedCA := fs.String("trusted-ca", "", "a PEM file of CAs to include as trusted_ca")
+		args, err := parseArgs(fs, os.Args[2:])
+		if err != nil {
+			break
+		}
+		if len(args) >= 2 {
+			needUsage = false
+			result = exportEnvoyConfig(args[0], args[1:], *name, *trustedCA, *output)
+		}
+	}
+
+	if needUsage {
+		usage()
+	}
+	finishTracing(result)
 
+	if interrupted.Err() != nil {
+		fmt.Fprintf(os.Stderr, "Interrupted\n")
+		os.Exit(interruptedExitCode)
+	}
 	if !result {
 		os.Exit(1)
 	}
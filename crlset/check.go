@@ -0,0 +1,522 @@
+// Copyright (c) 2012 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file of the Chromium repository.
+
+package crlset
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// SerialMatchMode selects how serials are compared when matching
+// certificates and serials against a CRLSet.
+type SerialMatchMode int
+
+const (
+	// SerialMatchChrome does what Chrome's CRLSet::CheckSerial does:
+	// leading zero bytes are stripped from the serial being checked, which
+	// is then compared exactly with the CRLSet's serials, so a serial that
+	// the CRLSet lists with a leading zero byte never matches.
+	SerialMatchChrome SerialMatchMode = iota
+	// SerialMatchUnsigned strips leading zero bytes from the CRLSet's
+	// serials too.
+	SerialMatchUnsigned
+)
+
+// NormalizeSerial strips the leading zero bytes from a serial that's being
+// checked, as Chrome does.
+func NormalizeSerial(serial []byte) []byte {
+	for len(serial) > 1 && serial[0] == 0 {
+		serial = serial[1:]
+	}
+	return serial
+}
+
+// normalizeListed returns a serial from a CRLSet in the form that mode
+// compares.
+func (mode SerialMatchMode) normalizeListed(serial []byte) []byte {
+	if mode == SerialMatchUnsigned {
+		return NormalizeSerial(serial)
+	}
+	return serial
+}
+
+// Match reports whether serial matches listed, a serial from a CRLSet, under
+// mode.
+func (mode SerialMatchMode) Match(listed, serial []byte) bool {
+	return bytes.Equal(mode.normalizeListed(listed), NormalizeSerial(serial))
+}
+
+// SerialBytes returns serial as it's looked up in a CRLSet. Chrome strips the
+// leading zero bytes from the contents of the DER INTEGER, so that's the
+// big-endian value without a padding byte before a set high bit. Chrome never
+// finds negative serials, which some CAs have issued, to be revoked, so
+// SerialBytes returns nil for them.
+func SerialBytes(serial *big.Int) []byte {
+	if serial.Sign() < 0 {
+		return nil
+	}
+	if serial.Sign() == 0 {
+		return []byte{0}
+	}
+	return serial.Bytes()
+}
+
+// SPKIHash returns the SHA-256 hash of cert's SubjectPublicKeyInfo, which is
+// how CRLSets identify keys.
+func SPKIHash(cert *x509.Certificate) []byte {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hash[:]
+}
+
+// serialIndex is a compact, read-only index of the serials revoked under each
+// SPKI, for checking large numbers of certificates without a map entry, and a
+// copy of the SPKI hash, per serial.
+//
+// Each SPKI's serials are sorted and front coded: a serial is stored as the
+// number of leading bytes it shares with the previous one, the number of
+// remaining bytes and then those bytes. Every serialIndexRestart'th serial is
+// stored in full so that a lookup can binary search for the right block and
+// then decode only that block. Serials in a CRLSet are at most 255 bytes, so
+// the counts fit in a byte.
+type serialIndex map[[SPKIHashLen]byte]*serialBlocks
+
+// serialBlocks holds the front coded serials for one SPKI.
+type serialBlocks struct {
+	data []byte
+	// restarts are the offsets in data of the serials stored in full.
+	restarts []uint32
+}
+
+const serialIndexRestart = 16
+
+// newSerialIndex indexes the serials in entries, in the form that mode
+// compares.
+func newSerialIndex(entries []Entry, mode SerialMatchMode) serialIndex {
+	bySPKI := make(map[[SPKIHashLen]byte][][]byte)
+	for _, entry := range entries {
+		var hash [SPKIHashLen]byte
+		copy(hash[:], entry.SPKIHash)
+		for _, serial := range entry.Serials {
+			bySPKI[hash] = append(bySPKI[hash], mode.normalizeListed(serial))
+		}
+	}
+
+	index := make(serialIndex, len(bySPKI))
+	for hash, serials := range bySPKI {
+		sort.Slice(serials, func(i, j int) bool {
+			return bytes.Compare(serials[i], serials[j]) < 0
+		})
+		blocks := &serialBlocks{}
+		var previous []byte
+		n := 0
+		for _, serial := range serials {
+			if n > 0 && bytes.Equal(serial, previous) {
+				continue
+			}
+			shared := 0
+			if n%serialIndexRestart == 0 {
+				blocks.restarts = append(blocks.restarts, uint32(len(blocks.data)))
+			} else {
+				for shared < len(serial) && shared < len(previous) && serial[shared] == previous[shared] {
+					shared++
+				}
+			}
+			blocks.data = append(blocks.data, byte(shared), byte(len(serial)-shared))
+			blocks.data = append(blocks.data, serial[shared:]...)
+			previous = serial
+			n++
+		}
+		index[hash] = blocks
+	}
+	return index
+}
+
+// contains reports whether serial is revoked under spkiHash.
+func (index serialIndex) contains(spkiHash, serial []byte) bool {
+	var hash [SPKIHashLen]byte
+	copy(hash[:], spkiHash)
+	blocks, ok := index[hash]
+	if !ok {
+		return false
+	}
+	serial = NormalizeSerial(serial)
+
+	// Find the last block whose first serial isn't after serial.
+	fullSerial := func(offset uint32) []byte {
+		return blocks.data[offset+2 : offset+2+uint32(blocks.data[offset+1])]
+	}
+	block := sort.Search(len(blocks.restarts), func(i int) bool {
+		return bytes.Compare(fullSerial(blocks.restarts[i]), serial) > 0
+	}) - 1
+	if block < 0 {
+		return false
+	}
+
+	end := uint32(len(blocks.data))
+	if block+1 < len(blocks.restarts) {
+		end = blocks.restarts[block+1]
+	}
+	var current []byte
+	for offset := blocks.restarts[block]; offset < end; {
+		shared, length := int(blocks.data[offset]), uint32(blocks.data[offset+1])
+		current = append(current[:shared], blocks.data[offset+2:offset+2+length]...)
+		offset += 2 + length
+		switch bytes.Compare(current, serial) {
+		case 0:
+			return true
+		case 1:
+			return false
+		}
+	}
+	return false
+}
+
+// Checker checks certificates against a CRLSet. Serials can only be checked
+// when the certificate's issuer is known, so Check finds issuers among the
+// certificates that have been added with Add.
+type Checker struct {
+	// KnownInterception and BlockedInterception say how certificates
+	// whose SPKIs are in KnownInterceptionSPKIs and BlockedInterceptionSPKIs
+	// are treated: "ignore", "warn" or "fail". NewChecker sets them to what
+	// Chrome does, but a deployment behind a sanctioned TLS-inspecting proxy
+	// may want to ignore the proxy's key, while one that should never see
+	// interception may want any sign of it to fail.
+	KnownInterception   string
+	BlockedInterception string
+	// FormatSerial formats serials in the messages of problems. NewChecker
+	// sets it to hex.EncodeToString.
+	FormatSerial func(serial []byte) string
+
+	set                 *CRLSet
+	blocked             map[[SPKIHashLen]byte]bool
+	knownInterception   map[[SPKIHashLen]byte]bool
+	blockedInterception map[[SPKIHashLen]byte]bool
+	revoked             serialIndex
+	// bySubject indexes the added certificates by their raw subject.
+	bySubject map[string][]*x509.Certificate
+}
+
+// NewChecker returns a Checker for set that compares serials under mode. The
+// serials are indexed, so set mustn't be modified afterwards.
+func NewChecker(set *CRLSet, mode SerialMatchMode) *Checker {
+	c := &Checker{
+		KnownInterception:   "warn",
+		BlockedInterception: "fail",
+		FormatSerial:        hex.EncodeToString,
+		set:                 set,
+		blocked:             make(map[[SPKIHashLen]byte]bool),
+		knownInterception:   make(map[[SPKIHashLen]byte]bool),
+		blockedInterception: make(map[[SPKIHashLen]byte]bool),
+		revoked:             newSerialIndex(set.Entries, mode),
+		bySubject:           make(map[string][]*x509.Certificate),
+	}
+	for _, hash := range set.Header.BlockedSPKIHashes() {
+		c.blocked[hash] = true
+	}
+	for _, hash := range set.Header.KnownInterceptionSPKIHashes() {
+		c.knownInterception[hash] = true
+	}
+	for _, hash := range set.Header.BlockedInterceptionSPKIHashes() {
+		c.blockedInterception[hash] = true
+	}
+	return c
+}
+
+// CRLSet returns the set that c checks against.
+func (c *Checker) CRLSet() *CRLSet {
+	return c.set
+}
+
+// Add makes cert available as a potential issuer of other certificates.
+func (c *Checker) Add(cert *x509.Certificate) {
+	for _, existing := range c.bySubject[string(cert.RawSubject)] {
+		if existing.Equal(cert) {
+			return
+		}
+	}
+	c.bySubject[string(cert.RawSubject)] = append(c.bySubject[string(cert.RawSubject)], cert)
+}
+
+// issuers returns the added certificates that have signed cert.
+func (c *Checker) issuers(cert *x509.Certificate) []*x509.Certificate {
+	var issuers []*x509.Certificate
+	for _, candidate := range c.bySubject[string(cert.RawIssuer)] {
+		if candidate != cert && cert.CheckSignatureFrom(candidate) == nil {
+			issuers = append(issuers, candidate)
+		}
+	}
+	return issuers
+}
+
+// Problem is a way in which a certificate is affected by a CRLSet.
+type Problem struct {
+	// Rule identifies the kind of problem, such as "revoked-serial", for
+	// machine-readable output.
+	Rule    string
+	Message string
+	// Warning is set for problems that cause Chrome to warn rather than
+	// block.
+	Warning bool
+}
+
+// appendInterceptionProblem appends problem to problems according to policy.
+func appendInterceptionProblem(problems []Problem, policy string, problem Problem) []Problem {
+	if policy == "ignore" {
+		return problems
+	}
+	problem.Warning = policy == "warn"
+	return append(problems, problem)
+}
+
+// IsRevoked reports whether serial is revoked under spkiHash.
+func (c *Checker) IsRevoked(spkiHash, serial []byte) bool {
+	return c.revoked.contains(spkiHash, serial)
+}
+
+// SPKIProblems describes how the header of the CRLSet treats the given SPKI
+// hash, if at all.
+func (c *Checker) SPKIProblems(hash [SPKIHashLen]byte) []Problem {
+	var problems []Problem
+	if c.blocked[hash] {
+		problems = append(problems, Problem{"blocked-spki", "blocked SPKI", false})
+	}
+	if c.blockedInterception[hash] {
+		problems = appendInterceptionProblem(problems, c.BlockedInterception, Problem{"blocked-interception-spki", "blocked interception SPKI", false})
+	}
+	if c.knownInterception[hash] {
+		problems = appendInterceptionProblem(problems, c.KnownInterception, Problem{"known-interception-spki", "known interception SPKI", true})
+	}
+	return problems
+}
+
+// Check returns the ways in which cert is affected by the CRLSet, which is
+// empty if the certificate is unaffected as far as can be determined.
+func (c *Checker) Check(cert *x509.Certificate) []Problem {
+	var hash [SPKIHashLen]byte
+	copy(hash[:], SPKIHash(cert))
+	problems := c.SPKIProblems(hash)
+
+	serial := SerialBytes(cert.SerialNumber)
+	for _, issuer := range c.issuers(cert) {
+		issuerHash := SPKIHash(issuer)
+		if serial != nil && c.revoked.contains(issuerHash, serial) {
+			problems = append(problems, Problem{"revoked-serial", fmt.Sprintf("serial %s revoked under SPKI %x", c.FormatSerial(serial), issuerHash), false})
+		}
+	}
+
+	// Walk up through the issuers, guarding against loops, to find any
+	// blocked SPKIs in the chain.
+	seen := map[*x509.Certificate]bool{cert: true}
+	queue := c.issuers(cert)
+	for len(queue) > 0 {
+		issuer := queue[0]
+		queue = queue[1:]
+		if seen[issuer] {
+			continue
+		}
+		seen[issuer] = true
+		var issuerHash [SPKIHashLen]byte
+		copy(issuerHash[:], SPKIHash(issuer))
+		for _, problem := range c.SPKIProblems(issuerHash) {
+			problem.Rule = "issuer-" + problem.Rule
+			problem.Message = fmt.Sprintf("chains to %s %x", problem.Message, issuerHash)
+			problems = append(problems, problem)
+		}
+		queue = append(queue, c.issuers(issuer)...)
+	}
+
+	return problems
+}
+
+// CheckChain returns the ways in which chain, which runs from a leaf to a
+// root with each certificate followed by its issuer, is affected by the
+// CRLSet. As in Chrome, each certificate's SPKI is looked up in the header and
+// each serial is looked up under the SPKI of the next certificate. Unlike
+// Check, it doesn't need the certificates to have been added.
+func (c *Checker) CheckChain(chain []*x509.Certificate) []Problem {
+	var problems []Problem
+	for i, cert := range chain {
+		var hash [SPKIHashLen]byte
+		copy(hash[:], SPKIHash(cert))
+		for _, problem := range c.SPKIProblems(hash) {
+			problem.Message = fmt.Sprintf("%s has %s %x", cert.Subject, problem.Message, hash)
+			problems = append(problems, problem)
+		}
+		if i+1 < len(chain) {
+			issuerHash := SPKIHash(chain[i+1])
+			serial := SerialBytes(cert.SerialNumber)
+			if serial != nil && c.revoked.contains(issuerHash, serial) {
+				problems = append(problems, Problem{"revoked-serial", fmt.Sprintf("%s has serial %s revoked under SPKI %x", cert.Subject, c.FormatSerial(serial), issuerHash), false})
+			}
+		}
+	}
+	return problems
+}
+
+// InterceptionMatch is a certificate whose SPKI a CRLSet lists as a TLS
+// interception key.
+type InterceptionMatch struct {
+	Cert *x509.Certificate
+	// Blocked is set if the SPKI is in BlockedInterceptionSPKIs, rather
+	// than KnownInterceptionSPKIs.
+	Blocked bool
+}
+
+// DetectInterception returns the certificates in chain whose SPKIs are
+// interception keys. If chain is what a server presented, completed with the
+// local roots, then any match means that the connection passed through a
+// TLS-inspecting middlebox.
+func (set *CRLSet) DetectInterception(chain []*x509.Certificate) []InterceptionMatch {
+	var matches []InterceptionMatch
+	for _, cert := range chain {
+		var hash [SPKIHashLen]byte
+		copy(hash[:], SPKIHash(cert))
+		for _, list := range []struct {
+			hashes  [][SPKIHashLen]byte
+			blocked bool
+		}{
+			{set.Header.BlockedInterceptionSPKIHashes(), true},
+			{set.Header.KnownInterceptionSPKIHashes(), false},
+		} {
+			for _, listed := range list.hashes {
+				if listed == hash {
+					matches = append(matches, InterceptionMatch{cert, list.blocked})
+				}
+			}
+		}
+	}
+	return matches
+}
+
+// statusCertificateError is the nonstandard status, used by nginx, for a
+// request whose client certificate was rejected.
+const statusCertificateError = 495
+
+// chainsProblems returns the problems, other than warnings, with chains if
+// every one of them has some, or nil if any chain is unaffected. Like Chrome's
+// path builder, it accepts a certificate if there's a path to a root that
+// avoids the CRLSet.
+func (c *Checker) chainsProblems(chains [][]*x509.Certificate) []Problem {
+	var problems []Problem
+	for _, chain := range chains {
+		var chainProblems []Problem
+		for _, problem := range c.CheckChain(chain) {
+			if !problem.Warning {
+				chainProblems = append(chainProblems, problem)
+			}
+		}
+		if len(chainProblems) == 0 {
+			return nil
+		}
+		problems = append(problems, chainProblems...)
+	}
+	return problems
+}
+
+// peerCertProblems returns chainsProblems for the peer's certificate chains
+// on a connection. The verified chains are checked if there are any, or else
+// the chain that the peer sent.
+func (c *Checker) peerCertProblems(state *tls.ConnectionState) []Problem {
+	chains := state.VerifiedChains
+	if len(chains) == 0 && len(state.PeerCertificates) > 0 {
+		chains = [][]*x509.Certificate{state.PeerCertificates}
+	}
+	return c.chainsProblems(chains)
+}
+
+// ChainError is returned by CheckChains when every chain is affected by the
+// CRLSet.
+type ChainError struct {
+	Sequence int
+	// Reasons describe how the chains are affected, such as which
+	// certificate is revoked.
+	Reasons []string
+}
+
+func newChainError(set *CRLSet, problems []Problem) *ChainError {
+	err := &ChainError{Sequence: set.Header.Sequence}
+	for _, problem := range problems {
+		err.Reasons = append(err.Reasons, problem.Message)
+	}
+	return err
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("certificate rejected by CRLSet %d: %s", e.Sequence, strings.Join(e.Reasons, "; "))
+}
+
+// CheckChains checks the chains returned by x509.Certificate.Verify against
+// the CRLSet, as Chrome would: each certificate's SPKI must not be blocked,
+// and its serial must not be revoked under its issuer's SPKI. It returns a
+// *ChainError if every chain is affected, and nil if any chain isn't, since
+// the certificate can then be trusted through that chain. Known interception
+// SPKIs, which only cause Chrome to warn, aren't an error.
+//
+// The serial index is built on the first call and kept, so the set mustn't be
+// modified after that.
+func (set *CRLSet) CheckChains(chains [][]*x509.Certificate) error {
+	set.checkerOnce.Do(func() {
+		set.checker = NewChecker(set, SerialMatchChrome)
+	})
+	if problems := set.checker.chainsProblems(chains); len(problems) > 0 {
+		return newChainError(set, problems)
+	}
+	return nil
+}
+
+// Handler returns an http.Handler that passes requests on to next unless
+// their TLS client certificate chain is affected by the CRLSet. Requests with
+// a revoked client certificate get status 495, and those whose chain has a
+// blocked SPKI get 403. Requests without a client certificate are passed on;
+// requiring one is up to the server's tls.Config. Local additions and
+// exceptions are made with Block and Unblock before calling Handler.
+func (set *CRLSet) Handler(next http.Handler) http.Handler {
+	checker := NewChecker(set, SerialMatchChrome)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		problems := checker.peerCertProblems(r.TLS)
+		if len(problems) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, problem := range problems {
+			if problem.Rule == "revoked-serial" {
+				http.Error(w, "Client certificate revoked", statusCertificateError)
+				return
+			}
+		}
+		http.Error(w, "Client certificate chain blocked", http.StatusForbidden)
+	})
+}
+
+// ConfigureTLS makes config reject, during the handshake, client and server
+// certificate chains that are affected by the CRLSet, after any
+// VerifyConnection callback that config already has.
+func (set *CRLSet) ConfigureTLS(config *tls.Config) {
+	checker := NewChecker(set, SerialMatchChrome)
+	previous := config.VerifyConnection
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if previous != nil {
+			if err := previous(state); err != nil {
+				return err
+			}
+		}
+		if problems := checker.peerCertProblems(&state); len(problems) > 0 {
+			return newChainError(set, problems)
+		}
+		return nil
+	}
+}
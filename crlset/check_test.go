@@ -0,0 +1,257 @@
+// Copyright (c) 2012 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file of the Chromium repository.
+
+package crlset
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestSerialIndex(t *testing.T) {
+	hashA, hashB := testHash(0xaa), testHash(0x11)
+	// Enough serials, sharing prefixes, to span several restart blocks.
+	var serials [][]byte
+	for i := 0; i < 3*serialIndexRestart+5; i++ {
+		serials = append(serials, []byte{0x01, 0x02, byte(i * 3)})
+	}
+	serials = append(serials, []byte{0x07}, []byte{0xff, 0xff, 0xff, 0xff}, []byte{0x01, 0x02, 0x03})
+	index := newSerialIndex([]Entry{
+		{hashA[:], serials},
+		{hashB[:], [][]byte{{0x42}}},
+	}, SerialMatchChrome)
+
+	tests := []struct {
+		name   string
+		hash   [SPKIHashLen]byte
+		serial []byte
+		want   bool
+	}{
+		{"first", hashA, []byte{0x01, 0x02, 0x00}, true},
+		{"block boundary", hashA, []byte{0x01, 0x02, byte(serialIndexRestart * 3)}, true},
+		{"last in prefix run", hashA, []byte{0x01, 0x02, byte((3*serialIndexRestart + 4) * 3)}, true},
+		{"between serials", hashA, []byte{0x01, 0x02, 0x04}, false},
+		{"before all", hashA, []byte{0x00}, false},
+		{"after all", hashA, []byte{0xff, 0xff, 0xff, 0xff, 0x00}, false},
+		{"prefix of a serial", hashA, []byte{0x01, 0x02}, false},
+		{"short serial", hashA, []byte{0x07}, true},
+		{"long serial", hashA, []byte{0xff, 0xff, 0xff, 0xff}, true},
+		{"other SPKI", hashB, []byte{0x42}, true},
+		{"wrong SPKI", hashB, []byte{0x07}, false},
+		{"unknown SPKI", testHash(0x00), []byte{0x07}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := index.contains(test.hash[:], test.serial); got != test.want {
+				t.Errorf("contains(%x) = %t, want %t", test.serial, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSerialMatchMode(t *testing.T) {
+	tests := []struct {
+		mode           SerialMatchMode
+		listed, serial []byte
+		want           bool
+	}{
+		{SerialMatchChrome, []byte{0x07}, []byte{0x07}, true},
+		{SerialMatchChrome, []byte{0x80}, []byte{0x00, 0x80}, true},
+		{SerialMatchChrome, []byte{0x07}, []byte{0x00, 0x00, 0x07}, true},
+		{SerialMatchChrome, []byte{0x00, 0x80}, []byte{0x00, 0x80}, false},
+		{SerialMatchChrome, []byte{0x00}, []byte{0x00}, true},
+		{SerialMatchUnsigned, []byte{0x00, 0x80}, []byte{0x00, 0x80}, true},
+		{SerialMatchUnsigned, []byte{0x00, 0x80}, []byte{0x80}, true},
+		{SerialMatchUnsigned, []byte{0x80}, []byte{0x81}, false},
+	}
+	for _, test := range tests {
+		if got := test.mode.Match(test.listed, test.serial); got != test.want {
+			t.Errorf("Mode %d: Match(%x, %x) = %t, want %t", test.mode, test.listed, test.serial, got, test.want)
+		}
+		index := newSerialIndex([]Entry{{make([]byte, SPKIHashLen), [][]byte{test.listed}}}, test.mode)
+		if got := index.contains(make([]byte, SPKIHashLen), test.serial); got != test.want {
+			t.Errorf("Mode %d: contains(%x) with %x listed = %t, want %t", test.mode, test.serial, test.listed, got, test.want)
+		}
+	}
+}
+
+func TestSerialBytes(t *testing.T) {
+	tests := []struct {
+		serial *big.Int
+		want   string
+	}{
+		{big.NewInt(1), "01"},
+		{big.NewInt(0x0102), "0102"},
+		{big.NewInt(0x80), "80"},
+		{big.NewInt(0x8001), "8001"},
+		{big.NewInt(0), "00"},
+		{big.NewInt(-1), ""},
+	}
+	for _, test := range tests {
+		if got := fmt.Sprintf("%x", SerialBytes(test.serial)); got != test.want {
+			t.Errorf("SerialBytes(%s) = %s, want %s", test.serial, got, test.want)
+		}
+	}
+}
+
+// testCert is a certificate and its key, for building test chains.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert returns a certificate with the given serial, issued by issuer,
+// or self-signed if issuer is nil.
+func newTestCert(t *testing.T, name string, serial int64, issuer *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  issuer == nil,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	parent, signer := template, key
+	if issuer != nil {
+		parent, signer = issuer.cert, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert, key}
+}
+
+// spkiHash returns c's SPKI hash as an array.
+func (c *testCert) spkiHash() [SPKIHashLen]byte {
+	return sha256.Sum256(c.cert.RawSubjectPublicKeyInfo)
+}
+
+// headerList returns the JSON for a list of SPKI hashes in a CRLSet header.
+func headerList(hashes ...[SPKIHashLen]byte) string {
+	out := "["
+	for i, hash := range hashes {
+		if i > 0 {
+			out += ","
+		}
+		out += `"` + base64.StdEncoding.EncodeToString(hash[:]) + `"`
+	}
+	return out + "]"
+}
+
+func TestCheckChains(t *testing.T) {
+	root := newTestCert(t, "Root", 1, nil)
+	otherRoot := newTestCert(t, "Other Root", 1, nil)
+	leaf := newTestCert(t, "Leaf", 0x0102, root)
+	revokedLeaf := newTestCert(t, "Revoked Leaf", 0x07, root)
+	// DER pads this serial to 00 80 1f, but the CRLSet, like Chrome, has
+	// it without the padding byte.
+	highBitLeaf := newTestCert(t, "High Bit Leaf", 0x801f, root)
+	// Go won't issue a certificate with a negative serial, but it will
+	// parse one, so the serial is negated after issuance.
+	negativeLeaf := newTestCert(t, "Negative Leaf", 0x07, root)
+	negativeLeaf.cert.SerialNumber.Neg(negativeLeaf.cert.SerialNumber)
+	interception := newTestCert(t, "Interception", 1, nil)
+	interceptedLeaf := newTestCert(t, "Intercepted Leaf", 2, interception)
+
+	rootHash := root.spkiHash()
+	set, err := Parse(rawCRLSet(
+		`{"Sequence":9,"BlockedSPKIs":`+headerList(otherRoot.spkiHash())+
+			`,"KnownInterceptionSPKIs":`+headerList(interception.spkiHash())+`}`,
+		Entry{rootHash[:], [][]byte{{0x07}, {0x80, 0x1f}, {0xf9}}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		chains [][]*x509.Certificate
+		want   bool
+	}{
+		{"clean", [][]*x509.Certificate{{leaf.cert, root.cert}}, false},
+		{"revoked serial", [][]*x509.Certificate{{revokedLeaf.cert, root.cert}}, true},
+		{"revoked high bit serial", [][]*x509.Certificate{{highBitLeaf.cert, root.cert}}, true},
+		{"negative serial is unknown", [][]*x509.Certificate{{negativeLeaf.cert, root.cert}}, false},
+		{"blocked root", [][]*x509.Certificate{{otherRoot.cert}}, true},
+		{"known interception only warns", [][]*x509.Certificate{{interceptedLeaf.cert, interception.cert}}, false},
+		{"one clean chain is enough", [][]*x509.Certificate{{otherRoot.cert}, {leaf.cert, root.cert}}, false},
+		{"every chain affected", [][]*x509.Certificate{{otherRoot.cert}, {revokedLeaf.cert, root.cert}}, true},
+		{"no chains", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := set.CheckChains(test.chains)
+			var chainErr *ChainError
+			if got := errors.As(err, &chainErr); got != test.want {
+				t.Fatalf("CheckChains = %v, want error %t", err, test.want)
+			}
+			if chainErr != nil && chainErr.Sequence != 9 {
+				t.Errorf("ChainError.Sequence = %d, want 9", chainErr.Sequence)
+			}
+		})
+	}
+}
+
+func TestCheckerCheck(t *testing.T) {
+	root := newTestCert(t, "Root", 1, nil)
+	blocked := newTestCert(t, "Blocked", 1, nil)
+	leaf := newTestCert(t, "Leaf", 0x07, root)
+	blockedLeaf := newTestCert(t, "Blocked Leaf", 3, blocked)
+
+	rootHash := root.spkiHash()
+	set, err := Parse(rawCRLSet(
+		`{"Sequence":1,"BlockedInterceptionSPKIs":`+headerList(blocked.spkiHash())+`}`,
+		Entry{rootHash[:], [][]byte{{0x07}}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		cert      *x509.Certificate
+		policy    string
+		wantRules []string
+	}{
+		{"revoked", leaf.cert, "fail", []string{"revoked-serial"}},
+		{"root unaffected", root.cert, "fail", nil},
+		{"blocked interception issuer", blockedLeaf.cert, "fail", []string{"issuer-blocked-interception-spki"}},
+		{"blocked interception ignored", blockedLeaf.cert, "ignore", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checker := NewChecker(set, SerialMatchChrome)
+			checker.BlockedInterception = test.policy
+			for _, cert := range []*x509.Certificate{root.cert, blocked.cert, leaf.cert, blockedLeaf.cert} {
+				checker.Add(cert)
+			}
+			problems := checker.Check(test.cert)
+			var rules []string
+			for _, problem := range problems {
+				rules = append(rules, problem.Rule)
+			}
+			if fmt.Sprint(rules) != fmt.Sprint(test.wantRules) {
+				t.Errorf("Check rules = %v, want %v", rules, test.wantRules)
+			}
+		})
+	}
+}
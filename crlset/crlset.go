@@ -0,0 +1,467 @@
+// Copyright (c) 2012 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file of the Chromium repository.
+
+// Package crlset parses, builds and serializes CRLSets, the lists of revoked
+// certificates and blocked keys that Chrome downloads, verifies the CRXs that
+// they're distributed in, and checks certificates against them as Chrome
+// does. The crlset command is built on it.
+package crlset
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Errors that ExtractCRX and Parse return, possibly wrapped, so that
+// callers can use errors.Is to tell corrupt input apart from a failure to
+// verify it. Network failures are reported as *url.Error.
+var (
+	// ErrTruncated means that a CRLSet or CRX ended early.
+	ErrTruncated = errors.New("truncated")
+	// ErrNotCRX means that a file isn't a CRX at all.
+	ErrNotCRX = errors.New("File doesn't look like a CRX")
+	// ErrBadHeader means that a CRLSet's JSON header is invalid.
+	ErrBadHeader = errors.New("Failed to parse header")
+	// ErrSignature means that a CRX isn't validly signed by a trusted key.
+	ErrSignature = errors.New("Signature verification failure")
+)
+
+// Header is the JSON header found in CRLSet files.
+type Header struct {
+	Sequence   int
+	NumParents int
+	// NotAfter, if non-zero, is the Unix time after which the CRLSet should
+	// be considered stale.
+	NotAfter int64
+	// BlockedSPKIs contains the base64 encoded SHA-256 hashes of
+	// SubjectPublicKeyInfos which are blocked regardless of serial number.
+	BlockedSPKIs []string
+	// KnownInterceptionSPKIs and BlockedInterceptionSPKIs contain the base64
+	// encoded SHA-256 hashes of keys known to be used by TLS interception
+	// products. Chrome warns about the former and blocks the latter.
+	KnownInterceptionSPKIs   []string
+	BlockedInterceptionSPKIs []string
+
+	blockedSPKIs             [][SPKIHashLen]byte
+	knownInterceptionSPKIs   [][SPKIHashLen]byte
+	blockedInterceptionSPKIs [][SPKIHashLen]byte
+}
+
+// decodeSPKIHashes decodes a list of base64 encoded SPKI hashes.
+func decodeSPKIHashes(b64s []string) ([][SPKIHashLen]byte, error) {
+	var hashes [][SPKIHashLen]byte
+	for _, b64 := range b64s {
+		spki, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil || len(spki) != SPKIHashLen {
+			return nil, fmt.Errorf("%w: invalid SPKI hash %q", ErrBadHeader, b64)
+		}
+		var hash [SPKIHashLen]byte
+		copy(hash[:], spki)
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+// DecodeSPKIs decodes the SPKI hash lists in the header, so that the accessors
+// needn't return errors. Parse and Build call it, and it must be called again
+// after the lists are modified.
+func (h *Header) DecodeSPKIs() (err error) {
+	if h.blockedSPKIs, err = decodeSPKIHashes(h.BlockedSPKIs); err != nil {
+		return err
+	}
+	if h.knownInterceptionSPKIs, err = decodeSPKIHashes(h.KnownInterceptionSPKIs); err != nil {
+		return err
+	}
+	h.blockedInterceptionSPKIs, err = decodeSPKIHashes(h.BlockedInterceptionSPKIs)
+	return err
+}
+
+// BlockedSPKIHashes returns the hashes of SubjectPublicKeyInfos which are
+// blocked regardless of serial number, in header order.
+func (h *Header) BlockedSPKIHashes() [][SPKIHashLen]byte {
+	return h.blockedSPKIs
+}
+
+// KnownInterceptionSPKIHashes returns the hashes of keys known to be used
+// for TLS interception, in header order.
+func (h *Header) KnownInterceptionSPKIHashes() [][SPKIHashLen]byte {
+	return h.knownInterceptionSPKIs
+}
+
+// BlockedInterceptionSPKIHashes returns the hashes of TLS interception keys
+// which are blocked, in header order.
+func (h *Header) BlockedInterceptionSPKIHashes() [][SPKIHashLen]byte {
+	return h.blockedInterceptionSPKIs
+}
+
+// Entry holds the revoked serial numbers for a single issuer, which is
+// identified by the SHA-256 hash of its SubjectPublicKeyInfo.
+type Entry struct {
+	SPKIHash []byte
+	Serials  [][]byte
+}
+
+// CRLSet is a parsed CRLSet file.
+type CRLSet struct {
+	Header Header
+	// Entries are the SPKI sections, in file order unless the set has been
+	// sorted or normalized.
+	Entries []Entry
+
+	// rawHeader contains the JSON header exactly as it appeared in the file,
+	// so that fields which we don't parse are preserved on output.
+	rawHeader []byte
+	// parsedHeader is Header as it was parsed from rawHeader, which is used
+	// to detect whether Header has since been modified.
+	parsedHeader Header
+
+	// checker is built by CheckChains on first use.
+	checkerOnce sync.Once
+	checker     *Checker
+}
+
+// SPKIHashLen is the length of the SHA-256 hashes that identify
+// SubjectPublicKeyInfos in CRLSets.
+const SPKIHashLen = 32
+
+// RawHeader returns the JSON header exactly as it appeared in the file, or as
+// it was last re-encoded by Normalize, including fields that Header doesn't
+// parse.
+func (set *CRLSet) RawHeader() []byte {
+	return set.rawHeader
+}
+
+// Parse parses the contents of a CRLSet file.
+func Parse(c []byte) (*CRLSet, error) {
+	if len(c) < 2 {
+		return nil, fmt.Errorf("CRLSet %w at header length", ErrTruncated)
+	}
+
+	headerLen := int(c[0]) | int(c[1])<<8
+	c = c[2:]
+
+	if len(c) < headerLen {
+		return nil, fmt.Errorf("CRLSet %w at header", ErrTruncated)
+	}
+	headerBytes := c[:headerLen]
+	c = c[headerLen:]
+
+	set := &CRLSet{rawHeader: headerBytes}
+	if err := json.Unmarshal(headerBytes, &set.Header); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadHeader, err)
+	}
+	if err := set.Header.DecodeSPKIs(); err != nil {
+		return nil, err
+	}
+	set.parsedHeader = set.Header
+
+	for len(c) > 0 {
+		if len(c) < SPKIHashLen {
+			return nil, fmt.Errorf("CRLSet %w at SPKI hash", ErrTruncated)
+		}
+		entry := Entry{SPKIHash: c[:SPKIHashLen]}
+		c = c[SPKIHashLen:]
+
+		if len(c) < 4 {
+			return nil, fmt.Errorf("CRLSet %w at serial count", ErrTruncated)
+		}
+		numSerials := uint32(c[0]) | uint32(c[1])<<8 | uint32(c[2])<<16 | uint32(c[3])<<24
+		c = c[4:]
+
+		for i := uint32(0); i < numSerials; i++ {
+			if len(c) < 1 {
+				return nil, fmt.Errorf("CRLSet %w at serial length", ErrTruncated)
+			}
+			serialLen := int(c[0])
+			c = c[1:]
+
+			if len(c) < serialLen {
+				return nil, fmt.Errorf("CRLSet %w at serial", ErrTruncated)
+			}
+			entry.Serials = append(entry.Serials, c[:serialLen])
+			c = c[serialLen:]
+		}
+
+		set.Entries = append(set.Entries, entry)
+	}
+
+	return set, nil
+}
+
+// Decode parses c, which may either be a bare CRLSet or the CRX that it's
+// distributed in. A CRX's signature is verified before the CRLSet is
+// extracted from it, and only Chrome's CRLSet key is trusted.
+func Decode(c []byte) (*CRLSet, error) {
+	return (*Verifier)(nil).Decode(c)
+}
+
+// Decode is like the function of the same name, but also accepts CRXs signed
+// with v's trusted keys.
+func (v *Verifier) Decode(c []byte) (*CRLSet, error) {
+	if bytes.HasPrefix(c, []byte("Cr24")) {
+		var err error
+		if c, err = v.ExtractCRX(bytes.NewReader(c), int64(len(c))); err != nil {
+			return nil, err
+		}
+	}
+	return Parse(c)
+}
+
+// Sort puts the SPKI sections, and the serials within each section, into
+// ascending byte order so that the output for a given set is canonical.
+func (set *CRLSet) Sort() {
+	sort.Slice(set.Entries, func(i, j int) bool {
+		return bytes.Compare(set.Entries[i].SPKIHash, set.Entries[j].SPKIHash) < 0
+	})
+	for _, entry := range set.Entries {
+		serials := entry.Serials
+		sort.Slice(serials, func(i, j int) bool {
+			return bytes.Compare(serials[i], serials[j]) < 0
+		})
+	}
+}
+
+// Normalize merges duplicate SPKI sections, removes duplicate serials, sorts
+// the result and re-encodes the header canonically. Two sets which contain the
+// same information will marshal to the same bytes after being normalized.
+func (set *CRLSet) Normalize() error {
+	headerBytes, err := set.encodeHeader()
+	if err != nil {
+		return err
+	}
+	// Marshaling a map sorts the keys, and RawMessages are compacted.
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(headerBytes, &fields); err != nil {
+		return fmt.Errorf("Failed to parse header: %s", err)
+	}
+	if set.rawHeader, err = json.Marshal(fields); err != nil {
+		return err
+	}
+	set.parsedHeader = set.Header
+
+	var entries []Entry
+	index := make(map[string]int)
+	for _, entry := range set.Entries {
+		i, ok := index[string(entry.SPKIHash)]
+		if !ok {
+			i = len(entries)
+			index[string(entry.SPKIHash)] = i
+			entries = append(entries, Entry{SPKIHash: entry.SPKIHash})
+		}
+		entries[i].Serials = append(entries[i].Serials, entry.Serials...)
+	}
+	set.Entries = entries
+	set.Sort()
+
+	for i, entry := range set.Entries {
+		var serials [][]byte
+		for j, serial := range entry.Serials {
+			if j == 0 || !bytes.Equal(serial, entry.Serials[j-1]) {
+				serials = append(serials, serial)
+			}
+		}
+		set.Entries[i].Serials = serials
+	}
+
+	return nil
+}
+
+// encodeHeader returns the JSON encoding of set's header. If the header hasn't
+// been modified since it was parsed then the original bytes are returned, so
+// that unmodified sets round-trip exactly. Otherwise the header's fields are
+// merged into the original so that any fields we don't parse are preserved.
+func (set *CRLSet) encodeHeader() ([]byte, error) {
+	current, err := json.Marshal(&set.Header)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := json.Marshal(&set.parsedHeader)
+	if err != nil {
+		return nil, err
+	}
+	if len(set.rawHeader) > 0 && bytes.Equal(current, parsed) {
+		return set.rawHeader, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if len(set.rawHeader) > 0 {
+		if err := json.Unmarshal(set.rawHeader, &fields); err != nil {
+			return nil, fmt.Errorf("Failed to parse header: %s", err)
+		}
+	} else {
+		// A set that wasn't parsed needs the fields that Chrome checks for.
+		fields = map[string]json.RawMessage{
+			"ContentType": json.RawMessage(`"CRLSet"`),
+			"Version":     json.RawMessage("0"),
+		}
+	}
+	var updated map[string]json.RawMessage
+	if err := json.Unmarshal(current, &updated); err != nil {
+		return nil, err
+	}
+	for name, value := range updated {
+		if string(value) == "null" {
+			// Chrome expects lists, even when they're empty.
+			value = json.RawMessage("[]")
+		}
+		fields[name] = value
+	}
+	return json.Marshal(fields)
+}
+
+// Marshal serializes set in the CRLSet file format. A set that was parsed and
+// not modified is reproduced byte for byte.
+func (set *CRLSet) Marshal() ([]byte, error) {
+	header, err := set.encodeHeader()
+	if err != nil {
+		return nil, err
+	}
+	if len(header) > 0xffff {
+		return nil, errors.New("CRLSet header too long")
+	}
+
+	var out bytes.Buffer
+	out.WriteByte(byte(len(header)))
+	out.WriteByte(byte(len(header) >> 8))
+	out.Write(header)
+
+	for _, entry := range set.Entries {
+		if len(entry.SPKIHash) != SPKIHashLen {
+			return nil, fmt.Errorf("SPKI hash %x has the wrong length", entry.SPKIHash)
+		}
+		out.Write(entry.SPKIHash)
+		numSerials := uint32(len(entry.Serials))
+		out.Write([]byte{byte(numSerials), byte(numSerials >> 8), byte(numSerials >> 16), byte(numSerials >> 24)})
+
+		for _, serial := range entry.Serials {
+			if len(serial) > 0xff {
+				return nil, fmt.Errorf("Serial %x is too long", serial)
+			}
+			out.WriteByte(byte(len(serial)))
+			out.Write(serial)
+		}
+	}
+
+	return out.Bytes(), nil
+}
+
+// Block adds a local entry to set, so that it's treated like the CRLSet's
+// own: serial, if not nil, is revoked under spki, and otherwise spki is
+// blocked outright. Call Normalize before marshaling the set.
+func (set *CRLSet) Block(spki [SPKIHashLen]byte, serial []byte) error {
+	if serial == nil {
+		set.Header.BlockedSPKIs = append(set.Header.BlockedSPKIs, base64.StdEncoding.EncodeToString(spki[:]))
+		return set.Header.DecodeSPKIs()
+	}
+	if len(serial) > 0xff {
+		return fmt.Errorf("Serial %x is too long", serial)
+	}
+	set.Entries = append(set.Entries, Entry{
+		SPKIHash: append([]byte(nil), spki[:]...),
+		Serials:  [][]byte{append([]byte(nil), serial...)},
+	})
+	return nil
+}
+
+// Unblock removes an entry from set, to keep trusting something that the
+// CRLSet affects. If serial is not nil, the serials under spki that match it
+// under mode are removed. Otherwise spki's section is removed
+// along with any mention of spki in the header's lists. Unblock reports
+// whether set contained the entry.
+func (set *CRLSet) Unblock(spki [SPKIHashLen]byte, serial []byte, mode SerialMatchMode) (bool, error) {
+	found := false
+	var entries []Entry
+	for _, entry := range set.Entries {
+		if !bytes.Equal(entry.SPKIHash, spki[:]) {
+			entries = append(entries, entry)
+			continue
+		}
+		if serial == nil {
+			found = true
+			continue
+		}
+		var serials [][]byte
+		for _, listed := range entry.Serials {
+			if mode.Match(listed, serial) {
+				found = true
+			} else {
+				serials = append(serials, listed)
+			}
+		}
+		if len(serials) > 0 {
+			entries = append(entries, Entry{SPKIHash: entry.SPKIHash, Serials: serials})
+		}
+	}
+	set.Entries = entries
+
+	if serial == nil {
+		encoded := base64.StdEncoding.EncodeToString(spki[:])
+		for _, list := range []*[]string{&set.Header.BlockedSPKIs, &set.Header.KnownInterceptionSPKIs, &set.Header.BlockedInterceptionSPKIs} {
+			var kept []string
+			for _, element := range *list {
+				if element == encoded {
+					found = true
+				} else {
+					kept = append(kept, element)
+				}
+			}
+			*list = kept
+		}
+	}
+	return found, set.Header.DecodeSPKIs()
+}
+
+// Builder constructs a CRLSet from scratch. The zero value is an empty set with
+// sequence number zero.
+type Builder struct {
+	header  Header
+	entries []Entry
+}
+
+// SetSequence sets the sequence number of the set being built.
+func (b *Builder) SetSequence(sequence int) {
+	b.header.Sequence = sequence
+}
+
+// AddBlockedSPKI adds spki to the header's list of SPKIs which are blocked
+// regardless of serial number.
+func (b *Builder) AddBlockedSPKI(spki [SPKIHashLen]byte) {
+	b.header.BlockedSPKIs = append(b.header.BlockedSPKIs, base64.StdEncoding.EncodeToString(spki[:]))
+}
+
+// AddSerial records that the certificate with the given serial, issued under
+// spki, is revoked. serial is the big-endian encoding of the serial number.
+func (b *Builder) AddSerial(spki [SPKIHashLen]byte, serial []byte) {
+	b.entries = append(b.entries, Entry{
+		SPKIHash: append([]byte(nil), spki[:]...),
+		Serials:  [][]byte{append([]byte(nil), serial...)},
+	})
+}
+
+// Build returns the set that has been described, in normalized form. The
+// Builder may continue to be used afterwards.
+func (b *Builder) Build() (*CRLSet, error) {
+	set := &CRLSet{Header: b.header}
+	set.Header.BlockedSPKIs = append([]string(nil), b.header.BlockedSPKIs...)
+	for _, entry := range b.entries {
+		for _, serial := range entry.Serials {
+			if len(serial) > 0xff {
+				return nil, fmt.Errorf("Serial %x is too long", serial)
+			}
+		}
+		set.Entries = append(set.Entries, entry)
+	}
+	if err := set.Header.DecodeSPKIs(); err != nil {
+		return nil, err
+	}
+	if err := set.Normalize(); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
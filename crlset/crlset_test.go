@@ -0,0 +1,227 @@
+// Copyright (c) 2012 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file of the Chromium repository.
+
+package crlset
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+// testHash returns an SPKI hash filled with b.
+func testHash(b byte) [SPKIHashLen]byte {
+	var hash [SPKIHashLen]byte
+	for i := range hash {
+		hash[i] = b
+	}
+	return hash
+}
+
+// rawCRLSet returns a CRLSet file with the given JSON header and sections.
+func rawCRLSet(header string, entries ...Entry) []byte {
+	out := []byte{byte(len(header)), byte(len(header) >> 8)}
+	out = append(out, header...)
+	for _, entry := range entries {
+		out = append(out, entry.SPKIHash...)
+		n := len(entry.Serials)
+		out = append(out, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+		for _, serial := range entry.Serials {
+			out = append(out, byte(len(serial)))
+			out = append(out, serial...)
+		}
+	}
+	return out
+}
+
+func TestParseMarshalRoundTrip(t *testing.T) {
+	hashA, hashB := testHash(0xaa), testHash(0x11)
+	tests := []struct {
+		name string
+		file []byte
+	}{
+		{"empty", rawCRLSet(`{"Sequence":1}`)},
+		{"unparsed header fields", rawCRLSet(`{"ContentType":"CRLSet","Version":0,"Sequence":7001,"NumParents":2,"Extra":{"kept":true}}`)},
+		{"sections out of order", rawCRLSet(`{"Sequence":2}`,
+			Entry{hashA[:], [][]byte{{0x07}, {0x01, 0x02}}},
+			Entry{hashB[:], [][]byte{{0x10}}})},
+		{"empty section", rawCRLSet(`{"Sequence":3}`, Entry{hashA[:], nil})},
+		{"blocked SPKIs", rawCRLSet(`{"Sequence":4,"BlockedSPKIs":["` + base64.StdEncoding.EncodeToString(hashB[:]) + `"]}`)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			set, err := Parse(test.file)
+			if err != nil {
+				t.Fatalf("Parse: %s", err)
+			}
+			out, err := set.Marshal()
+			if err != nil {
+				t.Fatalf("Marshal: %s", err)
+			}
+			if !bytes.Equal(out, test.file) {
+				t.Errorf("Marshal = %x, want %x", out, test.file)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	hash := testHash(0xaa)
+	valid := rawCRLSet(`{"Sequence":1}`, Entry{hash[:], [][]byte{{0x01, 0x02}}})
+	tests := []struct {
+		name string
+		file []byte
+		want error
+	}{
+		{"no header length", valid[:1], ErrTruncated},
+		{"short header", valid[:5], ErrTruncated},
+		{"short SPKI hash", valid[:len(valid)-10], ErrTruncated},
+		{"short serial", valid[:len(valid)-1], ErrTruncated},
+		{"bad JSON", rawCRLSet(`{"Sequence":`), ErrBadHeader},
+		{"bad SPKI hash", rawCRLSet(`{"BlockedSPKIs":["AAAA"]}`), ErrBadHeader},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Parse(test.file); !errors.Is(err, test.want) {
+				t.Errorf("Parse error = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestModifiedHeaderKeepsUnparsedFields(t *testing.T) {
+	set, err := Parse(rawCRLSet(`{"Sequence":1,"Extra":"kept"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	set.Header.Sequence = 2
+	out, err := set.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reparsed, err := Parse(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reparsed.Header.Sequence != 2 {
+		t.Errorf("Sequence = %d, want 2", reparsed.Header.Sequence)
+	}
+	if !bytes.Contains(reparsed.RawHeader(), []byte(`"Extra":"kept"`)) {
+		t.Errorf("header %s lost the Extra field", reparsed.RawHeader())
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	hashA, hashB := testHash(0xaa), testHash(0x11)
+	var b Builder
+	b.SetSequence(42)
+	b.AddBlockedSPKI(hashB)
+	b.AddSerial(hashA, []byte{0x07})
+	b.AddSerial(hashB, []byte{0x10})
+	b.AddSerial(hashA, []byte{0x01, 0x02})
+	b.AddSerial(hashA, []byte{0x07})
+	set, err := b.Build()
+	if err != nil {
+		t.Fatalf("Build: %s", err)
+	}
+
+	out, err := set.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %s", err)
+	}
+	parsed, err := Parse(out)
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	if parsed.Header.Sequence != 42 {
+		t.Errorf("Sequence = %d, want 42", parsed.Header.Sequence)
+	}
+	if blocked := parsed.Header.BlockedSPKIHashes(); len(blocked) != 1 || blocked[0] != hashB {
+		t.Errorf("BlockedSPKIHashes = %x, want [%x]", blocked, hashB)
+	}
+	// Sections are merged and sorted, and duplicate serials removed.
+	want := []Entry{
+		{hashB[:], [][]byte{{0x10}}},
+		{hashA[:], [][]byte{{0x01, 0x02}, {0x07}}},
+	}
+	if len(parsed.Entries) != len(want) {
+		t.Fatalf("got %d sections, want %d", len(parsed.Entries), len(want))
+	}
+	for i, entry := range parsed.Entries {
+		if !bytes.Equal(entry.SPKIHash, want[i].SPKIHash) || len(entry.Serials) != len(want[i].Serials) {
+			t.Errorf("section %d = %x %x, want %x %x", i, entry.SPKIHash, entry.Serials, want[i].SPKIHash, want[i].Serials)
+			continue
+		}
+		for j, serial := range entry.Serials {
+			if !bytes.Equal(serial, want[i].Serials[j]) {
+				t.Errorf("section %d serial %d = %x, want %x", i, j, serial, want[i].Serials[j])
+			}
+		}
+	}
+
+	// Normalizing an already normalized set changes nothing.
+	if err := parsed.Normalize(); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := parsed.Marshal(); err != nil || !bytes.Equal(again, out) {
+		t.Errorf("Marshal after Normalize = %x, %v, want %x", again, err, out)
+	}
+}
+
+func TestBuilderRejectsLongSerial(t *testing.T) {
+	var b Builder
+	b.AddSerial(testHash(1), make([]byte, 256))
+	if _, err := b.Build(); err == nil {
+		t.Error("Build accepted a 256 byte serial")
+	}
+}
+
+func TestBlockUnblock(t *testing.T) {
+	hashA, hashB, hashC := testHash(0xaa), testHash(0x11), testHash(0x22)
+	set, err := Parse(rawCRLSet(
+		`{"Sequence":1,"KnownInterceptionSPKIs":["`+base64.StdEncoding.EncodeToString(hashC[:])+`"]}`,
+		Entry{hashA[:], [][]byte{{0x01, 0x02}, {0x07}}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := set.Block(hashB, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := set.Block(hashB, []byte{0x42}); err != nil {
+		t.Fatal(err)
+	}
+	if blocked := set.Header.BlockedSPKIHashes(); len(blocked) != 1 || blocked[0] != hashB {
+		t.Errorf("BlockedSPKIHashes = %x, want [%x]", blocked, hashB)
+	}
+
+	tests := []struct {
+		name   string
+		spki   [SPKIHashLen]byte
+		serial []byte
+		want   bool
+	}{
+		{"padded serial", hashA, []byte{0x00, 0x01, 0x02}, true},
+		{"already removed", hashA, []byte{0x01, 0x02}, false},
+		{"interception only SPKI", hashC, nil, true},
+		{"blocked SPKI and its section", hashB, nil, true},
+		{"absent", testHash(0x33), nil, false},
+	}
+	for _, test := range tests {
+		found, err := set.Unblock(test.spki, test.serial, SerialMatchChrome)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if found != test.want {
+			t.Errorf("%s: Unblock = %t, want %t", test.name, found, test.want)
+		}
+	}
+
+	if len(set.Entries) != 1 || len(set.Entries[0].Serials) != 1 || !bytes.Equal(set.Entries[0].Serials[0], []byte{0x07}) {
+		t.Errorf("Entries = %x, want only serial 07 under %x", set.Entries, hashA)
+	}
+	if len(set.Header.BlockedSPKIHashes()) != 0 || len(set.Header.KnownInterceptionSPKIHashes()) != 0 {
+		t.Errorf("header still lists SPKIs: %+v", set.Header)
+	}
+}
@@ -0,0 +1,330 @@
+// Copyright (c) 2012 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file of the Chromium repository.
+
+package crlset
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// AppID is the hex(ish) encoded public key hash of the key that signs
+// the CRL sets, which is also the ID of the CRLSet component in Omaha.
+const AppID = "hfnkpimlhhgieaddgfemjhofmfblmnib"
+
+// crxHeader reflects the binary header of a CRX file. In CRX3 files the
+// PubKeyBytes field is instead the length of the protobuf header and SigBytes
+// is the start of that header.
+type crxHeader struct {
+	Magic       [4]byte
+	Version     uint32
+	PubKeyBytes uint32
+	SigBytes    uint32
+}
+
+// Verifier checks the signatures on CRXs. A nil or zero Verifier trusts only
+// Chrome's CRLSet key.
+type Verifier struct {
+	// TrustedKeys holds the SHA-256 hashes of the SubjectPublicKeyInfos of
+	// keys, besides Chrome's CRLSet key, that are trusted to sign CRXs.
+	// This allows for a rotation of Google's key, or for CRLSets that are
+	// signed internally.
+	TrustedKeys [][SPKIHashLen]byte
+}
+
+// isTrustedKey reports whether a CRX signed by the key with the given
+// SubjectPublicKeyInfo is accepted. appId is the key's extension ID.
+func (v *Verifier) isTrustedKey(pubKeyBytes []byte, appId string) bool {
+	if appId == AppID {
+		return true
+	}
+	if v == nil {
+		return false
+	}
+	hash := sha256.Sum256(pubKeyBytes)
+	for _, trusted := range v.TrustedKeys {
+		if trusted == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// crxAppId returns the extension ID for the first 16 bytes of a public key
+// hash. AppIds use a different hex character set, "a" to "p", so the hash is
+// converted into it.
+func crxAppId(hash []byte) string {
+	pubKeyHash := fmt.Sprintf("%x", hash[:16])
+	appId := make([]byte, len(pubKeyHash))
+	for i := range pubKeyHash {
+		if pubKeyHash[i] < 97 {
+			appId[i] = pubKeyHash[i] + 49
+		} else {
+			appId[i] = pubKeyHash[i] + 10
+		}
+	}
+	return string(appId)
+}
+
+// ExtractCRX verifies the signature on the CRX in crxFile, which is crxLen
+// bytes long, and returns the contents of the CRLSet inside it. Only CRXs
+// signed with Chrome's CRLSet key are accepted.
+func ExtractCRX(crxFile io.ReaderAt, crxLen int64) ([]byte, error) {
+	return (*Verifier)(nil).ExtractCRX(crxFile, crxLen)
+}
+
+// ExtractCRX is like the function of the same name, but also accepts CRXs
+// signed with v's trusted keys. Both the original CRX format and CRX3 are
+// supported.
+func (v *Verifier) ExtractCRX(crxFile io.ReaderAt, crxLen int64) ([]byte, error) {
+	crx := io.NewSectionReader(crxFile, 0, crxLen)
+
+	var header crxHeader
+	if err := binary.Read(crx, binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("CRX %w at header", ErrTruncated)
+	}
+	if !bytes.Equal(header.Magic[:], []byte("Cr24")) {
+		return nil, ErrNotCRX
+	}
+	if header.Version == 3 {
+		return v.extractCRX3(crxFile, crxLen)
+	}
+
+	headerLen := int64(binary.Size(header))
+	if int64(header.PubKeyBytes)+int64(header.SigBytes) > crxLen-headerLen {
+		return nil, ErrNotCRX
+	}
+
+	pubKeyBytes := make([]byte, header.PubKeyBytes)
+	sigBytes := make([]byte, header.SigBytes)
+	if _, err := io.ReadFull(crx, pubKeyBytes); err != nil {
+		return nil, fmt.Errorf("Failed to read CRX public key: %s", err)
+	}
+	if _, err := io.ReadFull(crx, sigBytes); err != nil {
+		return nil, fmt.Errorf("Failed to read CRX signature: %s", err)
+	}
+
+	pubKey, err := x509.ParsePKIXPublicKey(pubKeyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to parse public key: %s", ErrSignature, err)
+	}
+	rsaPubKey, ok := pubKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: not signed with an RSA key", ErrSignature)
+	}
+
+	pubKeyHash := sha256.Sum256(pubKeyBytes)
+	if appId := crxAppId(pubKeyHash[:]); !v.isTrustedKey(pubKeyBytes, appId) {
+		return nil, fmt.Errorf("%w: public key mismatch (%s)", ErrSignature, appId)
+	}
+
+	zipOffset := headerLen + int64(header.PubKeyBytes) + int64(header.SigBytes)
+	zipReader := io.NewSectionReader(crxFile, zipOffset, crxLen-zipOffset)
+
+	sha1Hash := sha1.New()
+	if _, err := io.Copy(sha1Hash, zipReader); err != nil {
+		return nil, fmt.Errorf("Failed to read CRX: %s", err)
+	}
+
+	if err := rsa.VerifyPKCS1v15(rsaPubKey, crypto.SHA1, sha1Hash.Sum(nil), sigBytes); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrSignature, err)
+	}
+
+	return readCRLSetFromZip(zipReader)
+}
+
+// crx3SignatureContext is prefixed to the signed data of a CRX3 file.
+const crx3SignatureContext = "CRX3 SignedData\x00"
+
+// Field numbers of the CRX3 header protobufs, from Chromium's
+// components/crx_file/crx3.proto.
+const (
+	crx3SHA256WithRSA   = 2     // CrxFileHeader.sha256_with_rsa
+	crx3SHA256WithECDSA = 3     // CrxFileHeader.sha256_with_ecdsa
+	crx3SignedHeader    = 10000 // CrxFileHeader.signed_header_data
+	crx3PublicKey       = 1     // AsymmetricKeyProof.public_key
+	crx3Signature       = 2     // AsymmetricKeyProof.signature
+	crx3CRXId           = 1     // SignedData.crx_id
+)
+
+// protoFields decodes the length-delimited fields of a protobuf message,
+// keyed by field number. Other wire types are skipped.
+func protoFields(b []byte) (map[uint64][][]byte, error) {
+	fields := make(map[uint64][][]byte)
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errors.New("invalid protobuf tag")
+		}
+		b = b[n:]
+		switch tag & 7 {
+		case 0:
+			if _, n = binary.Uvarint(b); n <= 0 {
+				return nil, errors.New("invalid protobuf varint")
+			}
+			b = b[n:]
+		case 1, 5:
+			size := 8
+			if tag&7 == 5 {
+				size = 4
+			}
+			if len(b) < size {
+				return nil, errors.New("protobuf truncated")
+			}
+			b = b[size:]
+		case 2:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || length > uint64(len(b)-n) {
+				return nil, errors.New("protobuf truncated")
+			}
+			fields[tag>>3] = append(fields[tag>>3], b[n:n+int(length)])
+			b = b[n+int(length):]
+		default:
+			return nil, fmt.Errorf("unsupported protobuf wire type %d", tag&7)
+		}
+	}
+	return fields, nil
+}
+
+// extractCRX3 verifies a CRX3 file and returns the CRLSet inside it. At
+// least one signature must be from a trusted key, and the crx_id in the
+// signed header must be the CRLSet's app ID or the ID of a trusted key that
+// signed it. An update response delivering a different component is
+// therefore rejected even if it's validly signed.
+func (v *Verifier) extractCRX3(crxFile io.ReaderAt, crxLen int64) ([]byte, error) {
+	var prefix [12]byte
+	if _, err := crxFile.ReadAt(prefix[:], 0); err != nil {
+		return nil, fmt.Errorf("CRX %w at header", ErrTruncated)
+	}
+	headerLen := int64(binary.LittleEndian.Uint32(prefix[8:]))
+	if headerLen > crxLen-int64(len(prefix)) {
+		return nil, fmt.Errorf("CRX %w in header", ErrTruncated)
+	}
+	headerBytes := make([]byte, headerLen)
+	if _, err := crxFile.ReadAt(headerBytes, int64(len(prefix))); err != nil {
+		return nil, fmt.Errorf("Failed to read CRX header: %s", err)
+	}
+	header, err := protoFields(headerBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse CRX header: %s", err)
+	}
+
+	if len(header[crx3SignedHeader]) != 1 {
+		return nil, fmt.Errorf("%w: CRX has no signed header", ErrSignature)
+	}
+	signedHeader := header[crx3SignedHeader][0]
+	signedData, err := protoFields(signedHeader)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse CRX signed header: %s", err)
+	}
+	if len(signedData[crx3CRXId]) != 1 || len(signedData[crx3CRXId][0]) != 16 {
+		return nil, fmt.Errorf("%w: CRX has no valid crx_id", ErrSignature)
+	}
+	crxId := crxAppId(signedData[crx3CRXId][0])
+
+	zipOffset := int64(len(prefix)) + headerLen
+	zipReader := io.NewSectionReader(crxFile, zipOffset, crxLen-zipOffset)
+
+	h := sha256.New()
+	h.Write([]byte(crx3SignatureContext))
+	binary.Write(h, binary.LittleEndian, uint32(len(signedHeader)))
+	h.Write(signedHeader)
+	if _, err := io.Copy(h, zipReader); err != nil {
+		return nil, fmt.Errorf("Failed to read CRX: %s", err)
+	}
+	digest := h.Sum(nil)
+
+	// signers holds the IDs of the trusted keys whose signatures verified.
+	signers := make(map[string]bool)
+	var lastErr error = fmt.Errorf("%w: no signature by a trusted key", ErrSignature)
+	for _, algorithm := range []uint64{crx3SHA256WithRSA, crx3SHA256WithECDSA} {
+		for _, proofBytes := range header[algorithm] {
+			proof, err := protoFields(proofBytes)
+			if err != nil || len(proof[crx3PublicKey]) != 1 || len(proof[crx3Signature]) != 1 {
+				continue
+			}
+			pubKeyBytes, sigBytes := proof[crx3PublicKey][0], proof[crx3Signature][0]
+			pubKeyHash := sha256.Sum256(pubKeyBytes)
+			signer := crxAppId(pubKeyHash[:])
+			if !v.isTrustedKey(pubKeyBytes, signer) {
+				continue
+			}
+			pubKey, err := x509.ParsePKIXPublicKey(pubKeyBytes)
+			if err != nil {
+				lastErr = fmt.Errorf("%w: failed to parse public key: %s", ErrSignature, err)
+				continue
+			}
+			switch key := pubKey.(type) {
+			case *rsa.PublicKey:
+				if algorithm != crx3SHA256WithRSA {
+					continue
+				}
+				if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, sigBytes); err != nil {
+					lastErr = fmt.Errorf("%w: %s", ErrSignature, err)
+					continue
+				}
+			case *ecdsa.PublicKey:
+				if algorithm != crx3SHA256WithECDSA || !ecdsa.VerifyASN1(key, digest, sigBytes) {
+					lastErr = fmt.Errorf("%w: invalid ECDSA signature", ErrSignature)
+					continue
+				}
+			default:
+				continue
+			}
+			signers[signer] = true
+		}
+	}
+	if len(signers) == 0 {
+		return nil, lastErr
+	}
+	if crxId != AppID && !signers[crxId] {
+		return nil, fmt.Errorf("%w: CRX is for %s rather than the CRLSet (%s) or a trusted signer", ErrSignature, crxId, AppID)
+	}
+
+	return readCRLSetFromZip(zipReader)
+}
+
+// readCRLSetFromZip returns the contents of the crl-set file in the ZIP
+// archive that forms the body of a CRX.
+func readCRLSetFromZip(zipReader *io.SectionReader) ([]byte, error) {
+	z, err := zip.NewReader(zipReader, zipReader.Size())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse ZIP file: %s", err)
+	}
+
+	var crlFile *zip.File
+	for _, file := range z.File {
+		if file.Name == "crl-set" {
+			crlFile = file
+			break
+		}
+	}
+
+	if crlFile == nil {
+		return nil, errors.New("CRX didn't contain a CRLSet")
+	}
+
+	crlSetReader, err := crlFile.Open()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open crl-set in ZIP: %s", err)
+	}
+	defer crlSetReader.Close()
+
+	crlSetBytes, err := ioutil.ReadAll(crlSetReader)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read crl-set in ZIP: %s", err)
+	}
+	return crlSetBytes, nil
+}
@@ -0,0 +1,230 @@
+// Copyright (c) 2012 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file of the Chromium repository.
+
+package crlset
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// crxZip returns a ZIP archive holding crlSet as its crl-set file.
+func crxZip(t *testing.T, crlSet []byte) []byte {
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+	w, err := z.Create("crl-set")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(crlSet)
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// buildCRX2 returns a CRX2 file holding body, signed by key.
+func buildCRX2(t *testing.T, key *rsa.PrivateKey, body []byte) []byte {
+	pubKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha1.Sum(body)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA1, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, crxHeader{
+		Magic:       [4]byte{'C', 'r', '2', '4'},
+		Version:     2,
+		PubKeyBytes: uint32(len(pubKey)),
+		SigBytes:    uint32(len(sig)),
+	})
+	buf.Write(pubKey)
+	buf.Write(sig)
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// protoField returns a length-delimited protobuf field.
+func protoField(field uint64, value []byte) []byte {
+	out := binary.AppendUvarint(nil, field<<3|2)
+	out = binary.AppendUvarint(out, uint64(len(value)))
+	return append(out, value...)
+}
+
+// appIdBytes converts an extension ID back into the 16 bytes it encodes.
+func appIdBytes(appId string) []byte {
+	out := make([]byte, len(appId)/2)
+	for i := range out {
+		out[i] = (appId[2*i]-'a')<<4 | (appId[2*i+1] - 'a')
+	}
+	return out
+}
+
+// buildCRX3 returns a CRX3 file holding body for the extension appId, signed
+// by key, which is an *rsa.PrivateKey or an *ecdsa.PrivateKey.
+func buildCRX3(t *testing.T, key crypto.Signer, appId string, body []byte) []byte {
+	signedHeader := protoField(crx3CRXId, appIdBytes(appId))
+	h := sha256.New()
+	h.Write([]byte(crx3SignatureContext))
+	binary.Write(h, binary.LittleEndian, uint32(len(signedHeader)))
+	h.Write(signedHeader)
+	h.Write(body)
+	sig, err := key.Sign(rand.Reader, h.Sum(nil), crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	algorithm := uint64(crx3SHA256WithRSA)
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		algorithm = crx3SHA256WithECDSA
+	}
+	proof := append(protoField(crx3PublicKey, pubKey), protoField(crx3Signature, sig)...)
+	header := append(protoField(algorithm, proof), protoField(crx3SignedHeader, signedHeader)...)
+
+	var buf bytes.Buffer
+	buf.WriteString("Cr24")
+	binary.Write(&buf, binary.LittleEndian, uint32(3))
+	binary.Write(&buf, binary.LittleEndian, uint32(len(header)))
+	buf.Write(header)
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// keyHash returns the SHA-256 hash of key's SubjectPublicKeyInfo.
+func keyHash(t *testing.T, key crypto.Signer) [SPKIHashLen]byte {
+	pubKey, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sha256.Sum256(pubKey)
+}
+
+// keyAppId returns the extension ID of CRXs signed by key.
+func keyAppId(t *testing.T, key crypto.Signer) string {
+	hash := keyHash(t, key)
+	return crxAppId(hash[:])
+}
+
+// errAny is used in tests that expect an error but not a particular one.
+var errAny = errors.New("any error")
+
+func TestExtractCRX(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	untrusted, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &Verifier{TrustedKeys: [][SPKIHashLen]byte{keyHash(t, rsaKey), keyHash(t, ecKey)}}
+
+	crlSet := rawCRLSet(`{"Sequence":1}`)
+	body := crxZip(t, crlSet)
+	tampered := crxZip(t, rawCRLSet(`{"Sequence":2}`))
+	noCRLSet := func() []byte {
+		var buf bytes.Buffer
+		z := zip.NewWriter(&buf)
+		z.Create("manifest.json")
+		z.Close()
+		return buf.Bytes()
+	}()
+
+	tests := []struct {
+		name    string
+		crx     []byte
+		wantErr error
+	}{
+		{"CRX2", buildCRX2(t, rsaKey, body), nil},
+		{"CRX3 RSA", buildCRX3(t, rsaKey, AppID, body), nil},
+		{"CRX3 ECDSA", buildCRX3(t, ecKey, AppID, body), nil},
+		// Internally signed CRLSets can use their signer's own ID.
+		{"CRX3 internally signed", buildCRX3(t, ecKey, keyAppId(t, ecKey), body), nil},
+		{"CRX3 other trusted key's ID", buildCRX3(t, ecKey, keyAppId(t, rsaKey), body), ErrSignature},
+		{"CRX3 untrusted key's ID", buildCRX3(t, untrusted, keyAppId(t, untrusted), body), ErrSignature},
+		{"not a CRX", []byte("PK\x03\x04 and some more bytes"), ErrNotCRX},
+		{"truncated", []byte("Cr24"), ErrTruncated},
+		{"CRX2 tampered", func() []byte {
+			crx := buildCRX2(t, rsaKey, body)
+			return append(crx[:len(crx)-len(body)], tampered...)
+		}(), ErrSignature},
+		{"CRX3 untrusted key", buildCRX3(t, untrusted, AppID, body), ErrSignature},
+		{"CRX3 other extension", buildCRX3(t, ecKey, "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", body), ErrSignature},
+		{"CRX3 tampered", func() []byte {
+			crx := buildCRX3(t, ecKey, AppID, body)
+			return append(crx[:len(crx)-len(body)], tampered...)
+		}(), ErrSignature},
+		{"no crl-set", buildCRX3(t, ecKey, AppID, noCRLSet), errAny},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := v.ExtractCRX(bytes.NewReader(test.crx), int64(len(test.crx)))
+			switch {
+			case test.wantErr == nil:
+				if err != nil {
+					t.Fatalf("ExtractCRX: %s", err)
+				}
+				if !bytes.Equal(got, crlSet) {
+					t.Errorf("ExtractCRX = %x, want %x", got, crlSet)
+				}
+			case err == nil:
+				t.Errorf("ExtractCRX succeeded, want %v", test.wantErr)
+			case test.wantErr != errAny && !errors.Is(err, test.wantErr):
+				t.Errorf("ExtractCRX error = %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+
+	// Without a Verifier, only Chrome's key is trusted.
+	crx := buildCRX3(t, ecKey, AppID, body)
+	if _, err := ExtractCRX(bytes.NewReader(crx), int64(len(crx))); !errors.Is(err, ErrSignature) {
+		t.Errorf("ExtractCRX error = %v, want %v", err, ErrSignature)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &Verifier{TrustedKeys: [][SPKIHashLen]byte{keyHash(t, key)}}
+
+	crlSet := rawCRLSet(`{"Sequence":5}`)
+	for name, file := range map[string][]byte{
+		"bare": crlSet,
+		"CRX":  buildCRX3(t, key, AppID, crxZip(t, crlSet)),
+	} {
+		t.Run(name, func(t *testing.T) {
+			set, err := v.Decode(file)
+			if err != nil {
+				t.Fatalf("Decode: %s", err)
+			}
+			if set.Header.Sequence != 5 {
+				t.Errorf("Sequence = %d, want 5", set.Header.Sequence)
+			}
+		})
+	}
+}
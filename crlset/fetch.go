@@ -0,0 +1,408 @@
+// Copyright (c) 2012 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file of the Chromium repository.
+
+package crlset
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// HTTPClient is the interface through which all HTTP requests are made. It is
+// satisfied by *http.Client. Programs can pass an instrumented client, one
+// with a custom transport, or a test double; where it's nil,
+// http.DefaultClient is used.
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// orDefault returns client, or http.DefaultClient if it's nil.
+func orDefault(client HTTPClient) HTTPClient {
+	if client == nil {
+		return http.DefaultClient
+	}
+	return client
+}
+
+// userAgent is sent with the requests that this package makes. Client's
+// transport may replace it.
+const userAgent = "crlset-tools"
+
+// newRequest returns a request, made with ctx, that carries userAgent.
+func newRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	return req, nil
+}
+
+// UpdateResponse and the related structures are the XML response of the legacy
+// Omaha protocol, as parsed by CheckForUpdate and served by mirrors. The
+// response looks like:
+//
+//	<?xml version="1.0" encoding="UTF-8"?>
+//	<gupdate xmlns="http://www.google.com/update2/response" protocol="2.0" server="prod">
+//	  <daystart elapsed_seconds="42913"/>
+//	  <app appid="hfnkpimlhhgieaddgfemjhofmfblmnib" status="ok">
+//	    <updatecheck codebase="http://www.gstatic.com/chrome/crlset/56/crl-set-14830555124393087472.crx.data" hash="" size="0" status="ok" version="56"/>
+//	  </app>
+//	</gupdate>
+type UpdateResponse struct {
+	XMLName  xml.Name    `xml:"gupdate"`
+	Xmlns    string      `xml:"xmlns,attr,omitempty"`
+	Protocol string      `xml:"protocol,attr,omitempty"`
+	Apps     []UpdateApp `xml:"app"`
+}
+
+type UpdateApp struct {
+	AppId       string `xml:"appid,attr"`
+	Status      string `xml:"status,attr,omitempty"`
+	UpdateCheck *UpdateCheck
+}
+
+type UpdateCheck struct {
+	XMLName xml.Name `xml:"updatecheck"`
+	URL     string   `xml:"codebase,attr,omitempty"`
+	Version string   `xml:"version,attr,omitempty"`
+	Status  string   `xml:"status,attr,omitempty"`
+}
+
+// OmahaURL is the update endpoint that is asked for the current CRLSet with
+// the legacy XML protocol. It can be pointed at an internal mirror.
+var OmahaURL = "http://clients2.google.com/service/update2/crx"
+
+// OmahaJSONURL is the endpoint for Omaha protocol 3.1 update checks.
+var OmahaJSONURL = "https://update.googleapis.com/service/update2/json"
+
+// CheckForUpdate asks Omaha for the current CRLSet and returns the URL of the
+// CRX containing it and its version, which is the same as the sequence number
+// in the CRLSet header. protocol is "xml" for the legacy update2/crx
+// protocol, "json" for protocol 3.1, or "auto" to try XML first and fall back
+// to JSON. Requests are made with client.
+func CheckForUpdate(ctx context.Context, client HTTPClient, protocol string) (crxURL, version string, err error) {
+	client = orDefault(client)
+	switch protocol {
+	case "xml":
+		return checkForUpdateXML(ctx, client)
+	case "json":
+		return checkForUpdateJSON(ctx, client)
+	case "auto":
+		if crxURL, version, err = checkForUpdateXML(ctx, client); err == nil {
+			return crxURL, version, nil
+		}
+		crxURL, version, jsonErr := checkForUpdateJSON(ctx, client)
+		if jsonErr != nil {
+			return "", "", fmt.Errorf("%s; with the JSON protocol: %s", err, jsonErr)
+		}
+		return crxURL, version, nil
+	}
+	return "", "", fmt.Errorf("Unknown Omaha protocol %q", protocol)
+}
+
+// checkForUpdateXML implements CheckForUpdate using the legacy XML protocol.
+func checkForUpdateXML(ctx context.Context, client HTTPClient) (crxURL, version string, err error) {
+	u, err := url.Parse(OmahaURL)
+	if err != nil {
+		return "", "", fmt.Errorf("Invalid Omaha URL: %s", err)
+	}
+	args := url.Values(make(map[string][]string))
+	args.Add("x", "id="+AppID+"&v=&uc")
+	u.RawQuery = args.Encode()
+
+	req, err := newRequest(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return "", "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to get current version: %s", err)
+	}
+
+	var reply UpdateResponse
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to read version reply: %s", err)
+	}
+	if err := xml.Unmarshal(bodyBytes, &reply); err != nil {
+		return "", "", fmt.Errorf("Failed to parse version reply: %s", err)
+	}
+
+	for _, app := range reply.Apps {
+		if app.AppId == AppID && app.UpdateCheck != nil {
+			crxURL = app.UpdateCheck.URL
+			version = app.UpdateCheck.Version
+			break
+		}
+	}
+
+	if len(crxURL) == 0 {
+		return "", "", errors.New("Failed to parse Omaha response")
+	}
+	return crxURL, version, nil
+}
+
+// omahaJSONRequest and omahaJSONResponse are the subsets of Omaha protocol
+// 3.1 messages that are needed for a CRLSet update check. See
+// https://github.com/google/omaha/blob/main/doc/ServerProtocolV3.md
+type omahaJSONRequest struct {
+	Request struct {
+		Protocol     string                `json:"protocol"`
+		Updater      string                `json:"@updater"`
+		AcceptFormat string                `json:"acceptformat"`
+		App          []omahaJSONRequestApp `json:"app"`
+	} `json:"request"`
+}
+
+type omahaJSONRequestApp struct {
+	AppID       string   `json:"appid"`
+	Version     string   `json:"version"`
+	UpdateCheck struct{} `json:"updatecheck"`
+}
+
+type omahaJSONResponse struct {
+	Response struct {
+		App []struct {
+			AppID       string `json:"appid"`
+			Status      string `json:"status"`
+			UpdateCheck struct {
+				Status string `json:"status"`
+				URLs   struct {
+					URL []struct {
+						Codebase string `json:"codebase"`
+					} `json:"url"`
+				} `json:"urls"`
+				Manifest struct {
+					Version  string `json:"version"`
+					Packages struct {
+						Package []struct {
+							Name string `json:"name"`
+						} `json:"package"`
+					} `json:"packages"`
+				} `json:"manifest"`
+			} `json:"updatecheck"`
+		} `json:"app"`
+	} `json:"response"`
+}
+
+// omahaJSONPrefix is prepended to JSON replies to prevent XSSI.
+const omahaJSONPrefix = ")]}'"
+
+// checkForUpdateJSON implements CheckForUpdate using Omaha protocol 3.1.
+func checkForUpdateJSON(ctx context.Context, client HTTPClient) (crxURL, version string, err error) {
+	var request omahaJSONRequest
+	request.Request.Protocol = "3.1"
+	request.Request.Updater = "crlset-tools"
+	request.Request.AcceptFormat = "crx2,crx3"
+	request.Request.App = []omahaJSONRequestApp{{AppID: AppID, Version: "0.0.0.0"}}
+
+	requestBytes, err := json.Marshal(request)
+	if err != nil {
+		return "", "", err
+	}
+
+	req, err := newRequest(ctx, "POST", OmahaJSONURL, bytes.NewReader(requestBytes))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to get current version: %s", err)
+	}
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to read version reply: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("Failed to get current version: %s", resp.Status)
+	}
+
+	var reply omahaJSONResponse
+	bodyBytes = bytes.TrimPrefix(bodyBytes, []byte(omahaJSONPrefix))
+	if err := json.Unmarshal(bodyBytes, &reply); err != nil {
+		return "", "", fmt.Errorf("Failed to parse version reply: %s", err)
+	}
+
+	for _, app := range reply.Response.App {
+		check := app.UpdateCheck
+		if app.AppID != AppID || check.Status != "ok" ||
+			len(check.URLs.URL) == 0 || len(check.Manifest.Packages.Package) == 0 {
+			continue
+		}
+		// Codebases are prefixes to which the package name is appended.
+		crxURL = check.URLs.URL[0].Codebase + check.Manifest.Packages.Package[0].Name
+		version = check.Manifest.Version
+		break
+	}
+
+	if len(crxURL) == 0 {
+		return "", "", errors.New("Failed to parse Omaha response")
+	}
+	return crxURL, version, nil
+}
+
+// MaxCRXSize is the largest CRX that Download accepts. Current CRLSets are
+// well under a megabyte.
+const MaxCRXSize = 64 << 20
+
+// Download asks Omaha for the current CRLSet, with client, and returns the
+// CRX containing it, which ExtractCRX or Decode verify.
+func Download(ctx context.Context, client HTTPClient) ([]byte, error) {
+	client = orDefault(client)
+	crxURL, _, err := CheckForUpdate(ctx, client, "auto")
+	if err != nil {
+		return nil, err
+	}
+	req, err := newRequest(ctx, "GET", crxURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to download %s: %s", crxURL, resp.Status)
+	}
+	crx, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxCRXSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to download %s: %s", crxURL, err)
+	}
+	if len(crx) > MaxCRXSize {
+		return nil, fmt.Errorf("%s is larger than %d bytes", crxURL, MaxCRXSize)
+	}
+	return crx, nil
+}
+
+// fetcherRetryInterval is how long a Fetcher waits after a failed refresh
+// before trying again.
+const fetcherRetryInterval = time.Minute
+
+// DefaultFetcherTTL is the TTL of a Fetcher that doesn't set one.
+const DefaultFetcherTTL = time.Hour
+
+// Fetcher keeps a CRLSet cached for programs that use this package. Once
+// the cached set is older than TTL, Get keeps returning it while a newer one
+// is fetched in the background, so callers don't wait on the network. Only
+// once it's older than MaxStale, or if there is none, does Get wait for a
+// fetch.
+type Fetcher struct {
+	// Fetch returns the current CRLSet, or a CRX containing one. It
+	// defaults to Download, using Client.
+	Fetch func(ctx context.Context) ([]byte, error)
+	// Client makes the requests of the default Fetch. If nil,
+	// http.DefaultClient is used.
+	Client HTTPClient
+	// TTL is how long a fetched CRLSet is used before it's refreshed. It
+	// defaults to DefaultFetcherTTL.
+	TTL time.Duration
+	// MaxStale, if non-zero, is how long since it was fetched a CRLSet can
+	// still be returned while it's being refreshed.
+	MaxStale time.Duration
+	// Verifier checks the signatures on fetched CRXs. If nil, only
+	// Chrome's CRLSet key is trusted.
+	Verifier *Verifier
+
+	mu      sync.Mutex
+	set     *CRLSet
+	fetched time.Time
+	// refreshed is closed when the refresh in progress, if any, finishes.
+	refreshed   chan struct{}
+	lastAttempt time.Time
+	lastErr     error
+}
+
+// Get returns the cached CRLSet, refreshing it in the background if it's
+// older than TTL. If there's no CRLSet, or the cached one is older than
+// MaxStale, Get waits for the refresh, or until ctx is done.
+func (f *Fetcher) Get(ctx context.Context) (*CRLSet, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	usable := func() bool {
+		return f.set != nil && (f.MaxStale == 0 || time.Since(f.fetched) < f.MaxStale)
+	}
+	ttl := f.TTL
+	if ttl <= 0 {
+		ttl = DefaultFetcherTTL
+	}
+	if f.set != nil && time.Since(f.fetched) < ttl {
+		return f.set, nil
+	}
+	if f.refreshed == nil && (f.lastErr == nil || time.Since(f.lastAttempt) >= fetcherRetryInterval) {
+		f.refreshed = make(chan struct{})
+		go f.refresh(f.refreshed)
+	}
+	if usable() {
+		return f.set, nil
+	}
+
+	if refreshed := f.refreshed; refreshed != nil {
+		f.mu.Unlock()
+		select {
+		case <-refreshed:
+		case <-ctx.Done():
+			f.mu.Lock()
+			return nil, ctx.Err()
+		}
+		f.mu.Lock()
+	}
+	if usable() {
+		return f.set, nil
+	}
+	if f.set == nil {
+		return nil, fmt.Errorf("failed to fetch CRLSet: %s", f.lastErr)
+	}
+	return nil, fmt.Errorf("CRLSet %d is %s old and refreshing it failed: %s", f.set.Header.Sequence, time.Since(f.fetched).Round(time.Second), f.lastErr)
+}
+
+// refresh fetches the current CRLSet and caches it, unless it's older than
+// the cached one, then closes refreshed.
+func (f *Fetcher) refresh(refreshed chan struct{}) {
+	set, err := f.fetch()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lastAttempt, f.lastErr = time.Now(), err
+	if err == nil {
+		if f.set == nil || set.Header.Sequence >= f.set.Header.Sequence {
+			f.set = set
+		}
+		f.fetched = time.Now()
+	}
+	f.refreshed = nil
+	close(refreshed)
+}
+
+// fetch downloads and parses the current CRLSet with f.Fetch. A refresh
+// isn't tied to any one caller of Get, so it isn't cancelled with their
+// contexts.
+func (f *Fetcher) fetch() (*CRLSet, error) {
+	fetch := f.Fetch
+	if fetch == nil {
+		fetch = func(ctx context.Context) ([]byte, error) {
+			return Download(ctx, f.Client)
+		}
+	}
+	contents, err := fetch(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return f.Verifier.Decode(contents)
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2012 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file of the Chromium repository.
+
+package crlset
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestFetcherDefaultTTL(t *testing.T) {
+	fetches := 0
+	f := &Fetcher{Fetch: func(ctx context.Context) ([]byte, error) {
+		fetches++
+		return rawCRLSet(`{"Sequence":1}`), nil
+	}}
+	for i := 0; i < 3; i++ {
+		set, err := f.Get(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if set.Header.Sequence != 1 {
+			t.Errorf("Get returned sequence %d, want 1", set.Header.Sequence)
+		}
+	}
+	// The first Get waits for the fetch, which finishes before it returns.
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if fetches != 1 {
+		t.Errorf("Fetched %d times with no TTL, want once", fetches)
+	}
+}
+
+// clientFunc is an HTTPClient that answers requests with a function.
+type clientFunc func(req *http.Request) (*http.Response, error)
+
+func (f clientFunc) Do(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestFetcherClient(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crx := buildCRX3(t, key, AppID, crxZip(t, rawCRLSet(`{"Sequence":9}`)))
+	const crxURL = "http://mirror.example/crlset-9.crx"
+
+	var requested []string
+	f := &Fetcher{
+		Client: clientFunc(func(req *http.Request) (*http.Response, error) {
+			requested = append(requested, req.URL.Host+req.URL.Path)
+			body := []byte(`<gupdate><app appid="` + AppID + `"><updatecheck codebase="` + crxURL + `" version="9"/></app></gupdate>`)
+			if req.URL.String() == crxURL {
+				body = crx
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(body))}, nil
+		}),
+		Verifier: &Verifier{TrustedKeys: [][SPKIHashLen]byte{keyHash(t, key)}},
+	}
+	set, err := f.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.Header.Sequence != 9 {
+		t.Errorf("Get returned sequence %d, want 9", set.Header.Sequence)
+	}
+	if want := []string{"clients2.google.com/service/update2/crx", "mirror.example/crlset-9.crx"}; !slices.Equal(requested, want) {
+		t.Errorf("Requested %q, want %q", requested, want)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2012 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file of the Chromium repository.
+
+//go:build cshared
+
+// This file exports a C API for parsing CRLSets and checking serials against
+// them, so that other languages can use the parser without running the
+// command line tool. Build with:
+//
+//	go build -buildmode=c-shared -tags cshared -o libcrlset.so .
+//
+// which also writes libcrlset.h.
+package main
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+
+// The results of crlset_check_serial.
+enum {
+	CRLSET_GOOD = 0,
+	CRLSET_REVOKED = 1,
+	CRLSET_BLOCKED_SPKI = 2,
+	CRLSET_UNKNOWN = 3,
+	CRLSET_INVALID = -1,
+};
+*/
+import "C"
+
+import (
+	"bytes"
+	"math/big"
+	"runtime/cgo"
+	"unsafe"
+
+	"github.com/robstradling/crlset-tools/crlset"
+)
+
+// crlset_parse parses the CRLSet, or CRX containing one, in the dataLen bytes
+// at data. It returns a handle to pass to the other functions, which must be
+// released with crlset_free, or zero on failure. If err isn't NULL then on
+// failure it's set to an error message that the caller must free().
+//
+//export crlset_parse
+func crlset_parse(data *C.char, dataLen C.int, err **C.char) C.uintptr_t {
+	set, parseErr := parseCRLSetOrCRX(C.GoBytes(unsafe.Pointer(data), dataLen))
+	if parseErr != nil {
+		if err != nil {
+			*err = C.CString(parseErr.Error())
+		}
+		return 0
+	}
+	return C.uintptr_t(cgo.NewHandle(set))
+}
+
+// crlset_sequence returns the sequence number of the CRLSet.
+//
+//export crlset_sequence
+func crlset_sequence(handle C.uintptr_t) C.int {
+	return C.int(cgo.Handle(handle).Value().(*crlset.CRLSet).Header.Sequence)
+}
+
+// crlset_check_serial reports whether a certificate, with the given serial
+// and issued under the 32 byte SHA-256 hash of an SPKI, is blocked by the
+// CRLSet. The serial is the contents of the DER INTEGER, without the tag and
+// length. As in Chrome's CRLSet::CheckSerial, leading zero bytes are stripped
+// before it's looked up, and a negative serial is never found revoked. It
+// returns CRLSET_BLOCKED_SPKI if the issuer's SPKI is blocked, CRLSET_REVOKED
+// if the serial is revoked, CRLSET_UNKNOWN if it's negative, CRLSET_GOOD if
+// none of those, and CRLSET_INVALID if the SPKI hash has the wrong length.
+//
+//export crlset_check_serial
+func crlset_check_serial(handle C.uintptr_t, spki *C.uchar, spkiLen C.int, serial *C.uchar, serialLen C.int) C.int {
+	set := cgo.Handle(handle).Value().(*crlset.CRLSet)
+	if spkiLen != crlset.SPKIHashLen {
+		return C.CRLSET_INVALID
+	}
+	var hash [crlset.SPKIHashLen]byte
+	copy(hash[:], C.GoBytes(unsafe.Pointer(spki), spkiLen))
+	serialValue := C.GoBytes(unsafe.Pointer(serial), serialLen)
+
+	for _, blocked := range set.Header.BlockedSPKIHashes() {
+		if blocked == hash {
+			return C.CRLSET_BLOCKED_SPKI
+		}
+	}
+	if len(serialValue) > 0 && serialValue[0]&0x80 != 0 {
+		return C.CRLSET_UNKNOWN
+	}
+	serialValue = crlset.SerialBytes(new(big.Int).SetBytes(serialValue))
+	for _, entry := range set.Entries {
+		if !bytes.Equal(entry.SPKIHash, hash[:]) {
+			continue
+		}
+		for _, revoked := range entry.Serials {
+			if bytes.Equal(revoked, serialValue) {
+				return C.CRLSET_REVOKED
+			}
+		}
+	}
+	return C.CRLSET_GOOD
+}
+
+// crlset_free releases a handle returned by crlset_parse.
+//
+//export crlset_free
+func crlset_free(handle C.uintptr_t) {
+	cgo.Handle(handle).Delete()
+}
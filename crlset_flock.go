@@ -0,0 +1,26 @@
+// Copyright (c) 2012 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file of the Chromium repository.
+
+//go:build unix && !aix && !solaris
+
+// This file locks files with flock, which AIX and Solaris don't have.
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+func init() {
+	tryLock = flockFile
+}
+
+// flockFile takes an exclusive flock on f without blocking.
+func flockFile(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2012 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file of the Chromium repository.
+
+//go:build js && wasm
+
+// This file exposes CRLSet parsing and certificate checking to JavaScript so
+// that a web page can inspect CRLSets entirely in the browser. Build with:
+//
+//	GOOS=js GOARCH=wasm go build -o crlset.wasm .
+package main
+
+import (
+	"encoding/hex"
+	"syscall/js"
+
+	"github.com/robstradling/crlset-tools/crlset"
+)
+
+func init() {
+	jsMain = func() {
+		js.Global().Set("crlsetParse", js.FuncOf(jsParse))
+		js.Global().Set("crlsetCheck", js.FuncOf(jsCheck))
+		// The functions can only be called while the program is running.
+		select {}
+	}
+}
+
+// jsBytes copies the contents of a Uint8Array into a byte slice.
+func jsBytes(v js.Value) []byte {
+	b := make([]byte, v.Get("length").Int())
+	js.CopyBytesToGo(b, v)
+	return b
+}
+
+// jsError returns an object whose error property is err's message.
+func jsError(err error) interface{} {
+	return map[string]interface{}{"error": err.Error()}
+}
+
+// jsStrings converts a slice of strings to a value that js.ValueOf accepts.
+func jsStrings(strs []string) []interface{} {
+	values := make([]interface{}, len(strs))
+	for i, s := range strs {
+		values[i] = s
+	}
+	return values
+}
+
+// jsParse implements crlsetParse(crlset: Uint8Array), which returns the
+// header and entries of a CRLSet, or a CRX containing one, with hashes and
+// serials in hex.
+func jsParse(this js.Value, args []js.Value) interface{} {
+	if len(args) != 1 {
+		return map[string]interface{}{"error": "crlsetParse takes one Uint8Array"}
+	}
+	set, err := parseCRLSetOrCRX(jsBytes(args[0]))
+	if err != nil {
+		return jsError(err)
+	}
+
+	var entries []interface{}
+	for _, entry := range set.Entries {
+		serials := make([]string, len(entry.Serials))
+		for i, serial := range entry.Serials {
+			serials[i] = hex.EncodeToString(serial)
+		}
+		entries = append(entries, map[string]interface{}{
+			"spki":    hex.EncodeToString(entry.SPKIHash),
+			"serials": jsStrings(serials),
+		})
+	}
+	return map[string]interface{}{
+		"sequence":                 set.Header.Sequence,
+		"notAfter":                 set.Header.NotAfter,
+		"blockedSPKIs":             jsStrings(set.Header.BlockedSPKIs),
+		"knownInterceptionSPKIs":   jsStrings(set.Header.KnownInterceptionSPKIs),
+		"blockedInterceptionSPKIs": jsStrings(set.Header.BlockedInterceptionSPKIs),
+		"entries":                  entries,
+	}
+}
+
+// jsCheck implements crlsetCheck(crlset: Uint8Array, certs: Uint8Array),
+// which checks each PEM or DER certificate in certs, using the others as
+// possible issuers, in the same way as scan-dir.
+func jsCheck(this js.Value, args []js.Value) interface{} {
+	if len(args) != 2 {
+		return map[string]interface{}{"error": "crlsetCheck takes two Uint8Arrays"}
+	}
+	set, err := parseCRLSetOrCRX(jsBytes(args[0]))
+	if err != nil {
+		return jsError(err)
+	}
+	certs := parseCertificates(jsBytes(args[1]))
+	checker := newCertChecker(set)
+	for _, cert := range certs {
+		checker.Add(cert)
+	}
+
+	var results []interface{}
+	for _, cert := range certs {
+		var problems []interface{}
+		for _, problem := range checker.Check(cert) {
+			problems = append(problems, map[string]interface{}{
+				"rule":    problem.Rule,
+				"message": problem.Message,
+				"warning": problem.Warning,
+			})
+		}
+		results = append(results, map[string]interface{}{
+			"subject":  cert.Subject.String(),
+			"spki":     hex.EncodeToString(crlset.SPKIHash(cert)),
+			"serial":   formatCertSerial(cert.SerialNumber),
+			"problems": problems,
+		})
+	}
+	return map[string]interface{}{"certificates": results}
+}
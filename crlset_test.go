@@ -0,0 +1,1402 @@
+// Copyright (c) 2012 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file of the Chromium repository.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robstradling/crlset-tools/crlset"
+)
+
+// writeTestCRLSet replaces filename, by renaming over it as fetch does, with
+// a CRLSet that revokes serial under spki.
+func writeTestCRLSet(t *testing.T, filename string, sequence int, spki [crlset.SPKIHashLen]byte, serial []byte) {
+	var b crlset.Builder
+	b.SetSequence(sequence)
+	b.AddSerial(spki, serial)
+	set, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := set.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filename+".tmp", contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filename+".tmp", filename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDNSServerReload(t *testing.T) {
+	var spki [crlset.SPKIHashLen]byte
+	for i := range spki {
+		spki[i] = 0xaa
+	}
+	prefix := hex.EncodeToString(spki[:])[:dnsMinSPKIPrefix]
+	filename := filepath.Join(t.TempDir(), "crl-set")
+	s := &dnsServer{filename: filename, zone: "crlset.test"}
+	defer func() {
+		if s.release != nil {
+			s.release()
+		}
+	}()
+
+	tests := []struct {
+		sequence      int
+		revoked       []byte
+		serial        string
+		wantListed    bool
+		wantMalformed bool
+	}{
+		{1, []byte{0x01, 0x02}, "0102", true, false},
+		{1, []byte{0x01, 0x02}, "07", false, false},
+		{1, []byte{0x01, 0x02}, "zz", false, true},
+		// The file is replaced and reloaded, and the old mapping released.
+		{2, []byte{0x07}, "0102", false, false},
+		{2, []byte{0x07}, "7", true, false},
+	}
+	loaded := 0
+	for _, test := range tests {
+		if test.sequence != loaded {
+			writeTestCRLSet(t, filename, test.sequence, spki, test.revoked)
+			if err := s.load(); err != nil {
+				t.Fatal(err)
+			}
+			if s.sequence != test.sequence {
+				t.Fatalf("Loaded sequence %d, want %d", s.sequence, test.sequence)
+			}
+			loaded = test.sequence
+		}
+		ip, _, ok := s.lookup([]string{test.serial, prefix})
+		if ok == test.wantMalformed {
+			t.Errorf("Sequence %d: lookup(%s) ok = %t, want %t", test.sequence, test.serial, ok, !test.wantMalformed)
+			continue
+		}
+		if listed := ip != nil; listed != test.wantListed {
+			t.Errorf("Sequence %d: lookup(%s) = %v, want listed %t", test.sequence, test.serial, ip, test.wantListed)
+		} else if listed && !ip.Equal(dnsRevokedSerial) {
+			t.Errorf("Sequence %d: lookup(%s) = %v, want %v", test.sequence, test.serial, ip, dnsRevokedSerial)
+		}
+	}
+}
+
+func TestMarshalWatchUpdate(t *testing.T) {
+	tests := []struct {
+		update watchUpdate
+		want   string
+	}{
+		{watchUpdate{}, ""},
+		{watchUpdate{Sequence: 7}, "0807"},
+		// 300 needs two bytes as a varint.
+		{watchUpdate{Sequence: 300, PreviousSequence: 299}, "08ac0210ab02"},
+		{watchUpdate{Sequence: 2, SerialsAdded: 3, SerialsRemoved: 4, SPKIsAdded: 5, SPKIsRemoved: 6}, "0802180320042805" + "3006"},
+	}
+	for _, test := range tests {
+		if got := hex.EncodeToString(marshalWatchUpdate(test.update)); got != test.want {
+			t.Errorf("marshalWatchUpdate(%+v) = %s, want %s", test.update, got, test.want)
+		}
+	}
+}
+
+func TestWatchUpdatesStream(t *testing.T) {
+	var b crlset.Builder
+	b.SetSequence(41)
+	current, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &omahaServer{current: current, watchers: make(map[chan watchUpdate]bool)}
+
+	server := httptest.NewUnstartedServer(s)
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	defer server.Close()
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: transport}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", server.URL+watchUpdatesMethod, bytes.NewReader([]byte{0, 0, 0, 0, 0}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/grpc" {
+		t.Fatalf("Got status %q and content type %q", resp.Status, resp.Header.Get("Content-Type"))
+	}
+
+	readMessage := func() string {
+		var prefix [5]byte
+		if _, err := io.ReadFull(resp.Body, prefix[:]); err != nil {
+			t.Fatal(err)
+		}
+		message := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+		if _, err := io.ReadFull(resp.Body, message); err != nil {
+			t.Fatal(err)
+		}
+		return hex.EncodeToString(message)
+	}
+	if got, want := readMessage(), hex.EncodeToString(marshalWatchUpdate(watchUpdate{Sequence: 41})); got != want {
+		t.Errorf("First message = %s, want %s", got, want)
+	}
+	update := watchUpdate{Sequence: 42, PreviousSequence: 41, SerialsAdded: 1}
+	s.watchMu.Lock()
+	s.announce(update)
+	s.watchMu.Unlock()
+	if got, want := readMessage(), hex.EncodeToString(marshalWatchUpdate(update)); got != want {
+		t.Errorf("Second message = %s, want %s", got, want)
+	}
+}
+
+// testFlagSet returns a FlagSet with a bool flag, a string flag and a
+// repeatable one, like the commands', and the values they set.
+func testFlagSet() (fs *flag.FlagSet, sorted *bool, output *string, watches *[]string) {
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	sorted = fs.Bool("sort", false, "")
+	output = fs.String("o", "", "")
+	watches = new([]string)
+	fs.Func("watch", "", func(value string) error {
+		*watches = append(*watches, value)
+		return nil
+	})
+	return fs, sorted, output, watches
+}
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		args        string
+		want        []string
+		wantSorted  bool
+		wantOutput  string
+		wantWatches []string
+		wantErr     bool
+	}{
+		{args: "crl-set", want: []string{"crl-set"}},
+		{args: "--sort crl-set", want: []string{"crl-set"}, wantSorted: true},
+		// Flags may follow positional arguments.
+		{args: "crl-set --sort -o out certs", want: []string{"crl-set", "certs"}, wantSorted: true, wantOutput: "out"},
+		{args: "--watch a crl-set -watch=b", want: []string{"crl-set"}, wantWatches: []string{"a", "b"}},
+		// Everything after -- is positional.
+		{args: "crl-set -- --sort -o", want: []string{"crl-set", "--sort", "-o"}},
+		{args: "-- -", want: []string{"-"}},
+		// Unless it's the value of a flag.
+		{args: "-o -- crl-set", want: []string{"crl-set"}, wantOutput: "--"},
+		{args: "--sort -- -o", want: []string{"-o"}, wantSorted: true},
+		{args: "--nope crl-set", wantErr: true},
+		{args: "crl-set -o", wantErr: true},
+	}
+	for _, test := range tests {
+		fs, sorted, output, watches := testFlagSet()
+		got, err := parseArgs(fs, strings.Fields(test.args))
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseArgs(%q) succeeded, want an error", test.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseArgs(%q): %s", test.args, err)
+			continue
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("parseArgs(%q) = %q, want %q", test.args, got, test.want)
+		}
+		if *sorted != test.wantSorted || *output != test.wantOutput || !slices.Equal(*watches, test.wantWatches) {
+			t.Errorf("parseArgs(%q) set --sort %t, -o %q and --watch %q; want %t, %q and %q", test.args, *sorted, *output, *watches, test.wantSorted, test.wantOutput, test.wantWatches)
+		}
+	}
+}
+
+func TestParseArgsEnvironment(t *testing.T) {
+	tests := []struct {
+		env         map[string]string
+		args        string
+		wantSorted  bool
+		wantOutput  string
+		wantWatches []string
+		wantErr     bool
+	}{
+		{env: map[string]string{"CRLSET_O": "env-out", "CRLSET_SORT": "true"}, wantSorted: true, wantOutput: "env-out"},
+		// The command line takes precedence.
+		{env: map[string]string{"CRLSET_O": "env-out"}, args: "-o out", wantOutput: "out"},
+		// Even for a repeatable flag, whose variable it replaces.
+		{env: map[string]string{"CRLSET_WATCH": "a"}, wantWatches: []string{"a"}},
+		{env: map[string]string{"CRLSET_WATCH": "a"}, args: "--watch b --watch c", wantWatches: []string{"b", "c"}},
+		{env: map[string]string{"CRLSET_SORT": "maybe"}, wantErr: true},
+	}
+	for _, test := range tests {
+		for _, name := range []string{"CRLSET_O", "CRLSET_SORT", "CRLSET_WATCH"} {
+			if value, ok := test.env[name]; ok {
+				t.Setenv(name, value)
+			} else {
+				t.Setenv(name, "")
+				os.Unsetenv(name)
+			}
+		}
+		fs, sorted, output, watches := testFlagSet()
+		args := append(strings.Fields(test.args), "crl-set")
+		got, err := parseArgs(fs, args)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseArgs(%q) with %v succeeded, want an error", args, test.env)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseArgs(%q) with %v: %s", args, test.env, err)
+			continue
+		}
+		if !slices.Equal(got, []string{"crl-set"}) {
+			t.Errorf("parseArgs(%q) with %v = %q, want [crl-set]", args, test.env, got)
+		}
+		if *sorted != test.wantSorted || *output != test.wantOutput || !slices.Equal(*watches, test.wantWatches) {
+			t.Errorf("parseArgs(%q) with %v set --sort %t, -o %q and --watch %q; want %t, %q and %q", args, test.env, *sorted, *output, *watches, test.wantSorted, test.wantOutput, test.wantWatches)
+		}
+	}
+}
+
+func TestThriftWriter(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(w *thriftWriter)
+		want  string
+	}{
+		{"i32", func(w *thriftWriter) { w.i32(1, 0) }, "1500"},
+		{"negative i32", func(w *thriftWriter) { w.i32(1, -1) }, "1501"},
+		{"multi-byte i32", func(w *thriftWriter) { w.i32(1, 300) }, "15d804"},
+		// A field ID more than 15 past the last one is written in full.
+		{"long field delta", func(w *thriftWriter) { w.i64(20, 1) }, "062802"},
+		{"field deltas", func(w *thriftWriter) { w.i32(1, 0); w.i32(3, 0) }, "15002500"},
+		{"binary", func(w *thriftWriter) { w.binary(4, "ab") }, "48026162"},
+		{"i32 list", func(w *thriftWriter) { w.i32List(2, 0, 3) }, "29250006"},
+		{"long list", func(w *thriftWriter) { w.list(1, thriftStruct, 15) }, "19fc0f"},
+		// Field deltas resume from the enclosing struct's last field.
+		{"nested struct", func(w *thriftWriter) {
+			w.beginStruct(3)
+			w.i32(1, 1)
+			w.endStruct()
+			w.i32(4, 0)
+		}, "3c1502001500"},
+	}
+	for _, test := range tests {
+		var w thriftWriter
+		w.beginStruct(0)
+		test.write(&w)
+		if got := hex.EncodeToString(w.buf.Bytes()); got != test.want {
+			t.Errorf("%s: wrote %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParquetColumnPage(t *testing.T) {
+	tests := []struct {
+		name   string
+		column *parquetColumn
+		add    func(c *parquetColumn)
+		want   string
+	}{
+		{"int64", &parquetColumn{typ: parquetInt64}, func(c *parquetColumn) {
+			c.addInt64(1)
+			c.addInt64(-2)
+		}, "0100000000000000" + "feffffffffffffff"},
+		{"required string", &parquetColumn{typ: parquetByteArray}, func(c *parquetColumn) {
+			c.addString("ab")
+		}, "020000006162"},
+		// Definition levels are runs of two non-null rows and one null.
+		{"optional string", &parquetColumn{typ: parquetByteArray, optional: true}, func(c *parquetColumn) {
+			c.addString("a")
+			c.addString("b")
+			c.addNull()
+		}, "04000000" + "04010200" + "0100000061" + "0100000062"},
+	}
+	for _, test := range tests {
+		test.add(test.column)
+		if got := hex.EncodeToString(test.column.page()); got != test.want {
+			t.Errorf("%s: page = %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestWriteParquet(t *testing.T) {
+	var b crlset.Builder
+	b.SetSequence(7)
+	var spki [crlset.SPKIHashLen]byte
+	b.AddSerial(spki, []byte{0x01, 0x02})
+	b.AddBlockedSPKI(spki)
+	set, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := writeParquet(&out, set); err != nil {
+		t.Fatal(err)
+	}
+
+	file := out.Bytes()
+	if !bytes.HasPrefix(file, []byte("PAR1")) || !bytes.HasSuffix(file, []byte("PAR1")) {
+		t.Fatalf("File doesn't start and end with PAR1: %x", file)
+	}
+	metaLen := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	if metaLen > len(file)-12 {
+		t.Fatalf("Footer length %d is longer than the file", metaLen)
+	}
+	meta := file[len(file)-8-metaLen : len(file)-8]
+	// FileMetaData starts with version 1 and ends with created_by.
+	if !bytes.HasPrefix(meta, []byte{0x15, 0x02}) || !bytes.HasSuffix(meta, []byte("crlset-tools\x00")) {
+		t.Errorf("Unexpected FileMetaData %x", meta)
+	}
+	// num_rows is the blocked SPKI and the revoked serial.
+	if !bytes.Contains(meta, []byte{0x16, 0x04}) {
+		t.Errorf("FileMetaData %x doesn't give two rows", meta)
+	}
+	for _, name := range []string{"sequence", "spki", "serial", "category"} {
+		if !bytes.Contains(meta, []byte(name)) {
+			t.Errorf("FileMetaData has no %s column", name)
+		}
+	}
+}
+
+func TestSCRAMClient(t *testing.T) {
+	// The example exchange from RFC 7677, section 3.
+	const (
+		clientNonce = "rOprNGfwEbeRWgbNEkqO"
+		serverFirst = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+		clientFinal = "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+		serverFinal = "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+	)
+	tests := []struct {
+		name        string
+		serverFirst string
+		serverFinal string
+		wantFinal   string
+		wantErr     bool
+	}{
+		{"RFC 7677", serverFirst, serverFinal, clientFinal, false},
+		{"wrong signature", serverFirst, "v=AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", clientFinal, true},
+		{"nonce not extended", strings.Replace(serverFirst, "r=rOpr", "r=xOpr", 1), "", "", true},
+		{"no iterations", strings.TrimSuffix(serverFirst, ",i=4096"), "", "", true},
+		{"invalid salt", strings.Replace(serverFirst, "s=W22", "s=!!!", 1), "", "", true},
+	}
+	for _, test := range tests {
+		// PostgreSQL's clients leave out the user name, but the RFC's
+		// example includes it.
+		s := &scramClient{password: "pencil", nonce: clientNonce, clientFirstBare: "n=user,r=" + clientNonce}
+		final, err := s.clientFinal(test.serverFirst)
+		if err == nil {
+			err = s.verifyServerFinal(test.serverFinal)
+		}
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: succeeded, want an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if final != test.wantFinal {
+			t.Errorf("%s: clientFinal = %q, want %q", test.name, final, test.wantFinal)
+		}
+	}
+}
+
+func TestPgConnReceive(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		wantType    byte
+		wantPayload string
+		wantErr     bool
+	}{
+		{"ReadyForQuery", "5a00000005" + "49", 'Z', "49", false},
+		{"empty payload", "4300000004", 'C', "", false},
+		{"length too short", "4300000003", 0, "", true},
+		{"truncated payload", "5a00000006" + "49", 0, "", true},
+		{"truncated header", "5a0000", 0, "", true},
+	}
+	for _, test := range tests {
+		input, _ := hex.DecodeString(test.input)
+		c := &pgConn{r: bufio.NewReader(bytes.NewReader(input))}
+		typ, payload, err := c.receive()
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: receive succeeded, want an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if typ != test.wantType || hex.EncodeToString(payload) != test.wantPayload {
+			t.Errorf("%s: receive = %c %x, want %c %s", test.name, typ, payload, test.wantType, test.wantPayload)
+		}
+	}
+}
+
+func TestPgError(t *testing.T) {
+	payload := []byte("SERROR\x00VERROR\x00C42P01\x00Mrelation \"crlset\" does not exist\x00\x00")
+	if got, want := pgError(payload).Error(), `ERROR: relation "crlset" does not exist`; got != want {
+		t.Errorf("pgError = %q, want %q", got, want)
+	}
+}
+
+func TestPgIdentifier(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"crlset", `"crlset"`},
+		{"audit.crlset", `"audit"."crlset"`},
+		{`odd"name`, `"odd""name"`},
+		{`x"; DROP TABLE y; --`, `"x""; DROP TABLE y; --"`},
+	}
+	for _, test := range tests {
+		if got := pgIdentifier(test.name); got != test.want {
+			t.Errorf("pgIdentifier(%q) = %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestWritePgCopy(t *testing.T) {
+	var b crlset.Builder
+	b.SetSequence(7)
+	var blocked, issuer [crlset.SPKIHashLen]byte
+	blocked[0], issuer[0] = 0xbb, 0xaa
+	b.AddBlockedSPKI(blocked)
+	b.AddSerial(issuer, []byte{0x01, 0x02})
+	set, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := writePgCopy(&out, set); err != nil {
+		t.Fatal(err)
+	}
+	zeros := strings.Repeat("00", crlset.SPKIHashLen-1)
+	want := "7\t\\\\xbb" + zeros + "\t\\N\tblocked_spki\n" +
+		"7\t\\\\xaa" + zeros + "\t\\\\x0102\trevoked_serial\n"
+	if out.String() != want {
+		t.Errorf("writePgCopy wrote\n%q\nwant\n%q", out.String(), want)
+	}
+}
+
+func TestRedisReply(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    interface{}
+		wantErr bool
+	}{
+		{"+OK\r\n", "OK", false},
+		{":42\r\n", int64(42), false},
+		{"$5\r\nhello\r\n", "hello", false},
+		{"$0\r\n\r\n", "", false},
+		{"$-1\r\n", nil, false},
+		{"*2\r\n:1\r\n$1\r\na\r\n", []interface{}{int64(1), "a"}, false},
+		{"*0\r\n", []interface{}{}, false},
+		{"-ERR wrong number of arguments\r\n", nil, true},
+		{"$5\r\nhel", nil, true},
+		{"?what\r\n", nil, true},
+		{"\r\n", nil, true},
+	}
+	for _, test := range tests {
+		c := &redisConn{r: bufio.NewReader(strings.NewReader(test.input))}
+		got, err := c.reply()
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("reply(%q) = %#v, want an error", test.input, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("reply(%q): %s", test.input, err)
+		} else if fmt.Sprintf("%#v", got) != fmt.Sprintf("%#v", test.want) {
+			t.Errorf("reply(%q) = %#v, want %#v", test.input, got, test.want)
+		}
+	}
+}
+
+func TestRedisSend(t *testing.T) {
+	var out bytes.Buffer
+	c := &redisConn{w: bufio.NewWriter(&out)}
+	c.send("SADD", "crlset:7", "")
+	c.w.Flush()
+	if want := "*3\r\n$4\r\nSADD\r\n$8\r\ncrlset:7\r\n$0\r\n\r\n"; out.String() != want {
+		t.Errorf("send wrote %q, want %q", out.String(), want)
+	}
+}
+
+func TestDialRedis(t *testing.T) {
+	tests := []struct {
+		url  string
+		want []string
+	}{
+		{"redis://%s", nil},
+		{"redis://:secret@%s", []string{"AUTH secret"}},
+		{"redis://admin:secret@%s/2", []string{"AUTH admin secret", "SELECT 2"}},
+	}
+	for _, test := range tests {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The server reads each command and replies +OK.
+		commands := make(chan []string, 4)
+		go func() {
+			defer close(commands)
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			server := &redisConn{r: bufio.NewReader(conn)}
+			for {
+				command, err := server.reply()
+				if err != nil {
+					return
+				}
+				var args []string
+				for _, arg := range command.([]interface{}) {
+					args = append(args, arg.(string))
+				}
+				commands <- args
+				io.WriteString(conn, "+OK\r\n")
+			}
+		}()
+
+		c, err := dialRedis(fmt.Sprintf(test.url, listener.Addr()))
+		if err != nil {
+			t.Fatalf("dialRedis(%s): %s", test.url, err)
+		}
+		c.Close()
+		var got []string
+		for command := range commands {
+			got = append(got, strings.Join(command, " "))
+		}
+		listener.Close()
+		if !slices.Equal(got, test.want) {
+			t.Errorf("dialRedis(%s) sent %q, want %q", test.url, got, test.want)
+		}
+	}
+}
+
+func TestPublishEncode(t *testing.T) {
+	event := changelogEvent{Time: "2026-10-16T00:00:00Z", Sequence: 8, PreviousSequence: 7, Change: "added", Kind: "serial", SPKI: "aa", Serial: "0102"}
+	tests := []struct {
+		format  string
+		want    string
+		wantErr bool
+	}{
+		{"json", `{"time":"2026-10-16T00:00:00Z","sequence":8,"previousSequence":7,"change":"added","kind":"serial","spki":"aa","serial":"0102"}`, false},
+		{"csv", "2026-10-16T00:00:00Z,8,7,added,serial,aa,0102", false},
+		{"xml", "", true},
+	}
+	for _, test := range tests {
+		c := &publishConfig{format: test.format}
+		got, err := c.encode(&event)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("encode with %s = %q, want an error", test.format, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("encode with %s: %s", test.format, err)
+		} else if string(got) != test.want {
+			t.Errorf("encode with %s = %q, want %q", test.format, got, test.want)
+		}
+	}
+}
+
+func TestPublishNATS(t *testing.T) {
+	tests := []struct {
+		url         string
+		reply       string
+		wantConnect string
+		wantErr     bool
+	}{
+		{"nats://%s", "PONG", "", false},
+		{"nats://s3cret@%s", "PONG", `"auth_token":"s3cret"`, false},
+		{"nats://alice:s3cret@%s", "PONG", `"pass":"s3cret","pedantic":false,"user":"alice"`, false},
+		{"nats://%s", "-ERR 'Authorization Violation'", "", true},
+	}
+	for _, test := range tests {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The server records what it's sent until the PING, then replies.
+		received := make(chan []string, 1)
+		go func() {
+			defer close(received)
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			io.WriteString(conn, "INFO {\"server_id\":\"test\"}\r\n")
+			r := bufio.NewReader(conn)
+			var lines []string
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				line = strings.TrimSuffix(line, "\r\n")
+				if line == "PING" {
+					break
+				}
+				lines = append(lines, line)
+			}
+			received <- lines
+			io.WriteString(conn, test.reply+"\r\n")
+		}()
+
+		err = publishNATS(fmt.Sprintf(test.url, listener.Addr()), "crlset.changes", [][]byte{[]byte("one"), []byte("two")})
+		lines := <-received
+		listener.Close()
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("publishNATS(%s) succeeded, want an error", test.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("publishNATS(%s): %s", test.url, err)
+			continue
+		}
+		if len(lines) != 5 || !strings.HasPrefix(lines[0], "CONNECT {") || !strings.Contains(lines[0], test.wantConnect) {
+			t.Fatalf("publishNATS(%s) sent %q", test.url, lines)
+		}
+		if want := []string{"PUB crlset.changes 3", "one", "PUB crlset.changes 3", "two"}; !slices.Equal(lines[1:], want) {
+			t.Errorf("publishNATS(%s) sent %q, want %q", test.url, lines[1:], want)
+		}
+	}
+}
+
+// dnsQuery returns a DNS query packet with ID 0x1234, RD set and one
+// question.
+func dnsQuery(name string, qtype, qclass uint16) []byte {
+	packet := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(name, ".") {
+		packet = append(packet, byte(len(label)))
+		packet = append(packet, label...)
+	}
+	packet = append(packet, 0)
+	packet = binary.BigEndian.AppendUint16(packet, qtype)
+	return binary.BigEndian.AppendUint16(packet, qclass)
+}
+
+func TestDNSServerAnswer(t *testing.T) {
+	var spki [crlset.SPKIHashLen]byte
+	for i := range spki {
+		spki[i] = 0xaa
+	}
+	prefix := hex.EncodeToString(spki[:])[:dnsMinSPKIPrefix]
+	filename := filepath.Join(t.TempDir(), "crl-set")
+	writeTestCRLSet(t, filename, 1, spki, []byte{0x01, 0x02})
+	s := &dnsServer{filename: filename, zone: "crlset.test"}
+	if err := s.load(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if s.release != nil {
+			s.release()
+		}
+	}()
+
+	revoked := "0102." + prefix + ".crlset.test"
+	tests := []struct {
+		name        string
+		packet      []byte
+		wantRcode   byte
+		wantAnswers int
+		wantRdata   []byte
+	}{
+		{"revoked A", dnsQuery(revoked, dnsTypeA, dnsClassIN), dnsNoError, 1, dnsRevokedSerial.To4()},
+		{"revoked, upper case", dnsQuery(strings.ToUpper(revoked), dnsTypeA, dnsClassIN), dnsNoError, 1, dnsRevokedSerial.To4()},
+		{"revoked TXT", dnsQuery(revoked, dnsTypeTXT, dnsClassIN), dnsNoError, 1, nil},
+		// The name exists, but has no MX records.
+		{"revoked MX", dnsQuery(revoked, 15, dnsClassIN), dnsNoError, 0, nil},
+		{"not revoked", dnsQuery("07."+prefix+".crlset.test", dnsTypeA, dnsClassIN), dnsNXDomain, 0, nil},
+		{"other zone", dnsQuery("0102."+prefix+".example.com", dnsTypeA, dnsClassIN), dnsRefused, 0, nil},
+		{"other class", dnsQuery(revoked, dnsTypeA, 3), dnsRefused, 0, nil},
+		{"inverse query", func() []byte {
+			packet := dnsQuery(revoked, dnsTypeA, dnsClassIN)
+			packet[2] |= 1 << 3
+			return packet
+		}(), dnsNotImp, 0, nil},
+		{"two questions", func() []byte {
+			packet := dnsQuery(revoked, dnsTypeA, dnsClassIN)
+			packet[5] = 2
+			return packet
+		}(), dnsFormErr, 0, nil},
+		{"truncated name", dnsQuery(revoked, dnsTypeA, dnsClassIN)[:20], dnsFormErr, 0, nil},
+		{"truncated question", func() []byte {
+			packet := dnsQuery(revoked, dnsTypeA, dnsClassIN)
+			return packet[:len(packet)-2]
+		}(), dnsFormErr, 0, nil},
+	}
+	for _, test := range tests {
+		out := s.answer(test.packet)
+		if len(out) < 12 {
+			t.Errorf("%s: answer = %x", test.name, out)
+			continue
+		}
+		if out[0] != 0x12 || out[1] != 0x34 || out[2] != 0x85 {
+			t.Errorf("%s: answer header %x, want ID 1234 with QR, AA and RD", test.name, out[:4])
+		}
+		if rcode := out[3] & 0x0f; rcode != test.wantRcode {
+			t.Errorf("%s: rcode %d, want %d", test.name, rcode, test.wantRcode)
+		}
+		if answers := int(binary.BigEndian.Uint16(out[6:])); answers != test.wantAnswers {
+			t.Errorf("%s: %d answers, want %d", test.name, answers, test.wantAnswers)
+		}
+		if test.wantRdata != nil && !bytes.HasSuffix(out, test.wantRdata) {
+			t.Errorf("%s: answer %x doesn't end with %x", test.name, out, test.wantRdata)
+		}
+	}
+
+	// Responses are ignored, so that servers can't be made to reply to
+	// each other.
+	response := dnsQuery(revoked, dnsTypeA, dnsClassIN)
+	response[2] |= 0x80
+	if out := s.answer(response); out != nil {
+		t.Errorf("answer to a response = %x, want nil", out)
+	}
+}
+
+// testCertificate returns a self-signed certificate for commonName.
+func testCertificate(t *testing.T, commonName string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// commonNames returns the subject common names of certs.
+func commonNames(certs []*x509.Certificate) []string {
+	var names []string
+	for _, cert := range certs {
+		names = append(names, cert.Subject.CommonName)
+	}
+	return names
+}
+
+// jksUTF and jksBytes encode strings and byte strings as keystores do.
+func jksUTF(s string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(s))), s...)
+}
+
+func jksBytes(b []byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(b))), b...)
+}
+
+// buildJKS returns a keystore with the given magic number, version and
+// entries, whose integrity hash uses password.
+func buildJKS(magic, version uint32, password string, entries ...[]byte) []byte {
+	out := binary.BigEndian.AppendUint32(nil, magic)
+	out = binary.BigEndian.AppendUint32(out, version)
+	out = binary.BigEndian.AppendUint32(out, uint32(len(entries)))
+	for _, entry := range entries {
+		out = append(out, entry...)
+	}
+	h := sha1.New()
+	for _, c := range password {
+		h.Write([]byte{byte(c >> 8), byte(c)})
+	}
+	h.Write([]byte("Mighty Aphrodite"))
+	h.Write(out)
+	return h.Sum(out)
+}
+
+// jksEntry returns a keystore entry: a trusted certificate if there's one
+// cert, or otherwise a private key and its chain.
+func jksEntry(version uint32, alias string, certs ...*x509.Certificate) []byte {
+	var out []byte
+	encodeCert := func(cert *x509.Certificate) {
+		if version == 2 {
+			out = append(out, jksUTF("X.509")...)
+		}
+		out = append(out, jksBytes(cert.Raw)...)
+	}
+	if len(certs) == 1 {
+		out = binary.BigEndian.AppendUint32(out, 2)
+		out = append(out, jksUTF(alias)...)
+		out = binary.BigEndian.AppendUint64(out, 0)
+		encodeCert(certs[0])
+		return out
+	}
+	out = binary.BigEndian.AppendUint32(out, 1)
+	out = append(out, jksUTF(alias)...)
+	out = binary.BigEndian.AppendUint64(out, 0)
+	out = append(out, jksBytes([]byte("encrypted key"))...)
+	out = binary.BigEndian.AppendUint32(out, uint32(len(certs)))
+	for _, cert := range certs {
+		encodeCert(cert)
+	}
+	return out
+}
+
+func TestParseJKS(t *testing.T) {
+	leaf, intermediate, root := testCertificate(t, "leaf"), testCertificate(t, "intermediate"), testCertificate(t, "root")
+	const jks, jceks = 0xfeedfeed, 0xcececece
+
+	tests := []struct {
+		name     string
+		keystore []byte
+		password string
+		want     []string
+		wantErr  bool
+	}{
+		{"JKS", buildJKS(jks, 2, "changeit", jksEntry(2, "server", leaf, intermediate), jksEntry(2, "ca", root)), "changeit", []string{"leaf", "intermediate", "root"}, false},
+		{"JCEKS", buildJKS(jceks, 2, "changeit", jksEntry(2, "ca", root)), "changeit", []string{"root"}, false},
+		{"version 1", buildJKS(jks, 1, "changeit", jksEntry(1, "ca", root)), "changeit", []string{"root"}, false},
+		// Without a password, the integrity check is skipped.
+		{"no password", buildJKS(jks, 2, "changeit", jksEntry(2, "ca", root)), "", []string{"root"}, false},
+		{"wrong password", buildJKS(jks, 2, "changeit", jksEntry(2, "ca", root)), "password", nil, true},
+		{"version 3", buildJKS(jks, 3, "changeit"), "changeit", nil, true},
+		{"secret key", buildJKS(jceks, 2, "changeit", append(binary.BigEndian.AppendUint32(nil, 3), jksUTF("secret")...)), "changeit", nil, true},
+		{"truncated entry", buildJKS(jks, 2, "changeit", jksEntry(2, "ca", root)[:40]), "", nil, true},
+		{"truncated", []byte{0xfe, 0xed, 0xfe, 0xed}, "", nil, true},
+	}
+	for _, test := range tests {
+		certs, err := parseJKS(test.keystore, test.password)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: parseJKS succeeded, want an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if got := commonNames(certs); !slices.Equal(got, test.want) {
+			t.Errorf("%s: parseJKS = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPKCS12KDF(t *testing.T) {
+	// From the tests of golang.org/x/crypto/pkcs12.
+	salt := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	if got, want := hex.EncodeToString(pkcs12KDF("sesame", salt, 2048, 1, 24)), "7cd9fd3e2b3be7691a44e3bef0f9ea0fb9b897d4e325d9d1"; got != want {
+		t.Errorf("pkcs12KDF = %s, want %s", got, want)
+	}
+}
+
+// marshal is asn1.Marshal for values that are known to encode.
+func marshal(t *testing.T, v interface{}) []byte {
+	der, err := asn1.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// explicit returns v wrapped in an explicit [0] tag.
+func explicit(t *testing.T, v interface{}) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: marshal(t, v)}
+}
+
+// buildPKCS12 returns a PKCS#12 file holding certs. If encrypt isn't nil,
+// it encrypts the SafeContents and returns the algorithm used.
+func buildPKCS12(t *testing.T, encrypt func(plaintext []byte) (pkix.AlgorithmIdentifier, []byte), certs ...*x509.Certificate) []byte {
+	type safeBag struct {
+		ID    asn1.ObjectIdentifier
+		Value asn1.RawValue
+	}
+	var bags []safeBag
+	for _, cert := range certs {
+		certBag := pkcs12CertBag{ID: oidX509CertificateBag, Data: cert.Raw}
+		bags = append(bags, safeBag{oidCertBag, explicit(t, asn1.RawValue{FullBytes: marshal(t, certBag)})})
+	}
+	safeContents := marshal(t, bags)
+
+	var info pkcs7ContentInfo
+	if encrypt == nil {
+		info = pkcs7ContentInfo{ContentType: oidPKCS7Data, Content: explicit(t, safeContents)}
+	} else {
+		var encrypted pkcs12EncryptedData
+		encrypted.EncryptedContentInfo.ContentType = oidPKCS7Data
+		encrypted.EncryptedContentInfo.Algorithm, encrypted.EncryptedContentInfo.EncryptedContent = encrypt(safeContents)
+		info = pkcs7ContentInfo{ContentType: oidPKCS7EncryptedData, Content: explicit(t, asn1.RawValue{FullBytes: marshal(t, encrypted)})}
+	}
+	authSafe := marshal(t, []pkcs7ContentInfo{info})
+	return marshal(t, struct {
+		Version  int
+		AuthSafe pkcs7ContentInfo
+	}{3, pkcs7ContentInfo{ContentType: oidPKCS7Data, Content: explicit(t, authSafe)}})
+}
+
+// cbcEncrypt pads plaintext and encrypts it with block in CBC mode.
+func cbcEncrypt(block cipher.Block, iv, plaintext []byte) []byte {
+	padding := block.BlockSize() - len(plaintext)%block.BlockSize()
+	padded := append(append([]byte(nil), plaintext...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(padded, padded)
+	return padded
+}
+
+func TestParsePKCS12(t *testing.T) {
+	leaf, root := testCertificate(t, "leaf"), testCertificate(t, "root")
+	salt := []byte("saltsalt")
+	const password = "changeit"
+
+	pbes2 := func(plaintext []byte) (pkix.AlgorithmIdentifier, []byte) {
+		iv := bytes.Repeat([]byte{7}, aes.BlockSize)
+		kdfParams := pkcs12PBKDF2Params{Salt: salt, Iterations: 2048, PRF: pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue}}
+		params := pkcs12PBES2Params{
+			KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: marshal(t, kdfParams)}},
+			EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: marshal(t, iv)}},
+		}
+		key, err := pbkdf2.Key(sha256.New, password, salt, 2048, 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: marshal(t, params)}}, cbcEncrypt(block, iv, plaintext)
+	}
+	tripleDES := func(plaintext []byte) (pkix.AlgorithmIdentifier, []byte) {
+		block, err := des.NewTripleDESCipher(pkcs12KDF(password, salt, 2048, 1, 24))
+		if err != nil {
+			t.Fatal(err)
+		}
+		iv := pkcs12KDF(password, salt, 2048, 2, des.BlockSize)
+		params := pkcs12PBEParams{Salt: salt, Iterations: 2048}
+		return pkix.AlgorithmIdentifier{Algorithm: oidPBEWithSHAAnd3DESCBC, Parameters: asn1.RawValue{FullBytes: marshal(t, params)}}, cbcEncrypt(block, iv, plaintext)
+	}
+
+	tests := []struct {
+		name     string
+		file     []byte
+		password string
+		want     []string
+		wantErr  bool
+	}{
+		{"unencrypted", buildPKCS12(t, nil, leaf, root), "", []string{"leaf", "root"}, false},
+		{"PBES2", buildPKCS12(t, pbes2, leaf, root), password, []string{"leaf", "root"}, false},
+		{"3DES", buildPKCS12(t, tripleDES, leaf), password, []string{"leaf"}, false},
+		{"PBES2, wrong password", buildPKCS12(t, pbes2, leaf), "password", nil, true},
+		{"3DES, wrong password", buildPKCS12(t, tripleDES, leaf), "password", nil, true},
+		{"not PKCS#12", []byte("not DER"), "", nil, true},
+	}
+	for _, test := range tests {
+		certs, err := parsePKCS12(test.file, test.password)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: parsePKCS12 succeeded, want an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if got := commonNames(certs); !slices.Equal(got, test.want) {
+			t.Errorf("%s: parsePKCS12 = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSQLiteVarint(t *testing.T) {
+	tests := []struct {
+		in    []byte
+		want  uint64
+		wantN int
+	}{
+		{[]byte{0x05}, 5, 1},
+		{[]byte{0x81, 0x00}, 128, 2},
+		{[]byte{0x8f, 0x5c, 0xff}, 2012, 2},
+		{[]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, 1<<64 - 1, 9},
+		{[]byte{0x81}, 1, 1},
+	}
+	for _, test := range tests {
+		if got, n := sqliteVarint(test.in); got != test.want || n != test.wantN {
+			t.Errorf("sqliteVarint(%x) = %d, %d, want %d, %d", test.in, got, n, test.want, test.wantN)
+		}
+	}
+}
+
+// appendSQLiteVarint appends v, which must be less than 1<<56, to b as a
+// SQLite variable length integer.
+func appendSQLiteVarint(b []byte, v uint64) []byte {
+	var groups []byte
+	for {
+		groups = append([]byte{byte(v & 0x7f)}, groups...)
+		if v >>= 7; v == 0 {
+			break
+		}
+	}
+	for i := range groups[:len(groups)-1] {
+		groups[i] |= 0x80
+	}
+	return append(b, groups...)
+}
+
+// sqliteRecord encodes a row whose columns are small integers, text or blobs.
+func sqliteRecord(columns ...interface{}) []byte {
+	var types, data []byte
+	for _, column := range columns {
+		switch column := column.(type) {
+		case int:
+			types = append(types, 1)
+			data = append(data, byte(column))
+		case string:
+			types = appendSQLiteVarint(types, uint64(13+2*len(column)))
+			data = append(data, column...)
+		case []byte:
+			types = appendSQLiteVarint(types, uint64(12+2*len(column)))
+			data = append(data, column...)
+		}
+	}
+	return append(append([]byte{byte(1 + len(types))}, types...), data...)
+}
+
+// sqliteLeafPage returns a table b-tree leaf page of size bytes holding
+// cells, with its page header at headerOffset. Each cell is a payload
+// length and row ID followed by the local part of the payload.
+func sqliteLeafPage(size, headerOffset int, cells ...[]byte) []byte {
+	p := make([]byte, size)
+	p[headerOffset] = 0x0d
+	binary.BigEndian.PutUint16(p[headerOffset+3:], uint16(len(cells)))
+	end := size
+	for i, cell := range cells {
+		end -= len(cell)
+		copy(p[end:], cell)
+		binary.BigEndian.PutUint16(p[headerOffset+8+2*i:], uint16(end))
+	}
+	return p
+}
+
+// sqliteCell returns a cell holding the whole of payload.
+func sqliteCell(rowID uint64, payload []byte) []byte {
+	cell := appendSQLiteVarint(nil, uint64(len(payload)))
+	return append(appendSQLiteVarint(cell, rowID), payload...)
+}
+
+// sqliteWAL returns a write-ahead log, with big-endian checksums, holding a
+// frame for each page. Only the frames in commits end a transaction.
+func sqliteWAL(pageSize int, pages map[int][]byte, order []int, commits map[int]int) []byte {
+	wal := binary.BigEndian.AppendUint32(nil, 0x377f0683)
+	wal = binary.BigEndian.AppendUint32(wal, 3007000)
+	wal = binary.BigEndian.AppendUint32(wal, uint32(pageSize))
+	wal = binary.BigEndian.AppendUint32(wal, 0)
+	wal = append(wal, "saltsalt"...)
+	s0, s1 := sqliteWALChecksum(binary.BigEndian, 0, 0, wal)
+	wal = binary.BigEndian.AppendUint32(wal, s0)
+	wal = binary.BigEndian.AppendUint32(wal, s1)
+	for _, n := range order {
+		frame := binary.BigEndian.AppendUint32(nil, uint32(n))
+		frame = binary.BigEndian.AppendUint32(frame, uint32(commits[n]))
+		s0, s1 = sqliteWALChecksum(binary.BigEndian, s0, s1, frame)
+		s0, s1 = sqliteWALChecksum(binary.BigEndian, s0, s1, pages[n])
+		frame = append(frame, "saltsalt"...)
+		frame = binary.BigEndian.AppendUint32(frame, s0)
+		frame = binary.BigEndian.AppendUint32(frame, s1)
+		wal = append(append(wal, frame...), pages[n]...)
+	}
+	return wal
+}
+
+func TestSQLiteBlobs(t *testing.T) {
+	const pageSize = 512
+	large := bytes.Repeat([]byte("large"), 120)
+
+	// Page 1 holds the database header and a row. The row on page 2
+	// overflows onto page 3. Page 4 is on the freelist, whose trunk is
+	// page 5.
+	header := make([]byte, 100)
+	copy(header, "SQLite format 3\x00")
+	binary.BigEndian.PutUint16(header[16:], pageSize)
+	binary.BigEndian.PutUint32(header[32:], 5)
+	page1 := sqliteLeafPage(pageSize, 100, sqliteCell(1, sqliteRecord(1, "text", []byte("first"))))
+	copy(page1, header)
+
+	// With 512 byte pages, 95 bytes of this 603 byte payload are stored
+	// on the page and the other 508 fill an overflow page.
+	payload := sqliteRecord(large)
+	local := appendSQLiteVarint(nil, uint64(len(payload)))
+	local = append(appendSQLiteVarint(local, 2), payload[:95]...)
+	local = binary.BigEndian.AppendUint32(local, 3)
+	page2 := sqliteLeafPage(pageSize, 0, local)
+	page3 := append(make([]byte, 4), payload[95:]...)
+
+	page4 := sqliteLeafPage(pageSize, 0, sqliteCell(3, sqliteRecord([]byte("deleted"))))
+	page5 := make([]byte, pageSize)
+	binary.BigEndian.PutUint32(page5[4:], 1)
+	binary.BigEndian.PutUint32(page5[8:], 4)
+
+	db := slices.Concat(page1, page2, page3, page4, page5)
+
+	walPages := map[int][]byte{
+		6: sqliteLeafPage(pageSize, 0, sqliteCell(4, sqliteRecord([]byte("committed")))),
+		7: sqliteLeafPage(pageSize, 0, sqliteCell(5, sqliteRecord([]byte("uncommitted")))),
+	}
+	wal := sqliteWAL(pageSize, walPages, []int{6, 7}, map[int]int{6: 6})
+	corruptWAL := slices.Clone(wal)
+	corruptWAL[32+24+pageSize-1]++
+	badPageSize := slices.Clone(db)
+	binary.BigEndian.PutUint16(badPageSize[16:], 256)
+
+	tests := []struct {
+		name    string
+		db, wal []byte
+		want    []string
+		wantErr bool
+	}{
+		{"database", db, nil, []string{"first", string(large)}, false},
+		{"write-ahead log", db, wal, []string{"first", string(large), "committed"}, false},
+		{"corrupt write-ahead log", db, corruptWAL, []string{"first", string(large)}, false},
+		{"not SQLite", []byte("not a database"), nil, nil, true},
+		{"bad page size", badPageSize, nil, nil, true},
+	}
+	for _, test := range tests {
+		blobs, err := sqliteBlobs(test.db, test.wal)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: sqliteBlobs succeeded, want an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		var got []string
+		for _, blob := range blobs {
+			got = append(got, string(blob))
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%s: sqliteBlobs = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// buildCAB returns a cabinet holding one file, of size bytes at offset in
+// the folder, whose data is split into blocks. With reserve set, the
+// cabinet has reserved areas in its header, folder and data blocks.
+func buildCAB(compression uint16, reserve bool, offset, size uint32, blocks ...[]byte) []byte {
+	const headerLen, folderLen, fileLen = 36, 8, 16 + 2
+	filesOffset, flags, dataReserve := headerLen+folderLen, 0, 0
+	if reserve {
+		// The reserve sizes, two bytes of header reserve and one of
+		// folder reserve.
+		filesOffset += 4 + 2 + 1
+		flags, dataReserve = 4, 3
+	}
+	dataOffset := filesOffset + fileLen
+
+	out := []byte("MSCF")
+	out = binary.LittleEndian.AppendUint32(out, 0)
+	out = binary.LittleEndian.AppendUint32(out, 0)
+	out = binary.LittleEndian.AppendUint32(out, 0)
+	out = binary.LittleEndian.AppendUint32(out, uint32(filesOffset))
+	out = binary.LittleEndian.AppendUint32(out, 0)
+	out = append(out, 3, 1)
+	out = binary.LittleEndian.AppendUint16(out, 1)
+	out = binary.LittleEndian.AppendUint16(out, 1)
+	out = binary.LittleEndian.AppendUint16(out, uint16(flags))
+	out = binary.LittleEndian.AppendUint16(out, 0)
+	out = binary.LittleEndian.AppendUint16(out, 0)
+	if reserve {
+		out = binary.LittleEndian.AppendUint16(out, 2)
+		out = append(out, 1, byte(dataReserve), 0xaa, 0xaa)
+	}
+
+	out = binary.LittleEndian.AppendUint32(out, uint32(dataOffset))
+	out = binary.LittleEndian.AppendUint16(out, uint16(len(blocks)))
+	out = binary.LittleEndian.AppendUint16(out, compression)
+	if reserve {
+		out = append(out, 0xaa)
+	}
+
+	out = binary.LittleEndian.AppendUint32(out, size)
+	out = binary.LittleEndian.AppendUint32(out, offset)
+	out = append(out, make([]byte, 8)...)
+	out = append(out, "x\x00"...)
+
+	for _, block := range blocks {
+		out = binary.LittleEndian.AppendUint32(out, 0)
+		out = binary.LittleEndian.AppendUint16(out, uint16(len(block)))
+		out = binary.LittleEndian.AppendUint16(out, 0)
+		out = append(out, bytes.Repeat([]byte{0xaa}, dataReserve)...)
+		out = append(out, block...)
+	}
+	return out
+}
+
+// mszipBlock compresses data as an MSZIP block that may refer back to
+// history.
+func mszipBlock(t *testing.T, history, data []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("CK")
+	w, err := flate.NewWriterDict(&buf, flate.BestCompression, history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractCAB(t *testing.T) {
+	first := []byte("the disallowed certificate trust list, ")
+	second := []byte("the disallowed certificate trust list, again")
+
+	tests := []struct {
+		name    string
+		cab     []byte
+		want    string
+		wantErr bool
+	}{
+		{"uncompressed", buildCAB(0, false, 4, 10, []byte("skipfirst "), []byte("file")), "first file", false},
+		{"reserved areas", buildCAB(0, true, 0, 4, []byte("file")), "file", false},
+		{"MSZIP", buildCAB(1, false, 0, uint32(len(first)+len(second)), mszipBlock(t, nil, first), mszipBlock(t, first, second)), string(first) + string(second), false},
+		{"invalid MSZIP block", buildCAB(1, false, 0, 4, []byte("file")), "", true},
+		{"LZX", buildCAB(3, false, 0, 4, []byte("file")), "", true},
+		{"file beyond folder", buildCAB(0, false, 2, 4, []byte("file")), "", true},
+		{"truncated block", buildCAB(0, false, 0, 4, []byte("file"))[:60], "", true},
+		{"not a cabinet", []byte("MSZP"), "", true},
+	}
+	for _, test := range tests {
+		got, err := extractCAB(test.cab)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: extractCAB succeeded, want an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if string(got) != test.want {
+			t.Errorf("%s: extractCAB = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// buildCTL returns a certificate trust list, as a PKCS#7 signed message,
+// whose trusted subjects are hashes. If wrap is set, the list is wrapped in
+// an OCTET STRING as in Microsoft's lists.
+func buildCTL(t *testing.T, wrap bool, hashes ...[]byte) []byte {
+	type trustedSubject struct {
+		Identifier []byte
+		Attributes []asn1.RawValue `asn1:"set"`
+	}
+	subjects := []trustedSubject{}
+	for _, hash := range hashes {
+		subjects = append(subjects, trustedSubject{Identifier: hash})
+	}
+	list := marshal(t, struct {
+		SubjectUsage     []asn1.ObjectIdentifier
+		SequenceNumber   int
+		ThisUpdate       time.Time `asn1:"utc"`
+		SubjectAlgorithm pkix.AlgorithmIdentifier
+		TrustedSubjects  []trustedSubject
+	}{
+		[]asn1.ObjectIdentifier{{1, 3, 6, 1, 4, 1, 311, 10, 3, 30}},
+		1,
+		time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}, Parameters: asn1.NullRawValue},
+		subjects,
+	})
+	if wrap {
+		list = marshal(t, list)
+	}
+	signedData := marshal(t, struct {
+		Version          int
+		DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+		ContentInfo      pkcs7ContentInfo
+	}{
+		1,
+		nil,
+		pkcs7ContentInfo{ContentType: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 10, 1}, Content: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: list}},
+	})
+	return marshal(t, pkcs7ContentInfo{ContentType: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}, Content: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedData}})
+}
+
+func TestParseDisallowedCTL(t *testing.T) {
+	hashA, hashB := bytes.Repeat([]byte{0xaa}, sha1.Size), bytes.Repeat([]byte{0xbb}, sha1.Size)
+
+	tests := []struct {
+		name    string
+		ctl     []byte
+		want    [][]byte
+		wantErr bool
+	}{
+		{"wrapped", buildCTL(t, true, hashA, hashB), [][]byte{hashA, hashB}, false},
+		{"unwrapped", buildCTL(t, false, hashA), [][]byte{hashA}, false},
+		{"SHA-256 identifiers", buildCTL(t, true, make([]byte, sha256.Size)), nil, true},
+		{"no subjects", buildCTL(t, true), nil, true},
+		{"not DER", []byte("not DER"), nil, true},
+	}
+	for _, test := range tests {
+		got, err := parseDisallowedCTL(test.ctl)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: parseDisallowedCTL succeeded, want an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if !slices.EqualFunc(got, test.want, bytes.Equal) {
+			t.Errorf("%s: parseDisallowedCTL = %x, want %x", test.name, got, test.want)
+		}
+	}
+}
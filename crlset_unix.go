@@ -0,0 +1,46 @@
+// Copyright (c) 2012 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file of the Chromium repository.
+
+//go:build unix
+
+// This file memory-maps CRLSet files on Unix so that the serve modes share
+// them through the page cache rather than each holding a copy on the heap.
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+func init() {
+	mapFile = mmapFile
+}
+
+// mmapFile maps filename read-only and returns its contents, along with a
+// function that unmaps them.
+func mmapFile(filename string) ([]byte, func(), error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	size := info.Size()
+	if size == 0 {
+		// Zero length mappings aren't allowed.
+		return nil, func() {}, nil
+	}
+	if size != int64(int(size)) {
+		return nil, nil, fmt.Errorf("%s is too large to map", filename)
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to map %s: %s", filename, err)
+	}
+	return data, func() { syscall.Munmap(data) }, nil
+}
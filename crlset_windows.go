@@ -0,0 +1,413 @@
+// Copyright (c) 2012 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file of the Chromium repository.
+
+//go:build windows
+
+// This file implements the service command, which installs and runs
+// long-running commands such as serve-omaha and fetch --interval as native
+// Windows services. It talks to the Service Control Manager through
+// advapi32.dll directly, since golang.org/x/sys/windows/svc isn't in the
+// standard library.
+// It also locks files with LockFileEx.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+func init() {
+	windowsService = serviceCommand
+	tryLock = lockFileEx
+}
+
+var (
+	advapi32                         = syscall.NewLazyDLL("advapi32.dll")
+	procOpenSCManagerW               = advapi32.NewProc("OpenSCManagerW")
+	procCreateServiceW               = advapi32.NewProc("CreateServiceW")
+	procOpenServiceW                 = advapi32.NewProc("OpenServiceW")
+	procDeleteService                = advapi32.NewProc("DeleteService")
+	procStartServiceW                = advapi32.NewProc("StartServiceW")
+	procControlService               = advapi32.NewProc("ControlService")
+	procQueryServiceStatus           = advapi32.NewProc("QueryServiceStatus")
+	procCloseServiceHandle           = advapi32.NewProc("CloseServiceHandle")
+	procStartServiceCtrlDispatcherW  = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerEx = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus             = advapi32.NewProc("SetServiceStatus")
+
+	kernel32       = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx = kernel32.NewProc("LockFileEx")
+)
+
+// Constants from winsvc.h.
+const (
+	scManagerConnect       = 0x0001
+	scManagerCreateService = 0x0002
+	serviceQueryStatus     = 0x0004
+	serviceStart           = 0x0010
+	serviceStop            = 0x0020
+	serviceDelete          = 0x10000
+	serviceAllAccess       = 0xf01ff
+
+	serviceWin32OwnProcess = 0x10
+	serviceAutoStart       = 2
+	serviceErrorNormal     = 1
+
+	serviceStopped      = 1
+	serviceStartPending = 2
+	serviceStopPending  = 3
+	serviceRunning      = 4
+
+	serviceControlStop        = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown    = 5
+
+	serviceAcceptStop     = 1
+	serviceAcceptShutdown = 4
+
+	errorServiceSpecificError = 1066
+)
+
+// serviceStatus is SERVICE_STATUS.
+type serviceStatus struct {
+	ServiceType             uint32
+	CurrentState            uint32
+	ControlsAccepted        uint32
+	Win32ExitCode           uint32
+	ServiceSpecificExitCode uint32
+	CheckPoint              uint32
+	WaitHint                uint32
+}
+
+// serviceTableEntry is SERVICE_TABLE_ENTRYW.
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+// serviceStateNames are the names printed by service status.
+var serviceStateNames = map[uint32]string{
+	serviceStopped:      "stopped",
+	serviceStartPending: "starting",
+	serviceStopPending:  "stopping",
+	serviceRunning:      "running",
+}
+
+// serviceCommand implements service install, uninstall, start, stop, status
+// and run.
+func serviceCommand(args []string) bool {
+	if len(args) == 0 {
+		usage()
+		return false
+	}
+	verb, args := args[0], args[1:]
+	if verb == "install" || verb == "run" {
+		// Everything after the name belongs to the command being run, so
+		// flags stop at the first positional argument.
+		fs := flag.NewFlagSet("service "+verb, flag.ContinueOnError)
+		logFile := fs.String("log", "", "append the command's output to this file (default <name>.log beside the executable)")
+		if err := fs.Parse(args); err != nil {
+			return false
+		}
+		if fs.NArg() < 2 {
+			usage()
+			return false
+		}
+		name, command := fs.Arg(0), fs.Args()[1:]
+		if len(*logFile) == 0 {
+			exe, err := os.Executable()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				return false
+			}
+			*logFile = filepath.Join(filepath.Dir(exe), name+".log")
+		}
+		if verb == "install" {
+			return installService(name, *logFile, command)
+		}
+		return runService(name, *logFile, command)
+	}
+
+	if len(args) != 1 {
+		usage()
+		return false
+	}
+	name := args[0]
+	switch verb {
+	case "uninstall":
+		return controlService(name, serviceDelete, func(service uintptr) error {
+			return serviceCall(procDeleteService, service)
+		})
+	case "start":
+		return controlService(name, serviceStart, func(service uintptr) error {
+			return serviceCall(procStartServiceW, service, 0, 0)
+		})
+	case "stop":
+		return controlService(name, serviceStop, func(service uintptr) error {
+			var status serviceStatus
+			return serviceCall(procControlService, service, serviceControlStop, uintptr(unsafe.Pointer(&status)))
+		})
+	case "status":
+		return controlService(name, serviceQueryStatus, func(service uintptr) error {
+			var status serviceStatus
+			if err := serviceCall(procQueryServiceStatus, service, uintptr(unsafe.Pointer(&status))); err != nil {
+				return err
+			}
+			state, ok := serviceStateNames[status.CurrentState]
+			if !ok {
+				state = fmt.Sprintf("state %d", status.CurrentState)
+			}
+			fmt.Printf("%s: %s\n", name, state)
+			return nil
+		})
+	}
+	usage()
+	return false
+}
+
+// serviceCall calls proc, which returns a BOOL, and returns the error if it
+// fails.
+func serviceCall(proc *syscall.LazyProc, args ...uintptr) error {
+	if r, _, err := proc.Call(args...); r == 0 {
+		return err
+	}
+	return nil
+}
+
+// openSCManager connects to the Service Control Manager with the given
+// access rights.
+func openSCManager(access uintptr) (uintptr, error) {
+	scm, _, err := procOpenSCManagerW.Call(0, 0, access)
+	if scm == 0 {
+		return 0, fmt.Errorf("Failed to connect to the Service Control Manager: %s", err)
+	}
+	return scm, nil
+}
+
+// controlService opens the named service with the given access rights and
+// calls f with its handle.
+func controlService(name string, access uintptr, f func(service uintptr) error) bool {
+	scm, err := openSCManager(scManagerConnect)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+	defer procCloseServiceHandle.Call(scm)
+
+	namePtr, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+	service, _, err := procOpenServiceW.Call(scm, uintptr(unsafe.Pointer(namePtr)), access)
+	if service == 0 {
+		fmt.Fprintf(os.Stderr, "Failed to open service %s: %s\n", name, err)
+		return false
+	}
+	defer procCloseServiceHandle.Call(service)
+
+	if err := f(service); err != nil {
+		fmt.Fprintf(os.Stderr, "Service %s: %s\n", name, err)
+		return false
+	}
+	return true
+}
+
+// installService registers a service that starts automatically and runs
+// this executable with "service run", which in turn runs command.
+func installService(name, logFile string, command []string) bool {
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+	var cmdLine []string
+	for _, arg := range append([]string{exe, "service", "run", "--log", logFile, name}, command...) {
+		cmdLine = append(cmdLine, syscall.EscapeArg(arg))
+	}
+
+	scm, err := openSCManager(scManagerConnect | scManagerCreateService)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+	defer procCloseServiceHandle.Call(scm)
+
+	namePtr, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+	binaryPath, err := syscall.UTF16PtrFromString(strings.Join(cmdLine, " "))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+	service, _, err := procCreateServiceW.Call(scm,
+		uintptr(unsafe.Pointer(namePtr)), uintptr(unsafe.Pointer(namePtr)),
+		serviceAllAccess, serviceWin32OwnProcess, serviceAutoStart, serviceErrorNormal,
+		uintptr(unsafe.Pointer(binaryPath)), 0, 0, 0, 0, 0)
+	if service == 0 {
+		fmt.Fprintf(os.Stderr, "Failed to create service %s: %s\n", name, err)
+		return false
+	}
+	procCloseServiceHandle.Call(service)
+	fmt.Printf("Installed service %s; start it with \"service start %s\"\n", name, name)
+	return true
+}
+
+// windowsServiceRun is the state of the service being run by runService. The
+// Service Control Manager calls back into it on threads of its own.
+type windowsServiceRun struct {
+	name    string
+	logFile string
+	command []string
+
+	mu     sync.Mutex
+	handle uintptr
+	cmd    *exec.Cmd
+	// stopping is set once the service has been asked to stop.
+	stopping bool
+	ok       bool
+}
+
+// runService is what the Service Control Manager starts. It runs command as
+// a child process, with its output appended to logFile, until the command
+// exits or the service is stopped, which kills it. Output files are only
+// ever replaced atomically, so that leaves nothing half written.
+func runService(name, logFile string, command []string) bool {
+	run := &windowsServiceRun{name: name, logFile: logFile, command: command}
+	namePtr, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+	table := []serviceTableEntry{
+		{namePtr, syscall.NewCallback(run.serviceMain)},
+		{nil, 0},
+	}
+	// This only returns once the service has stopped.
+	if err := serviceCall(procStartServiceCtrlDispatcherW, uintptr(unsafe.Pointer(&table[0]))); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start the service dispatcher, as \"service run\" is only for the Service Control Manager: %s\n", err)
+		return false
+	}
+	return run.ok
+}
+
+// setStatus reports the service's state to the Service Control Manager.
+func (run *windowsServiceRun) setStatus(state uint32, exitCode int) {
+	status := serviceStatus{ServiceType: serviceWin32OwnProcess, CurrentState: state}
+	if state == serviceRunning {
+		status.ControlsAccepted = serviceAcceptStop | serviceAcceptShutdown
+	}
+	if exitCode != 0 {
+		status.Win32ExitCode = errorServiceSpecificError
+		status.ServiceSpecificExitCode = uint32(exitCode)
+	}
+	procSetServiceStatus.Call(run.handle, uintptr(unsafe.Pointer(&status)))
+}
+
+// serviceMain is the ServiceMain callback.
+func (run *windowsServiceRun) serviceMain(argc, argv uintptr) uintptr {
+	namePtr, _ := syscall.UTF16PtrFromString(run.name)
+	run.mu.Lock()
+	run.handle, _, _ = procRegisterServiceCtrlHandlerEx.Call(uintptr(unsafe.Pointer(namePtr)), syscall.NewCallback(run.handler), 0)
+	run.mu.Unlock()
+	if run.handle == 0 {
+		return 0
+	}
+	run.setStatus(serviceStartPending, 0)
+
+	exitCode := 1
+	defer func() { run.setStatus(serviceStopped, exitCode) }()
+
+	log, err := os.OpenFile(run.logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return 0
+	}
+	defer log.Close()
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(log, "%s\n", err)
+		return 0
+	}
+	cmd := exec.Command(exe, run.command...)
+	cmd.Stdout, cmd.Stderr = log, log
+	run.mu.Lock()
+	if run.stopping {
+		run.mu.Unlock()
+		exitCode = 0
+		return 0
+	}
+	err = cmd.Start()
+	run.cmd = cmd
+	run.mu.Unlock()
+	if err != nil {
+		fmt.Fprintf(log, "Failed to start %s: %s\n", strings.Join(run.command, " "), err)
+		return 0
+	}
+	run.setStatus(serviceRunning, 0)
+
+	err = cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		exitCode = exitErr.ExitCode()
+	} else if err == nil {
+		exitCode = 0
+	}
+	run.mu.Lock()
+	stopping := run.stopping
+	run.mu.Unlock()
+	if stopping {
+		// Being killed by a stop request isn't a failure.
+		exitCode = 0
+	}
+	run.ok = exitCode == 0
+	return 0
+}
+
+// handler is the HandlerEx callback, which is told of stop requests.
+func (run *windowsServiceRun) handler(control, eventType, eventData, context uintptr) uintptr {
+	switch control {
+	case serviceControlStop, serviceControlShutdown:
+		run.setStatus(serviceStopPending, 0)
+		run.mu.Lock()
+		run.stopping = true
+		if run.cmd != nil && run.cmd.Process != nil {
+			run.cmd.Process.Kill()
+		}
+		run.mu.Unlock()
+	case serviceControlInterrogate:
+	default:
+		return 120 // ERROR_CALL_NOT_IMPLEMENTED
+	}
+	return 0
+}
+
+// Constants from fileapi.h and winerror.h.
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+
+	errorLockViolation syscall.Errno = 33
+)
+
+// lockFileEx takes an exclusive lock on the whole of f without blocking.
+func lockFileEx(f *os.File) (bool, error) {
+	var overlapped syscall.Overlapped
+	r, _, err := procLockFileEx.Call(f.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 0xffffffff, 0xffffffff, uintptr(unsafe.Pointer(&overlapped)))
+	if r != 0 {
+		return true, nil
+	}
+	if err == errorLockViolation {
+		return false, nil
+	}
+	return false, err
+}
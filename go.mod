@@ -0,0 +1,3 @@
+module github.com/robstradling/crlset-tools
+
+go 1.24